@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"compress/flate"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -14,11 +25,102 @@ import (
 	"github.com/cheggaaa/pb/v3"
 )
 
+// protocolMagic opens the requests of the header-based protocol.
+const protocolMagic = "FILES/1"
+
+var (
+    noCopy = flag.Bool("no-copy", false,
+        "abort the upload if the file would be renamed on the server")
+    useTLS = flag.Bool("tls", false, "connect to the server over TLS")
+    caFile = flag.String("ca", "",
+        "PEM file with the certificate authorities to trust instead of the system ones, implies -tls")
+    pin = flag.String("pin", "",
+        "SHA-256 fingerprint of the certificate of the server to accept instead of verifying it, in hex, implies -tls")
+    auth = flag.String("auth", "", "the secret of the server or an upload token")
+    dictFile = flag.String("flate-dict", "",
+        "file with the preset DEFLATE dictionary to compress the data with, the server must have it too")
+    verbose = flag.Bool("verbose", false,
+        "print how well the file compressed and how long the server took to decompress it")
+    verify = flag.Bool("verify", false,
+        "check that the server stores the file under its name or a copy of it, with the same checksum")
+)
+
+// copySuffix precedes the copy number in the names of the renamed files.
+const copySuffix = "_copy"
+
+// splitName splits the filename into the bare name and the extension the way
+// the server does, a trailing dot being no extension.
+func splitName(filename string) (string, string) {
+    ext := filepath.Ext(filename)
+    if ext == "." {
+        ext = ""
+    }
+
+    return strings.TrimSuffix(filename, ext), ext
+}
+
+// verifyName checks that the server is storing the file under the requested
+// name or a copy of it. A name without an extension may get the default one
+// of the server.
+func verifyName(requested, stored string) error {
+    bare, ext := splitName(requested)
+    if ext == "" {
+        _, ext = splitName(stored)
+    }
+
+    if stored == bare + ext {
+        return nil
+    }
+
+    copyNum := strings.TrimSuffix(strings.TrimPrefix(stored, bare + copySuffix), ext)
+    if n, err := strconv.Atoi(copyNum); err == nil && n > 0 &&
+       stored == bare + copySuffix + copyNum + ext {
+        return nil
+    }
+
+    return fmt.Errorf("the server stores %s as %s, which is not a copy of it", requested, stored)
+}
+
+// verifyStatus checks that the server stored the whole file it named, with
+// the checksum computed while sending it.
+func verifyStatus(resp, status *response, sum string) error {
+    if status.Name != "" && status.Name != resp.Name {
+        return fmt.Errorf("the server stored %s, it named the file %s", status.Name, resp.Name)
+    }
+
+    if status.SHA256 != "" && status.SHA256 != sum {
+        return fmt.Errorf("the server stored %s with the SHA-256 %s, %s was sent",
+                          resp.Name, status.SHA256, sum)
+    }
+
+    return nil
+}
+
+// response is what the server tells about the upload, one JSON object per line.
+type response struct {
+    Name        string `json:"name"`
+    Copy        bool   `json:"copy"`
+    PriorCopies int    `json:"prior_copies"`
+    Token       string `json:"token"`
+    Status      string `json:"status"`
+    Size        int64  `json:"size"`
+    SHA256      string `json:"sha256"`
+    Error       string `json:"error"`
+    Kind        string `json:"kind"`
+
+    Deduplicated bool `json:"deduplicated"`
+    Appended     bool `json:"appended"`
+
+    CompressedSize   int64   `json:"compressed_size"`
+    CompressionRatio float64 `json:"compression_ratio"`
+    DecompressionMs  float64 `json:"decompression_ms"`
+}
+
 type Parcel struct {
     File *os.File
     Path string
     Name string
-    Size int
+    Size int64
 }
 
 // NewParcel will construct the new parcel, filling it with information
@@ -40,7 +142,7 @@ func NewParcel(fullPath string) (*Parcel, error) {
         return nil, fmt.Errorf("could not create parcel, %v\n", err)
     }
 
-    parcel.Size = int(stat.Size())
+    parcel.Size = stat.Size()
 
     return parcel, nil
 }
@@ -53,11 +155,89 @@ func (p *Parcel) Close() {
     p.File.Close()
 }
 
+// tlsConfig will create the configuration for connecting to the server over
+// TLS, or return nil if TLS is not used.
+func tlsConfig() (*tls.Config, error) {
+    if !*useTLS && *caFile == "" && *pin == "" {
+        return nil, nil
+    }
+
+    config := &tls.Config{}
+    if *pin != "" {
+        fingerprint, err := parseFingerprint(*pin)
+        if err != nil {
+            return nil, err
+        }
+
+        // The pinned certificate is trusted whoever signed it, so the chain
+        // isn't verified at all.
+        config.InsecureSkipVerify = true
+        config.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+            return checkPin(certs, fingerprint)
+        }
+        return config, nil
+    }
+
+    if *caFile != "" {
+        pem, err := ioutil.ReadFile(*caFile)
+        if err != nil {
+            return nil, fmt.Errorf("could not read certificate authorities, %v", err)
+        }
+
+        config.RootCAs = x509.NewCertPool()
+        if !config.RootCAs.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in %q", *caFile)
+        }
+    }
+
+    return config, nil
+}
+
+// parseFingerprint parses the hex encoded SHA-256 fingerprint, the bytes may
+// be separated by colons, like openssl prints them.
+func parseFingerprint(fingerprint string) ([]byte, error) {
+    sum, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+    if err != nil || len(sum) != sha256.Size {
+        return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", fingerprint)
+    }
+
+    return sum, nil
+}
+
+// checkPin tells whether the certificate of the server, the first one it
+// sent, has the pinned fingerprint.
+func checkPin(certs [][]byte, fingerprint []byte) error {
+    if len(certs) == 0 {
+        return fmt.Errorf("the server sent no certificate")
+    }
+
+    sum := sha256.Sum256(certs[0])
+    if !bytes.Equal(sum[:], fingerprint) {
+        return fmt.Errorf("the certificate of the server has the fingerprint %s, not the pinned one",
+                          hex.EncodeToString(sum[:]))
+    }
+
+    return nil
+}
+
+type dialer interface {
+    DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
 func dial(hostAddr string) (net.Conn, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
     defer cancel()
 
-    var d net.Dialer
+    config, err := tlsConfig()
+    if err != nil {
+        return nil, err
+    }
+
+    var d dialer = &net.Dialer{}
+    if config != nil {
+        d = &tls.Dialer{Config: config}
+    }
+
     con, err := d.DialContext(ctx, "tcp", hostAddr)
     if err != nil {
         return nil, fmt.Errorf("could not dial destination host, %v", err)
@@ -66,72 +246,260 @@ func dial(hostAddr string) (net.Conn, error) {
     return con, nil
 }
 
-func main() {
-    if len(os.Args) != 3 {
-        fmt.Printf("Usage:\n\tfilec <filename> <host>:<port>\n\n")
-        return
+// readResponse reads the next response of the server.
+func readResponse(r *bufio.Reader) (*response, error) {
+    resp, err := decodeResponse(r)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.Error != "" {
+        return nil, fmt.Errorf("the server refused the upload, %s", resp.Error)
     }
 
-    parcel, err := NewParcel(os.Args[1])
+    return resp, nil
+}
+
+// readStatus receives the final response of the server, telling whether the
+// file was stored.
+func readStatus(r *bufio.Reader) (*response, error) {
+    resp, err := decodeResponse(r)
     if err != nil {
-        fmt.Println(err)
-        return
+        return nil, err
     }
-    defer parcel.Close()
 
-    con, err := dial(os.Args[2])
+    if resp.Status != "ok" {
+        switch resp.Kind {
+        case "unavailable":
+            return nil, fmt.Errorf("the storage of the server is unavailable, try again later, %s",
+                                   resp.Error)
+        case "permission":
+            return nil, fmt.Errorf("the server is not permitted to store the file, %s", resp.Error)
+        }
+        return nil, fmt.Errorf("the server could not store the file, %s", resp.Error)
+    }
+
+    return resp, nil
+}
+
+func decodeResponse(r *bufio.Reader) (*response, error) {
+    line, err := r.ReadBytes('\n')
     if err != nil {
-        fmt.Println(err)
-        return
+        return nil, fmt.Errorf("could not receive the response of the server, %v", err)
+    }
+
+    resp := &response{}
+    if err := json.Unmarshal(line, resp); err != nil {
+        return nil, fmt.Errorf("malformed response of the server, %v", err)
+    }
+
+    return resp, nil
+}
+
+// upload sends the file of the parcel to the server, under the name of the
+// parcel, and tells whether the server stored it.
+func upload(parcel *Parcel, hostAddr string, dict []byte) error {
+    con, err := dial(hostAddr)
+    if err != nil {
+        return err
     }
     defer con.Close()
 
-    // Protocol (with Clinet and Server)
-    // C: <filename>\n
-    // S: <filename on the server>
+    // Protocol (with Client and Server)
+    // C: FILES/1\n
+    // C: Name: <filename>\n
+    // C: Size: <file size in bytes>\n
+    // C: Confirm: true\n                         (with -no-copy only)
+    // C: Status: true\n
+    // C: Footer: sha256\n
+    // C: Auth: <secret or upload token>\n          (with -auth only)
+    // C: Dictionary: <SHA-256 of dictionary>\n     (with -flate-dict only)
+    // C: Verbose: true\n                         (with -verbose only)
+    // C: \n
+    // S: {"name": <filename on the server>, "copy": <renamed or not>}\n
+    // C: proceed\n | abort\n                     (with -no-copy only)
     // C: <data>
+    // C: <SHA-256 of the file>\n
+    // S: {"status": "ok" | "error", "size": <size>, "sha256": <checksum>}\n
+
+    _, err = fmt.Fprintf(con, "%s\nName: %s\nSize: %d\nStatus: true\nFooter: sha256\n",
+                         protocolMagic, parcel.Name, parcel.Size)
+    if err == nil && *noCopy {
+        _, err = fmt.Fprint(con, "Confirm: true\n")
+    }
+    if err == nil && *auth != "" {
+        _, err = fmt.Fprintf(con, "Auth: %s\n", *auth)
+    }
+    if err == nil && *verbose {
+        _, err = fmt.Fprint(con, "Verbose: true\n")
+    }
+    if err == nil && dict != nil {
+        sum := sha256.Sum256(dict)
+        _, err = fmt.Fprintf(con, "Dictionary: %s\n", hex.EncodeToString(sum[:]))
+    }
+    if err == nil {
+        _, err = fmt.Fprint(con, "\n")
+    }
+    if err != nil {
+        return fmt.Errorf("could not transfer metadata, %v", err)
+    }
 
-    _, err = fmt.Fprintf(con, "%s\n", parcel.Name)
+    r := bufio.NewReader(con)
+    resp, err := readResponse(r)
     if err != nil {
-        fmt.Printf("could not transfer metadata, %v\n", err)
-        return
+        return err
     }
 
-    buf := make([]byte, 1024)
-    n, err := con.Read(buf)
-    serverFilename := string(buf[:n])
-    if serverFilename != parcel.Name {
-        fmt.Printf("warning: %s already exists on server, will be renamed to %s\n",
-                  parcel.Name, serverFilename)
+    // Nothing is sent to a server that won't store the file as asked.
+    if *verify {
+        if err := verifyName(parcel.Name, resp.Name); err != nil {
+            return fmt.Errorf("verification failed, %v", err)
+        }
     }
 
-    zw, err := flate.NewWriter(con, flate.BestSpeed)
+    if *noCopy {
+        answer := "proceed"
+        if resp.Copy {
+            answer = "abort"
+        }
+
+        _, err = fmt.Fprintf(con, "%s\n", answer)
+        if err != nil {
+            return fmt.Errorf("could not transfer metadata, %v", err)
+        }
+
+        if resp.Copy {
+            return fmt.Errorf("%s already exists on server, upload aborted", parcel.Name)
+        }
+    }
+
+    if resp.Copy {
+        fmt.Printf("warning: %s already exists on server (with %d copies), will be renamed to %s\n",
+                  parcel.Name, resp.PriorCopies, resp.Name)
+    }
+
+    zw, err := flate.NewWriterDict(con, flate.BestSpeed, dict)
     if err != nil {
-        fmt.Printf("could not initialize DEFLATE compressor, %v\n", err)
-        return
+        return fmt.Errorf("could not initialize DEFLATE compressor, %v", err)
     }
 
-    bar := pb.Full.Start(parcel.Size)
+    buf := make([]byte, 1024)
+    bar := pb.Full.Start64(parcel.Size)
     barWriter := bar.NewProxyWriter(zw)
 
-    for i, n := 0, 0; i < parcel.Size; i += n {
+    // The checksum is computed while the file is sent and follows the data,
+    // so that the server can tell the file arrived intact.
+    h := sha256.New()
+    out := io.MultiWriter(barWriter, h)
+
+    var n int
+    for i := int64(0); i < parcel.Size; i += int64(n) {
         n, err = parcel.Read(buf)
         if err != nil && err != io.EOF {
-            fmt.Printf("unexpected error reading file at byte %d, %v\n", i, err)
-            return
+            return fmt.Errorf("unexpected error reading file at byte %d, %v", i, err)
         }
 
-        _, err = barWriter.Write(buf[:n])
+        _, err = out.Write(buf[:n])
         if err != nil {
-            fmt.Printf("unexpected error transferring file at byte %d, %v\n", i, err)
-            return
+            // The server might have told why it stopped receiving.
+            if _, statusErr := readStatus(r); statusErr != nil {
+                return fmt.Errorf("unexpected error transferring file at byte %d, %v; %v",
+                                  i, err, statusErr)
+            }
+            return fmt.Errorf("unexpected error transferring file at byte %d, %v", i, err)
         }
     }
 
     if err = zw.Close(); err != nil {
-        fmt.Printf("could not close DEFLATE compressor (some data may have been lost), %v", err)
-        return
+        if _, statusErr := readStatus(r); statusErr != nil {
+            return fmt.Errorf("could not close DEFLATE compressor (some data may have been lost), %v; %v",
+                              err, statusErr)
+        }
+        return fmt.Errorf("could not close DEFLATE compressor (some data may have been lost), %v", err)
+    }
+
+    sum := hex.EncodeToString(h.Sum(nil))
+    _, err = fmt.Fprintf(con, "%s\n", sum)
+    if err != nil {
+        return fmt.Errorf("could not transfer checksum, %v", err)
     }
 
     bar.Finish()
+
+    status, err := readStatus(r)
+    if err != nil {
+        return err
+    }
+
+    if *verify {
+        if err := verifyStatus(resp, status, sum); err != nil {
+            return fmt.Errorf("verification failed, %v", err)
+        }
+    }
+
+    if status.Size != parcel.Size {
+        fmt.Printf("warning: the server stored %d bytes of %s, %d were sent\n",
+                   status.Size, parcel.Name, parcel.Size)
+    }
+
+    if status.Deduplicated {
+        fmt.Printf("%s has the same contents as a file already stored, the server linked it\n",
+                   status.Name)
+    }
+
+    if *verbose {
+        fmt.Printf("%s was compressed to %d bytes (%.2fx), the server decompressed it in %.3f ms\n",
+                   status.Name, status.CompressedSize, status.CompressionRatio, status.DecompressionMs)
+    }
+
+    if status.Appended {
+        fmt.Printf("%s was appended to the file stored under the name\n", status.Name)
+    }
+
+    if resp.Token != "" {
+        fmt.Printf("%s is held by the server until approved, token %s\n",
+                   resp.Name, resp.Token)
+    }
+
+    return nil
+}
+
+func main() {
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(),
+            "Usage:\n\tfilec [flags] <filename or directory> <host>:<port>\n\nFlags:\n")
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    if flag.NArg() != 2 {
+        flag.Usage()
+        return
+    }
+
+    var dict []byte
+    if *dictFile != "" {
+        var err error
+        dict, err = ioutil.ReadFile(*dictFile)
+        if err != nil {
+            fmt.Printf("could not read DEFLATE dictionary, %v\n", err)
+            return
+        }
+    }
+
+    if stat, err := os.Stat(flag.Arg(0)); err == nil && stat.IsDir() {
+        uploadDir(flag.Arg(0), flag.Arg(1), dict)
+        return
+    }
+
+    parcel, err := NewParcel(flag.Arg(0))
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    defer parcel.Close()
+
+    if err := upload(parcel, flag.Arg(1), dict); err != nil {
+        fmt.Println(err)
+    }
 }
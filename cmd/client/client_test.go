@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubServer accepts a single upload, replying with the name and the final
+// status whatever the data, and returns its address.
+func stubServer(t *testing.T, name string, status *response) string {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { l.Close() })
+
+    go func() {
+        con, err := l.Accept()
+        if err != nil {
+            return
+        }
+        defer con.Close()
+
+        r := bufio.NewReader(con)
+        for {
+            line, err := r.ReadString('\n')
+            if err != nil {
+                return
+            }
+            if line == "\n" {
+                break
+            }
+        }
+        enc := json.NewEncoder(con)
+        enc.Encode(&response{Name: name})
+
+        // The data, then the checksum footer.
+        zr := flate.NewReader(r)
+        io.Copy(ioutil.Discard, zr)
+        zr.Close()
+        r.ReadString('\n')
+        enc.Encode(status)
+    }()
+
+    return l.Addr().String()
+}
+
+func TestVerify(t *testing.T) {
+    *verify = true
+    defer func() { *verify = false }()
+
+    path := filepath.Join(t.TempDir(), "a.txt")
+    if err := ioutil.WriteFile(path, []byte("data"), 0666); err != nil {
+        t.Fatal(err)
+    }
+    sum := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+
+    for _, test := range []struct {
+        name    string
+        status  response
+        failure string
+    }{
+        {"a.txt", response{Status: "ok", Size: 4, SHA256: sum}, ""},
+        {"a_copy2.txt", response{Status: "ok", Size: 4, SHA256: sum}, ""},
+        {"a.txt", response{Status: "ok", Size: 4, SHA256: strings.Repeat("0", 64)}, "SHA-256"},
+        {"b.txt", response{Status: "ok", Size: 4, SHA256: sum}, "not a copy"},
+        {"a.txt", response{Status: "ok", Size: 4, SHA256: sum, Name: "c.txt"}, "stored c.txt"},
+    } {
+        parcel, err := NewParcel(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        err = upload(parcel, stubServer(t, test.name, &test.status), nil)
+        parcel.Close()
+        switch {
+        case test.failure == "" && err != nil:
+            t.Errorf("the upload stored as %s failed the verification, %v", test.name, err)
+        case test.failure != "" && (err == nil || !strings.Contains(err.Error(), test.failure)):
+            t.Errorf("the upload stored as %s with %+v failed with %v, want the discrepancy %q",
+                     test.name, test.status, err, test.failure)
+        }
+    }
+}
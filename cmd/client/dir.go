@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The policies for the symbolic links met in a directory being uploaded.
+const (
+    symlinksSkip   = "skip"
+    symlinksFollow = "follow"
+)
+
+var symlinks = flag.String("symlinks", symlinksSkip,
+    "what to do with the symbolic links in a directory, " + symlinksSkip + " them or " +
+    symlinksFollow + " those to files")
+
+var flatten = flag.String("flatten", "",
+    "upload the files of the subdirectories of a directory with their paths joined " +
+    "with the separator, e.g. _ for sub_file.txt, since the server stores the files flat")
+
+// errNested stops the walk looking for the files of the subdirectories.
+var errNested = errors.New("a file in a subdirectory")
+
+// nestedFile returns the path, relative to the directory, of a file in one
+// of its subdirectories, if there's any.
+func nestedFile(dir string) (string, bool) {
+    var nested string
+    filepath.Walk(dir, func(path string, stat os.FileInfo, err error) error {
+        if err != nil || stat.IsDir() || filepath.Dir(path) == filepath.Clean(dir) {
+            return nil
+        }
+
+        nested, err = filepath.Rel(dir, path)
+        if err != nil {
+            nested = path
+        }
+        return errNested
+    })
+
+    return nested, nested != ""
+}
+
+// remoteName returns the name the file is uploaded under, its path relative
+// to the directory, with the separators replaced by the one of -flatten.
+func remoteName(rel, separator string) string {
+    return strings.Replace(filepath.ToSlash(rel), "/", separator, -1)
+}
+
+// uploadDir uploads the regular files of the directory and its
+// subdirectories one after another, every one under its path relative to
+// the directory, flattened with -flatten, and tells how each went. The
+// server refuses the names with path separators, so without -flatten the
+// directories with subdirectories to upload are refused up front rather than
+// failing a file at a time. The directory is walked as it's uploaded, so the
+// tree is never held in memory whole. The symbolic links to directories are
+// never followed, not to loop.
+func uploadDir(dir, hostAddr string, dict []byte) {
+    if *symlinks != symlinksSkip && *symlinks != symlinksFollow {
+        fmt.Printf("unknown -symlinks policy %q, want %s or %s\n", *symlinks, symlinksSkip, symlinksFollow)
+        return
+    }
+    if strings.ContainsAny(*flatten, "/" + string(os.PathSeparator)) {
+        fmt.Printf("the -flatten separator %q contains a path separator\n", *flatten)
+        return
+    }
+    if *flatten == "" {
+        if nested, ok := nestedFile(dir); ok {
+            fmt.Printf("%s has files in subdirectories, e.g. %s, which the server can't store " +
+                       "under their paths, pass -flatten _ to upload them as %s\n",
+                       dir, filepath.ToSlash(nested), remoteName(nested, "_"))
+            return
+        }
+    }
+
+    uploaded, failed, skipped := 0, 0, 0
+    err := filepath.Walk(dir, func(path string, stat os.FileInfo, err error) error {
+        if err != nil {
+            fmt.Printf("%s: could not read, %v\n", path, err)
+            failed++
+            return nil
+        }
+        if stat.IsDir() {
+            return nil
+        }
+
+        rel, err := filepath.Rel(dir, path)
+        if err != nil {
+            return err
+        }
+        name := remoteName(rel, *flatten)
+
+        if stat.Mode()&os.ModeSymlink != 0 {
+            if *symlinks == symlinksSkip {
+                fmt.Printf("%s: skipped, a symbolic link\n", name)
+                skipped++
+                return nil
+            }
+
+            stat, err = os.Stat(path)
+            if err != nil {
+                fmt.Printf("%s: could not follow the symbolic link, %v\n", name, err)
+                failed++
+                return nil
+            }
+        }
+        if !stat.Mode().IsRegular() {
+            fmt.Printf("%s: skipped, not a regular file\n", name)
+            skipped++
+            return nil
+        }
+
+        parcel, err := NewParcel(path)
+        if err != nil {
+            fmt.Printf("%s: %v\n", name, err)
+            failed++
+            return nil
+        }
+        defer parcel.Close()
+        parcel.Name = name
+
+        if err := upload(parcel, hostAddr, dict); err != nil {
+            fmt.Printf("%s: %v\n", name, err)
+            failed++
+            return nil
+        }
+
+        fmt.Printf("%s: uploaded\n", name)
+        uploaded++
+        return nil
+    })
+    if err != nil {
+        fmt.Printf("could not walk %s, %v\n", dir, err)
+    }
+
+    fmt.Printf("uploaded %d files, %d failed, %d skipped\n", uploaded, failed, skipped)
+}
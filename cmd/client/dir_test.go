@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNestedFile(t *testing.T) {
+    dir := t.TempDir()
+    if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), nil, 0666); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.MkdirAll(filepath.Join(dir, "empty", "too"), 0777); err != nil {
+        t.Fatal(err)
+    }
+
+    if nested, ok := nestedFile(dir); ok {
+        t.Fatalf("the flat directory has the nested file %q", nested)
+    }
+
+    if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+        t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), nil, 0666); err != nil {
+        t.Fatal(err)
+    }
+
+    nested, ok := nestedFile(dir)
+    if !ok || filepath.ToSlash(nested) != "sub/b.txt" {
+        t.Errorf("the nested file is %q, %t, want sub/b.txt", nested, ok)
+    }
+}
+
+func TestRemoteName(t *testing.T) {
+    tests := []struct {
+        rel, separator, want string
+    }{
+        {"a.txt", "_", "a.txt"},
+        {filepath.Join("logs", "2020", "app.log"), "_", "logs_2020_app.log"},
+        {filepath.Join("logs", "app.log"), "--", "logs--app.log"},
+    }
+
+    for _, test := range tests {
+        if got := remoteName(test.rel, test.separator); got != test.want {
+            t.Errorf("remoteName(%q, %q) = %q, want %q", test.rel, test.separator, got, test.want)
+        }
+    }
+}
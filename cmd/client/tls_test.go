@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPin(t *testing.T) {
+    ts := httptest.NewTLSServer(http.NotFoundHandler())
+    defer ts.Close()
+    addr := ts.Listener.Addr().String()
+
+    sum := sha256.Sum256(ts.Certificate().Raw)
+    fingerprint := hex.EncodeToString(sum[:])
+    var colons []string
+    for i := 0; i < len(fingerprint); i += 2 {
+        colons = append(colons, strings.ToUpper(fingerprint[i:i + 2]))
+    }
+
+    defer func() { *pin = "" }()
+    for _, test := range []struct {
+        pin string
+        ok  bool
+    }{
+        {fingerprint, true},
+        {strings.Join(colons, ":"), true},
+        {strings.Repeat("00", sha256.Size), false},
+    } {
+        *pin = test.pin
+        con, err := dial(addr)
+        if err == nil {
+            con.Close()
+        }
+        if test.ok && err != nil {
+            t.Errorf("the pinned %s was refused, %v", test.pin, err)
+        }
+        if !test.ok && err == nil {
+            t.Errorf("the certificate was accepted for the pinned %s", test.pin)
+        }
+    }
+
+    if _, err := parseFingerprint("abcd"); err == nil {
+        t.Error("the short fingerprint was accepted")
+    }
+}
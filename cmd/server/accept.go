@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// defaultAcceptTimeout is how often the accept loop waiting for the next
+// connection checks whether the server is shutting down.
+const defaultAcceptTimeout = time.Second
+
+// errListenerClosed is what the accept of a server shutting down returns.
+var errListenerClosed = errors.New("the listener is closed")
+
+// deadlineListener waits for the connections a timeout at a time, checking
+// in between whether the server is shutting down. Closing the listener
+// interrupts the accept anyway, the deadline is only a safety net should it
+// not, so that the shutdown can't hang on an idle listener.
+type deadlineListener struct {
+    *net.TCPListener
+    timeout time.Duration
+    closing func() bool
+}
+
+// withAcceptTimeout guards the TCP listener with the accept timeout of the
+// server, the other listeners are returned as they are.
+func (s *Server) withAcceptTimeout(l net.Listener) net.Listener {
+    tl, ok := l.(*net.TCPListener)
+    if !ok || s.AcceptTimeout <= 0 {
+        return l
+    }
+
+    return &deadlineListener{TCPListener: tl, timeout: s.AcceptTimeout, closing: s.isClosing}
+}
+
+func (l *deadlineListener) Accept() (net.Conn, error) {
+    for {
+        if err := l.SetDeadline(time.Now().Add(l.timeout)); err != nil {
+            return nil, err
+        }
+
+        con, err := l.TCPListener.Accept()
+        if ne, ok := err.(net.Error); ok && ne.Timeout() {
+            if l.closing() {
+                return nil, errListenerClosed
+            }
+            continue
+        }
+
+        return con, err
+    }
+}
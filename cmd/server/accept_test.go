@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveIdle serves the listener in background and returns what Serve
+// returns.
+func serveIdle(s *Server, l net.Listener) <-chan error {
+    done := make(chan error, 1)
+    go func() { done <- s.Serve(l) }()
+    return done
+}
+
+// waitServed fails the test unless Serve returned nil within a second.
+func waitServed(t *testing.T, done <-chan error) {
+    t.Helper()
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatalf("Serve returned %v once shut down, want nil", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("the idle accept loop is still running after the shutdown")
+    }
+}
+
+func listenTest(t *testing.T) *net.TCPListener {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { l.Close() })
+
+    return l.(*net.TCPListener)
+}
+
+func TestShutdownIdle(t *testing.T) {
+    for _, timeout := range []time.Duration{0, time.Hour} {
+        s := newTestServer(t)
+        s.AcceptTimeout = timeout
+        l := listenTest(t)
+        done := serveIdle(s, s.withAcceptTimeout(l))
+
+        // Once an upload went through, the loop is blocked in the accept.
+        mustUpload(t, l.Addr().String(), "a.txt", "data")
+        s.Shutdown()
+        waitServed(t, done)
+    }
+
+    // Shut down before it got the listener.
+    s := newTestServer(t)
+    s.Shutdown()
+    waitServed(t, serveIdle(s, listenTest(t)))
+}
+
+func TestDeadlineListener(t *testing.T) {
+    var closing int32
+    l := &deadlineListener{
+        TCPListener: listenTest(t),
+        timeout:     10 * time.Millisecond,
+        closing:     func() bool { return atomic.LoadInt32(&closing) == 1 },
+    }
+
+    // The connections are still accepted past the timeouts.
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        if con, err := net.Dial("tcp", l.Addr().String()); err == nil {
+            con.Close()
+        }
+    }()
+    con, err := l.Accept()
+    if err != nil {
+        t.Fatalf("the connection coming after the timeouts wasn't accepted, %v", err)
+    }
+    con.Close()
+
+    // The listener never closed, the accept still ends once the server
+    // shuts down.
+    atomic.StoreInt32(&closing, 1)
+    start := time.Now()
+    if _, err := l.Accept(); err != errListenerClosed {
+        t.Fatalf("the accept of the server shutting down returned %v, want %v", err, errListenerClosed)
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Fatalf("the accept returned %v after the shutdown, want about %v", elapsed, l.timeout)
+    }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// The uploads may be stored under more names at once, given in the Also
+// header, e.g. a versioned name and "latest.bin". Every name resolves to a
+// copy if it's taken, like the name of the upload itself, and is a hard link
+// to the stored file where the filesystem has them, or a copy of it.
+
+// parseAlso splits the comma separated names of the Also header.
+func parseAlso(value string) ([]string, error) {
+    if value == "" {
+        return nil, nil
+    }
+
+    var names []string
+    for _, name := range strings.Split(value, ",") {
+        name = strings.TrimSpace(name)
+        if err := checkName(name); err != nil {
+            return nil, fmt.Errorf("malformed Also header, %v", err)
+        }
+        names = append(names, name)
+    }
+
+    return names, nil
+}
+
+// storeAliases stores the file under the names the client asked for too, and
+// returns the names it's stored under. The names that can't be stored are
+// left out, the file itself is stored all the same.
+func (s *Server) storeAliases(stored string, req *request, sum string, size int64) []string {
+    var names []string
+    for _, alias := range req.Also {
+        name, err := s.storeAlias(stored, s.withDefaultExt(alias))
+        if err != nil {
+            log.Printf("warning: %v", err)
+            continue
+        }
+
+        if stat, err := os.Stat(name); err == nil {
+            err := s.meta.save(name, &fileMeta{
+                Size:     stat.Size(),
+                ModTime:  stat.ModTime(),
+                SHA256:   sum,
+                Uploader: req.uploader,
+            })
+            if err != nil {
+                log.Print(err)
+            }
+        }
+        if s.quota != nil {
+            s.quota.add(name, req.uploader, size)
+        }
+        if s.DoneMarkers && !req.deferMarker {
+            if err := writeMarker(name); err != nil {
+                log.Printf("warning: %v", err)
+            }
+        }
+
+        log.Printf("stored %q as %q too", stored, name)
+        names = append(names, name)
+    }
+
+    return names
+}
+
+// storeAlias makes the stored file available under the name, or a copy
+// name of it, which is returned.
+func (s *Server) storeAlias(stored, alias string) (string, error) {
+    name, _, err := s.reserveTarget(alias)
+    if err != nil {
+        return "", err
+    }
+    tempFilename := name + partSuffix
+
+    err = os.Link(stored, tempFilename)
+    if err != nil && !os.IsExist(err) {
+        err = copyFile(stored, tempFilename, s.DoneMarkers)
+    }
+    if err == nil {
+        err = os.Rename(tempFilename, name)
+    }
+    if err != nil {
+        os.Remove(tempFilename)
+        s.index.Release(name)
+        return "", newStorageError(err, fmt.Errorf("could not store %q as %q, %v", stored, name, err))
+    }
+
+    s.index.keep(name)
+    return name, nil
+}
+
+// copyFile copies the file to a new one, which must not exist, syncing it to
+// the disk if durable.
+func copyFile(from, to string, durable bool) error {
+    src, err := os.Open(from)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+
+    dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+    if err != nil {
+        return err
+    }
+
+    if _, err := io.Copy(dst, src); err != nil {
+        dst.Close()
+        return err
+    }
+    if durable {
+        if err := dst.Sync(); err != nil {
+            dst.Close()
+            return err
+        }
+    }
+
+    return dst.Close()
+}
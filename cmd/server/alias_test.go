@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlso(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+    mustUpload(t, addr, "latest.bin", "old")
+
+    // The taken name resolves to a copy, like the name of the upload.
+    _, status := upload(t, addr, "v1.bin", "new", "Also: latest.bin, stable.bin")
+    if status == nil || status.Status != "ok" {
+        t.Fatalf("got %+v for the upload with more names, want it stored", status)
+    }
+    want := []string{"v1.bin", "latest_copy1.bin", "stable.bin"}
+    if !reflect.DeepEqual(status.Names, want) {
+        t.Fatalf("the file was stored as %q, want %q", status.Names, want)
+    }
+    for _, name := range want {
+        if got := readFile(t, name); got != "new" {
+            t.Errorf("%s has %q, want the uploaded contents", name, got)
+        }
+    }
+    if got := readFile(t, "latest.bin"); got != "old" {
+        t.Errorf("the taken latest.bin was changed to %q", got)
+    }
+    assertFiles(t, "latest.bin", "latest_copy1.bin", "stable.bin", "v1.bin")
+
+    // The malformed names are refused before the data.
+    for _, also := range []string{"a/b.bin", "a.bin,", ".."} {
+        first, status := upload(t, addr, "v2.bin", "new", "Also: " + also)
+        if status != nil || !strings.Contains(first.Error, "Also") {
+            t.Errorf("got %+v for the Also header %q, want it refused", first, also)
+        }
+    }
+    assertFiles(t, "latest.bin", "latest_copy1.bin", "stable.bin", "v1.bin")
+}
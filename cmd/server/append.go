@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// In the append mode, the uploads of a name are appended to the file of the
+// name rather than stored as copies, e.g. for the clients uploading the
+// fragments of a log. Every fragment is still received aside in full first,
+// so that a failed upload never leaves a part of it in the file, and then
+// appended at once, with the separator between the fragments.
+
+// appendLocks serialize the appends to the same name, so that the fragments
+// never interleave. The lock of a name is forgotten once nobody holds or
+// waits for it.
+type appendLocks struct {
+    locks map[string]*appendLock
+    sync.Mutex
+}
+
+type appendLock struct {
+    sync.Mutex
+    refs int
+}
+
+func newAppendLocks() *appendLocks {
+    return &appendLocks{locks: make(map[string]*appendLock)}
+}
+
+// lock locks the name, returning the function unlocking it.
+func (al *appendLocks) lock(name string) func() {
+    al.Lock()
+    l, exists := al.locks[name]
+    if !exists {
+        l = &appendLock{}
+        al.locks[name] = l
+    }
+    l.refs++
+    al.Unlock()
+
+    l.Lock()
+    return func() {
+        l.Unlock()
+
+        al.Lock()
+        l.refs--
+        if l.refs == 0 {
+            delete(al.locks, name)
+        }
+        al.Unlock()
+    }
+}
+
+// appendFragment appends the received fragment to the file of the name,
+// creating it if there's none yet, and removes the fragment. The file is
+// left as it was if the fragment can't be appended whole. The size of the
+// file with the fragment is returned.
+func (s *Server) appendFragment(fragmentName, name string) (int64, error) {
+    unlock := s.appends.lock(name)
+    defer unlock()
+
+    fragment, err := os.Open(fragmentName)
+    if err != nil {
+        return 0, fmt.Errorf("could not append to %q, %v", name, err)
+    }
+    defer fragment.Close()
+
+    target, err := os.OpenFile(name, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0666)
+    if err != nil {
+        return 0, newStorageError(err, fmt.Errorf("could not append to %q, %v", name, err))
+    }
+
+    stat, err := target.Stat()
+    if err != nil {
+        target.Close()
+        return 0, fmt.Errorf("could not append to %q, %v", name, err)
+    }
+    if !stat.Mode().IsRegular() {
+        target.Close()
+        return 0, fmt.Errorf("could not append to %q, it's not a regular file", name)
+    }
+
+    size := stat.Size()
+    err = writeFragment(target, fragment, size > 0, s.AppendSeparator)
+    if err == nil && s.DoneMarkers {
+        err = target.Sync()
+    }
+    if err != nil {
+        target.Truncate(size)
+        target.Close()
+        return 0, newStorageError(err, fmt.Errorf("could not append to %q, %v", name, err))
+    }
+
+    if err := target.Close(); err != nil {
+        return 0, newStorageError(err, fmt.Errorf("could not append to %q, %v", name, err))
+    }
+
+    stat, err = os.Stat(name)
+    if err != nil {
+        return 0, fmt.Errorf("could not append to %q, %v", name, err)
+    }
+
+    fragment.Close()
+    os.Remove(fragmentName)
+
+    return stat.Size(), nil
+}
+
+// writeFragment writes the fragment, preceded by the separator unless it's
+// the first one.
+func writeFragment(w io.Writer, fragment io.Reader, separate bool, separator string) error {
+    if separate && separator != "" {
+        if _, err := io.WriteString(w, separator); err != nil {
+            return err
+        }
+    }
+
+    _, err := io.Copy(w, fragment)
+    return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newAppendServer(t *testing.T) string {
+    t.Helper()
+    s := newTestServer(t)
+    s.Append = true
+    s.AppendSeparator = "\n"
+    s.appends = newAppendLocks()
+    return serveTest(t, s)
+}
+
+func TestAppend(t *testing.T) {
+    addr := newAppendServer(t)
+
+    for _, fragment := range []string{"one", "two", "three"} {
+        if _, status := upload(t, addr, "app.log", fragment); status.Status != "ok" || status.Name != "app.log" ||
+           *status.Size != int64(len(fragment)) {
+            t.Fatalf("the fragment %s ended with %+v", fragment, status)
+        }
+    }
+
+    if got := readFile(t, "app.log"); got != "one\ntwo\nthree" {
+        t.Fatalf("the log holds %q, want the fragments one after another", got)
+    }
+    assertFiles(t, "app.log")
+}
+
+func TestAppendConcurrent(t *testing.T) {
+    const fragments = 20
+
+    addr := newAppendServer(t)
+    var want []string
+    var wg sync.WaitGroup
+    for i := 0; i < fragments; i++ {
+        fragment := fmt.Sprintf("fragment %d %s", i, strings.Repeat("x", 1000))
+        want = append(want, fragment)
+
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := tryUpload(addr, "app.log", fragment); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+
+    // Every fragment is appended whole, never interleaved with another.
+    got := strings.Split(readFile(t, "app.log"), "\n")
+    sort.Strings(got)
+    sort.Strings(want)
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("the log holds %d fragments, want the %d appended whole", len(got), len(want))
+    }
+    assertFiles(t, "app.log")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// archiveName checks the name of the tar entry, returning the name the file
+// is to be stored under. The storage directory is flat, so the entries must
+// name the files right in the root of the archive.
+func archiveName(name string) (string, error) {
+    clean := path.Clean(name)
+    switch {
+    case path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../"):
+        return "", fmt.Errorf("unsafe path %q in the archive", name)
+    case strings.Contains(clean, "/"):
+        return "", fmt.Errorf("%q is in a directory, only the files in the root of the archive can be stored",
+                              name)
+    }
+
+    if err := checkName(clean); err != nil {
+        return "", err
+    }
+
+    return clean, nil
+}
+
+// receivedFile is a file that was stored, or held with the token, without
+// asking the client anything, like the files of an archive.
+type receivedFile struct {
+    name   string
+    token  string
+    size   int64
+    sha256 string
+
+    // dedup tells that the file is a link to a stored file with the same
+    // contents.
+    dedup bool
+
+    // appended tells that the file was appended to the file of the name.
+    appended bool
+
+    // also are the other names the file was stored under.
+    also []string
+}
+
+// receiveArchive receives a DEFLATE compressed tar archive and stores every
+// regular file in it as if it was uploaded on its own, the directories and
+// the like are skipped. The names the files were stored under are written
+// back once the archive was received. If the archive fails, the files already
+// stored are removed, so that either the whole archive is stored or nothing.
+func (s *Server) receiveArchive(con net.Conn, r *bufio.Reader, req *request,
+                                sp *span) error {
+    start := s.clock().Now()
+    zr := s.newFlateReader(r, req)
+    defer zr.Close()
+
+    // The checksum the client sent, in the header or in the footer, is the
+    // one of the whole archive.
+    h := sha256.New()
+    src := io.TeeReader(&trailerReader{zr: zr, con: con, r: r, req: req, strict: s.StrictTrailer,
+                                        strictClose: s.StrictClose}, h)
+
+    entries, err := s.extractArchive(src, req, sp)
+    if err == nil {
+        // Whatever follows the end of the archive has to be read for the
+        // footer to be seen.
+        _, err = io.Copy(ioutil.Discard, src)
+    }
+    if sum := hex.EncodeToString(h.Sum(nil)); err == nil && req.SHA256 != "" && req.SHA256 != sum {
+        err = fmt.Errorf("the checksum %s doesn't match the expected %s", sum, req.SHA256)
+    }
+    sp.set("files.count", int64(len(entries)))
+
+    var names []string
+    for _, entry := range entries {
+        names = append(names, entry.name)
+    }
+
+    status := &response{Status: "ok", Names: names}
+    if err != nil {
+        s.discardArchive(entries)
+        status = errorResponse(err)
+    }
+    s.events.archive(req, start, names, err)
+    req.flateStats.report(status)
+    if err := req.reply(con, status); err != nil {
+        log.Printf("could not send the names of the archive back.")
+    }
+
+    if err != nil {
+        return fmt.Errorf("could not receive archive, %v", err)
+    }
+
+    // The files are only complete once the archive is, the held ones are
+    // marked once approved.
+    if s.DoneMarkers {
+        for _, entry := range entries {
+            if entry.token != "" && s.scanner == nil {
+                continue
+            }
+            if err := writeMarker(entry.name); err != nil {
+                log.Printf("warning: %v", err)
+            }
+        }
+    }
+
+    log.Printf("received archive of %d files", len(names))
+    return nil
+}
+
+// extractArchive stores the files of the archive, within the limits of the
+// number of the entries and of their total size. The stored files are
+// returned even if the archive fails.
+func (s *Server) extractArchive(src io.Reader, req *request, sp *span) ([]receivedFile, error) {
+    // The checksum and the size of the request are the ones of the whole
+    // archive, everything else applies to every file.
+    entryReq := *req
+    entryReq.SHA256 = ""
+    entryReq.deferMarker = true
+
+    var entries []receivedFile
+    var count int
+    var total int64
+    tr := tar.NewReader(src)
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            return entries, nil
+        }
+        if err != nil {
+            return entries, fmt.Errorf("malformed archive, %v", err)
+        }
+
+        // Every entry counts, the skipped ones still cost reading them.
+        count++
+        if s.MaxArchiveFiles > 0 && count > s.MaxArchiveFiles {
+            return entries, fmt.Errorf("the archive exceeds the limit of %d entries",
+                                       s.MaxArchiveFiles)
+        }
+
+        if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+            continue
+        }
+
+        name, err := archiveName(hdr.Name)
+        if err != nil {
+            return entries, err
+        }
+        entryReq.originalName = ""
+        if fixed, err := s.NamePolicy.apply(name); err != nil {
+            return entries, err
+        } else if fixed != name {
+            entryReq.originalName, name = name, fixed
+        }
+        if err := s.checkStoredName(name); err != nil {
+            return entries, err
+        }
+
+        // The sizes come from the archive, they're compared so that no sum
+        // of them can overflow.
+        if s.MaxArchiveSize > 0 && hdr.Size > s.MaxArchiveSize - total {
+            return entries, fmt.Errorf("the files of the archive exceed the limit of %d bytes",
+                                       s.MaxArchiveSize)
+        }
+        total += hdr.Size
+
+        entryReq.Name = name
+        entryReq.Size = hdr.Size
+        entry, err := s.storeNamed(tr, &entryReq, sp)
+        if err != nil {
+            return entries, err
+        }
+        entries = append(entries, entry)
+    }
+}
+
+// discardArchive removes the stored files of a failed archive.
+func (s *Server) discardArchive(entries []receivedFile) {
+    for _, entry := range entries {
+        if entry.token != "" {
+            if _, err := s.holds.reject(entry.token); err == nil {
+                continue
+            }
+        }
+
+        // The file appended to isn't the archive's to remove.
+        if entry.appended {
+            log.Printf("keeping what was appended to %q by the failed archive", entry.name)
+            continue
+        }
+
+        // The file is either not held or was served already.
+        if err := os.Remove(entry.name); err != nil && !os.IsNotExist(err) {
+            log.Printf("could not remove %q of the failed archive, %v", entry.name, err)
+            continue
+        }
+
+        if err := s.meta.remove(entry.name); err != nil {
+            log.Print(err)
+        }
+        if s.DoneMarkers {
+            if err := removeMarker(entry.name); err != nil {
+                log.Print(err)
+            }
+        }
+        if s.quota != nil {
+            s.quota.remove(entry.name)
+        }
+    }
+
+    if len(entries) > 0 {
+        log.Printf("removed %d files of the failed archive", len(entries))
+    }
+}
+
+// storeNamed stores a single file like receiveFile does, only without asking
+// the client anything, e.g. a file of an archive.
+func (s *Server) storeNamed(src io.Reader, req *request, sp *span) (receivedFile, error) {
+    var token string
+    if s.holds != nil {
+        var err error
+        if token, err = newHoldToken(); err != nil {
+            return receivedFile{}, err
+        }
+    }
+
+    serverFilename, _, err := s.reserveTarget(s.withDefaultExt(req.Name))
+    if err != nil {
+        return receivedFile{}, err
+    }
+
+    if err := checkPathLength(serverFilename, token); err != nil {
+        s.index.Release(serverFilename)
+        return receivedFile{}, err
+    }
+
+    file, err := s.storeFile(src, req, serverFilename, token, sp)
+    if s.readOnly != nil {
+        s.readOnly.note(err)
+    }
+    return file, err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// tarData returns a tar archive of the files, by their names and contents.
+func tarData(t *testing.T, files ...string) string {
+    t.Helper()
+    var buf bytes.Buffer
+    tw := tar.NewWriter(&buf)
+    for i := 0; i + 1 < len(files); i += 2 {
+        hdr := &tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i + 1])), Typeflag: tar.TypeReg}
+        if err := tw.WriteHeader(hdr); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := tw.Write([]byte(files[i + 1])); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := tw.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    return buf.String()
+}
+
+// uploadTar sends the archive, right after the header, and returns the reply
+// telling the names the files were stored under.
+func uploadTar(t *testing.T, addr, archive string) *response {
+    t.Helper()
+    con := dialTest(t, addr)
+    con.request("Op: tar")
+    con.sendData(archive)
+    con.closeWrite()
+    return con.reply()
+}
+
+func TestArchive(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+    mustUpload(t, addr, "b.txt", "taken")
+
+    status := uploadTar(t, addr, tarData(t, "a.txt", "first", "b.txt", "second", "./c.txt", "third"))
+    if status.Status != "ok" {
+        t.Fatalf("the archive failed, %+v", status)
+    }
+    if want := []string{"a.txt", "b_copy1.txt", "c.txt"}; !reflect.DeepEqual(status.Names, want) {
+        t.Fatalf("the files were stored as %q, want %q", status.Names, want)
+    }
+    for name, want := range map[string]string{"a.txt": "first", "b_copy1.txt": "second", "c.txt": "third"} {
+        if got := readFile(t, name); got != want {
+            t.Fatalf("%s holds %q, want %q", name, got, want)
+        }
+    }
+
+    for _, unsafe := range []string{"../escape.txt", "/etc/escape.txt", "dir/nested.txt"} {
+        if status := uploadTar(t, addr, tarData(t, "ok.txt", "fine", unsafe, "bad")); status.Status == "ok" {
+            t.Fatalf("the archive with %s was stored", unsafe)
+        }
+    }
+    assertFiles(t, "a.txt", "b.txt", "b_copy1.txt", "c.txt")
+}
+
+func TestArchiveLimits(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxArchiveFiles = 2
+    s.MaxArchiveSize = 10
+    addr := serveTest(t, s)
+
+    status := uploadTar(t, addr, tarData(t, "a.txt", "1", "b.txt", "2", "c.txt", "3"))
+    if status.Status == "ok" {
+        t.Fatal("the archive over the limit of the entries was stored")
+    }
+    assertFiles(t)
+
+    status = uploadTar(t, addr, tarData(t, "a.txt", "123456", "b.txt", "123456"))
+    if status.Status == "ok" {
+        t.Fatal("the archive over the limit of the size was stored")
+    }
+    assertFiles(t)
+
+    // The names of the removed files stay taken, like those of any stored
+    // file removed.
+    status = uploadTar(t, addr, tarData(t, "a.txt", "1", "b.txt", "2"))
+    if status.Status != "ok" || len(status.Names) != 2 {
+        t.Fatalf("the archive within the limits failed, %+v", status)
+    }
+    assertFiles(t, status.Names...)
+}
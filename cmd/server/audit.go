@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// The outcomes of auditing a file.
+const (
+    auditOK       = "ok"
+    auditMismatch = "mismatch"
+
+    // The file was changed since its checksum was recorded, so the checksum
+    // tells nothing about it.
+    auditStale = "stale"
+
+    // There's no checksum recorded for the file.
+    auditUnrecorded = "unrecorded"
+
+    auditError = "error"
+)
+
+// auditEntry is the outcome of auditing a stored file.
+type auditEntry struct {
+    Name     string `json:"name"`
+    Status   string `json:"status"`
+    SHA256   string `json:"sha256,omitempty"`
+    Expected string `json:"expected,omitempty"`
+    Error    string `json:"error,omitempty"`
+}
+
+// auditSummary closes the audit.
+type auditSummary struct {
+    Checked    int `json:"checked"`
+    Mismatched int `json:"mismatched"`
+    Stale      int `json:"stale"`
+    Unrecorded int `json:"unrecorded"`
+    Failed     int `json:"failed"`
+}
+
+// auditFile recomputes the checksum of the stored file and compares it to the
+// recorded one. Nothing is recorded, the audit only looks.
+func (s *Server) auditFile(stat os.FileInfo) auditEntry {
+    entry := auditEntry{Name: stat.Name()}
+
+    meta, err := s.meta.load(stat.Name())
+    if err != nil {
+        entry.Status, entry.Error = auditError, err.Error()
+        return entry
+    }
+
+    if meta == nil || meta.SHA256 == "" {
+        entry.Status = auditUnrecorded
+        return entry
+    }
+    if !meta.fresh(stat) {
+        entry.Status = auditStale
+        return entry
+    }
+
+    entry.SHA256, err = fileSHA256(stat.Name())
+    if err != nil {
+        entry.Status, entry.Error = auditError, err.Error()
+        return entry
+    }
+
+    entry.Status = auditOK
+    if entry.SHA256 != meta.SHA256 {
+        entry.Status, entry.Expected = auditMismatch, meta.SHA256
+    }
+
+    return entry
+}
+
+// sendAudit checks every stored file whose name starts with prefix, streaming
+// a line of JSON for every file as it's checked, followed by the summary. The
+// audit stops as soon as the client goes away.
+func (s *Server) sendAudit(w io.Writer, prefix string) error {
+    dir, err := os.Open(".")
+    if err != nil {
+        return fmt.Errorf("could not open storage directory, %v", err)
+    }
+    defer dir.Close()
+
+    var summary auditSummary
+    enc := json.NewEncoder(w)
+    for {
+        stats, err := dir.Readdir(manifestBatch)
+        for _, stat := range stats {
+            if !isStoredFile(stat, s.DoneMarkers) || !strings.HasPrefix(stat.Name(), prefix) {
+                continue
+            }
+
+            entry := s.auditFile(stat)
+            summary.Checked++
+            switch entry.Status {
+            case auditMismatch:
+                summary.Mismatched++
+                log.Printf("audit: checksum of %q is %s, expected %s",
+                           entry.Name, entry.SHA256, entry.Expected)
+            case auditStale:
+                summary.Stale++
+            case auditUnrecorded:
+                summary.Unrecorded++
+            case auditError:
+                summary.Failed++
+            }
+
+            if err := enc.Encode(&entry); err != nil {
+                return fmt.Errorf("audit cancelled after %d files, %v", summary.Checked, err)
+            }
+        }
+
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("could not read storage directory, %v", err)
+        }
+    }
+
+    log.Printf("audited %d files, %d mismatched, %d stale, %d unrecorded, %d failed",
+               summary.Checked, summary.Mismatched, summary.Stale,
+               summary.Unrecorded, summary.Failed)
+
+    if err := enc.Encode(&summary); err != nil {
+        return fmt.Errorf("could not send audit summary, %v", err)
+    }
+
+    return nil
+}
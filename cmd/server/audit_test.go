@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+    mustUpload(t, addr, "intact.txt", "intact")
+    mustUpload(t, addr, "corrupt.txt", "stored")
+
+    // The bits rot, the size and the modification time stay.
+    stat, err := os.Stat("corrupt.txt")
+    if err != nil {
+        t.Fatal(err)
+    }
+    writeFile(t, "corrupt.txt", "rotten")
+    chtimes(t, "corrupt.txt", stat.ModTime(), stat.ModTime())
+
+    c := dialTest(t, addr)
+    c.request("Op: audit")
+    dec := json.NewDecoder(c.r)
+    entries := make(map[string]auditEntry)
+    for i := 0; i < 2; i++ {
+        var entry auditEntry
+        if err := dec.Decode(&entry); err != nil {
+            t.Fatal(err)
+        }
+        entries[entry.Name] = entry
+    }
+    var summary auditSummary
+    if err := dec.Decode(&summary); err != nil {
+        t.Fatal(err)
+    }
+
+    if entries["intact.txt"].Status != auditOK {
+        t.Errorf("the intact file is %+v", entries["intact.txt"])
+    }
+    corrupt := entries["corrupt.txt"]
+    if corrupt.Status != auditMismatch || corrupt.SHA256 != sha256Hex("rotten") || corrupt.Expected != sha256Hex("stored") {
+        t.Errorf("the corrupt file is %+v", corrupt)
+    }
+    if summary != (auditSummary{Checked: 2, Mismatched: 1}) {
+        t.Errorf("the summary is %+v, want 2 checked and 1 mismatched", summary)
+    }
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When the server has a secret, every request must carry either the secret
+// itself or an upload token minted with it. The upload tokens let a client
+// upload a single file without ever knowing the secret:
+//
+//     <base64 of the JSON payload>.<base64 of its HMAC-SHA256>
+
+// maxSpentTokens is the number of the spent, but not yet expired, upload
+// tokens the server remembers. Once that many are remembered, the new tokens
+// are refused until the old ones expire, rather than forgetting a token
+// that could then be used again.
+const maxSpentTokens = 65536
+
+// uploadToken is the payload of an upload token.
+type uploadToken struct {
+    // Nonce tells the tokens apart, so that every token can be used once.
+    Nonce string `json:"nonce"`
+
+    // Expires is the Unix time the token can't be used after.
+    Expires int64 `json:"exp"`
+
+    // Name and MaxSize, if set, constrain the upload.
+    Name    string `json:"name,omitempty"`
+    MaxSize int64  `json:"max_size,omitempty"`
+}
+
+// errUnauthorized is all the clients failing to authenticate are told, the
+// actual reason is only logged.
+var errUnauthorized = errors.New("unauthorized")
+
+// authFailures counts the requests refused for their credentials.
+var authFailures = expvar.NewInt("auth_failures")
+
+type authenticator struct {
+    secret []byte
+
+    // secretSum is the SHA-256 of the secret. The credentials are compared
+    // by their checksums, so that the comparison takes the same time whatever
+    // their length.
+    secretSum [sha256.Size]byte
+
+    // spent maps the nonces of the used tokens to their expiry.
+    spent map[string]int64
+    sync.Mutex
+
+    clock Clock
+}
+
+// loadSecret reads the secret from the file. The surrounding whitespace, like
+// the trailing newline, is not a part of the secret.
+func loadSecret(name string) ([]byte, error) {
+    data, err := ioutil.ReadFile(name)
+    if err != nil {
+        return nil, fmt.Errorf("could not read secret, %v", err)
+    }
+
+    secret := []byte(strings.TrimSpace(string(data)))
+    if len(secret) == 0 {
+        return nil, fmt.Errorf("the secret in %q is empty", name)
+    }
+
+    return secret, nil
+}
+
+// loadAuthenticator returns the authenticator with the secret from the file,
+// or nil if no file is given.
+func loadAuthenticator(name string, clock Clock) (*authenticator, error) {
+    if name == "" {
+        return nil, nil
+    }
+
+    secret, err := loadSecret(name)
+    if err != nil {
+        return nil, err
+    }
+
+    return newAuthenticator(secret, clock), nil
+}
+
+func newAuthenticator(secret []byte, clock Clock) *authenticator {
+    return &authenticator{
+        secret:    secret,
+        secretSum: sha256.Sum256(secret),
+        spent:     make(map[string]int64),
+        clock:     clock,
+    }
+}
+
+func (a *authenticator) sign(payload []byte) []byte {
+    mac := hmac.New(sha256.New, a.secret)
+    mac.Write(payload)
+    return mac.Sum(nil)
+}
+
+// mint creates a token valid for ttl, constrained to the name and the size
+// if they're set.
+func (a *authenticator) mint(ttl time.Duration, name string, maxSize int64) (string, error) {
+    nonce := make([]byte, 16)
+    if _, err := rand.Read(nonce); err != nil {
+        return "", fmt.Errorf("could not generate token, %v", err)
+    }
+
+    payload, err := json.Marshal(&uploadToken{
+        Nonce:   hex.EncodeToString(nonce),
+        Expires: a.clock.Now().Add(ttl).Unix(),
+        Name:    name,
+        MaxSize: maxSize,
+    })
+    if err != nil {
+        return "", fmt.Errorf("could not generate token, %v", err)
+    }
+
+    enc := base64.RawURLEncoding
+    return enc.EncodeToString(payload) + "." + enc.EncodeToString(a.sign(payload)), nil
+}
+
+// authorize checks the credentials of the request. An upload token also
+// constrains the upload and is spent right away. The returned errors tell
+// the actual reason, which is meant for the logs, not for the client.
+func (a *authenticator) authorize(req *request) error {
+    if req.Auth == "" {
+        return fmt.Errorf("the request is not authenticated")
+    }
+
+    if a.isSecret(req.Auth) {
+        req.credentials = credentialsKey(req.Auth)
+        return nil
+    }
+
+    token, err := a.verify(req.Auth)
+    if err != nil {
+        return err
+    }
+
+    if req.Op != opUpload {
+        return fmt.Errorf("upload tokens are only good for uploads")
+    }
+    if token.Name != "" && token.Name != req.Name {
+        return fmt.Errorf("the upload token is not good for %q", req.Name)
+    }
+    if token.Name != "" && len(req.Also) > 0 {
+        return fmt.Errorf("the upload token is only good for %q, not for the Also names", token.Name)
+    }
+    if token.MaxSize > 0 {
+        if req.Size < 0 || req.Size > token.MaxSize {
+            return fmt.Errorf("the upload token is good for at most %d bytes", token.MaxSize)
+        }
+        req.maxSize = token.MaxSize
+    }
+
+    if err := a.spend(token); err != nil {
+        return err
+    }
+
+    req.credentials = credentialsKey(req.Auth)
+    return nil
+}
+
+// credentialsKey tells the credentials apart without keeping them around.
+func credentialsKey(auth string) string {
+    sum := sha256.Sum256([]byte(auth))
+    return hex.EncodeToString(sum[:])
+}
+
+// isSecret tells whether the credentials are the secret itself.
+func (a *authenticator) isSecret(auth string) bool {
+    authSum := sha256.Sum256([]byte(auth))
+    return subtle.ConstantTimeCompare(authSum[:], a.secretSum[:]) == 1
+}
+
+// verify checks the signature and the expiry of the token.
+func (a *authenticator) verify(auth string) (*uploadToken, error) {
+    enc := base64.RawURLEncoding
+    parts := strings.Split(auth, ".")
+    if len(parts) != 2 {
+        return nil, fmt.Errorf("invalid credentials")
+    }
+
+    payload, err := enc.DecodeString(parts[0])
+    if err != nil {
+        return nil, fmt.Errorf("invalid credentials")
+    }
+    sig, err := enc.DecodeString(parts[1])
+    if err != nil || !hmac.Equal(sig, a.sign(payload)) {
+        return nil, fmt.Errorf("invalid credentials")
+    }
+
+    token := &uploadToken{}
+    if err := json.Unmarshal(payload, token); err != nil || token.Nonce == "" {
+        return nil, fmt.Errorf("malformed upload token")
+    }
+
+    if a.clock.Now().Unix() > token.Expires {
+        return nil, fmt.Errorf("the upload token has expired")
+    }
+
+    return token, nil
+}
+
+// spend remembers the token as used, unless it already was.
+func (a *authenticator) spend(token *uploadToken) error {
+    a.Lock()
+    defer a.Unlock()
+
+    if _, spent := a.spent[token.Nonce]; spent {
+        return fmt.Errorf("the upload token was already used")
+    }
+
+    if len(a.spent) >= maxSpentTokens {
+        now := a.clock.Now().Unix()
+        for nonce, expires := range a.spent {
+            if now > expires {
+                delete(a.spent, nonce)
+            }
+        }
+    }
+    if len(a.spent) >= maxSpentTokens {
+        return fmt.Errorf("too many upload tokens in use, try again later")
+    }
+
+    a.spent[token.Nonce] = token.Expires
+    return nil
+}
+
+// mintCommand prints a new upload token, as asked for by the arguments of
+// the mint-token subcommand.
+func mintCommand(args []string, secretFile string) error {
+    fs := flag.NewFlagSet("mint-token", flag.ExitOnError)
+    ttl := fs.Duration("ttl", time.Hour, "how long the token can be used for")
+    name := fs.String("name", "", "the only name the token is good for, any if empty")
+    maxSize := fs.Int64("max-size", 0,
+        "the largest file size in bytes the token is good for, 0 means no limit")
+    fs.Parse(args)
+
+    if secretFile == "" {
+        return fmt.Errorf("-secret-file is needed to mint a token")
+    }
+
+    secret, err := loadSecret(secretFile)
+    if err != nil {
+        return err
+    }
+
+    token, err := newAuthenticator(secret, realClock{}).mint(*ttl, *name, *maxSize)
+    if err != nil {
+        return err
+    }
+
+    fmt.Println(token)
+    return nil
+}
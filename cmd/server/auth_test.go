@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadTokenExpiry(t *testing.T) {
+    clock := newFakeClock()
+    a := newAuthenticator([]byte("secret"), clock)
+
+    token, err := a.mint(time.Hour, "", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    clock.Advance(2 * time.Hour)
+    req := &request{Op: opUpload, Name: "a.txt", Size: 1, Auth: token}
+    if err := a.authorize(req); err == nil {
+        t.Fatal("an expired token is accepted")
+    }
+}
+
+func TestUploadToken(t *testing.T) {
+    clock := newFakeClock()
+    a := newAuthenticator([]byte("secret"), clock)
+
+    token, err := a.mint(time.Hour, "a.txt", 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, req := range []*request{
+        {Op: opUpload, Name: "b.txt", Size: 1, Auth: token},
+        {Op: opUpload, Name: "a.txt", Size: 11, Auth: token},
+        {Op: opUpload, Name: "a.txt", Size: 1, Auth: token + "x"},
+    } {
+        if err := a.authorize(req); err == nil {
+            t.Errorf("the token is accepted for %q of %d bytes", req.Name, req.Size)
+        }
+    }
+
+    clock.Advance(59 * time.Minute)
+    req := &request{Op: opUpload, Name: "a.txt", Size: 10, Auth: token}
+    if err := a.authorize(req); err != nil {
+        t.Fatalf("the token is refused, %v", err)
+    }
+    if req.maxSize != 10 {
+        t.Errorf("the upload is limited to %d bytes, want 10", req.maxSize)
+    }
+
+    if err := a.authorize(&request{Op: opUpload, Name: "a.txt", Size: 10, Auth: token}); err == nil {
+        t.Error("the token is accepted twice")
+    }
+
+    if err := a.authorize(&request{Op: opUpload, Name: "c.txt", Auth: "secret"}); err != nil {
+        t.Errorf("the secret is refused, %v", err)
+    }
+}
+
+func TestUploadTokenLimit(t *testing.T) {
+    s := newTestServer(t)
+    s.auth = newAuthenticator([]byte("secret"), realClock{})
+    addr := serveTest(t, s)
+
+    // The size must be declared within the limit of the token, which the
+    // data must keep to as well.
+    token, _ := s.auth.mint(time.Hour, "a.txt", 5)
+    if first, _ := upload(t, addr, "a.txt", "01234", "Auth: " + token); first.Error == "" {
+        t.Fatal("the token limiting the size is accepted for an upload not declaring it")
+    }
+    token, _ = s.auth.mint(time.Hour, "a.txt", 5)
+    _, status := upload(t, addr, "a.txt", "0123456789", "Auth: " + token, "Size: 5")
+    if status == nil || status.Status != "error" {
+        t.Fatal("the upload beyond the limit of the token is stored")
+    }
+
+    token, _ = s.auth.mint(time.Hour, "", 0)
+    mustUpload(t, addr, "b.txt", "data", "Auth: " + token)
+    if first, _ := upload(t, addr, "c.txt", "data", "Auth: " + token); first.Error == "" {
+        t.Fatal("the spent token is accepted")
+    }
+
+    other, _ := newAuthenticator([]byte("other"), realClock{}).mint(time.Hour, "", 0)
+    if first, _ := upload(t, addr, "d.txt", "data", "Auth: " + other); first.Error == "" {
+        t.Fatal("the token of another secret is accepted")
+    }
+    assertFiles(t, "b.txt")
+}
+
+func TestUnauthorized(t *testing.T) {
+    s := newTestServer(t)
+    s.auth = newAuthenticator([]byte("secret"), realClock{})
+    addr := serveTest(t, s)
+
+    failures := authFailures.Value()
+    for _, auth := range []string{"Op: upload", "Auth: wrong", "Auth: secreT"} {
+        c := dialTest(t, addr)
+        c.request("Name: a.txt", "Size: 4", auth)
+        if resp := c.reply(); resp.Error != errUnauthorized.Error() {
+            t.Errorf("got %q for %q, want the generic error", resp.Error, auth)
+        }
+        if !c.isClosed() {
+            t.Errorf("the connection with %q is left open", auth)
+        }
+    }
+    if got := authFailures.Value() - failures; got != 3 {
+        t.Errorf("auth_failures grew by %d, want 3", got)
+    }
+    assertFiles(t)
+    if s.index.Len() != 0 {
+        t.Errorf("the index has %q", s.index.Names())
+    }
+}
+
+func TestSecretTiming(t *testing.T) {
+    secret := strings.Repeat("s", 64)
+    a := newAuthenticator([]byte(secret), realClock{})
+
+    // The fastest of the batches, to leave out the noise.
+    timing := func(auth string) time.Duration {
+        fastest := time.Duration(1 << 62)
+        for batch := 0; batch < 20; batch++ {
+            start := time.Now()
+            for i := 0; i < 200; i++ {
+                a.isSecret(auth)
+            }
+            if elapsed := time.Since(start); elapsed < fastest {
+                fastest = elapsed
+            }
+        }
+        return fastest
+    }
+
+    first := timing("x" + secret[1:])
+    last := timing(secret[:63] + "x")
+    if first > 2 * last || last > 2 * first {
+        t.Errorf("the wrong first byte takes %v, the wrong last one %v", first, last)
+    }
+}
+
+func TestUploadTokenAlso(t *testing.T) {
+    s := newTestServer(t)
+    s.auth = newAuthenticator([]byte("secret"), realClock{})
+    s.httpAuth = s.auth
+    addr := serveTest(t, s)
+
+    // The token bound to a name is good for that name only.
+    token, _ := s.auth.mint(time.Hour, "a.txt", 0)
+    if first, _ := upload(t, addr, "a.txt", "data", "Auth: " + token, "Also: other.txt"); first.Error == "" {
+        t.Fatal("the token bound to a.txt is accepted with another name in Also")
+    }
+    r := httptest.NewRequest(http.MethodPut, filesPath + "a.txt", strings.NewReader("data"))
+    r.Header.Set("Authorization", "Bearer " + token)
+    r.Header.Set("Also", "other.txt")
+    w := httptest.NewRecorder()
+    s.receiveHTTP(w, r)
+    if w.Code != http.StatusUnauthorized {
+        t.Fatalf("got %d for the HTTP upload with another name in Also, want 401", w.Code)
+    }
+    assertFiles(t)
+
+    // Refused, the token isn't spent.
+    mustUpload(t, addr, "a.txt", "data", "Auth: " + token)
+
+    token, _ = s.auth.mint(time.Hour, "", 0)
+    mustUpload(t, addr, "b.txt", "data", "Auth: " + token, "Also: c.txt")
+    assertFiles(t, "a.txt", "b.txt", "c.txt")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBatchSeq(t *testing.T) {
+    addr := serveTest(t, newTestServer(t))
+    con := dialTest(t, addr)
+
+    seqOf := func(resp *response) int64 {
+        if resp.Seq == nil {
+            t.Fatalf("the reply %+v has no seq", resp)
+        }
+        return *resp.Seq
+    }
+
+    con.request("Name: a.txt", "Status: true", "Seq: 1")
+    if first := con.reply(); first.Error != "" || seqOf(first) != 1 {
+        t.Fatalf("the first upload got %+v, want it accepted as 1", first)
+    }
+    con.sendData("first")
+    if status := con.reply(); status.Status != "ok" || seqOf(status) != 1 {
+        t.Fatalf("the first upload ended with %+v, want 1 stored", status)
+    }
+
+    // Refused before the data, the batch goes on.
+    con.request("Name: a/b.txt", "Status: true", "Seq: 2")
+    if first := con.reply(); first.Error == "" || seqOf(first) != 2 {
+        t.Fatalf("the second upload got %+v, want 2 refused", first)
+    }
+
+    con.request("Name: c.txt", "Status: true", "Seq: 3", "SHA256: " + sha256Hex("other"))
+    if first := con.reply(); first.Error != "" || seqOf(first) != 3 {
+        t.Fatalf("the third upload got %+v, want it accepted as 3", first)
+    }
+    con.sendData("third")
+    if status := con.reply(); status.Status == "ok" || seqOf(status) != 3 {
+        t.Fatalf("the third upload ended with %+v, want 3 failed", status)
+    }
+
+    // Failed once its data was sent, nothing more is read.
+    if !con.isClosed() {
+        t.Fatal("the connection is still open after the failed upload")
+    }
+    assertFiles(t, "a.txt")
+}
+
+func TestBatchLimit(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxBatchFiles = 2
+    addr := serveTest(t, s)
+    con := dialTest(t, addr)
+
+    for i, name := range []string{"a.txt", "b.txt"} {
+        con.request("Name: " + name, "Status: true", fmt.Sprintf("Seq: %d", i + 1))
+        if first := con.reply(); first.Error != "" {
+            t.Fatalf("the upload %d within the limit got %+v", i + 1, first)
+        }
+        con.sendData(name)
+        if status := con.reply(); status.Status != "ok" {
+            t.Fatalf("the upload %d within the limit ended with %+v", i + 1, status)
+        }
+    }
+
+    // The one over the limit is refused before its data, with its seq.
+    con.request("Name: c.txt", "Status: true", "Seq: 3")
+    first := con.reply()
+    if first.Kind != "batch_limit" || first.Seq == nil || *first.Seq != 3 {
+        t.Fatalf("the upload over the limit got %+v, want 3 refused as batch_limit", first)
+    }
+    if !con.isClosed() {
+        t.Fatal("the connection is still open past the limit")
+    }
+    assertFiles(t, "a.txt", "b.txt")
+
+    // Another connection starts over.
+    mustUpload(t, addr, "c.txt", "c.txt")
+}
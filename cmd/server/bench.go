@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The bench command uploads synthetic files to a running server for a while,
+// from several connections at once, to tell how much it can take: the
+// throughput, the latencies of the uploads and how many of them failed. The
+// uploads go through the upload protocol like those of the client, and are
+// stored like any other.
+
+// benchConfig is what the bench uploads and how.
+type benchConfig struct {
+    addr        string
+    size        int64
+    concurrency int
+    duration    time.Duration
+    prefix      string
+    auth        string
+    tls         *tls.Config
+}
+
+// benchResult is what the uploads of the bench measured.
+type benchResult struct {
+    uploads   int
+    failures  int
+    bytes     int64
+    elapsed   time.Duration
+    latencies []time.Duration
+
+    // errors counts the failures by their error.
+    errors map[string]int
+}
+
+func benchCommand(args []string) error {
+    fs := flag.NewFlagSet("bench", flag.ExitOnError)
+    size := fs.Int64("size", 1 << 20, "size in bytes of every file uploaded")
+    concurrency := fs.Int("concurrency", 4, "number of the uploads at once")
+    duration := fs.Duration("duration", 10 * time.Second, "how long to upload for")
+    prefix := fs.String("name", "bench", "what the names of the uploaded files start with")
+    auth := fs.String("auth", "", "the secret of the server or an upload token")
+    useTLS := fs.Bool("tls", false, "connect to the server over TLS")
+    insecure := fs.Bool("insecure", false, "don't verify the certificate of the server, implies -tls")
+    fs.Parse(args)
+
+    if fs.NArg() != 1 {
+        return fmt.Errorf("usage: files bench [flags] <host>:<port>")
+    }
+    if *size < 0 || *concurrency < 1 || *duration <= 0 {
+        return fmt.Errorf("the size, the concurrency and the duration must be positive")
+    }
+
+    config := &benchConfig{
+        addr:        fs.Arg(0),
+        size:        *size,
+        concurrency: *concurrency,
+        duration:    *duration,
+        prefix:      *prefix,
+        auth:        *auth,
+    }
+    if *useTLS || *insecure {
+        host, _, _ := net.SplitHostPort(config.addr)
+        config.tls = &tls.Config{ServerName: host, InsecureSkipVerify: *insecure}
+    }
+
+    result := runBench(config)
+    result.print()
+    return nil
+}
+
+// runBench uploads from the connections until the duration is over, the
+// uploads in progress are finished then.
+func runBench(config *benchConfig) *benchResult {
+    result := &benchResult{errors: make(map[string]int)}
+    var mu sync.Mutex
+    var seq int64
+
+    start := time.Now()
+    deadline := start.Add(config.duration)
+
+    var wg sync.WaitGroup
+    for worker := 0; worker < config.concurrency; worker++ {
+        wg.Add(1)
+        go func(worker int) {
+            defer wg.Done()
+
+            rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+            data := make([]byte, config.size)
+            rnd.Read(data)
+
+            for time.Now().Before(deadline) {
+                n := atomic.AddInt64(&seq, 1)
+                name := fmt.Sprintf("%s_%d.bin", config.prefix, n)
+
+                // Every file gets contents of its own, not to be deduplicated.
+                if len(data) >= 8 {
+                    binary.BigEndian.PutUint64(data, uint64(rnd.Int63()))
+                }
+
+                began := time.Now()
+                err := benchUpload(config, name, data)
+                latency := time.Since(began)
+
+                mu.Lock()
+                result.uploads++
+                if err != nil {
+                    result.failures++
+                    result.errors[err.Error()]++
+                } else {
+                    result.bytes += config.size
+                    result.latencies = append(result.latencies, latency)
+                }
+                mu.Unlock()
+            }
+        }(worker)
+    }
+    wg.Wait()
+
+    result.elapsed = time.Since(start)
+    sort.Slice(result.latencies, func(i, j int) bool {
+        return result.latencies[i] < result.latencies[j]
+    })
+    return result
+}
+
+// benchUpload uploads the data under the name on a connection of its own,
+// until the server tells it's stored.
+func benchUpload(config *benchConfig, name string, data []byte) error {
+    var con net.Conn
+    var err error
+    if config.tls != nil {
+        con, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp",
+                                      config.addr, config.tls)
+    } else {
+        con, err = net.DialTimeout("tcp", config.addr, 10 * time.Second)
+    }
+    if err != nil {
+        return fmt.Errorf("could not connect, %v", netCause(err))
+    }
+    defer con.Close()
+
+    header := fmt.Sprintf("%s\nName: %s\nSize: %d\nStatus: true\nFooter: sha256\n",
+                          protocolMagic, name, len(data))
+    if config.auth != "" {
+        header += fmt.Sprintf("Auth: %s\n", config.auth)
+    }
+    if _, err := io.WriteString(con, header + "\n"); err != nil {
+        return fmt.Errorf("could not send the request, %v", netCause(err))
+    }
+
+    r := bufio.NewReader(con)
+    if _, err := benchResponse(r, name); err != nil {
+        return err
+    }
+
+    // The server might have told why it stopped receiving.
+    refused := func(err error) error {
+        if _, err := benchResponse(r, name); err != nil {
+            var refusal *benchRefusal
+            if errors.As(err, &refusal) {
+                return refusal
+            }
+        }
+        return fmt.Errorf("could not send the data, %v", netCause(err))
+    }
+
+    zw, err := flate.NewWriter(con, flate.BestSpeed)
+    if err != nil {
+        return fmt.Errorf("could not initialize DEFLATE compressor, %v", err)
+    }
+    if _, err := zw.Write(data); err != nil {
+        return refused(err)
+    }
+    if err := zw.Close(); err != nil {
+        return refused(err)
+    }
+
+    sum := sha256.Sum256(data)
+    if _, err := fmt.Fprintf(con, "%s\n", hex.EncodeToString(sum[:])); err != nil {
+        return refused(err)
+    }
+
+    status, err := benchResponse(r, name)
+    if err != nil {
+        return err
+    }
+    if status.Status != "ok" {
+        return fmt.Errorf("the server could not store the file")
+    }
+
+    return nil
+}
+
+// benchRefusal is the error the server refused the upload with.
+type benchRefusal struct {
+    reason string
+}
+
+func (r *benchRefusal) Error() string {
+    return "the server refused the upload, " + r.reason
+}
+
+// benchResponse reads the next response of the server, an error if it
+// refused the upload. The name is left out of the error, so that the same
+// failures are counted together whatever file they're about.
+func benchResponse(r *bufio.Reader, name string) (*response, error) {
+    line, err := r.ReadBytes('\n')
+    if err != nil {
+        return nil, fmt.Errorf("could not receive the response of the server, %v", netCause(err))
+    }
+
+    resp := &response{}
+    if err := json.Unmarshal(line, resp); err != nil {
+        return nil, fmt.Errorf("malformed response of the server, %v", err)
+    }
+
+    if resp.Status == "error" || resp.Error != "" {
+        reason := strings.ReplaceAll(resp.Error, strconv.Quote(name), "<name>")
+        return nil, &benchRefusal{reason: reason}
+    }
+
+    return resp, nil
+}
+
+// netCause strips the addresses off the network errors, so that the same
+// failures are counted together whatever connection they happened on.
+func netCause(err error) error {
+    var op *net.OpError
+    if errors.As(err, &op) {
+        return op.Err
+    }
+
+    return err
+}
+
+// percentile returns the latency below which the fraction p of the
+// successful uploads are, zero if there are none.
+func (br *benchResult) percentile(p float64) time.Duration {
+    if len(br.latencies) == 0 {
+        return 0
+    }
+
+    i := int(p * float64(len(br.latencies)))
+    if i >= len(br.latencies) {
+        i = len(br.latencies) - 1
+    }
+    return br.latencies[i]
+}
+
+func (br *benchResult) print() {
+    seconds := br.elapsed.Seconds()
+    rate := 0.0
+    if br.uploads > 0 {
+        rate = float64(br.failures) / float64(br.uploads) * 100
+    }
+
+    fmt.Printf("uploads: %d in %v, %.1f/s\n", br.uploads, br.elapsed.Round(time.Millisecond),
+               float64(br.uploads - br.failures) / seconds)
+    fmt.Printf("throughput: %.2f MiB/s (%d bytes)\n", float64(br.bytes) / seconds / (1 << 20), br.bytes)
+    fmt.Printf("latency: p50=%v p90=%v p99=%v max=%v\n",
+               br.percentile(0.5).Round(time.Microsecond), br.percentile(0.9).Round(time.Microsecond),
+               br.percentile(0.99).Round(time.Microsecond), br.percentile(1).Round(time.Microsecond))
+    fmt.Printf("errors: %d (%.2f%%)\n", br.failures, rate)
+
+    reasons := make([]string, 0, len(br.errors))
+    for reason := range br.errors {
+        reasons = append(reasons, reason)
+    }
+    sort.Strings(reasons)
+    for _, reason := range reasons {
+        fmt.Printf("\t%d\t%s\n", br.errors[reason], reason)
+    }
+}
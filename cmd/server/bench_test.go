@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+
+    config := &benchConfig{addr: addr, size: 4096, concurrency: 3, duration: 200 * time.Millisecond, prefix: "bench"}
+    result := runBench(config)
+    if result.uploads == 0 || result.failures != 0 || len(result.errors) != 0 {
+        t.Fatalf("the bench made %d uploads, %d failed with %v, want some and none failed",
+                 result.uploads, result.failures, result.errors)
+    }
+    if result.bytes != int64(result.uploads) * config.size || len(result.latencies) != result.uploads {
+        t.Fatalf("the bench told %d bytes and %d latencies for %d uploads", result.bytes,
+                 len(result.latencies), result.uploads)
+    }
+    if result.elapsed < config.duration || result.elapsed > config.duration + 5 * time.Second {
+        t.Fatalf("the bench took %v for the duration of %v", result.elapsed, config.duration)
+    }
+    p50, p90, max := result.percentile(0.5), result.percentile(0.9), result.percentile(1)
+    if p50 <= 0 || p50 > p90 || p90 > max || max > result.elapsed {
+        t.Fatalf("the latencies are p50=%v p90=%v max=%v over %v", p50, p90, max, result.elapsed)
+    }
+    if n := len(listFiles(t)); n != result.uploads {
+        t.Fatalf("stored %d files for the %d uploads", n, result.uploads)
+    }
+
+    // The refusals are counted together whatever file they're about.
+    s = newTestServer(t)
+    s.MaxSize = 100
+    config.addr = serveTest(t, s)
+    result = runBench(config)
+    if result.uploads == 0 || result.failures != result.uploads || len(result.errors) != 1 {
+        t.Fatalf("the bench made %d uploads, %d failed with %v, want all failed for one reason",
+                 result.uploads, result.failures, result.errors)
+    }
+    if result.bytes != 0 || result.percentile(0.5) != 0 {
+        t.Fatalf("the failed uploads told %d bytes and the latency %v", result.bytes, result.percentile(0.5))
+    }
+}
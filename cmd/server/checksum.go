@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// checksumAlgorithms are the checksums the data can be verified with, in the
+// SHA256 header or in the footer.
+var checksumAlgorithms = []string{"sha256"}
+
+// otherChecksums are the algorithms a client might ask to verify the data
+// with, but the server doesn't support. An upload asking for one of them is
+// refused rather than stored unverified, since the unknown headers are
+// otherwise ignored.
+var otherChecksums = []string{
+    "md5", "sha1", "sha224", "sha384", "sha512", "sha512-224", "sha512-256",
+    "sha3-224", "sha3-256", "sha3-384", "sha3-512",
+    "blake2b", "blake2s", "blake3", "crc32", "crc32c", "crc64", "xxh64", "xxh3",
+}
+
+// errUnsupportedChecksum tells the client which algorithms it could use
+// instead.
+func errUnsupportedChecksum(algorithm string) error {
+    return fmt.Errorf("unsupported checksum algorithm %q, the server supports %s",
+                      algorithm, strings.Join(checksumAlgorithms, ", "))
+}
+
+// checkChecksums makes sure the checksums the client asks for, in the header
+// keys or as the footer, are all the server can verify.
+func checkChecksums(header textproto.MIMEHeader) error {
+    for _, algorithm := range otherChecksums {
+        if _, exists := header[textproto.CanonicalMIMEHeaderKey(algorithm)]; exists {
+            return errUnsupportedChecksum(algorithm)
+        }
+    }
+
+    if footer := strings.ToLower(header.Get("Footer")); footer != "" {
+        for _, algorithm := range checksumAlgorithms {
+            if footer == algorithm {
+                return nil
+            }
+        }
+        return errUnsupportedChecksum(footer)
+    }
+
+    return nil
+}
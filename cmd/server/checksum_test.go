@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequireChecksum(t *testing.T) {
+    sum := "SHA256: " + sha256Hex("data")
+
+    // The checksum is optional by default.
+    addr := serveTest(t, newTestServer(t))
+    mustUpload(t, addr, "a.txt", "data")
+    mustUpload(t, addr, "b.txt", "data", sum)
+    assertFiles(t, "a.txt", "b.txt")
+
+    s := newTestServer(t)
+    s.RequireChecksum = true
+    addr = serveTest(t, s)
+    if first, _ := upload(t, addr, "c.txt", "data"); first.Error == "" {
+        t.Fatal("the upload without a checksum was accepted")
+    }
+    mustUpload(t, addr, "d.txt", "data", sum)
+    if _, status := upload(t, addr, "e.txt", "data", "SHA256: " + sha256Hex("other")); status.Status == "ok" {
+        t.Fatal("the upload with a wrong checksum was stored")
+    }
+    assertFiles(t, "d.txt")
+}
+
+func TestMalformedChecksum(t *testing.T) {
+    addr := serveTest(t, newTestServer(t))
+    sum := sha256Hex("data")
+
+    for _, test := range []struct{ sum, failure string }{
+        {strings.Repeat("z", 64), "not hex encoded"},
+        {sum[:62], "62 hex digits long instead of 64"},
+        {sum + "00", "66 hex digits long instead of 64"},
+    } {
+        first, status := upload(t, addr, "a.txt", "data", "SHA256: " + test.sum)
+        if status != nil || !strings.Contains(first.Error, test.failure) {
+            t.Errorf("the checksum %q was refused with %q, want it refused up front as %s",
+                     test.sum, first.Error, test.failure)
+        }
+    }
+    assertFiles(t)
+
+    mustUpload(t, addr, "a.txt", "data", "SHA256: " + strings.ToUpper(sum))
+}
+
+func TestUnsupportedChecksum(t *testing.T) {
+    addr := serveTest(t, newTestServer(t))
+
+    for _, header := range []string{"MD5: " + strings.Repeat("0", 32), "Blake3: " + strings.Repeat("0", 64),
+                                    "Footer: md5"} {
+        first, status := upload(t, addr, "a.txt", "data", header)
+        if status != nil || !strings.Contains(first.Error, "unsupported checksum algorithm") ||
+           !strings.Contains(first.Error, "the server supports sha256") {
+            t.Errorf("the upload with %q was refused with %q, want the supported algorithms told", header,
+                     first.Error)
+        }
+    }
+    assertFiles(t)
+
+    if status := uploadRaw(t, addr, "a.txt", "data", sha256Hex("data") + "\n", "Footer: SHA256"); status.Status != "ok" {
+        t.Fatalf("the upload with the sha256 footer failed, %s", status.Error)
+    }
+}
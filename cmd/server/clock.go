@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+)
+
+// Clock tells the time to whatever depends on it, like the expiry of the
+// upload tokens and of the holds or the lifetime of the server, so that it
+// can be replaced with a clock advanced at will.
+type Clock interface {
+    Now() time.Time
+
+    // AfterFunc calls f in its own goroutine once d elapsed.
+    AfterFunc(d time.Duration, f func()) Timer
+
+    // Tick delivers the time every d.
+    Tick(d time.Duration) <-chan time.Time
+
+    // NewTicker delivers the time every d, until stopped.
+    NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the function scheduled with AfterFunc.
+type Timer interface {
+    // Stop prevents the function from being called, telling whether it
+    // wasn't called already.
+    Stop() bool
+}
+
+// Ticker delivers the time on its channel until stopped.
+type Ticker interface {
+    C() <-chan time.Time
+    Stop()
+}
+
+// sleep blocks for d as told by the clock.
+func sleep(c Clock, d time.Duration) {
+    done := make(chan struct{})
+    c.AfterFunc(d, func() { close(done) })
+    <-done
+}
+
+// realClock tells the wall-clock time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+    return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+    return time.AfterFunc(d, f)
+}
+
+func (realClock) Tick(d time.Duration) <-chan time.Time {
+    return time.Tick(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+    return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+    *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+    return t.Ticker.C
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock advanced at will. The functions and the tickers due
+// fire as the clock is advanced past them.
+type fakeClock struct {
+    now    time.Time
+    timers []*fakeTimer
+    sync.Mutex
+}
+
+type fakeTimer struct {
+    clock  *fakeClock
+    at     time.Time
+    period time.Duration
+    f      func()
+    c      chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+    return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+    c.Lock()
+    defer c.Unlock()
+
+    return c.now
+}
+
+func (c *fakeClock) schedule(t *fakeTimer) *fakeTimer {
+    c.Lock()
+    defer c.Unlock()
+
+    t.clock = c
+    t.at = c.now.Add(t.period)
+    c.timers = append(c.timers, t)
+    return t
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+    return c.schedule(&fakeTimer{period: d, f: f})
+}
+
+func (c *fakeClock) Tick(d time.Duration) <-chan time.Time {
+    return c.NewTicker(d).C()
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+    return fakeTicker{c.schedule(&fakeTimer{period: d, c: make(chan time.Time, 1)})}
+}
+
+// pending returns the number of the functions and the tickers scheduled.
+func (c *fakeClock) pending() int {
+    c.Lock()
+    defer c.Unlock()
+
+    return len(c.timers)
+}
+
+// waitPending waits until n functions or tickers are scheduled, e.g. by a
+// goroutine about to sleep.
+func (c *fakeClock) waitPending(t *testing.T, n int) {
+    t.Helper()
+    for deadline := time.Now().Add(5 * time.Second); c.pending() < n; {
+        if time.Now().After(deadline) {
+            t.Fatalf("%d timers are scheduled, want %d", c.pending(), n)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+// Advance moves the time forward, firing what's due.
+func (c *fakeClock) Advance(d time.Duration) {
+    c.Lock()
+    defer c.Unlock()
+
+    c.now = c.now.Add(d)
+    timers := c.timers[:0]
+    for _, t := range c.timers {
+        if t.at.After(c.now) {
+            timers = append(timers, t)
+            continue
+        }
+
+        if t.f != nil {
+            go t.f()
+            continue
+        }
+
+        select {
+        case t.c <- c.now:
+        default:
+        }
+        for !t.at.After(c.now) {
+            t.at = t.at.Add(t.period)
+        }
+        timers = append(timers, t)
+    }
+    c.timers = timers
+}
+
+func (t *fakeTimer) stop() bool {
+    c := t.clock
+    c.Lock()
+    defer c.Unlock()
+
+    for i, other := range c.timers {
+        if other == t {
+            c.timers = append(c.timers[:i], c.timers[i + 1:]...)
+            return true
+        }
+    }
+
+    return false
+}
+
+func (t *fakeTimer) Stop() bool {
+    return t.stop()
+}
+
+type fakeTicker struct {
+    *fakeTimer
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+    return t.c
+}
+
+func (t fakeTicker) Stop() {
+    t.stop()
+}
+
+func TestSleep(t *testing.T) {
+    clock := newFakeClock()
+    done := make(chan struct{})
+    go func() {
+        sleep(clock, time.Minute)
+        close(done)
+    }()
+
+    clock.waitPending(t, 1)
+    clock.Advance(30 * time.Second)
+    select {
+    case <-done:
+        t.Fatal("the sleep ended early")
+    case <-time.After(10 * time.Millisecond):
+    }
+
+    clock.Advance(30 * time.Second)
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("the sleep did not end")
+    }
+}
+
+func TestRateLimiterClock(t *testing.T) {
+    clock := newFakeClock()
+    l := newRateLimiter(100, clock)
+
+    // A second worth of bytes passes right away, the next ones wait.
+    l.wait(100)
+    done := make(chan struct{})
+    go func() {
+        l.wait(50)
+        close(done)
+    }()
+
+    clock.waitPending(t, 1)
+    clock.Advance(time.Second / 2)
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("the limiter did not let the bytes through")
+    }
+}
+
+func TestStormDetectorClock(t *testing.T) {
+    clock := newFakeClock()
+    d := newStormDetector(2, time.Minute, true, 0, clock)
+
+    for i := 0; i < 2; i++ {
+        if err := d.record("a.txt"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := d.record("a.txt"); err == nil {
+        t.Fatal("the third upload within the window is accepted")
+    }
+
+    clock.Advance(2 * time.Minute)
+    if err := d.record("a.txt"); err != nil {
+        t.Fatalf("the upload after the window is refused, %v", err)
+    }
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// compressedDir keeps the DEFLATE streams the files arrived in, named by the
+// SHA-256 of their content, so that the same content is kept once whatever
+// names it's stored under, swapped to or copied to.
+const compressedDir = dataDir + "/compressed"
+
+// zlibHeader starts a zlib stream of DEFLATE with a 32 KiB window and no
+// preset dictionary, which HTTP calls the deflate encoding.
+var zlibHeader = []byte{0x78, 0x9c}
+
+// flateInput is what the decompressor reads the compressed bytes from, a
+// byte at a time, so that it doesn't read past the end of the stream.
+type flateInput interface {
+    io.Reader
+    io.ByteReader
+}
+
+// compressedCopy keeps the compressed bytes of an upload as the decompressor
+// reads them, as a zlib stream to be served as such later.
+type compressedCopy struct {
+    in   flateInput
+    file *os.File
+    w    *bufio.Writer
+    err  error
+}
+
+// newCompressedCopy starts keeping the bytes read from in. Failing to, the
+// upload is only received as usual.
+func newCompressedCopy(in flateInput) *compressedCopy {
+    err := os.MkdirAll(compressedDir, 0777)
+    var file *os.File
+    if err == nil {
+        file, err = ioutil.TempFile(compressedDir, "*" + partSuffix)
+    }
+    if err != nil {
+        log.Printf("warning: could not keep the compressed data, %v", err)
+        return nil
+    }
+
+    c := &compressedCopy{in: in, file: file, w: bufio.NewWriter(file)}
+    _, c.err = c.w.Write(zlibHeader)
+    return c
+}
+
+func (c *compressedCopy) Read(p []byte) (int, error) {
+    n, err := c.in.Read(p)
+    if n > 0 && c.err == nil {
+        _, c.err = c.w.Write(p[:n])
+    }
+    return n, err
+}
+
+func (c *compressedCopy) ReadByte() (byte, error) {
+    b, err := c.in.ReadByte()
+    if err == nil && c.err == nil {
+        c.err = c.w.WriteByte(b)
+    }
+    return b, err
+}
+
+// keep ends the zlib stream with the Adler-32 of the decompressed data and
+// saves it for the content of the checksum, unless it's kept already.
+func (c *compressedCopy) keep(sum string, weak uint32) {
+    if c == nil || c.file == nil {
+        return
+    }
+    defer c.discard()
+
+    var trailer [4]byte
+    binary.BigEndian.PutUint32(trailer[:], weak)
+    if c.err == nil {
+        _, c.err = c.w.Write(trailer[:])
+    }
+    if c.err == nil {
+        c.err = c.w.Flush()
+    }
+    if c.err == nil {
+        c.err = c.file.Close()
+    }
+    if c.err == nil {
+        c.err = os.Rename(c.file.Name(), filepath.Join(compressedDir, sum))
+    }
+    if c.err != nil {
+        log.Printf("warning: could not keep the compressed data of %s, %v", sum, c.err)
+    }
+}
+
+// discard removes what was kept, unless it was saved.
+func (c *compressedCopy) discard() {
+    if c == nil || c.file == nil {
+        return
+    }
+
+    c.file.Close()
+    os.Remove(c.file.Name())
+    c.file = nil
+}
+
+// acceptsCoding tells whether the client accepts the content coding.
+func acceptsCoding(r *http.Request, coding string) bool {
+    for _, value := range r.Header.Values("Accept-Encoding") {
+        for _, entry := range strings.Split(value, ",") {
+            params := strings.Split(entry, ";")
+            name := strings.ToLower(strings.TrimSpace(params[0]))
+            if name != coding && name != "*" {
+                continue
+            }
+
+            accepted := true
+            for _, param := range params[1:] {
+                param = strings.TrimSpace(param)
+                if strings.HasPrefix(param, "q=") {
+                    q, err := strconv.ParseFloat(param[len("q="):], 64)
+                    accepted = err == nil && q > 0
+                }
+            }
+            return accepted
+        }
+    }
+
+    return false
+}
+
+// openEncoded opens the data of the content of the checksum compressed with
+// the codec, kept with -keep-compressed or by the recompressor, if there's
+// one.
+func openEncoded(c codec, sum string) (*os.File, bool) {
+    if sum == "" {
+        return nil, false
+    }
+
+    f, err := os.Open(encodedPath(c, sum))
+    if err != nil {
+        return nil, false
+    }
+
+    return f, true
+}
+
+// contentType tells the type of the stored file, from its extension or else
+// from its first bytes, since the compressed ones tell nothing.
+func contentType(name string, f io.ReadSeeker) string {
+    if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+        return ctype
+    }
+
+    var buf [512]byte
+    n, _ := io.ReadFull(f, buf[:])
+    f.Seek(0, io.SeekStart)
+    return http.DetectContentType(buf[:n])
+}
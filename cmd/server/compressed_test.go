@@ -0,0 +1,56 @@
+package main
+
+import (
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestKeepCompressed(t *testing.T) {
+    s := newTestServer(t)
+    s.KeepCompressed = true
+    addr := serveTest(t, s)
+
+    data := strings.Repeat("compresses well ", 1000)
+    mustUpload(t, addr, "a.txt", data)
+
+    w := download(s, "a.txt", "gzip, deflate")
+    if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "deflate" {
+        t.Fatalf("got %d with the encoding %q, want 200 deflate", w.Code, w.Header().Get("Content-Encoding"))
+    }
+    if w.Body.Len() >= len(data) {
+        t.Fatalf("sent %d bytes of the kept stream for %d bytes of data", w.Body.Len(), len(data))
+    }
+    zr, err := zlib.NewReader(w.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    decoded, err := ioutil.ReadAll(zr)
+    if err != nil {
+        t.Fatalf("the kept stream doesn't decode, %v", err)
+    }
+    if string(decoded) != data {
+        t.Fatal("the kept stream doesn't decode to the file")
+    }
+
+    // The others get the file as it is.
+    for _, encoding := range []string{"", "gzip", "br, gzip", "deflate;q=0"} {
+        w := download(s, "a.txt", encoding)
+        if w.Header().Get("Content-Encoding") != "" || w.Body.String() != data {
+            t.Errorf("the client accepting %q didn't get the file as it is", encoding)
+        }
+        if w.Header().Get("Vary") != "Accept-Encoding" {
+            t.Errorf("the download accepting %q doesn't vary by Accept-Encoding", encoding)
+        }
+    }
+
+    // Unless asked to, the streams aren't kept.
+    s = newTestServer(t)
+    addr = serveTest(t, s)
+    mustUpload(t, addr, "a.txt", data)
+    if w := download(s, "a.txt", "deflate"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != data {
+        t.Fatal("the stream was served compressed without -keep-compressed")
+    }
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+)
+
+// decompressionLimiter bounds the number of the uploads decompressing their
+// data at once. Decompressing takes the CPU while the rest of an upload
+// mostly waits for the network or the disk, so it's limited apart from the
+// connections.
+type decompressionLimiter struct {
+    slots chan struct{}
+}
+
+func newDecompressionLimiter(n int) *decompressionLimiter {
+    return &decompressionLimiter{slots: make(chan struct{}, n)}
+}
+
+// limitedDecompressor takes a slot of the limiter for every read of the
+// decompressed data, rather than for the whole upload, so that the uploads
+// take turns decompressing. The compressed data can't be waited for before
+// the slot is taken, since the decompressor may still have data to give out
+// once it has all of it.
+type limitedDecompressor struct {
+    io.ReadCloser
+    limiter *decompressionLimiter
+}
+
+func (d *limitedDecompressor) Read(p []byte) (int, error) {
+    d.limiter.slots <- struct{}{}
+    defer func() { <-d.limiter.slots }()
+
+    return d.ReadCloser.Read(p)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrency tells the most reads of its readers that ran at once.
+type concurrency struct {
+    running, most int
+    sync.Mutex
+}
+
+// slowReader reads slowly, counting its reads as running meanwhile.
+type slowReader struct {
+    r io.Reader
+    c *concurrency
+}
+
+func (sr *slowReader) Read(p []byte) (int, error) {
+    sr.c.Lock()
+    sr.c.running++
+    if sr.c.running > sr.c.most {
+        sr.c.most = sr.c.running
+    }
+    sr.c.Unlock()
+
+    time.Sleep(time.Millisecond)
+
+    sr.c.Lock()
+    sr.c.running--
+    sr.c.Unlock()
+    return sr.r.Read(p)
+}
+
+func TestDecompressionLimiter(t *testing.T) {
+    const slots, uploads = 2, 6
+
+    limiter := newDecompressionLimiter(slots)
+    c := &concurrency{}
+    var wg sync.WaitGroup
+    for i := 0; i < uploads; i++ {
+        sr := &slowReader{r: strings.NewReader(strings.Repeat("x", 100)), c: c}
+        d := &limitedDecompressor{ReadCloser: ioutil.NopCloser(sr), limiter: limiter}
+
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            buf := make([]byte, 10)
+            for {
+                if _, err := d.Read(buf); err != nil {
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+
+    if c.most > slots || c.most == 0 {
+        t.Fatalf("%d decompressions ran at once, want at most %d", c.most, slots)
+    }
+}
+
+func TestDecompressionLimiterUploads(t *testing.T) {
+    s := newTestServer(t)
+    s.decompressions = newDecompressionLimiter(1)
+    addr := serveTest(t, s)
+
+    // The connections are all admitted, they take turns decompressing.
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := tryUpload(addr, "a.txt", strings.Repeat("data", 10000)); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+
+    if n := len(listFiles(t)); n != 4 {
+        t.Fatalf("stored %d files, want 4", n)
+    }
+}
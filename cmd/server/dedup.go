@@ -0,0 +1,163 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// The policies for the same contents stored under different names, either
+// stored as they are or as hard links to the first file with the contents.
+const (
+    dedupNone     = "none"
+    dedupHardlink = "hardlink"
+)
+
+// The savings of the deduplication since the start: the bytes of the files
+// received, those they take on the disk and the difference. The files linked
+// to already stored ones take no space of their own.
+var (
+    dedupLogicalBytes  = expvar.NewInt("dedup_logical_bytes")
+    dedupPhysicalBytes = expvar.NewInt("dedup_physical_bytes")
+    dedupSavedBytes    = expvar.NewInt("dedup_saved_bytes")
+)
+
+func init() {
+    expvar.Publish("dedup_ratio", expvar.Func(dedupRatio))
+}
+
+// dedupRatio is how many times the files received are larger than what they
+// take on the disk, 1 until anything is received.
+func dedupRatio() interface{} {
+    physical := dedupPhysicalBytes.Value()
+    if physical == 0 {
+        return 1.0
+    }
+
+    return float64(dedupLogicalBytes.Value()) / float64(physical)
+}
+
+// contentIndex maps the checksums of the stored files to their names, so
+// that a file with the same contents as a stored one can be made a hard link
+// to it. The stored files are shared until all their names are removed.
+type contentIndex struct {
+    meta    *metaStore
+    markers bool
+
+    names map[string]string
+    sync.Mutex
+}
+
+// newContentIndex will look up the checksums of the stored files in their
+// metadata. The files whose checksum isn't known are not linked to.
+func newContentIndex(meta *metaStore, markers bool) (*contentIndex, error) {
+    ci := &contentIndex{meta: meta, markers: markers, names: make(map[string]string)}
+
+    dir, err := os.Open(".")
+    if err != nil {
+        return nil, fmt.Errorf("could not open storage directory, %v", err)
+    }
+    defer dir.Close()
+
+    for {
+        stats, err := dir.Readdir(scanBatch)
+        for _, stat := range stats {
+            if !isStoredFile(stat, markers) {
+                continue
+            }
+
+            meta, metaErr := meta.load(stat.Name())
+            if metaErr != nil {
+                log.Print(metaErr)
+                continue
+            }
+            if meta == nil || !meta.fresh(stat) || meta.SHA256 == "" {
+                continue
+            }
+
+            if _, exists := ci.names[meta.SHA256]; !exists {
+                ci.names[meta.SHA256] = stat.Name()
+            }
+        }
+
+        if err == io.EOF {
+            return ci, nil
+        }
+        if err != nil {
+            return nil, fmt.Errorf("could not list stored files, %v", err)
+        }
+    }
+}
+
+// stored checks that the file with the name still has the checksum.
+func (ci *contentIndex) stored(name, sum string) bool {
+    stat, err := os.Stat(name)
+    if err != nil || !isStoredFile(stat, ci.markers) {
+        return false
+    }
+
+    meta, err := ci.meta.load(name)
+    return err == nil && meta != nil && meta.fresh(stat) && meta.SHA256 == sum
+}
+
+// link replaces the file just stored with a hard link to the stored file
+// with the same checksum, if there's one, and tells whether it did.
+// Otherwise, the file is the one the next files with the checksum are linked
+// to. The file is kept as it is if it can't be linked, e.g. on the
+// filesystems without hard links. The size of the file is counted in the
+// savings either way.
+func (ci *contentIndex) link(name, sum string, size int64) (linked bool) {
+    ci.Lock()
+    defer ci.Unlock()
+
+    dedupLogicalBytes.Add(size)
+    defer func() {
+        if linked {
+            dedupSavedBytes.Add(size)
+        } else {
+            dedupPhysicalBytes.Add(size)
+        }
+    }()
+
+    original, exists := ci.names[sum]
+    if !exists || original == name || !ci.stored(original, sum) {
+        ci.names[sum] = name
+        return false
+    }
+
+    // The link is made aside and renamed over the file, so that the file is
+    // never missing.
+    linkName := name + partSuffix
+    if err := os.Link(original, linkName); err != nil {
+        log.Printf("warning: could not link %q to %q, keeping it as it is, %v",
+                   name, original, err)
+        return false
+    }
+    if err := os.Rename(linkName, name); err != nil {
+        log.Printf("warning: could not link %q to %q, keeping it as it is, %v",
+                   name, original, err)
+        os.Remove(linkName)
+        return false
+    }
+
+    log.Printf("stored %q as a link to %q, which has the same contents", name, original)
+    return true
+}
+
+// swap follows the files of the names, which swapped their contents.
+func (ci *contentIndex) swap(a, b string) {
+    ci.Lock()
+    defer ci.Unlock()
+
+    for sum, name := range ci.names {
+        switch name {
+        case a:
+            ci.names[sum] = b
+        case b:
+            ci.names[sum] = a
+        }
+    }
+}
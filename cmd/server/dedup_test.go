@@ -0,0 +1,119 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// distinctFiles counts the distinct files on the disk the names are of, the
+// hard links counting once.
+func distinctFiles(t *testing.T, names ...string) int {
+    t.Helper()
+    var distinct []os.FileInfo
+    for _, name := range names {
+        stat, err := os.Stat(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        seen := false
+        for _, other := range distinct {
+            seen = seen || os.SameFile(stat, other)
+        }
+        if !seen {
+            distinct = append(distinct, stat)
+        }
+    }
+
+    return len(distinct)
+}
+
+func TestDedupPolicies(t *testing.T) {
+    for _, policy := range []string{dedupNone, dedupHardlink} {
+        s := newTestServer(t)
+        if policy == dedupHardlink {
+            var err error
+            if s.content, err = newContentIndex(s.meta, false); err != nil {
+                t.Fatal(err)
+            }
+        }
+        addr := serveTest(t, s)
+
+        mustUpload(t, addr, "a.bin", "same contents")
+        mustUpload(t, addr, "b.bin", "same contents")
+        mustUpload(t, addr, "c.bin", "other contents")
+
+        want := 3
+        if policy == dedupHardlink {
+            want = 2
+        }
+        if n := distinctFiles(t, "a.bin", "b.bin", "c.bin"); n != want {
+            t.Errorf("%s stored %d distinct files, want %d", policy, n, want)
+        }
+        if got := readFile(t, "b.bin"); got != "same contents" {
+            t.Errorf("%s stored b.bin with %q", policy, got)
+        }
+    }
+}
+
+func TestDedupResponse(t *testing.T) {
+    s := newTestServer(t)
+    var err error
+    if s.content, err = newContentIndex(s.meta, false); err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTest(t, s)
+
+    if _, status := upload(t, addr, "a.bin", "same contents"); status.Status != "ok" || status.Deduplicated {
+        t.Fatalf("the first upload ended with %+v, want it stored anew", status)
+    }
+    if _, status := upload(t, addr, "b.bin", "same contents"); status.Status != "ok" || !status.Deduplicated {
+        t.Fatalf("the second upload ended with %+v, want it deduplicated", status)
+    }
+    if _, status := upload(t, addr, "c.bin", "other contents"); status.Deduplicated {
+        t.Fatal("the upload of other contents was deduplicated")
+    }
+
+    // The HTTP uploads tell it too.
+    if w := putFile(s, "d.bin", "same contents"); w.Code != http.StatusCreated ||
+       !strings.Contains(w.Body.String(), `"deduplicated":true`) {
+        t.Fatalf("the HTTP upload got %d with %s, want it deduplicated", w.Code, w.Body.String())
+    }
+}
+
+func TestDedupSavings(t *testing.T) {
+    s := newTestServer(t)
+    var err error
+    if s.content, err = newContentIndex(s.meta, false); err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTest(t, s)
+
+    // The counters are of the whole process, only what this test adds counts.
+    logical, physical, saved := dedupLogicalBytes.Value(), dedupPhysicalBytes.Value(), dedupSavedBytes.Value()
+
+    same, other := "same contents", "other contents"
+    for _, upload := range [][2]string{{"a.bin", same}, {"b.bin", same}, {"c.bin", other}, {"b.bin", same}} {
+        mustUpload(t, addr, upload[0], upload[1])
+    }
+
+    want := [3]int64{int64(3 * len(same) + len(other)), int64(len(same) + len(other)), int64(2 * len(same))}
+    got := [3]int64{dedupLogicalBytes.Value() - logical, dedupPhysicalBytes.Value() - physical,
+                    dedupSavedBytes.Value() - saved}
+    if got != want {
+        t.Fatalf("the logical, physical and saved bytes grew by %v, want %v", got, want)
+    }
+
+    ratio := float64(dedupLogicalBytes.Value()) / float64(dedupPhysicalBytes.Value())
+    if got, err := strconv.ParseFloat(expvar.Get("dedup_ratio").String(), 64); err != nil || got != ratio {
+        t.Fatalf("the metrics tell the ratio %v, %v, want %v", got, err, ratio)
+    }
+    if got := expvar.Get("dedup_saved_bytes").String(); got != fmt.Sprint(dedupSavedBytes.Value()) {
+        t.Fatalf("the metrics tell %s bytes saved, want %d", got, dedupSavedBytes.Value())
+    }
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+)
+
+// maxDictLen is the size of the DEFLATE window. Only that many bytes at the
+// end of a preset dictionary can ever be referred to.
+const maxDictLen = 32 * 1024
+
+// flateDict is a preset dictionary the clients may compress the data with.
+// The clients refer to it by the SHA-256 of its content, so that a client
+// using another dictionary is refused instead of sending garbage.
+type flateDict struct {
+    data []byte
+    sum  string
+}
+
+// loadDict reads the dictionary from the file, which is taken as it is, raw
+// bytes without any framing.
+func loadDict(name string) (*flateDict, error) {
+    data, err := ioutil.ReadFile(name)
+    if err != nil {
+        return nil, fmt.Errorf("could not read DEFLATE dictionary, %v", err)
+    }
+
+    if len(data) > maxDictLen {
+        return nil, fmt.Errorf("the DEFLATE dictionary in %q is larger than the window of %d bytes",
+                               name, maxDictLen)
+    }
+
+    sum := sha256.Sum256(data)
+    return &flateDict{data: data, sum: hex.EncodeToString(sum[:])}, nil
+}
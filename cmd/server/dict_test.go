@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"strings"
+	"testing"
+)
+
+func TestDictionary(t *testing.T) {
+    s := newTestServer(t)
+    dictData := strings.Repeat("the common preamble of the files ", 10)
+    writeFile(t, ".dict", dictData)
+    var err error
+    s.dict, err = loadDict(".dict")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTest(t, s)
+
+    data := dictData + "and what follows"
+    var buf bytes.Buffer
+    zw, _ := flate.NewWriterDict(&buf, flate.BestCompression, []byte(dictData))
+    zw.Write([]byte(data))
+    zw.Close()
+
+    c := dialTest(t, addr)
+    c.request("Name: dict.txt", "Status: true", "Dictionary: " + strings.ToUpper(s.dict.sum))
+    c.reply()
+    c.write(buf.Bytes())
+    c.closeWrite()
+    if status := c.reply(); status.Status != "ok" {
+        t.Fatalf("the upload with the dictionary failed, %s", status.Error)
+    }
+    if got := readFile(t, "dict.txt"); got != data {
+        t.Fatalf("the file with the dictionary has %q", got)
+    }
+
+    // The clients without the dictionary are served as usual.
+    mustUpload(t, addr, "plain.txt", data)
+    if got := readFile(t, "plain.txt"); got != data {
+        t.Fatalf("the file without the dictionary has %q", got)
+    }
+
+    unknown := strings.Repeat("0", 64)
+    if first, _ := upload(t, addr, "other.txt", data, "Dictionary: " + unknown); first.Error == "" {
+        t.Fatal("the upload with another dictionary is accepted")
+    }
+}
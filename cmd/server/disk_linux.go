@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The limits of the filesystem paths, NAME_MAX for a single component and
+// PATH_MAX, including the terminating NUL, for the whole path.
+const (
+    maxNameLen = 255
+    maxPathLen = 4096
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which reserves the space without
+// changing the size of the file, so that a file shorter than announced is
+// not padded.
+const fallocKeepSize = 0x1
+
+// preallocate reserves the disk space for size bytes of the file.
+func preallocate(file *os.File, size int64) error {
+    if size == 0 {
+        return nil
+    }
+
+    return syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+}
+
+// freeSpace returns the number of bytes available to the unprivileged users
+// on the filesystem of the path, or -1 if it's not known on the platform.
+func freeSpace(path string) (int64, error) {
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(path, &stat); err != nil {
+        return 0, err
+    }
+
+    return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// freeInodes returns the number of the free inodes on the filesystem of the
+// path, or -1 if it's not known, e.g. on the filesystems allocating them on
+// demand, which report none at all.
+func freeInodes(path string) (int64, error) {
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(path, &stat); err != nil {
+        return 0, err
+    }
+
+    if stat.Files == 0 {
+        return -1, nil
+    }
+
+    return int64(stat.Ffree), nil
+}
+
+// stNoatime is ST_NOATIME, the flag of the filesystems mounted with noatime.
+const stNoatime = 0x400
+
+// accessTime returns the time the file was last accessed at.
+func accessTime(stat os.FileInfo) (time.Time, bool) {
+    sys, ok := stat.Sys().(*syscall.Stat_t)
+    if !ok {
+        return time.Time{}, false
+    }
+
+    return time.Unix(sys.Atim.Unix()), true
+}
+
+// atimeEnabled tells whether the filesystem of the path keeps track of the
+// access times.
+func atimeEnabled(path string) (bool, error) {
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(path, &stat); err != nil {
+        return false, err
+    }
+
+    return stat.Flags & stNoatime == 0, nil
+}
+
+// syncDir makes the renames and the creations of the files in the directory
+// durable.
+func syncDir(path string) error {
+    dir, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+
+    return dir.Sync()
+}
+
+// deviceID returns the major and the minor number of the device the file is
+// on, as in major:minor.
+func deviceID(stat os.FileInfo) string {
+    sys, ok := stat.Sys().(*syscall.Stat_t)
+    if !ok {
+        return ""
+    }
+
+    dev := uint64(sys.Dev)
+    major := (dev >> 8) & 0xfff | (dev >> 32) & ^uint64(0xfff)
+    minor := dev & 0xff | (dev >> 12) & ^uint64(0xff)
+    return fmt.Sprintf("%d:%d", major, minor)
+}
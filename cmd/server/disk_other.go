@@ -0,0 +1,53 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// The limits of the filesystem paths, for a single component and for the
+// whole path. These are the lowest common ones, Windows without long paths
+// enabled is still more strict about the whole path.
+const (
+    maxNameLen = 255
+    maxPathLen = 1024
+)
+
+// preallocate does nothing, the platform offers no way to reserve the space.
+func preallocate(file *os.File, size int64) error {
+    return nil
+}
+
+// freeSpace returns -1, the free space is not known on the platform.
+func freeSpace(path string) (int64, error) {
+    return -1, nil
+}
+
+// freeInodes returns -1, the free inodes are not known on the platform.
+func freeInodes(path string) (int64, error) {
+    return -1, nil
+}
+
+// accessTime returns false, the access time is not known on the platform.
+func accessTime(stat os.FileInfo) (time.Time, bool) {
+    return time.Time{}, false
+}
+
+// atimeEnabled returns false, the access time is not known on the platform.
+func atimeEnabled(path string) (bool, error) {
+    return false, nil
+}
+
+// syncDir does nothing, not every platform can sync a directory. The renames
+// are as durable as the filesystem makes them.
+func syncDir(path string) error {
+    return nil
+}
+
+// deviceID returns nothing, the device is not known on the platform.
+func deviceID(stat os.FileInfo) string {
+    return ""
+}
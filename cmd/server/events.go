@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+    // eventQueue is the number of the events waiting to be written. While
+    // the reader is away, the events beyond are dropped rather than slowing
+    // the transfers down.
+    eventQueue = 1024
+
+    // eventRetryInterval is how often the socket is connected to again once
+    // it's gone.
+    eventRetryInterval = time.Second
+
+    // eventWriteTimeout is how long the reader of the socket may take to
+    // read an event before it's taken for gone.
+    eventWriteTimeout = 10 * time.Second
+)
+
+// transferEvent tells how a transfer ended, a JSON line for every one.
+type transferEvent struct {
+    Time     time.Time `json:"time"`
+    Op       string    `json:"op"`
+    Name     string    `json:"name,omitempty"`
+    Names    []string  `json:"names,omitempty"`
+    Size     *int64    `json:"size,omitempty"`
+    SHA256   string    `json:"sha256,omitempty"`
+    Remote   string    `json:"remote,omitempty"`
+    Status   string    `json:"status"`
+    Error    string    `json:"error,omitempty"`
+    Kind     string    `json:"kind,omitempty"`
+    Duration float64   `json:"duration_ms"`
+}
+
+// eventSink writes the events of the transfers to a Unix socket or a named
+// pipe in background, connecting to it again whenever it's gone. A nil sink
+// does nothing.
+type eventSink struct {
+    path    string
+    events  chan []byte
+    dropped int64
+    clock   Clock
+}
+
+// newEventSink will start writing the events to the socket or the pipe at
+// the path in background.
+func newEventSink(path string, clock Clock) *eventSink {
+    es := &eventSink{path: path, events: make(chan []byte, eventQueue), clock: clock}
+    go es.write()
+
+    return es
+}
+
+// transfer queues the event of the transfer of the request that started at
+// the time, with the file it was stored as, unless it failed with the error.
+func (es *eventSink) transfer(req *request, start time.Time, file receivedFile, err error) {
+    if es == nil {
+        return
+    }
+
+    now := es.clock.Now()
+    event := &transferEvent{
+        Time:     now,
+        Op:       req.Op,
+        Name:     req.Name,
+        Remote:   req.remote,
+        Status:   "ok",
+        Duration: float64(now.Sub(start)) / float64(time.Millisecond),
+    }
+    if err != nil {
+        event.Status = "error"
+        event.Error = err.Error()
+        event.Kind = errorKind(err)
+    } else {
+        event.Names = append([]string{file.name}, file.also...)
+        event.Size = &file.size
+        event.SHA256 = file.sha256
+    }
+
+    es.queue(event)
+}
+
+// archive queues the event of the archive of the request, with the names its
+// files were stored under.
+func (es *eventSink) archive(req *request, start time.Time, names []string, err error) {
+    if es == nil {
+        return
+    }
+
+    now := es.clock.Now()
+    event := &transferEvent{
+        Time:     now,
+        Op:       req.Op,
+        Remote:   req.remote,
+        Status:   "ok",
+        Duration: float64(now.Sub(start)) / float64(time.Millisecond),
+    }
+    if err != nil {
+        event.Status = "error"
+        event.Error = err.Error()
+        event.Kind = errorKind(err)
+    } else {
+        event.Names = names
+        event.SHA256 = req.SHA256
+    }
+
+    es.queue(event)
+}
+
+func (es *eventSink) queue(event *transferEvent) {
+    line, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("could not encode the event, %v", err)
+        return
+    }
+
+    select {
+    case es.events <- append(line, '\n'):
+    default:
+        atomic.AddInt64(&es.dropped, 1)
+    }
+}
+
+// write writes the events as they come, holding on to the one it couldn't
+// write until it's connected again.
+func (es *eventSink) write() {
+    var w io.WriteCloser
+    connected := true
+    for line := range es.events {
+        for {
+            if w == nil {
+                var err error
+                w, err = es.connect()
+                if err != nil {
+                    if connected {
+                        log.Printf("could not connect to the event socket %q, %v", es.path, err)
+                        connected = false
+                    }
+                    sleep(es.clock, eventRetryInterval)
+                    continue
+                }
+                if !connected {
+                    log.Printf("connected to the event socket %q again", es.path)
+                    connected = true
+                }
+            }
+
+            if con, ok := w.(net.Conn); ok {
+                con.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+            }
+            if _, err := w.Write(line); err != nil {
+                log.Printf("could not write to the event socket %q, %v", es.path, err)
+                w.Close()
+                w = nil
+                connected = false
+                continue
+            }
+            break
+        }
+
+        if dropped := atomic.SwapInt64(&es.dropped, 0); dropped > 0 {
+            log.Printf("warning: dropped %d events, the event socket %q couldn't keep up",
+                       dropped, es.path)
+        }
+    }
+}
+
+// connect opens the named pipe, or connects to the Unix socket, at the path.
+func (es *eventSink) connect() (io.WriteCloser, error) {
+    if stat, err := os.Stat(es.path); err == nil && stat.Mode()&os.ModeNamedPipe != 0 {
+        return os.OpenFile(es.path, os.O_WRONLY, 0)
+    }
+
+    return net.DialTimeout("unix", es.path, eventWriteTimeout)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// eventReader reads the events the sink writes to the listening socket.
+type eventReader struct {
+    t   *testing.T
+    con net.Conn
+    r   *bufio.Reader
+}
+
+func acceptEvents(t *testing.T, l net.Listener) *eventReader {
+    t.Helper()
+    con, err := l.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    con.SetReadDeadline(time.Now().Add(5 * time.Second))
+    t.Cleanup(func() { con.Close() })
+
+    return &eventReader{t: t, con: con, r: bufio.NewReader(con)}
+}
+
+func (er *eventReader) next() *transferEvent {
+    er.t.Helper()
+    line, err := er.r.ReadBytes('\n')
+    if err != nil {
+        er.t.Fatalf("could not read the event, %v", err)
+    }
+    event := &transferEvent{}
+    if err := json.Unmarshal(line, event); err != nil {
+        er.t.Fatalf("could not decode the event %q, %v", line, err)
+    }
+    return event
+}
+
+func TestEventSocket(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "events.sock")
+    l, err := net.Listen("unix", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    clock := newFakeClock()
+    s := newTestServer(t)
+    s.events = newEventSink(path, clock)
+    addr := serveTest(t, s)
+
+    mustUpload(t, addr, "a.txt", "first")
+    mustUpload(t, addr, "a.txt", "second")
+    upload(t, addr, "b.txt", "third", "SHA256: " + sha256Hex("other"))
+
+    events := acceptEvents(t, l)
+    for _, want := range []string{"a.txt", "a_copy1.txt"} {
+        event := events.next()
+        if event.Op != opUpload || event.Status != "ok" || len(event.Names) != 1 || event.Names[0] != want {
+            t.Fatalf("got the event %+v, want %s stored", event, want)
+        }
+        if event.Size == nil || *event.Size == 0 || event.SHA256 == "" || event.Remote == "" {
+            t.Fatalf("the event %+v tells nothing of the stored file", event)
+        }
+    }
+    if event := events.next(); event.Status != "error" || event.Name != "b.txt" || event.Error == "" {
+        t.Fatalf("got the event %+v, want b.txt failed", event)
+    }
+
+    // The reader is gone, the event is held until it's back.
+    events.con.Close()
+    l.Close()
+    mustUpload(t, addr, "c.txt", "fourth")
+    clock.waitPending(t, 1)
+
+    l, err = net.Listen("unix", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    clock.Advance(eventRetryInterval)
+
+    events = acceptEvents(t, l)
+    if event := events.next(); event.Status != "ok" || len(event.Names) != 1 || event.Names[0] != "c.txt" {
+        t.Fatalf("got the event %+v once connected again, want c.txt stored", event)
+    }
+}
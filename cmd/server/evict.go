@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The policies choosing the files to evict first, the least recently
+// modified or the least recently accessed ones.
+const (
+    evictByMtime = "mtime"
+    evictByAtime = "atime"
+)
+
+// evictor keeps the total size of the stored files within the limit by
+// removing the least recently used ones.
+type evictor struct {
+    maxTotal int64
+    policy   string
+    meta     *metaStore
+
+    // markers tells whether the stored files have completion markers, which
+    // are removed along.
+    markers bool
+
+    // quota, if not nil, is freed of the evicted files.
+    quota *quotaTracker
+
+    // Only one eviction runs at once, the concurrent ones would see the same
+    // files and remove more than needed.
+    sync.Mutex
+}
+
+// newEvictor will check that the policy can be followed. If the access times
+// aren't kept by the filesystem of dir, the modification times are used
+// instead.
+func newEvictor(maxTotal int64, policy, dir string, meta *metaStore, markers bool) (*evictor, error) {
+    switch policy {
+    case evictByMtime:
+    case evictByAtime:
+        enabled, err := atimeEnabled(dir)
+        if err != nil {
+            return nil, fmt.Errorf("could not check access times, %v", err)
+        }
+        if !enabled {
+            log.Printf("warning: access times are not kept for %q, evicting by %s instead",
+                       dir, evictByMtime)
+            policy = evictByMtime
+        }
+    default:
+        return nil, fmt.Errorf("unknown eviction policy %q", policy)
+    }
+
+    return &evictor{maxTotal: maxTotal, policy: policy, meta: meta, markers: markers}, nil
+}
+
+// storedFile is a candidate for eviction.
+type storedFile struct {
+    name string
+    size int64
+    used time.Time
+}
+
+// usedAt returns the time the file was last used according to the policy.
+func (e *evictor) usedAt(stat os.FileInfo) time.Time {
+    if e.policy == evictByAtime {
+        if atime, ok := accessTime(stat); ok {
+            return atime
+        }
+    }
+
+    return stat.ModTime()
+}
+
+// evict removes the least recently used files until the total size of the
+// stored files is within the limit. The file just stored, keep, is never
+// removed, even if it alone exceeds the limit.
+func (e *evictor) evict(keep string) error {
+    e.Lock()
+    defer e.Unlock()
+
+    dir, err := os.Open(".")
+    if err != nil {
+        return fmt.Errorf("could not open storage directory, %v", err)
+    }
+    defer dir.Close()
+
+    var files []storedFile
+    var total int64
+    for {
+        stats, err := dir.Readdir(scanBatch)
+        for _, stat := range stats {
+            if !isStoredFile(stat, e.markers) {
+                continue
+            }
+
+            total += stat.Size()
+            if stat.Name() != keep {
+                files = append(files, storedFile{stat.Name(), stat.Size(), e.usedAt(stat)})
+            }
+        }
+
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("could not list stored files, %v", err)
+        }
+    }
+
+    sort.Slice(files, func(i, j int) bool {
+        if !files[i].used.Equal(files[j].used) {
+            return files[i].used.Before(files[j].used)
+        }
+        return files[i].name < files[j].name
+    })
+
+    for _, file := range files {
+        if total <= e.maxTotal {
+            break
+        }
+
+        if err := os.Remove(file.name); err != nil {
+            return fmt.Errorf("could not evict %q, %v", file.name, err)
+        }
+        total -= file.size
+
+        if err := e.meta.remove(file.name); err != nil {
+            log.Print(err)
+        }
+        if e.markers {
+            if err := removeMarker(file.name); err != nil {
+                log.Print(err)
+            }
+        }
+        if e.quota != nil {
+            e.quota.remove(file.name)
+        }
+        log.Printf("evicted %q (%d bytes) to stay within the total size limit",
+                   file.name, file.size)
+    }
+
+    return nil
+}
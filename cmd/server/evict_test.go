@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvictPolicies(t *testing.T) {
+    old, recent := time.Now().Add(-2 * time.Hour), time.Now().Add(-time.Hour)
+    policies := map[string]string{
+        // Modified long ago, read recently.
+        evictByMtime: "read.txt",
+        // Modified recently, read long ago.
+        evictByAtime: "written.txt",
+    }
+    for policy, evicted := range policies {
+        s := newTestServer(t)
+        writeFile(t, "read.txt", "12345")
+        writeFile(t, "written.txt", "12345")
+        writeFile(t, "new.txt", "12345")
+        chtimes(t, "read.txt", recent, old)
+        chtimes(t, "written.txt", old, recent)
+        if stat, _ := os.Stat("read.txt"); policy == evictByAtime && !hasAccessTime(stat) {
+            t.Logf("the access times can't be told here, skipping the %s policy", policy)
+            continue
+        }
+
+        e := &evictor{maxTotal: 10, policy: policy, meta: s.meta}
+        if err := e.evict("new.txt"); err != nil {
+            t.Fatal(err)
+        }
+
+        kept := "read.txt"
+        if evicted == kept {
+            kept = "written.txt"
+        }
+        assertFiles(t, "new.txt", kept)
+    }
+
+    if _, err := newEvictor(10, "size", ".", nil, false); err == nil {
+        t.Error("an unknown policy is accepted")
+    }
+}
+
+func TestEvictKeepsNewFile(t *testing.T) {
+    s := newTestServer(t)
+    writeFile(t, "old.txt", "12345")
+    writeFile(t, "huge.txt", "1234567890")
+    chtimes(t, "huge.txt", time.Now(), time.Now().Add(time.Hour))
+
+    e := &evictor{maxTotal: 5, policy: evictByMtime, meta: s.meta}
+    if err := e.evict("huge.txt"); err != nil {
+        t.Fatal(err)
+    }
+    assertFiles(t, "huge.txt")
+}
+
+func hasAccessTime(stat os.FileInfo) bool {
+    _, ok := accessTime(stat)
+    return ok
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// exportIndexCSV writes the index as CSV, a "name,copies" header followed by
+// a line for every filename with its latest copy number. The names are
+// quoted as needed, so the commas, quotes and newlines in them are kept.
+func exportIndexCSV(w io.Writer, fi *FileIndex) error {
+    out := csv.NewWriter(w)
+    out.Write([]string{"name", "copies"})
+
+    for _, name := range fi.Names() {
+        copies, exists := fi.CopyCount(name)
+        if !exists {
+            continue
+        }
+
+        out.Write([]string{name, strconv.Itoa(copies)})
+    }
+
+    out.Flush()
+    if err := out.Error(); err != nil {
+        return fmt.Errorf("could not export index, %v", err)
+    }
+
+    return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"testing"
+)
+
+func TestExportIndexCSV(t *testing.T) {
+    names := []string{"plain.txt", "plain_copy1.txt", "a,b.txt", `say "hi".txt`, "two\nlines.txt"}
+    fi, _ := NewFileIndexFromSlice(names)
+
+    var buf bytes.Buffer
+    if err := exportIndexCSV(&buf, fi); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Contains(buf.Bytes(), []byte(`"a,b.txt",0`)) || !bytes.Contains(buf.Bytes(), []byte(`"say ""hi"".txt",0`)) {
+        t.Errorf("the names aren't escaped in %q", buf.String())
+    }
+
+    records, err := csv.NewReader(&buf).ReadAll()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := [][]string{
+        {"name", "copies"},
+        {"a,b.txt", "0"},
+        {"plain.txt", "1"},
+        {"plain_copy1.txt", "0"},
+        {`say "hi".txt`, "0"},
+        {"two\nlines.txt", "0"},
+    }
+    if !reflect.DeepEqual(records, want) {
+        t.Fatalf("the export reads back as %q, want %q", records, want)
+    }
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+// flateStats tells the clients asking for it how well their data compressed
+// and how long it took to decompress, so that they can tell whether the
+// compression is worth it, e.g. for the data that doesn't compress.
+type flateStats struct {
+    compressed   int64
+    decompressed int64
+
+    // decompressing is the time spent in the decompressor, waiting is the
+    // part of it spent waiting for the data to arrive.
+    decompressing time.Duration
+    waiting       time.Duration
+}
+
+// countingReader counts the compressed bytes the decompressor reads, and the
+// time it waits for them. It reads a byte at a time, like the decompressor
+// does from the buffered connection, so that it never reads past the end of
+// the stream, into the footer.
+type countingReader struct {
+    r     *bufio.Reader
+    stats *flateStats
+}
+
+// Only the reads with nothing buffered may wait for the network.
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    if c.r.Buffered() > 0 {
+        n, err := c.r.Read(p)
+        c.stats.compressed += int64(n)
+        return n, err
+    }
+
+    start := time.Now()
+    n, err := c.r.Read(p)
+    c.stats.waiting += time.Since(start)
+    c.stats.compressed += int64(n)
+    return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+    if c.r.Buffered() > 0 {
+        c.stats.compressed++
+        return c.r.ReadByte()
+    }
+
+    start := time.Now()
+    b, err := c.r.ReadByte()
+    c.stats.waiting += time.Since(start)
+    if err == nil {
+        c.stats.compressed++
+    }
+    return b, err
+}
+
+// timedDecompressor counts and times the reads of the decompressed data.
+type timedDecompressor struct {
+    io.ReadCloser
+    stats *flateStats
+}
+
+func (d *timedDecompressor) Read(p []byte) (int, error) {
+    start := time.Now()
+    n, err := d.ReadCloser.Read(p)
+    d.stats.decompressing += time.Since(start)
+    d.stats.decompressed += int64(n)
+    return n, err
+}
+
+// report adds the statistics to the final response of the request.
+func (fs *flateStats) report(resp *response) {
+    if fs == nil || resp.Status != "ok" {
+        return
+    }
+
+    compressed := fs.compressed
+    resp.CompressedSize = &compressed
+    if compressed > 0 {
+        resp.CompressionRatio = float64(fs.decompressed) / float64(compressed)
+    }
+
+    cpu := fs.decompressing - fs.waiting
+    if cpu < 0 {
+        cpu = 0
+    }
+    ms := float64(cpu) / float64(time.Millisecond)
+    resp.DecompressionMs = &ms
+}
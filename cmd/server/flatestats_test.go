@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestVerboseStats(t *testing.T) {
+    addr := serveTest(t, newTestServer(t))
+
+    data := strings.Repeat("compresses well ", 10000)
+    _, status := upload(t, addr, "a.txt", data, "Verbose: true")
+    if status.CompressedSize == nil || status.DecompressionMs == nil {
+        t.Fatalf("the verbose status %+v has no compressed size or decompression time", status)
+    }
+    if size := int64(len(deflate(data))); *status.CompressedSize != size {
+        t.Errorf("the compressed size is %d, want %d", *status.CompressedSize, size)
+    }
+    if want := float64(len(data)) / float64(*status.CompressedSize); status.CompressionRatio != want ||
+       status.CompressionRatio < 10 {
+        t.Errorf("the compression ratio is %v, want %v", status.CompressionRatio, want)
+    }
+    if ms := *status.DecompressionMs; ms < 0 || ms > 10000 {
+        t.Errorf("the decompression took %v ms", ms)
+    }
+
+    // The data that doesn't compress has a ratio around 1.
+    random := make([]byte, 10000)
+    rand.Read(random)
+    if _, status := upload(t, addr, "b.bin", string(random), "Verbose: true"); status.CompressionRatio > 1.1 {
+        t.Errorf("the incompressible data has the compression ratio %v", status.CompressionRatio)
+    }
+
+    // Only the verbose clients are told.
+    if _, status := upload(t, addr, "c.txt", data); status.CompressedSize != nil || status.CompressionRatio != 0 {
+        t.Errorf("the status %+v tells the verbose fields", status)
+    }
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultHandshakeTimeout is how long the clients have by default to get
+// through the TLS handshake and the PROXY header.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// handshake completes the TLS handshake and reads the PROXY header of the
+// connection, whichever it has, within HandshakeTimeout, so that the clients
+// stalling before the request don't hold on to the connections. Both happen
+// lazily otherwise, on the first read of the request.
+func (s *Server) handshake(con net.Conn) error {
+    if s.HandshakeTimeout <= 0 {
+        return nil
+    }
+
+    con.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+    defer con.SetDeadline(time.Time{})
+
+    // The PROXY header precedes the TLS handshake, which reads it.
+    var err error
+    switch c := con.(type) {
+    case *tls.Conn:
+        err = c.Handshake()
+    case *proxyConn:
+        c.readHeader()
+        err = c.err
+    }
+    if err != nil {
+        return fmt.Errorf("could not complete the handshake with %v, %v", con.RemoteAddr(), err)
+    }
+
+    return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// inStorage makes a temporary directory the working directory, which is the
+// storage directory, for the test.
+func inStorage(t *testing.T) string {
+    t.Helper()
+    dir := t.TempDir()
+    wd, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Chdir(dir); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.Chdir(wd) })
+
+    return dir
+}
+
+// newTestServer creates a server with the defaults of main, storing into a
+// temporary directory.
+func newTestServer(t *testing.T) *Server {
+    t.Helper()
+    inStorage(t)
+
+    meta, err := newMetaStore(metaDir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    index, err := NewFileIndexFromSlice(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return &Server{
+        index:           index,
+        meta:            meta,
+        transfers:       newTransfers(realClock{}),
+        readOnly:        newReadOnlyGuard(realClock{}),
+        MaxNameAttempts: defaultMaxNameAttempts,
+    }
+}
+
+func writeFile(t *testing.T, name, data string) {
+    t.Helper()
+    if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func chtimes(t *testing.T, name string, atime, mtime time.Time) {
+    t.Helper()
+    if err := os.Chtimes(name, atime, mtime); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func readFile(t *testing.T, name string) string {
+    t.Helper()
+    data, err := ioutil.ReadFile(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return string(data)
+}
+
+// serveTest serves the connections of the server on a loopback listener for
+// the test, returning its address.
+func serveTest(t *testing.T, s *Server) string {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    done := make(chan struct{})
+    go func() {
+        s.Serve(l)
+        close(done)
+    }()
+    t.Cleanup(func() {
+        s.Shutdown()
+        <-done
+    })
+
+    return l.Addr().String()
+}
+
+// testConn is a connection of a client speaking the header-based protocol.
+type testConn struct {
+    t *testing.T
+    net.Conn
+    r *bufio.Reader
+}
+
+func dialTest(t *testing.T, addr string) *testConn {
+    t.Helper()
+    con, err := net.DialTimeout("tcp", addr, 5 * time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    con.SetDeadline(time.Now().Add(10 * time.Second))
+    t.Cleanup(func() { con.Close() })
+
+    return &testConn{t: t, Conn: con, r: bufio.NewReader(con)}
+}
+
+// request sends the header of the request, "Key: value" lines.
+func (c *testConn) request(header ...string) {
+    c.t.Helper()
+    var buf bytes.Buffer
+    buf.WriteString(protocolMagic + "\n")
+    for _, line := range header {
+        buf.WriteString(line + "\n")
+    }
+    buf.WriteString("\n")
+    c.write(buf.Bytes())
+}
+
+func (c *testConn) write(data []byte) {
+    c.t.Helper()
+    if _, err := c.Write(data); err != nil {
+        c.t.Fatal(err)
+    }
+}
+
+// sendData sends the data DEFLATE compressed.
+func (c *testConn) sendData(data string) {
+    c.t.Helper()
+    c.write(deflate(data))
+}
+
+// closeWrite tells the server nothing more follows.
+func (c *testConn) closeWrite() {
+    c.Conn.(*net.TCPConn).CloseWrite()
+}
+
+// reply reads the next response of the server.
+func (c *testConn) reply() *response {
+    c.t.Helper()
+    resp, err := readResponse(c.r)
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    return resp
+}
+
+// isClosed tells whether the server closed the connection, with nothing more
+// to read.
+func (c *testConn) isClosed() bool {
+    _, err := c.r.Peek(1)
+    return err != nil
+}
+
+// upload uploads the data with the header and Status: true, returning the
+// name reply and the final status, which is nil if the upload was refused
+// before the data.
+func upload(t *testing.T, addr, name, data string, header ...string) (*response, *response) {
+    t.Helper()
+    first, status, err := sendUpload(addr, name, data, header...)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return first, status
+}
+
+// mustUpload uploads the data, failing the test unless it's stored, and
+// returns the name it's stored under.
+func mustUpload(t *testing.T, addr, name, data string, header ...string) string {
+    t.Helper()
+    stored, err := tryUpload(addr, name, data, header...)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return stored
+}
+
+// mustUploadFails fails the test if the upload goes through.
+func mustUploadFails(t *testing.T, addr, name, data string) {
+    t.Helper()
+    if _, err := tryUpload(addr, name, data); err == nil {
+        t.Fatalf("the upload of %s went through", name)
+    }
+}
+
+// tryUpload uploads the data, returning the name it's stored under or why it
+// isn't. Unlike mustUpload, it may be called by the goroutines of the test.
+func tryUpload(addr, name, data string, header ...string) (string, error) {
+    first, status, err := sendUpload(addr, name, data, header...)
+    switch {
+    case err != nil:
+        return "", err
+    case first.Error != "":
+        return "", fmt.Errorf("the upload of %q was refused, %s", name, first.Error)
+    case status.Status != "ok":
+        return "", fmt.Errorf("the upload of %q failed, %s", name, status.Error)
+    }
+
+    return status.Name, nil
+}
+
+func sendUpload(addr, name, data string, header ...string) (*response, *response, error) {
+    con, err := net.DialTimeout("tcp", addr, 5 * time.Second)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer con.Close()
+    con.SetDeadline(time.Now().Add(10 * time.Second))
+
+    var buf bytes.Buffer
+    buf.WriteString(protocolMagic + "\n")
+    for _, line := range append([]string{"Name: " + name, "Status: true"}, header...) {
+        buf.WriteString(line + "\n")
+    }
+    buf.WriteString("\n")
+    if _, err := con.Write(buf.Bytes()); err != nil {
+        return nil, nil, err
+    }
+
+    r := bufio.NewReader(con)
+    first, err := readResponse(r)
+    if err != nil || first.Error != "" {
+        return first, nil, err
+    }
+
+    if _, err := con.Write(deflate(data)); err != nil {
+        return nil, nil, err
+    }
+    con.(*net.TCPConn).CloseWrite()
+    status, err := readResponse(r)
+    return first, status, err
+}
+
+func readResponse(r *bufio.Reader) (*response, error) {
+    line, err := r.ReadBytes('\n')
+    if err != nil {
+        return nil, fmt.Errorf("could not read the reply, %v", err)
+    }
+
+    resp := &response{}
+    if err := json.Unmarshal(line, resp); err != nil {
+        return nil, fmt.Errorf("could not decode the reply %q, %v", line, err)
+    }
+    return resp, nil
+}
+
+func deflate(data string) []byte {
+    var buf bytes.Buffer
+    zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+    zw.Write([]byte(data))
+    zw.Close()
+    return buf.Bytes()
+}
+
+// listFiles returns the names in the storage directory, besides the dot
+// files.
+func listFiles(t *testing.T) []string {
+    t.Helper()
+    infos, err := ioutil.ReadDir(".")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var names []string
+    for _, info := range infos {
+        if info.Name()[0] != '.' {
+            names = append(names, info.Name())
+        }
+    }
+    return names
+}
+
+// assertFiles fails the test unless the storage directory has exactly the
+// names.
+func assertFiles(t *testing.T, want ...string) {
+    t.Helper()
+    got := listFiles(t)
+    if fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Fatalf("the storage has %q, want %q", got, want)
+    }
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// holdDir keeps the uploads waiting for approval. Every held upload is kept
+// in a directory named after its token, under the name it will get once
+// approved.
+const holdDir = dataDir + "/held"
+
+// holdTokenLen is the length of the hex encoded hold tokens.
+const holdTokenLen = 32
+
+// holdSweepInterval is how often the expired holds are looked for.
+const holdSweepInterval = time.Minute
+
+type holdStore struct {
+    dir string
+
+    // ttl is how long the uploads are held before they are discarded.
+    ttl time.Duration
+
+    clock Clock
+}
+
+// newHoldStore will create the hold directory if it doesn't exist yet.
+func newHoldStore(dir string, ttl time.Duration, clock Clock) (*holdStore, error) {
+    if err := os.MkdirAll(dir, 0777); err != nil {
+        return nil, fmt.Errorf("could not create hold directory, %v", err)
+    }
+
+    return &holdStore{dir: dir, ttl: ttl, clock: clock}, nil
+}
+
+// newHoldToken generates a token that can't be guessed.
+func newHoldToken() (string, error) {
+    b := make([]byte, holdTokenLen / 2)
+    if _, err := rand.Read(b); err != nil {
+        return "", fmt.Errorf("could not generate hold token, %v", err)
+    }
+
+    return hex.EncodeToString(b), nil
+}
+
+// tokenDir returns the directory of the held upload, checking that the token
+// can't point outside of the hold directory.
+func (hs *holdStore) tokenDir(token string) (string, error) {
+    if _, err := hex.DecodeString(token); err != nil || len(token) != holdTokenLen {
+        return "", fmt.Errorf("malformed hold token %q", token)
+    }
+
+    return filepath.Join(hs.dir, token), nil
+}
+
+// hold moves the received file to the hold directory.
+func (hs *holdStore) hold(token, tempFilename, name string) error {
+    dir, err := hs.tokenDir(token)
+    if err != nil {
+        return err
+    }
+
+    if err := os.Mkdir(dir, 0777); err != nil {
+        return fmt.Errorf("could not hold %q, %v", name, err)
+    }
+
+    if err := os.Rename(tempFilename, filepath.Join(dir, name)); err != nil {
+        os.Remove(dir)
+        return fmt.Errorf("could not hold %q, %v", name, err)
+    }
+
+    return nil
+}
+
+// heldPath returns where the upload of the name is held with the token.
+func (hs *holdStore) heldPath(token, name string) string {
+    return filepath.Join(hs.dir, token, name)
+}
+
+// find returns the name of the held upload.
+func (hs *holdStore) find(token string) (string, error) {
+    dir, err := hs.tokenDir(token)
+    if err != nil {
+        return "", err
+    }
+
+    names, err := readDirNames(dir)
+    if os.IsNotExist(err) || err == nil && len(names) != 1 {
+        return "", fmt.Errorf("no upload is held with token %q", token)
+    }
+    if err != nil {
+        return "", fmt.Errorf("could not look up hold %q, %v", token, err)
+    }
+
+    return names[0], nil
+}
+
+// approve moves the held upload to the storage directory and returns its name.
+func (hs *holdStore) approve(token string) (string, error) {
+    name, err := hs.find(token)
+    if err != nil {
+        return "", err
+    }
+
+    dir := filepath.Join(hs.dir, token)
+    if err := os.Rename(filepath.Join(dir, name), name); err != nil {
+        return "", fmt.Errorf("could not approve %q, %v", name, err)
+    }
+
+    if err := os.Remove(dir); err != nil {
+        log.Printf("could not remove hold directory %q, %v", dir, err)
+    }
+
+    return name, nil
+}
+
+// reject discards the held upload and returns its name.
+func (hs *holdStore) reject(token string) (string, error) {
+    name, err := hs.find(token)
+    if err != nil {
+        return "", err
+    }
+
+    if err := os.RemoveAll(filepath.Join(hs.dir, token)); err != nil {
+        return "", fmt.Errorf("could not reject %q, %v", name, err)
+    }
+
+    return name, nil
+}
+
+// names returns the names the held uploads will get once approved, so that
+// they are not given to anyone else in the meantime.
+func (hs *holdStore) names() ([]string, error) {
+    tokens, err := readDirNames(hs.dir)
+    if err != nil {
+        return nil, fmt.Errorf("could not read hold directory, %v", err)
+    }
+
+    var names []string
+    for _, token := range tokens {
+        held, err := readDirNames(filepath.Join(hs.dir, token))
+        if err != nil {
+            log.Printf("could not read hold %q, %v", token, err)
+            continue
+        }
+
+        names = append(names, held...)
+    }
+
+    return names, nil
+}
+
+// sweep discards the uploads held for longer than the ttl.
+func (hs *holdStore) sweep() {
+    stats, err := ioutil.ReadDir(hs.dir)
+    if err != nil {
+        log.Printf("could not read hold directory, %v", err)
+        return
+    }
+
+    for _, stat := range stats {
+        if hs.clock.Now().Sub(stat.ModTime()) < hs.ttl {
+            continue
+        }
+
+        if err := os.RemoveAll(filepath.Join(hs.dir, stat.Name())); err != nil {
+            log.Printf("could not discard expired hold %q, %v", stat.Name(), err)
+            continue
+        }
+
+        log.Printf("discarded expired hold %q", stat.Name())
+    }
+}
+
+// sweepPeriodically will keep discarding the expired holds.
+func (hs *holdStore) sweepPeriodically() {
+    for range hs.clock.Tick(holdSweepInterval) {
+        hs.sweep()
+    }
+}
+
+// readDirNames returns the names of the entries of the directory.
+func readDirNames(name string) ([]string, error) {
+    dir, err := os.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    defer dir.Close()
+
+    return dir.Readdirnames(-1)
+}
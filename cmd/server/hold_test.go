@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHoldExpiry(t *testing.T) {
+    dir := t.TempDir()
+    clock := newFakeClock()
+    hs, err := newHoldStore(filepath.Join(dir, "held"), time.Hour, clock)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    token, err := newHoldToken()
+    if err != nil {
+        t.Fatal(err)
+    }
+    temp := filepath.Join(dir, "a.txt.part")
+    if err := ioutil.WriteFile(temp, []byte("data"), 0666); err != nil {
+        t.Fatal(err)
+    }
+    if err := hs.hold(token, temp, "a.txt"); err != nil {
+        t.Fatal(err)
+    }
+
+    clock.Advance(30 * time.Minute)
+    hs.sweep()
+    if name, err := hs.find(token); err != nil || name != "a.txt" {
+        t.Fatalf("the hold is %q, %v before it expires, want a.txt", name, err)
+    }
+
+    clock.Advance(time.Hour)
+    hs.sweep()
+    if _, err := hs.find(token); err == nil {
+        t.Fatal("the expired hold is kept")
+    }
+    if _, err := os.Stat(filepath.Join(hs.dir, token)); !os.IsNotExist(err) {
+        t.Errorf("the directory of the expired hold is left, %v", err)
+    }
+}
+
+func TestHoldApprove(t *testing.T) {
+    dir := t.TempDir()
+    hs, err := newHoldStore(filepath.Join(dir, "held"), time.Hour, newFakeClock())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    token, _ := newHoldToken()
+    temp := filepath.Join(dir, "a.txt.part")
+    ioutil.WriteFile(temp, []byte("data"), 0666)
+    if err := hs.hold(token, temp, "a.txt"); err != nil {
+        t.Fatal(err)
+    }
+
+    names, err := hs.names()
+    if err != nil || len(names) != 1 || names[0] != "a.txt" {
+        t.Fatalf("the held names are %q, %v, want a.txt", names, err)
+    }
+
+    if _, err := hs.tokenDir("../../etc"); err == nil {
+        t.Error("a malformed token is accepted")
+    }
+    if _, err := hs.reject(token); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := hs.approve(token); err == nil {
+        t.Error("the rejected hold is approved")
+    }
+}
+
+// decide approves or rejects the held upload of the token.
+func decide(t *testing.T, addr, op, token string) *response {
+    t.Helper()
+    c := dialTest(t, addr)
+    c.request("Op: " + op, "Token: " + token)
+    return c.reply()
+}
+
+func TestHoldFlow(t *testing.T) {
+    s := newTestServer(t)
+    var err error
+    s.holds, err = newHoldStore(holdDir, time.Hour, realClock{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTest(t, s)
+
+    first, status := upload(t, addr, "good.txt", "good")
+    if first.Token == "" || status.Status != "ok" {
+        t.Fatalf("the held upload got %+v and %+v, want a token and ok", first, status)
+    }
+    assertFiles(t)
+
+    if resp := decide(t, addr, opApprove, first.Token); resp.Error != "" || resp.Name != "good.txt" {
+        t.Fatalf("the approval got %+v, want good.txt", resp)
+    }
+    assertFiles(t, "good.txt")
+    if data := readFile(t, "good.txt"); data != "good" {
+        t.Fatalf("the approved file has %q, want good", data)
+    }
+
+    first, _ = upload(t, addr, "bad.txt", "bad")
+    if resp := decide(t, addr, opReject, first.Token); resp.Error != "" || resp.Name != "bad.txt" {
+        t.Fatalf("the rejection got %+v, want bad.txt", resp)
+    }
+    assertFiles(t, "good.txt")
+    if resp := decide(t, addr, opApprove, first.Token); resp.Error == "" {
+        t.Fatal("the rejected upload was approved")
+    }
+}
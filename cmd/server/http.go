@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// filesPath is the path the stored files are uploaded to and downloaded from
+// over HTTP, the name of the file follows it.
+const filesPath = "/files/"
+
+// fileETag returns the ETag of the stored file with the checksum. The ETag
+// only changes with the contents, so it's the same across the restarts and
+// for the copies of the same data.
+func fileETag(sum string) string {
+    if sum == "" {
+        return ""
+    }
+
+    return `"` + sum + `"`
+}
+
+// metricsPath is the path the metrics are served at, as JSON.
+const metricsPath = "/debug/vars"
+
+// serveHTTP serves the handler on the listener until the server is shut
+// down.
+func (s *Server) serveHTTP(l net.Listener, handler http.Handler) {
+    // The TLS handshake of the HTTP clients is limited by the timeout of the
+    // request headers.
+    hs := &http.Server{Handler: handler, ReadHeaderTimeout: s.HandshakeTimeout}
+
+    s.mu.Lock()
+    s.httpServers = append(s.httpServers, hs)
+    s.mu.Unlock()
+
+    go func() {
+        if err := hs.Serve(l); err != http.ErrServerClosed {
+            log.Fatalf("could not serve HTTP, %v", err)
+        }
+    }()
+}
+
+// shutdownHTTP stops the HTTP servers, waiting for the requests in progress,
+// like the downloads, to finish.
+func (s *Server) shutdownHTTP() {
+    s.mu.Lock()
+    servers := s.httpServers
+    s.mu.Unlock()
+
+    for _, hs := range servers {
+        hs.Shutdown(context.Background())
+    }
+}
+
+// metricsHandler serves the metrics of expvar, e.g. auth_failures, with the
+// secret of the metrics.
+func (s *Server) metricsHandler() http.Handler {
+    vars := expvar.Handler()
+
+    mux := http.NewServeMux()
+    mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+        if s.checkSecret(s.metricsAuth, w, r) {
+            vars.ServeHTTP(w, r)
+        }
+    })
+    mux.HandleFunc(progressPath, func(w http.ResponseWriter, r *http.Request) {
+        if s.checkSecret(s.metricsAuth, w, r) {
+            s.streamProgress(w, r)
+        }
+    })
+    mux.HandleFunc(recompressPath, func(w http.ResponseWriter, r *http.Request) {
+        if s.checkSecret(s.metricsAuth, w, r) {
+            s.serveRecompress(w, r)
+        }
+    })
+    return mux
+}
+
+// httpHandler serves the uploads and the downloads of the stored files.
+func (s *Server) httpHandler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc(filesPath, s.handleFiles)
+    return mux
+}
+
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet, http.MethodHead:
+        s.serveFile(w, r)
+    case http.MethodPut, http.MethodPost:
+        s.receiveHTTP(w, r)
+    default:
+        w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// httpFilename returns the name of the file the path refers to. Only the
+// files at the root of the storage directory are ever referred to, never the
+// metadata or the held uploads.
+func httpFilename(r *http.Request) (string, bool) {
+    name := strings.TrimPrefix(r.URL.Path, filesPath)
+    if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+        return "", false
+    }
+
+    return name, true
+}
+
+// httpRemote returns the address of the HTTP client, as told by the trusted
+// proxies if the request comes from one of them.
+func (s *Server) httpRemote(r *http.Request) string {
+    return forwardedFor(s.TrustedProxies, r)
+}
+
+// checkSecret tells whether the request carries the secret of the
+// authenticator, answering 401 Unauthorized if it doesn't. Any request will
+// do if the authenticator is nil.
+func (s *Server) checkSecret(a *authenticator, w http.ResponseWriter, r *http.Request) bool {
+    return s.checkCredentials(a, w, r, bearerToken(r), "Bearer")
+}
+
+// checkCredentials tells whether the credentials are the secret of the
+// authenticator, answering 401 Unauthorized with the challenge if they
+// aren't.
+func (s *Server) checkCredentials(a *authenticator, w http.ResponseWriter, r *http.Request,
+                                  auth, challenge string) bool {
+    if a == nil || auth != "" && a.isSecret(auth) {
+        return true
+    }
+
+    authFailures.Add(1)
+    log.Printf("refused %s %q from %s, the request is not authenticated",
+               r.Method, r.URL.Path, s.httpRemote(r))
+    w.Header().Set("WWW-Authenticate", challenge)
+    http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+    return false
+}
+
+// bearerToken returns the credentials of the Authorization header.
+func bearerToken(r *http.Request) string {
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "Bearer ") {
+        return ""
+    }
+
+    return auth[len("Bearer "):]
+}
+
+// writeHTTPResponse sends the response as JSON, like over the upload
+// protocol.
+func writeHTTPResponse(w http.ResponseWriter, code int, resp *response) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(resp)
+}
+
+// receiveHTTP stores the body of the request under the name of the path,
+// like the upload protocol does with the data. The body isn't compressed and
+// its length doesn't have to be known up front, the chunked bodies are
+// decoded by net/http and limited like any other. The checksum may come in
+// the SHA256 header, and the credentials in the Authorization header as
+// "Bearer <secret or upload token>".
+func (s *Server) receiveHTTP(w http.ResponseWriter, r *http.Request) {
+    name, ok := httpFilename(r)
+    if !ok {
+        writeHTTPResponse(w, http.StatusBadRequest,
+                          &response{Status: "error", Error: "invalid name of the file"})
+        return
+    }
+
+    // The length is -1 for the chunked bodies, just like an undeclared size.
+    code, resp := s.storeHTTP(r, bearerToken(r), name, r.Body, r.ContentLength)
+    switch {
+    case code == http.StatusUnauthorized:
+        w.Header().Set("WWW-Authenticate", "Bearer")
+    case code == http.StatusCreated && resp.Token == "":
+        w.Header().Set("Location", (&url.URL{Path: filesPath + resp.Name}).String())
+        w.Header().Set("ETag", resp.ETag)
+    }
+    writeHTTPResponse(w, code, resp)
+}
+
+// storeHTTP stores the body sent over HTTP under the name, with the
+// credentials and the checksum of the headers of the request, and returns
+// the status code and the response to reply with.
+func (s *Server) storeHTTP(r *http.Request, auth, name string, body io.Reader,
+                           size int64) (int, *response) {
+    remote := s.httpRemote(r)
+
+    sp := s.tracer.start("files http upload")
+    defer s.tracer.end(sp)
+    sp.set("client.address", remote)
+    sp.set("files.name", name)
+
+    sum, err := parseSHA256(r.Header.Get("SHA256"))
+    if err != nil {
+        return http.StatusBadRequest, &response{Status: "error", Error: err.Error()}
+    }
+
+    also, err := parseAlso(r.Header.Get("Also"))
+    if err != nil {
+        return http.StatusBadRequest, &response{Status: "error", Error: err.Error()}
+    }
+
+    req := &request{
+        Op:     opUpload,
+        Name:   name,
+        Size:   size,
+        SHA256: sum,
+        Auth:   auth,
+        Also:   also,
+    }
+    req.uploader = remote
+    if host, _, err := net.SplitHostPort(remote); err == nil {
+        req.uploader = host
+    }
+    req.remote = remote
+
+    if s.httpAuth != nil {
+        if err := s.httpAuth.authorize(req); err != nil {
+            authFailures.Add(1)
+            log.Printf("%v from %v. HTTP upload refused.", err, remote)
+            sp.fail(err)
+            return http.StatusUnauthorized, &response{Status: "error", Error: errUnauthorized.Error()}
+        }
+    }
+
+    // The upload is refused before the body is read, so a client that
+    // expects 100-continue doesn't send it at all.
+    if err := s.checkRequest(req); err != nil {
+        log.Printf("%v. HTTP upload refused.", err)
+        sp.fail(err)
+        return httpStatus(err), errorResponse(err)
+    }
+
+    start := s.clock().Now()
+    file, err := s.storeNamed(body, req, sp)
+    s.events.transfer(req, start, file, err)
+    if err != nil {
+        log.Print(err)
+        sp.fail(err)
+        return httpStatus(err), errorResponse(err)
+    }
+
+    resp := &response{
+        Status: "ok",
+        Name:   file.name,
+        Size:   &file.size,
+        SHA256: file.sha256,
+        ETag:   fileETag(file.sha256),
+
+        Deduplicated: file.dedup,
+        Appended:     file.appended,
+    }
+    if len(file.also) > 0 {
+        resp.Names = append([]string{file.name}, file.also...)
+    }
+    if file.token != "" && s.scanner == nil {
+        resp.Token = file.token
+    }
+    return http.StatusCreated, resp
+}
+
+// serveFile sends the stored file named by the path, with its checksum as
+// the ETag. The conditional requests are answered with 304 Not Modified if
+// the file is unchanged, as are the range requests supported.
+// The file is sent as it was compressed by the client that uploaded it
+// to the clients accepting the deflate encoding, if it was kept.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+    if s.checkSecret(s.httpAuth, w, r) {
+        s.sendFile(w, r)
+    }
+}
+
+// sendFile sends the stored file named by the path, once the request is
+// authenticated.
+func (s *Server) sendFile(w http.ResponseWriter, r *http.Request) {
+    name, ok := httpFilename(r)
+    if !ok {
+        http.NotFound(w, r)
+        return
+    }
+
+    f, err := os.Open(name)
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    defer f.Close()
+
+    stat, err := f.Stat()
+    if err != nil || !isStoredFile(stat, s.DoneMarkers) {
+        http.NotFound(w, r)
+        return
+    }
+
+    sum, err := s.meta.checksum(stat)
+    if err != nil {
+        log.Print(err)
+        http.Error(w, "could not read the file", http.StatusInternalServerError)
+        return
+    }
+
+    // The compressed data is another representation, with its own ETag.
+    if c := s.downloadCodec(); c != nil {
+        w.Header().Set("Vary", "Accept-Encoding")
+        if compressed, ok := openEncoded(c, sum); ok && acceptsCoding(r, c.name()) {
+            defer compressed.Close()
+
+            w.Header().Set("Content-Type", contentType(name, f))
+            w.Header().Set("Content-Encoding", c.name())
+            w.Header().Set("ETag", `"` + sum + "-" + c.name() + `"`)
+            http.ServeContent(w, r, name, stat.ModTime(), compressed)
+            return
+        }
+    }
+
+    w.Header().Set("ETag", fileETag(sum))
+    http.ServeContent(w, r, name, stat.ModTime(), f)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// statFile asks for the stat of the stored file.
+func statFile(t *testing.T, addr, name string) *response {
+    t.Helper()
+    con := dialTest(t, addr)
+    con.request("Op: stat", "Name: " + name)
+    return con.reply()
+}
+
+// getFile downloads the stored file over HTTP with the header, "Key", "value"
+// pairs.
+func getFile(s *Server, name string, header ...string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(http.MethodGet, filesPath + name, nil)
+    for i := 0; i + 1 < len(header); i += 2 {
+        r.Header.Set(header[i], header[i + 1])
+    }
+    w := httptest.NewRecorder()
+    s.serveFile(w, r)
+    return w
+}
+
+// putFile uploads the data over HTTP.
+func putFile(s *Server, name, data string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(http.MethodPut, filesPath + name, strings.NewReader(data))
+    w := httptest.NewRecorder()
+    s.receiveHTTP(w, r)
+    return w
+}
+
+func TestETag(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+
+    _, status := upload(t, addr, "a.txt", "contents")
+    if status.ETag == "" {
+        t.Fatal("the upload told no ETag")
+    }
+    etag := status.ETag
+
+    // The copies of the same contents share it, the stat tells the same.
+    if _, status := upload(t, addr, "a.txt", "contents"); status.ETag != etag {
+        t.Fatalf("the copy has the ETag %s, want %s", status.ETag, etag)
+    }
+    if stat := statFile(t, addr, "a.txt"); stat.ETag != etag {
+        t.Fatalf("the stat tells the ETag %s, want %s", stat.ETag, etag)
+    }
+    if _, status := upload(t, addr, "b.txt", "other"); status.ETag == etag {
+        t.Fatal("other contents have the same ETag")
+    }
+
+    w := getFile(s, "a.txt")
+    if w.Code != http.StatusOK || w.Header().Get("ETag") != etag || w.Body.String() != "contents" {
+        t.Fatalf("got %d with the ETag %s, want 200 with %s", w.Code, w.Header().Get("ETag"), etag)
+    }
+    if w := getFile(s, "a.txt", "If-None-Match", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+        t.Fatalf("got %d with the matching ETag, want 304 and no body", w.Code)
+    }
+    if w := getFile(s, "a.txt", "If-None-Match", `"stale"`); w.Code != http.StatusOK {
+        t.Fatalf("got %d with another ETag, want 200", w.Code)
+    }
+
+    // The ETag follows the contents.
+    writeFile(t, "a.txt", "changed")
+    if w := getFile(s, "a.txt", "If-None-Match", etag); w.Code != http.StatusOK || w.Body.String() != "changed" {
+        t.Fatalf("got %d once changed, want 200 with the new contents", w.Code)
+    }
+}
+
+// putChunked uploads the body over HTTP, chunked since its length is not
+// known up front.
+func putChunked(t *testing.T, ts *httptest.Server, name, data string) (int, *response) {
+    t.Helper()
+    body := io.MultiReader(strings.NewReader(data))
+    req, err := http.NewRequest(http.MethodPut, ts.URL + filesPath + name, body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("SHA256", sha256Hex(data))
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+
+    reply := &response{}
+    if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+        t.Fatal(err)
+    }
+    return resp.StatusCode, reply
+}
+
+func TestChunkedUpload(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxSize = 100
+    var chunked bool
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        chunked = r.ContentLength == -1 && len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+        s.httpHandler().ServeHTTP(w, r)
+    }))
+    t.Cleanup(ts.Close)
+
+    data := strings.Repeat("x", 100)
+    code, resp := putChunked(t, ts, "a.txt", data)
+    if !chunked {
+        t.Fatal("the body was not sent chunked")
+    }
+    if code != http.StatusCreated || *resp.Size != 100 || resp.SHA256 != sha256Hex(data) {
+        t.Fatalf("got %d with %+v, want 201 with the size and the checksum", code, resp)
+    }
+    if got := readFile(t, "a.txt"); got != data {
+        t.Fatal("the chunked body was not stored as sent")
+    }
+
+    // The limit applies to the decoded body.
+    if code, resp := putChunked(t, ts, "b.txt", data + "x"); code == http.StatusCreated {
+        t.Fatalf("got %d with %+v over the limit, want it refused", code, resp)
+    }
+    assertFiles(t, "a.txt")
+}
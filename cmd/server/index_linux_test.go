@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIndexIgnoresSpecialFiles(t *testing.T) {
+    s := newTestServer(t)
+    writeFile(t, "regular.txt", "data")
+    if err := os.Mkdir("dir.txt", 0777); err != nil {
+        t.Fatal(err)
+    }
+    if err := syscall.Mkfifo("pipe.txt", 0666); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Symlink("regular.txt", "link.txt"); err != nil {
+        t.Fatal(err)
+    }
+
+    dir, err := os.Open(".")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer dir.Close()
+    s.index, err = NewFileIndexFromDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if names := s.index.Names(); len(names) != 1 || names[0] != "regular.txt" {
+        t.Fatalf("the index has %q, want only regular.txt", names)
+    }
+
+    // The upload never replaces them.
+    addr := serveTest(t, s)
+    for _, name := range []string{"dir.txt", "pipe.txt"} {
+        stored := mustUpload(t, addr, name, "data")
+        if stored == name {
+            t.Errorf("the upload of %s replaced it", name)
+        }
+    }
+    if stat, err := os.Lstat("pipe.txt"); err != nil || stat.Mode()&os.ModeNamedPipe == 0 {
+        t.Errorf("the FIFO is gone, %v", err)
+    }
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestResolveConcurrent(t *testing.T) {
+    const goroutines, resolves = 50, 20
+
+    fi, _ := NewFileIndexFromSlice([]string{"x.txt"})
+    names := make(chan string, goroutines * resolves)
+    var wg sync.WaitGroup
+    for i := 0; i < goroutines; i++ {
+        wg.Add(1)
+        go func(reserve bool) {
+            defer wg.Done()
+            for j := 0; j < resolves; j++ {
+                if reserve {
+                    names <- fi.Reserve("new.txt")
+                } else {
+                    names <- fi.Resolve("new.txt")
+                }
+            }
+        }(i % 2 == 0)
+    }
+    wg.Wait()
+    close(names)
+
+    seen := make(map[string]bool)
+    for name := range names {
+        if seen[name] {
+            t.Fatalf("%q was resolved to twice", name)
+        }
+        seen[name] = true
+    }
+    if !seen["new.txt"] || !seen["new_copy999.txt"] || len(seen) != goroutines * resolves {
+        t.Fatalf("resolved to %d names, want new.txt and its copies up to new_copy999.txt", len(seen))
+    }
+}
+
+func TestMergeFrom(t *testing.T) {
+    a, _ := NewFileIndexFromSlice([]string{"report.txt", "report_copy1.txt", "notes.txt"})
+    b, _ := NewFileIndexFromSlice([]string{"report.txt", "report_copy1.txt", "report_copy4.txt", "data.bin"})
+    a.MergeFrom(b)
+
+    want := map[string]int{"report.txt": 4, "notes.txt": 0, "data.bin": 0}
+    for name, copies := range want {
+        if got, ok := a.CopyCount(name); !ok || got != copies {
+            t.Errorf("%s has %d copies, %t, in the merged index, want %d", name, got, ok, copies)
+        }
+    }
+    if got, _ := b.CopyCount("notes.txt"); got != 0 || b.Len() != 4 {
+        t.Errorf("the merged index was changed")
+    }
+    if name := a.Resolve("report.txt"); name != "report_copy5.txt" {
+        t.Errorf("the next copy is %q, want report_copy5.txt", name)
+    }
+
+    // Merging both ways at once can't deadlock.
+    var wg sync.WaitGroup
+    for i := 0; i < 100; i++ {
+        wg.Add(2)
+        go func() { defer wg.Done(); a.MergeFrom(b) }()
+        go func() { defer wg.Done(); b.MergeFrom(a) }()
+    }
+    wg.Wait()
+}
+
+// manyNames returns n names, with copies of some of them.
+func manyNames(n int) []string {
+    names := make([]string, 0, n)
+    for i := 0; len(names) < n; i++ {
+        base := fmt.Sprintf("file%d", i)
+        names = append(names, base + ".txt")
+        for copyNum := 1; copyNum <= i % 4 && len(names) < n; copyNum++ {
+            names = append(names, fmt.Sprintf("%s_copy%d.txt", base, copyNum))
+        }
+    }
+    return names
+}
+
+func TestIndexParallel(t *testing.T) {
+    names := manyNames(3000)
+    sequential, _ := NewFileIndexFromSlice(names)
+    for _, workers := range []int{1, 3, 8, 5000} {
+        parallel := newFileIndexParallel(names, workers)
+        if !reflect.DeepEqual(parallel.Dump(), sequential.Dump()) {
+            t.Errorf("the index built by %d workers differs from the sequential one", workers)
+        }
+    }
+}
+
+func BenchmarkIndexFromDir(b *testing.B) {
+    dir := b.TempDir()
+    names := manyNames(5000)
+    for _, name := range names {
+        if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+            b.Fatal(err)
+        }
+    }
+
+    b.Run("sequential", func(b *testing.B) {
+        for i := 0; i < b.N; i++ {
+            f, _ := os.Open(dir)
+            names, _ := f.Readdirnames(-1)
+            f.Close()
+            NewFileIndexFromSlice(names)
+        }
+    })
+    b.Run("parallel", func(b *testing.B) {
+        for i := 0; i < b.N; i++ {
+            f, _ := os.Open(dir)
+            NewFileIndexFromDir(f)
+            f.Close()
+        }
+    })
+}
+
+func TestReserveRelease(t *testing.T) {
+    fi, _ := NewFileIndexFromSlice([]string{"a.txt"})
+    got := []string{fi.Reserve("a.txt"), fi.Reserve("a.txt"), fi.Reserve("a.txt"), fi.Reserve("b.txt")}
+    want := []string{"a_copy1.txt", "a_copy2.txt", "a_copy3.txt", "b.txt"}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("reserved %q, want %q", got, want)
+    }
+
+    // The released copy is the next one resolved to, the others are kept.
+    fi.Release("a_copy2.txt")
+    if name := fi.Resolve("a.txt"); name != "a_copy2.txt" {
+        t.Errorf("resolved to %q after the release, want a_copy2.txt", name)
+    }
+    if name := fi.Resolve("a.txt"); name != "a_copy4.txt" {
+        t.Errorf("resolved to %q next, want a_copy4.txt", name)
+    }
+
+    fi.Release("b.txt")
+    if name := fi.Resolve("b.txt"); name != "b.txt" {
+        t.Errorf("resolved to %q after releasing b.txt, want b.txt", name)
+    }
+
+    // The kept names and the ones never reserved can't be released.
+    fi.keep("a_copy3.txt")
+    fi.Release("a_copy3.txt")
+    fi.Release("a.txt")
+    for _, name := range []string{"a.txt", "a_copy3.txt"} {
+        if _, ok := fi.CopyCount(name); !ok {
+            t.Errorf("%s was released", name)
+        }
+    }
+}
+
+func TestTrailingDot(t *testing.T) {
+    for _, test := range []struct {
+        name   string
+        copies []string
+    }{
+        {"archive.", []string{"archive._copy1", "archive._copy2"}},
+        {"file..", []string{"file.._copy1", "file.._copy2"}},
+        {"report.txt", []string{"report_copy1.txt", "report_copy2.txt"}},
+        {"notes", []string{"notes_copy1", "notes_copy2"}},
+    } {
+        fi, _ := NewFileIndexFromSlice([]string{test.name})
+        if name := fi.Resolve(test.name); name != test.copies[0] {
+            t.Errorf("the copy of %q is %q, want %q", test.name, name, test.copies[0])
+        }
+
+        // The copies are parsed back from the names found.
+        fi, _ = NewFileIndexFromSlice([]string{test.name, test.copies[0]})
+        if name := fi.Resolve(test.name); name != test.copies[1] {
+            t.Errorf("the copy of %q next to %q is %q, want %q", test.name, test.copies[0], name, test.copies[1])
+        }
+    }
+}
+
+func TestDump(t *testing.T) {
+    fi, _ := NewFileIndexFromSlice([]string{"a.txt", "b.txt", "orphan_copy3.txt"})
+    fi.Resolve("a.txt")
+    fi.Resolve("a.txt")
+    fi.Resolve("b.txt")
+    fi.Resolve("c.txt")
+
+    dump := fi.Dump()
+    want := map[string]int{
+        "a.txt": 2, "a_copy1.txt": 0, "a_copy2.txt": 0,
+        "b.txt": 1, "b_copy1.txt": 0,
+        "c.txt": 0, "orphan_copy3.txt": 0,
+    }
+    if !reflect.DeepEqual(dump, want) {
+        t.Fatalf("dumped %v, want %v", dump, want)
+    }
+
+    // The copies aren't counted, unless their original is gone.
+    if histogram, want := fi.CopyHistogram(), map[int]int{0: 2, 1: 1, 2: 1}; !reflect.DeepEqual(histogram, want) {
+        t.Fatalf("the histogram is %v, want %v", histogram, want)
+    }
+
+    // The dump is a copy.
+    dump["a.txt"] = 10
+    delete(dump, "b.txt")
+    if name := fi.Resolve("a.txt"); name != "a_copy3.txt" {
+        t.Fatalf("resolved to %q once the dump was changed, want a_copy3.txt", name)
+    }
+    if _, ok := fi.CopyCount("b.txt"); !ok {
+        t.Fatal("b.txt was deleted from the index with the dump")
+    }
+}
+
+func TestPrefixNames(t *testing.T) {
+    fi, _ := NewFileIndexFromSlice([]string{
+        "report", "report2", "reporter",
+        "report2_copy1", "report2_copy2", "reporter_copy5", "report_copy1",
+        "report.txt", "report2_copy7.txt",
+    })
+
+    for _, test := range []struct{ name, want string }{
+        {"report", "report_copy2"},
+        {"report2", "report2_copy3"},
+        {"reporter", "reporter_copy6"},
+        {"report.txt", "report_copy1.txt"},
+        {"report2.txt", "report2.txt"},
+    } {
+        if name := fi.Resolve(test.name); name != test.want {
+            t.Errorf("resolved %q to %q, want %q", test.name, name, test.want)
+        }
+    }
+}
+
+func TestAbsurdCopyNumbers(t *testing.T) {
+    for digits, want := range map[string]int{"1": 1, "007": 7, "1000000": maxCopyNum} {
+        if copyNum, ok := parseCopyNum(digits); !ok || copyNum != want {
+            t.Errorf("parseCopyNum(%q) = %d, %t, want %d", digits, copyNum, ok, want)
+        }
+    }
+    for _, digits := range []string{"", "1000001", "99999999999999999999999", "-3", "+4", " 7", "0x10", "1e3", "٣"} {
+        if copyNum, ok := parseCopyNum(digits); ok {
+            t.Errorf("parseCopyNum(%q) = %d, want no copy number", digits, copyNum)
+        }
+    }
+
+    // The names of another tool are unrelated files, the copies go on from
+    // the sane ones.
+    fi, _ := NewFileIndexFromSlice([]string{
+        "a.txt",
+        "a_copy2.txt",
+        "a_copy1000001.txt",
+        "a_copy99999999999999999999999.txt",
+        "a_copy-3.txt",
+        "a_copy 7.txt",
+        "a_copy١٠.txt",
+    })
+    for _, want := range []string{"a_copy3.txt", "a_copy4.txt"} {
+        if name := fi.Resolve("a.txt"); name != want {
+            t.Fatalf("the copy of a.txt is %q, want %q", name, want)
+        }
+    }
+
+    // Still unrelated, they get copies of their own.
+    if name := fi.Resolve("a_copy1000001.txt"); name != "a_copy1000001_copy1.txt" {
+        t.Fatalf("the copy of a_copy1000001.txt is %q, want a_copy1000001_copy1.txt", name)
+    }
+}
+
+func TestIndexAtStart(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+    mustUpload(t, addr, "a.txt", "first")
+    mustUpload(t, addr, "a.txt", "second")
+    s.Shutdown()
+
+    // Meanwhile another tool changes the storage.
+    if err := os.Remove("a_copy1.txt"); err != nil {
+        t.Fatal(err)
+    }
+    writeFile(t, "a_copy4.txt", "added")
+    writeFile(t, "b.txt", "added")
+
+    // There's nothing stale to load, the index of the next start is built
+    // from the storage.
+    dir, err := os.Open(".")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer dir.Close()
+    fi, err := NewFileIndexFromDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, want := range map[string]string{
+        "a.txt":       "a_copy5.txt",
+        "b.txt":       "b_copy1.txt",
+        "a_copy1.txt": "a_copy1.txt",
+        "c.txt":       "c.txt",
+    } {
+        if got := fi.Resolve(name); got != want {
+            t.Errorf("%s resolved to %s at the next start, want %s", name, got, want)
+        }
+    }
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// inodeCheckInterval is how often the free inodes are counted.
+const inodeCheckInterval = 10 * time.Second
+
+// inodeGuard refuses the uploads once the filesystem of the storage runs low
+// on inodes. Many small files can use them all up while there's plenty of
+// space left, and the files then fail to be created with ENOSPC all the same.
+type inodeGuard struct {
+    min int64
+
+    // statfs counts the free inodes on the filesystem of the path, -1 if it
+    // can't tell.
+    statfs func(path string) (int64, error)
+
+    // free is the number of the free inodes as last counted, -1 if unknown.
+    free int64
+
+    clock Clock
+}
+
+func newInodeGuard(min int64, clock Clock) *inodeGuard {
+    return &inodeGuard{min: min, statfs: freeInodes, free: -1, clock: clock}
+}
+
+// update counts the free inodes again, warning once they run low and once
+// there are enough of them again.
+func (g *inodeGuard) update() error {
+    free, err := g.statfs(".")
+    if err != nil {
+        return fmt.Errorf("could not count the free inodes, %v", err)
+    }
+
+    prev := atomic.SwapInt64(&g.free, free)
+    low, wasLow := g.isLow(free), g.isLow(prev)
+    switch {
+    case low && !wasLow:
+        log.Printf("warning: out of inodes, %d free of the %d required, refusing the uploads",
+                   free, g.min)
+    case !low && wasLow:
+        log.Printf("%d inodes free, accepting the uploads again", free)
+    }
+
+    return nil
+}
+
+// updatePeriodically will keep counting the free inodes.
+func (g *inodeGuard) updatePeriodically() {
+    for range g.clock.Tick(inodeCheckInterval) {
+        if err := g.update(); err != nil {
+            log.Print(err)
+        }
+    }
+}
+
+func (g *inodeGuard) isLow(free int64) bool {
+    return free >= 0 && free < g.min
+}
+
+// check refuses the upload if the inodes ran low, as an error of the
+// unavailable storage so that the client may try again later.
+func (g *inodeGuard) check() error {
+    free := atomic.LoadInt64(&g.free)
+    if !g.isLow(free) {
+        return nil
+    }
+
+    err := fmt.Errorf("out of inodes, the server can't store any more files for now")
+    return &storageError{kind: ErrBackendUnavailable, err: err}
+}
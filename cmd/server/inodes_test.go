@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInodeGuard(t *testing.T) {
+    s := newTestServer(t)
+    free := int64(1000)
+    s.inodes = newInodeGuard(100, realClock{})
+    s.inodes.statfs = func(string) (int64, error) { return free, nil }
+    if err := s.inodes.update(); err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTest(t, s)
+
+    mustUpload(t, addr, "a.txt", "data")
+
+    free = 99
+    if err := s.inodes.update(); err != nil {
+        t.Fatal(err)
+    }
+    first, status := upload(t, addr, "b.txt", "data")
+    if status != nil || !strings.Contains(first.Error, "out of inodes") || first.Kind != "unavailable" {
+        t.Fatalf("the upload was refused with %+v, want out of inodes and unavailable", first)
+    }
+
+    // The filesystems that can't tell refuse nothing.
+    free = -1
+    if err := s.inodes.update(); err != nil {
+        t.Fatal(err)
+    }
+    mustUpload(t, addr, "c.txt", "data")
+    assertFiles(t, "a.txt", "c.txt")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"time"
+)
+
+// defaultMaxTrackedKeys is the number of the keys every table of the limits
+// keeps track of by default, the names of the storm detector, the credentials
+// of the rate limits and the uploaders of the quota.
+const defaultMaxTrackedKeys = 100000
+
+// trackedSweepInterval is how often the idle entries of the tables are
+// removed, on top of the least recently used ones once they are full.
+const trackedSweepInterval = time.Minute
+
+// lruTable maps the keys the clients come up with, like their addresses or
+// the names they upload, to whatever is tracked about them, so that a server
+// seeing new keys all the time doesn't keep them forever. Beyond max entries,
+// the least recently used are evicted, except those the pinned function
+// tells are in use, which the table may then hold more of than the max. The
+// caller must serialize the access.
+type lruTable struct {
+    max     int
+    pinned  func(value interface{}) bool
+    evicted int64
+
+    entries map[string]*list.Element
+
+    // order has the most recently used entries in the front.
+    order *list.List
+}
+
+type lruEntry struct {
+    key   string
+    value interface{}
+    used  time.Time
+}
+
+// newLRUTable will create a table of at most max entries, unless they are
+// pinned, which pinned may be nil for none. The table is unbounded if max
+// isn't positive.
+func newLRUTable(max int, pinned func(value interface{}) bool) *lruTable {
+    return &lruTable{
+        max:     max,
+        pinned:  pinned,
+        entries: make(map[string]*list.Element),
+        order:   list.New(),
+    }
+}
+
+// get returns the value of the key, marking it used at the time.
+func (t *lruTable) get(key string, now time.Time) (interface{}, bool) {
+    elem, ok := t.entries[key]
+    if !ok {
+        return nil, false
+    }
+
+    entry := elem.Value.(*lruEntry)
+    entry.used = now
+    t.order.MoveToFront(elem)
+    return entry.value, true
+}
+
+// put sets the value of the key, marking it used at the time, and evicts the
+// least recently used entries beyond the max.
+func (t *lruTable) put(key string, value interface{}, now time.Time) {
+    if elem, ok := t.entries[key]; ok {
+        entry := elem.Value.(*lruEntry)
+        entry.value, entry.used = value, now
+        t.order.MoveToFront(elem)
+        return
+    }
+
+    t.entries[key] = t.order.PushFront(&lruEntry{key: key, value: value, used: now})
+    if t.max <= 0 {
+        return
+    }
+
+    for elem := t.order.Back(); elem != nil && len(t.entries) > t.max; {
+        prev := elem.Prev()
+        entry := elem.Value.(*lruEntry)
+        if entry.key != key && (t.pinned == nil || !t.pinned(entry.value)) {
+            t.removeElement(elem)
+            t.evicted++
+        }
+        elem = prev
+    }
+}
+
+func (t *lruTable) remove(key string) {
+    if elem, ok := t.entries[key]; ok {
+        t.removeElement(elem)
+    }
+}
+
+func (t *lruTable) removeElement(elem *list.Element) {
+    delete(t.entries, elem.Value.(*lruEntry).key)
+    t.order.Remove(elem)
+}
+
+// removeIdle removes the entries not used for longer than maxIdle, unless
+// they are pinned, telling how many there were.
+func (t *lruTable) removeIdle(maxIdle time.Duration, now time.Time) int {
+    removed := 0
+    for elem := t.order.Back(); elem != nil; {
+        prev := elem.Prev()
+        entry := elem.Value.(*lruEntry)
+        if now.Sub(entry.used) <= maxIdle {
+            // The rest were used even more recently.
+            break
+        }
+        if t.pinned == nil || !t.pinned(entry.value) {
+            t.removeElement(elem)
+            removed++
+        }
+        elem = prev
+    }
+
+    return removed
+}
+
+func (t *lruTable) len() int {
+    return len(t.entries)
+}
+
+// sweepTrackedPeriodically will keep removing the idle entries of the tables
+// of the limits, so that they shrink back once the clients are gone rather
+// than only when the next ones come.
+func (s *Server) sweepTrackedPeriodically() {
+    for range s.clock().Tick(trackedSweepInterval) {
+        if s.storms != nil {
+            s.storms.sweep()
+        }
+        if s.tokenLimiters != nil {
+            s.tokenLimiters.sweep()
+        }
+    }
+}
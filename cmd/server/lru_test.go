@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLRUTable(t *testing.T) {
+    now := time.Now()
+    table := newLRUTable(2, nil)
+    table.put("a", 1, now)
+    table.put("b", 2, now)
+    table.get("a", now)
+    table.put("c", 3, now)
+
+    if _, ok := table.get("b", now); ok {
+        t.Error("the least recently used entry is kept")
+    }
+    for _, key := range []string{"a", "c"} {
+        if _, ok := table.get(key, now); !ok {
+            t.Errorf("%s is evicted", key)
+        }
+    }
+    if table.evicted != 1 {
+        t.Errorf("%d entries are evicted, want 1", table.evicted)
+    }
+}
+
+func TestLRUTablePinned(t *testing.T) {
+    now := time.Now()
+    table := newLRUTable(2, func(value interface{}) bool { return value.(bool) })
+    table.put("a", true, now)
+    table.put("b", true, now)
+    table.put("c", false, now)
+    if table.len() != 3 {
+        t.Errorf("the table holds %d entries, want the 3 pinned and new ones", table.len())
+    }
+
+    table.put("d", false, now)
+    if _, ok := table.get("c", now); ok {
+        t.Error("the unpinned entry is kept beyond the max")
+    }
+    if table.len() != 3 {
+        t.Errorf("the table holds %d entries, want 3", table.len())
+    }
+}
+
+func TestLRUTableRemoveIdle(t *testing.T) {
+    now := time.Now()
+    table := newLRUTable(0, nil)
+    table.put("old", 1, now)
+    table.put("new", 2, now.Add(time.Minute))
+
+    if n := table.removeIdle(30 * time.Second, now.Add(time.Minute)); n != 1 {
+        t.Errorf("%d idle entries are removed, want 1", n)
+    }
+    if _, ok := table.get("new", now); !ok {
+        t.Error("the entry in use is removed")
+    }
+}
+
+// churn makes up many client addresses.
+func churn(n int, fn func(addr string)) {
+    for i := 0; i < n; i++ {
+        fn(fmt.Sprintf("10.%d.%d.%d", i >> 16 & 0xff, i >> 8 & 0xff, i & 0xff))
+    }
+}
+
+func TestLimiterPoolBounded(t *testing.T) {
+    clock := newFakeClock()
+    pool := newLimiterPool(1 << 20, 100, clock)
+
+    busy := pool.acquire("busy")
+    churn(10000, func(addr string) {
+        pool.acquire(addr)
+        pool.release(addr)
+    })
+    if n := pool.limiters.len(); n > 101 {
+        t.Errorf("the pool holds %d limiters, want at most 101", n)
+    }
+
+    // The limiter in use is kept, however many others came and went.
+    if pool.acquire("busy") != busy {
+        t.Error("the limiter in use is evicted")
+    }
+    pool.release("busy")
+    pool.release("busy")
+
+    clock.Advance(2 * idleLimiterTimeout)
+    pool.sweep()
+    if n := pool.limiters.len(); n != 0 {
+        t.Errorf("the pool holds %d idle limiters after the sweep, want 0", n)
+    }
+}
+
+func TestStormDetectorBounded(t *testing.T) {
+    clock := newFakeClock()
+    d := newStormDetector(5, time.Minute, true, 100, clock)
+
+    churn(10000, func(addr string) {
+        d.record(addr + ".txt")
+    })
+    if n := d.names.len(); n > 100 {
+        t.Errorf("the detector tracks %d names, want at most 100", n)
+    }
+
+    clock.Advance(2 * time.Minute)
+    d.sweep()
+    if n := d.names.len(); n != 0 {
+        t.Errorf("the detector tracks %d names after the sweep, want 0", n)
+    }
+}
+
+func TestQuotaTrackerBounded(t *testing.T) {
+    q := newQuotaTracker(100, nil, false, 10, newFakeClock())
+    q.add("first.txt", "192.0.2.1", 90)
+
+    churn(1000, func(addr string) {
+        if err := q.charge(addr, 10); err != nil {
+            t.Fatal(err)
+        }
+        q.refund(addr, 10)
+        q.add(addr + ".txt", addr, 1)
+    })
+    if n := q.stored.len(); n > 10 {
+        t.Errorf("the quota tracks %d uploaders, want at most 10", n)
+    }
+    if n := len(q.receiving); n != 0 {
+        t.Errorf("the quota tracks %d uploaders receiving nothing", n)
+    }
+
+    // The uploader evicted long ago still has the bytes stored.
+    if err := q.check("192.0.2.1", 20); err == nil {
+        t.Error("the quota of the evicted uploader is forgotten")
+    }
+    if err := q.check("192.0.2.1", 10); err != nil {
+        t.Errorf("the quota of the evicted uploader is miscounted, %v", err)
+    }
+
+    q.remove("first.txt")
+    if err := q.check("192.0.2.1", 100); err != nil {
+        t.Errorf("the quota is not freed with the file, %v", err)
+    }
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// manifestBatch is the number of directory entries read at once while
+// sending the manifest, so that huge directories are never held in memory.
+const manifestBatch = 256
+
+// manifestEntry describes a stored file in the manifest.
+type manifestEntry struct {
+    Name   string `json:"name"`
+    Size   int64  `json:"size"`
+    SHA256 string `json:"sha256,omitempty"`
+    ETag   string `json:"etag,omitempty"`
+    Error  string `json:"error,omitempty"`
+}
+
+// isStoredFile tells whether the directory entry is a file received by the
+// server, as opposed to the files being received, the completion markers, if
+// there are, or the metadata.
+func isStoredFile(stat os.FileInfo, markers bool) bool {
+    return stat.Mode().IsRegular() && !strings.HasSuffix(stat.Name(), partSuffix) &&
+           !isMarker(stat.Name(), markers)
+}
+
+// sendManifest streams a line of JSON for every stored file whose name starts
+// with prefix. The files whose checksum can't be computed are still listed,
+// with the error instead of the checksum.
+func (s *Server) sendManifest(w io.Writer, prefix string) error {
+    enc := json.NewEncoder(w)
+    return eachStoredFile(prefix, s.DoneMarkers, func(stat os.FileInfo) error {
+        entry := manifestEntry{Name: stat.Name(), Size: stat.Size()}
+        sum, sumErr := s.meta.checksum(stat)
+        if sumErr != nil {
+            entry.Error = sumErr.Error()
+        }
+        entry.SHA256 = sum
+        entry.ETag = fileETag(sum)
+
+        if err := enc.Encode(&entry); err != nil {
+            return fmt.Errorf("could not send manifest, %v", err)
+        }
+        return nil
+    })
+}
+
+// eachStoredFile calls fn with every stored file whose name starts with
+// prefix, in the order of the directory, until it returns an error.
+func eachStoredFile(prefix string, markers bool, fn func(stat os.FileInfo) error) error {
+    dir, err := os.Open(".")
+    if err != nil {
+        return fmt.Errorf("could not open storage directory, %v", err)
+    }
+    defer dir.Close()
+
+    for {
+        stats, err := dir.Readdir(manifestBatch)
+        for _, stat := range stats {
+            if !isStoredFile(stat, markers) || !strings.HasPrefix(stat.Name(), prefix) {
+                continue
+            }
+
+            if err := fn(stat); err != nil {
+                return err
+            }
+        }
+
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("could not read storage directory, %v", err)
+        }
+    }
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"testing"
+)
+
+func sha256Hex(data string) string {
+    sum := sha256.Sum256([]byte(data))
+    return hex.EncodeToString(sum[:])
+}
+
+// requestManifest returns the entries of the manifest, by name.
+func requestManifest(t *testing.T, addr string, header ...string) map[string]manifestEntry {
+    t.Helper()
+    c := dialTest(t, addr)
+    c.request(append([]string{"Op: manifest"}, header...)...)
+
+    entries := make(map[string]manifestEntry)
+    dec := json.NewDecoder(c.r)
+    for {
+        var entry manifestEntry
+        if err := dec.Decode(&entry); err == io.EOF {
+            return entries
+        } else if err != nil {
+            t.Fatal(err)
+        }
+        entries[entry.Name] = entry
+    }
+}
+
+func TestManifest(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+
+    files := map[string]string{"report.txt": "report", "report.csv": "a,b", "notes.txt": ""}
+    for name, data := range files {
+        mustUpload(t, addr, name, data)
+    }
+    // Written by others, its checksum is computed for the manifest.
+    writeFile(t, "report.log", "log")
+    files["report.log"] = "log"
+
+    entries := requestManifest(t, addr)
+    if len(entries) != len(files) {
+        t.Fatalf("the manifest lists %d files, want %d", len(entries), len(files))
+    }
+    for name, data := range files {
+        entry := entries[name]
+        if entry.Size != int64(len(data)) || entry.SHA256 != sha256Hex(data) || entry.ETag != fileETag(entry.SHA256) {
+            t.Errorf("the manifest lists %+v for %s, want the size %d and the checksum %s",
+                     entry, name, len(data), sha256Hex(data))
+        }
+    }
+
+    var names []string
+    for name := range requestManifest(t, addr, "Prefix: report.") {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    if len(names) != 3 || names[0] != "report.csv" || names[1] != "report.log" || names[2] != "report.txt" {
+        t.Fatalf("the manifest of the prefix lists %q, want the report files", names)
+    }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// doneSuffix is appended to the name of a stored file to get the name of its
+// completion marker.
+const doneSuffix = ".done"
+
+// isMarker tells whether the name is one of a completion marker, with the
+// markers being written. The markers are then not stored files themselves,
+// and the names ending with doneSuffix are kept for them.
+func isMarker(name string, markers bool) bool {
+    return markers && strings.HasSuffix(name, doneSuffix)
+}
+
+// writeMarker creates the completion marker of the stored file, an empty file
+// next to it. The file is durable, renamed into place and synced, before the
+// marker appears, so that whoever waits for the marker never reads a file
+// that could still be lost.
+func writeMarker(name string) error {
+    if err := syncDir("."); err != nil {
+        return fmt.Errorf("could not write the completion marker of %q, %v", name, err)
+    }
+
+    marker, err := os.OpenFile(name + doneSuffix, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0666)
+    if err != nil {
+        return fmt.Errorf("could not write the completion marker of %q, %v", name, err)
+    }
+    if err := marker.Sync(); err != nil {
+        marker.Close()
+        return fmt.Errorf("could not write the completion marker of %q, %v", name, err)
+    }
+    if err := marker.Close(); err != nil {
+        return fmt.Errorf("could not write the completion marker of %q, %v", name, err)
+    }
+
+    if err := syncDir("."); err != nil {
+        return fmt.Errorf("could not write the completion marker of %q, %v", name, err)
+    }
+
+    return nil
+}
+
+// removeMarker removes the completion marker of the file removed from the
+// storage, if it has one.
+func removeMarker(name string) error {
+    err := os.Remove(name + doneSuffix)
+    if err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("could not remove the completion marker of %q, %v", name, err)
+    }
+
+    return nil
+}
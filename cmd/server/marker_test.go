@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDoneMarker(t *testing.T) {
+    s := newTestServer(t)
+    s.DoneMarkers = true
+    addr := serveTest(t, s)
+
+    exists := func(name string) bool {
+        _, err := os.Stat(name)
+        return err == nil
+    }
+
+    con := dialTest(t, addr)
+    con.request("Name: a.txt", "Status: true")
+    if first := con.reply(); first.Error != "" {
+        t.Fatal(first.Error)
+    }
+    con.write(deflate("data")[:2])
+    if exists("a.txt" + doneSuffix) {
+        t.Fatal("the marker appeared while the file was being received")
+    }
+
+    con.write(deflate("data")[2:])
+    con.closeWrite()
+    if status := con.reply(); status.Status != "ok" {
+        t.Fatal(status.Error)
+    }
+    if !exists("a.txt" + doneSuffix) || readFile(t, "a.txt") != "data" {
+        t.Fatal("the stored file has no marker")
+    }
+
+    // The failed uploads are never marked.
+    if _, status := upload(t, addr, "b.txt", "data", "SHA256: " + sha256Hex("other")); status.Status == "ok" {
+        t.Fatal("the upload with a wrong checksum was stored")
+    }
+    assertFiles(t, "a.txt", "a.txt" + doneSuffix)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dataDir is the directory, within the storage directory, where the server
+// keeps everything besides the stored files themselves.
+const dataDir = ".files"
+
+// metaDir is where the metadata of the stored files is kept. The metadata of
+// a file is stored under the same name as the file itself.
+const metaDir = dataDir + "/meta"
+
+// fileMeta is what the server remembers about a stored file. The metadata is
+// only trusted as long as the size and the modification time match the file.
+type fileMeta struct {
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"mod_time"`
+    SHA256  string    `json:"sha256,omitempty"`
+
+    // Adler32 is the weak checksum of the file, hex encoded, if the server
+    // keeps them.
+    Adler32 string `json:"adler32,omitempty"`
+
+    // Uploader is the address of the client the file was received from.
+    Uploader string `json:"uploader,omitempty"`
+
+    // OriginalName is the name the client sent, if the file was stored
+    // under another because it wasn't valid UTF-8. It's encoded in base64,
+    // JSON strings being UTF-8.
+    OriginalName []byte `json:"original_name,omitempty"`
+
+    // Recompressed is the codec the recompressor compressed the file with,
+    // and RecompressedSize the size of the compressed data, zero if the file
+    // didn't compress enough for it to be kept.
+    Recompressed     string `json:"recompressed,omitempty"`
+    RecompressedSize int64  `json:"recompressed_size,omitempty"`
+}
+
+// fresh tells whether the metadata still describes the file.
+func (m *fileMeta) fresh(stat os.FileInfo) bool {
+    return m.Size == stat.Size() && m.ModTime.Equal(stat.ModTime())
+}
+
+type metaStore struct {
+    dir string
+
+    // weak tells to keep the weak checksums of the files too.
+    weak bool
+}
+
+// newMetaStore will create the metadata directory if it doesn't exist yet.
+func newMetaStore(dir string) (*metaStore, error) {
+    if err := os.MkdirAll(dir, 0777); err != nil {
+        return nil, fmt.Errorf("could not create metadata directory, %v", err)
+    }
+
+    return &metaStore{dir: dir}, nil
+}
+
+// load returns the metadata of the file, or nil if there's none.
+func (ms *metaStore) load(name string) (*fileMeta, error) {
+    data, err := ioutil.ReadFile(filepath.Join(ms.dir, name))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("could not load metadata of %q, %v", name, err)
+    }
+
+    meta := &fileMeta{}
+    if err := json.Unmarshal(data, meta); err != nil {
+        return nil, fmt.Errorf("malformed metadata of %q, %v", name, err)
+    }
+
+    return meta, nil
+}
+
+// save replaces the metadata of the file atomically, so that the concurrent
+// readers never see it half written.
+func (ms *metaStore) save(name string, meta *fileMeta) error {
+    data, err := json.Marshal(meta)
+    if err != nil {
+        return fmt.Errorf("could not save metadata of %q, %v", name, err)
+    }
+
+    temp, err := ioutil.TempFile(ms.dir, name + partSuffix)
+    if err != nil {
+        return fmt.Errorf("could not save metadata of %q, %v", name, err)
+    }
+    defer os.Remove(temp.Name())
+
+    _, err = temp.Write(data)
+    if closeErr := temp.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Rename(temp.Name(), filepath.Join(ms.dir, name))
+    }
+    if err != nil {
+        return fmt.Errorf("could not save metadata of %q, %v", name, err)
+    }
+
+    return nil
+}
+
+// remove forgets the metadata of the file, if there's any.
+func (ms *metaStore) remove(name string) error {
+    err := os.Remove(filepath.Join(ms.dir, name))
+    if err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("could not remove metadata of %q, %v", name, err)
+    }
+
+    return nil
+}
+
+// fileSHA256 computes the hex encoded SHA-256 of the content of the file.
+func fileSHA256(name string) (string, error) {
+    file, err := os.Open(name)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    h := sha256.New()
+    if _, err := io.Copy(h, file); err != nil {
+        return "", err
+    }
+
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksum returns the SHA-256 of the stored file described by stat. The
+// checksum is taken from the metadata if it's fresh, otherwise it's computed
+// and saved for the next time.
+func (ms *metaStore) checksum(stat os.FileInfo) (string, error) {
+    meta, err := ms.checksums(stat)
+    if err != nil {
+        return "", err
+    }
+
+    return meta.SHA256, nil
+}
+
+// checksums returns the metadata of the stored file described by stat with
+// the checksums, computing and saving them if they aren't known. Both are
+// computed at once, so the file is read only once.
+func (ms *metaStore) checksums(stat os.FileInfo) (*fileMeta, error) {
+    meta, err := ms.load(stat.Name())
+    if err != nil {
+        return nil, err
+    }
+
+    if meta != nil && meta.fresh(stat) && meta.SHA256 != "" && (!ms.weak || meta.Adler32 != "") {
+        return meta, nil
+    }
+
+    sum, weak, err := fileChecksums(stat.Name(), ms.weak)
+    if err != nil {
+        return nil, fmt.Errorf("could not compute checksum of %q, %v", stat.Name(), err)
+    }
+
+    fresh := &fileMeta{Size: stat.Size(), ModTime: stat.ModTime(), SHA256: sum, Adler32: weak}
+    if meta != nil {
+        fresh.Uploader = meta.Uploader
+        fresh.OriginalName = meta.OriginalName
+    }
+
+    err = ms.save(stat.Name(), fresh)
+    if err != nil {
+        log.Print(err)
+    }
+
+    return fresh, nil
+}
+
+// fileChecksums computes the hex encoded SHA-256 of the content of the file,
+// and the Adler-32 too if asked for.
+func fileChecksums(name string, weak bool) (sum, weakSum string, err error) {
+    file, err := os.Open(name)
+    if err != nil {
+        return "", "", err
+    }
+    defer file.Close()
+
+    h := sha256.New()
+    var w io.Writer = h
+    a := adler32.New()
+    if weak {
+        w = io.MultiWriter(h, a)
+    }
+    if _, err := io.Copy(w, file); err != nil {
+        return "", "", err
+    }
+
+    if weak {
+        weakSum = adlerString(a.Sum32())
+    }
+    return hex.EncodeToString(h.Sum(nil)), weakSum, nil
+}
+
+// adlerString hex encodes the Adler-32, as 8 digits.
+func adlerString(sum uint32) string {
+    return fmt.Sprintf("%08x", sum)
+}
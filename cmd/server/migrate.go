@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Before the trailing dot was kept out of the extension, the copies of
+// "archive." were named "archive_copy1." and so on. The migrate subcommand
+// renames them to the names they get now, "archive._copy1", so that they're
+// counted as the copies again.
+
+// migratedName returns the current name of the copy named the old way, the
+// name it's a copy of, and whether the name is one of such a copy at all.
+func migratedName(name string) (migrated, original string, ok bool) {
+    if !strings.HasSuffix(name, ".") {
+        return "", "", false
+    }
+
+    bare := strings.TrimSuffix(name, ".")
+    numStart := strings.LastIndex(bare, copySuffix)
+    if numStart == -1 {
+        return "", "", false
+    }
+
+    copyNum := bare[numStart + len(copySuffix):]
+    if n, err := strconv.Atoi(copyNum); err != nil || n < 1 {
+        return "", "", false
+    }
+
+    original = bare[:numStart] + "."
+    return original + copySuffix + copyNum, original, true
+}
+
+// migration is a planned rename.
+type migration struct {
+    from string
+    to   string
+}
+
+// planMigration returns the renames of the copies named the old way in the
+// storage directory. If the current name is taken, the copy gets the next
+// free copy number instead, so that nothing is ever overwritten.
+func planMigration() ([]migration, error) {
+    names, err := readDirNames(".")
+    if err != nil {
+        return nil, fmt.Errorf("could not list stored files, %v", err)
+    }
+    sort.Strings(names)
+
+    // Everything in the directory is in the way, not only the stored files.
+    index, _ := NewFileIndexFromSlice(names)
+
+    var plan []migration
+    for _, name := range names {
+        stat, err := os.Lstat(name)
+        if err != nil || !isStoredFile(stat, false) {
+            continue
+        }
+
+        to, original, ok := migratedName(name)
+        if !ok {
+            continue
+        }
+
+        if _, taken := index.CopyCount(to); taken {
+            to = index.Resolve(original)
+        } else {
+            index.Resolve(to)
+        }
+        plan = append(plan, migration{from: name, to: to})
+    }
+
+    return plan, nil
+}
+
+// migrateCommand renames the copies named the old way, as asked for by the
+// arguments of the migrate subcommand, along with their metadata. The server
+// must not be running meanwhile.
+func migrateCommand(args []string) error {
+    fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+    dryRun := fs.Bool("dry-run", false, "only print the renames, without renaming anything")
+    fs.Parse(args)
+
+    plan, err := planMigration()
+    if err != nil {
+        return err
+    }
+
+    for _, m := range plan {
+        if *dryRun {
+            fmt.Printf("would rename %q to %q\n", m.from, m.to)
+            continue
+        }
+
+        if _, err := os.Lstat(m.to); !os.IsNotExist(err) {
+            return fmt.Errorf("could not rename %q to %q, the name is taken", m.from, m.to)
+        }
+        if err := os.Rename(m.from, m.to); err != nil {
+            return fmt.Errorf("could not rename %q, %v", m.from, err)
+        }
+
+        err := os.Rename(filepath.Join(metaDir, m.from), filepath.Join(metaDir, m.to))
+        if err != nil && !os.IsNotExist(err) {
+            return fmt.Errorf("could not rename the metadata of %q, %v", m.from, err)
+        }
+
+        err = os.Rename(m.from + doneSuffix, m.to + doneSuffix)
+        if err != nil && !os.IsNotExist(err) {
+            return fmt.Errorf("could not rename the completion marker of %q, %v", m.from, err)
+        }
+
+        fmt.Printf("renamed %q to %q\n", m.from, m.to)
+    }
+
+    if len(plan) == 0 {
+        fmt.Println("nothing to migrate")
+    }
+
+    return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+    inStorage(t)
+    for _, name := range []string{"archive.", "archive._copy2", "archive_copy1.", "archive_copy2.",
+                                  "report.txt", "report_copy1.txt", "odd_copy0."} {
+        writeFile(t, name, name)
+    }
+    writeFile(t, "archive_copy1." + doneSuffix, "")
+
+    if err := migrateCommand([]string{"-dry-run"}); err != nil {
+        t.Fatal(err)
+    }
+    assertFiles(t, "archive.", "archive._copy2", "archive_copy1.", "archive_copy1." + doneSuffix,
+                "archive_copy2.", "odd_copy0.", "report.txt", "report_copy1.txt")
+
+    // The copy whose new name is taken gets the next free copy number.
+    if err := migrateCommand(nil); err != nil {
+        t.Fatal(err)
+    }
+    assertFiles(t, "archive.", "archive._copy1", "archive._copy1" + doneSuffix, "archive._copy2",
+                "archive._copy3", "odd_copy0.", "report.txt", "report_copy1.txt")
+    if got := readFile(t, "archive._copy3"); got != "archive_copy2." {
+        t.Fatalf("archive._copy3 holds %q, want the former archive_copy2.", got)
+    }
+
+    // The index built from the migrated names counts the copies.
+    fi, err := NewFileIndexFromSlice(listFiles(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if name := fi.Resolve("archive."); name != "archive._copy4" {
+        t.Fatalf("the next copy is %q, want archive._copy4", name)
+    }
+
+    if err := migrateCommand(nil); err != nil {
+        t.Fatalf("migrating again failed, %v", err)
+    }
+}
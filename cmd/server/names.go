@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// namePolicy tells what's done with the names of the files that aren't valid
+// UTF-8, e.g. sent by a client in a legacy locale. Kept as they are, they end
+// up mangled in the JSON responses, which replace the invalid bytes, and
+// confuse the tools reading the logs or the directory.
+type namePolicy string
+
+const (
+    // namesKeep stores the files under the names as they are.
+    namesKeep namePolicy = "keep"
+
+    // namesReject refuses the files.
+    namesReject namePolicy = "reject"
+
+    // namesEscape percent-encodes the invalid bytes, e.g. "caf\xe9.txt" is
+    // stored as "caf%E9.txt", the original name being kept in the metadata.
+    namesEscape namePolicy = "escape"
+)
+
+func (p namePolicy) String() string {
+    if p == "" {
+        return string(namesKeep)
+    }
+
+    return string(p)
+}
+
+func parseNamePolicy(value string) (namePolicy, error) {
+    switch p := namePolicy(value); p {
+    case namesKeep, namesReject, namesEscape:
+        return p, nil
+    }
+
+    return "", fmt.Errorf("unknown policy %q for the names that aren't UTF-8, want keep, reject or escape",
+                          value)
+}
+
+// apply returns the name the file is to be stored under, or an error if it's
+// refused. The valid names are always left as they are.
+func (p namePolicy) apply(name string) (string, error) {
+    if utf8.ValidString(name) {
+        return name, nil
+    }
+
+    switch p {
+    case namesReject:
+        return "", fmt.Errorf("the name of the file %q is not valid UTF-8", name)
+    case namesEscape:
+        return escapeInvalidUTF8(name), nil
+    }
+
+    return name, nil
+}
+
+// escapeInvalidUTF8 percent-encodes the bytes of the name that aren't part of
+// a valid UTF-8 sequence.
+func escapeInvalidUTF8(name string) string {
+    var b strings.Builder
+    for len(name) > 0 {
+        r, size := utf8.DecodeRuneInString(name)
+        if r == utf8.RuneError && size == 1 {
+            fmt.Fprintf(&b, "%%%02X", name[0])
+        } else {
+            b.WriteString(name[:size])
+        }
+        name = name[size:]
+    }
+
+    return b.String()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// rawUpload uploads the data with Status: true and returns the replies as
+// they're sent, the first one only if the upload was refused before the data.
+func rawUpload(t *testing.T, addr, name, data string) [][]byte {
+    t.Helper()
+    con := dialTest(t, addr)
+    con.request("Name: " + name, "Status: true")
+
+    readLine := func() []byte {
+        line, err := con.r.ReadBytes('\n')
+        if err != nil {
+            t.Fatalf("could not read the reply, %v", err)
+        }
+        return line
+    }
+    first := readLine()
+    var resp response
+    if err := json.Unmarshal(first, &resp); err != nil {
+        t.Fatal(err)
+    }
+    if resp.Error != "" {
+        return [][]byte{first}
+    }
+
+    con.sendData(data)
+    con.closeWrite()
+    return [][]byte{first, readLine()}
+}
+
+func TestNamePolicies(t *testing.T) {
+    const name = "caf\xe9.txt"
+    for _, test := range []struct {
+        policy namePolicy
+        stored []string
+    }{
+        {namesKeep, []string{name}},
+        {namesReject, nil},
+        {namesEscape, []string{"caf%E9.txt"}},
+    } {
+        s := newTestServer(t)
+        s.NamePolicy = test.policy
+        addr := serveTest(t, s)
+
+        replies := rawUpload(t, addr, name, "data")
+        for _, reply := range replies {
+            if !utf8.Valid(reply) {
+                t.Errorf("the %s policy sent the reply %q, not valid UTF-8", test.policy, reply)
+            }
+        }
+        if test.stored == nil {
+            var resp response
+            json.Unmarshal(replies[0], &resp)
+            if len(replies) != 1 || !strings.Contains(resp.Error, "not valid UTF-8") {
+                t.Errorf("the %s policy replied %q, want the name refused", test.policy, replies)
+            }
+        }
+        if got := listFiles(t); strings.Join(got, ",") != strings.Join(test.stored, ",") {
+            t.Errorf("the %s policy stored %q, want %q", test.policy, got, test.stored)
+        }
+    }
+
+    // The escaped names keep what was sent in the metadata.
+    s := newTestServer(t)
+    s.NamePolicy = namesEscape
+    addr := serveTest(t, s)
+    rawUpload(t, addr, name, "data")
+    if stat := statFile(t, addr, name); stat.Name != "caf%E9.txt" || string(stat.OriginalName) != name {
+        t.Fatalf("the stat told %q sent as %q, want caf%%E9.txt sent as %q", stat.Name, stat.OriginalName, name)
+    }
+
+    if _, err := parseNamePolicy("transliterate"); err == nil {
+        t.Fatal("the unknown policy was accepted")
+    }
+    for _, p := range []namePolicy{namesKeep, namesReject, namesEscape} {
+        if got, err := p.apply("café.txt"); err != nil || got != "café.txt" {
+            t.Errorf("the %s policy made %q, %v of the valid name", p, got, err)
+        }
+    }
+}
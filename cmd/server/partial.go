@@ -0,0 +1,58 @@
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// partialDir keeps what was received of the uploads whose data failed to
+// decompress, as <name>.<random>.partial, for the operator to look into.
+// They're never served, nor removed by the server.
+const partialDir = dataDir + "/partial"
+
+// partialSuffix marks the salvaged files as incomplete.
+const partialSuffix = ".partial"
+
+// isDecompressionError tells whether the data failed to decompress, either
+// because it's corrupt or because it ended before the DEFLATE stream did.
+func isDecompressionError(err error) bool {
+    var corrupt flate.CorruptInputError
+    return errors.As(err, &corrupt) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// salvagePartial moves the size bytes of the file decompressed so far to the
+// partial directory and returns the path it was moved to. The file is
+// truncated first, since it may have been preallocated.
+func salvagePartial(file *os.File, tempFilename, name string, size int64) (string, error) {
+    if err := file.Truncate(size); err != nil {
+        return "", fmt.Errorf("could not salvage %q, %v", name, err)
+    }
+    if err := file.Close(); err != nil {
+        return "", fmt.Errorf("could not salvage %q, %v", name, err)
+    }
+
+    if err := os.MkdirAll(partialDir, 0777); err != nil {
+        return "", fmt.Errorf("could not salvage %q, %v", name, err)
+    }
+
+    // The name is reserved by an empty file first, so that the partials of
+    // the same name never replace each other.
+    reserved, err := ioutil.TempFile(partialDir, name + ".*" + partialSuffix)
+    if err != nil {
+        return "", fmt.Errorf("could not salvage %q, %v", name, err)
+    }
+    reserved.Close()
+
+    path := reserved.Name()
+    if err := os.Rename(tempFilename, path); err != nil {
+        os.Remove(path)
+        return "", fmt.Errorf("could not salvage %q, %v", name, err)
+    }
+
+    return filepath.ToSlash(path), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// flushedPrefix returns a DEFLATE stream that decodes to the data and then
+// ends, or goes on with the garbage, before the stream does.
+func flushedPrefix(t *testing.T, data, garbage string) []byte {
+    t.Helper()
+    var buf bytes.Buffer
+    zw, err := flate.NewWriter(&buf, flate.BestSpeed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    zw.Write([]byte(data))
+    if err := zw.Flush(); err != nil {
+        t.Fatal(err)
+    }
+
+    return append(buf.Bytes(), garbage...)
+}
+
+func TestKeepPartial(t *testing.T) {
+    s := newTestServer(t)
+    s.KeepPartial = true
+    addr := serveTest(t, s)
+    data := strings.Repeat("salvaged ", 1000)
+
+    for i, garbage := range []string{"", "\xff\xff\xff\xff"} {
+        con := dialTest(t, addr)
+        con.request("Name: a.txt", "Status: true")
+        if first := con.reply(); first.Error != "" {
+            t.Fatal(first.Error)
+        }
+        con.write(flushedPrefix(t, data, garbage))
+        con.closeWrite()
+        if status := con.reply(); status.Status == "ok" {
+            t.Fatal("the broken stream was stored")
+        }
+
+        partials, err := filepath.Glob(filepath.Join(partialDir, "a.txt.*" + partialSuffix))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(partials) != i + 1 {
+            t.Fatalf("found the partial files %q, want %d", partials, i + 1)
+        }
+        for _, partial := range partials {
+            got, err := ioutil.ReadFile(partial)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if string(got) != data {
+                t.Fatalf("%s has %d bytes, want the %d decompressed", partial, len(got), len(data))
+            }
+        }
+    }
+
+    // Nothing is served under the name.
+    assertFiles(t)
+}
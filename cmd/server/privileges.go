@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// credentials are the user and the group the server drops its privileges
+// to, -1 meaning to keep the current one.
+type credentials struct {
+    uid int
+    gid int
+}
+
+// lookupCredentials looks up the user and the group by their names or IDs.
+// The group is the primary one of the user if not given.
+func lookupCredentials(userName, groupName string) (credentials, error) {
+    creds := credentials{uid: -1, gid: -1}
+
+    if userName != "" {
+        u, err := user.Lookup(userName)
+        if _, numeric := strconv.Atoi(userName); err != nil && numeric == nil {
+            u, err = user.LookupId(userName)
+        }
+        if err != nil {
+            return creds, fmt.Errorf("could not look up the user %q, %v", userName, err)
+        }
+
+        creds.uid, err = strconv.Atoi(u.Uid)
+        if err != nil {
+            return creds, fmt.Errorf("could not look up the user %q, the ID %q is not numeric",
+                                     userName, u.Uid)
+        }
+        if groupName == "" {
+            groupName = u.Gid
+        }
+    }
+
+    if groupName != "" {
+        g, err := user.LookupGroup(groupName)
+        if _, numeric := strconv.Atoi(groupName); err != nil && numeric == nil {
+            g, err = user.LookupGroupId(groupName)
+        }
+        if err != nil {
+            return creds, fmt.Errorf("could not look up the group %q, %v", groupName, err)
+        }
+
+        creds.gid, err = strconv.Atoi(g.Gid)
+        if err != nil {
+            return creds, fmt.Errorf("could not look up the group %q, the ID %q is not numeric",
+                                     groupName, g.Gid)
+        }
+    }
+
+    return creds, nil
+}
+
+// chownState hands the directories of the server, with everything in them,
+// over to the user and the group, since they were made before the
+// privileges were dropped.
+func chownState(creds credentials) error {
+    err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+
+        return os.Lchown(path, creds.uid, creds.gid)
+    })
+    if err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("could not hand %s over, %v", dataDir, err)
+    }
+
+    return nil
+}
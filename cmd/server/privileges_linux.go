@@ -0,0 +1,47 @@
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// dropPrivileges switches the whole process to the user and the group, the
+// group first, while the server is still allowed to change it. The system
+// calls of syscall apply to all the threads of the process, unlike the plain
+// ones, which would leave the other threads of the runtime privileged; they
+// only do since Go 1.16, before which they fail with EOPNOTSUPP on Linux. The
+// server refuses to go on if the privileges could be regained.
+func dropPrivileges(creds credentials) error {
+    if creds.gid >= 0 {
+        if err := syscall.Setgroups([]int{creds.gid}); err != nil {
+            return fmt.Errorf("could not drop the supplementary groups, %v", err)
+        }
+        if err := syscall.Setgid(creds.gid); err != nil {
+            return fmt.Errorf("could not switch to the group %d, %v", creds.gid, err)
+        }
+    }
+
+    if creds.uid >= 0 {
+        if err := syscall.Setuid(creds.uid); err != nil {
+            return fmt.Errorf("could not switch to the user %d, %v", creds.uid, err)
+        }
+    }
+
+    if creds.gid >= 0 && (syscall.Getgid() != creds.gid || syscall.Getegid() != creds.gid) {
+        return fmt.Errorf("could not switch to the group %d, the process is still of %d",
+                          creds.gid, syscall.Getegid())
+    }
+    if creds.uid >= 0 && (syscall.Getuid() != creds.uid || syscall.Geteuid() != creds.uid) {
+        return fmt.Errorf("could not switch to the user %d, the process is still of %d",
+                          creds.uid, syscall.Geteuid())
+    }
+    if creds.uid > 0 && syscall.Setuid(0) == nil {
+        return fmt.Errorf("the privileges of root could be regained after switching to the user %d",
+                          creds.uid)
+    }
+
+    return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux || !go1.16
+// +build !linux !go1.16
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// dropPrivileges can't switch the user, the platform offers no way to do it
+// for all the threads of the process, nor does Go before 1.16 on Linux.
+func dropPrivileges(creds credentials) error {
+    if runtime.GOOS == "linux" {
+        return fmt.Errorf("dropping the privileges needs the server built with Go 1.16 or later")
+    }
+
+    return fmt.Errorf("dropping the privileges is not supported on %s", runtime.GOOS)
+}
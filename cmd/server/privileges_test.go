@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os/user"
+	"testing"
+)
+
+func TestLookupCredentials(t *testing.T) {
+    if _, err := user.LookupId("0"); err != nil {
+        t.Skipf("the users can't be looked up, %v", err)
+    }
+
+    for _, name := range []string{"root", "0"} {
+        creds, err := lookupCredentials(name, "")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if creds.uid != 0 || creds.gid != 0 {
+            t.Errorf("%s is %+v, want the user and the group 0", name, creds)
+        }
+    }
+
+    creds, err := lookupCredentials("", "")
+    if err != nil || creds.uid != -1 || creds.gid != -1 {
+        t.Errorf("no user nor group is %+v, %v, want both kept", creds, err)
+    }
+
+    if _, err := lookupCredentials("no-such-user-of-files", ""); err == nil {
+        t.Error("an unknown user is looked up")
+    }
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressPath is the path the progress of the transfers in flight is
+// streamed at, as server-sent events, next to the metrics.
+const progressPath = "/debug/transfers"
+
+// progressInterval is how often the progress is sent by default.
+const progressInterval = time.Second
+
+// transfer is a file being received. Only the count of the received bytes
+// changes, atomically, so the transfer never waits for the ones watching it.
+type transfer struct {
+    id       uint64
+    name     string
+    remote   string
+    started  time.Time
+    received int64
+}
+
+func (t *transfer) add(n int64) {
+    atomic.AddInt64(&t.received, n)
+}
+
+// transfers are the files being received.
+type transfers struct {
+    lastID uint64
+    active map[uint64]*transfer
+    clock  Clock
+    sync.Mutex
+}
+
+func newTransfers(clock Clock) *transfers {
+    return &transfers{active: make(map[uint64]*transfer), clock: clock}
+}
+
+// start registers the transfer of the file, to be ended once it's done.
+func (ts *transfers) start(name, remote string) *transfer {
+    ts.Lock()
+    defer ts.Unlock()
+
+    ts.lastID++
+    t := &transfer{id: ts.lastID, name: name, remote: remote, started: ts.clock.Now()}
+    ts.active[t.id] = t
+    return t
+}
+
+// busy tells whether any file is being received.
+func (ts *transfers) busy() bool {
+    ts.Lock()
+    defer ts.Unlock()
+
+    return len(ts.active) > 0
+}
+
+func (ts *transfers) end(t *transfer) {
+    ts.Lock()
+    defer ts.Unlock()
+
+    delete(ts.active, t.id)
+}
+
+// transferProgress is the progress of a transfer, as streamed. The rate is
+// of the bytes received since the previous snapshot, in bytes per second.
+type transferProgress struct {
+    ID       uint64  `json:"id"`
+    Name     string  `json:"name"`
+    Remote   string  `json:"remote"`
+    Received int64   `json:"received"`
+    Rate     float64 `json:"rate"`
+    Elapsed  float64 `json:"elapsed"`
+}
+
+type progressSnapshot struct {
+    Time      time.Time          `json:"time"`
+    Transfers []transferProgress `json:"transfers"`
+}
+
+// snapshot returns the progress of the transfers, sorted by their IDs, and
+// remembers the received bytes for the rates of the next one.
+func (ts *transfers) snapshot(prev map[uint64]int64, since time.Time) *progressSnapshot {
+    ts.Lock()
+    active := make([]*transfer, 0, len(ts.active))
+    for _, t := range ts.active {
+        active = append(active, t)
+    }
+    ts.Unlock()
+    sort.Slice(active, func(i, j int) bool { return active[i].id < active[j].id })
+
+    now := ts.clock.Now()
+    snap := &progressSnapshot{Time: now, Transfers: []transferProgress{}}
+    seen := make(map[uint64]bool, len(active))
+    for _, t := range active {
+        received := atomic.LoadInt64(&t.received)
+        p := transferProgress{
+            ID:       t.id,
+            Name:     t.name,
+            Remote:   t.remote,
+            Received: received,
+            Elapsed:  now.Sub(t.started).Seconds(),
+        }
+
+        // The transfers started since the previous snapshot are rated from
+        // their start.
+        from, before := since, prev[t.id]
+        if _, known := prev[t.id]; !known || t.started.After(since) {
+            from, before = t.started, 0
+        }
+        if elapsed := now.Sub(from).Seconds(); elapsed > 0 {
+            p.Rate = float64(received - before) / elapsed
+        }
+
+        snap.Transfers = append(snap.Transfers, p)
+        prev[t.id] = received
+        seen[t.id] = true
+    }
+
+    for id := range prev {
+        if !seen[id] {
+            delete(prev, id)
+        }
+    }
+
+    return snap
+}
+
+// streamProgress sends a snapshot of the transfers in flight as a server-sent
+// event every interval, which may be given in the query, e.g. ?interval=5s,
+// until the client goes away or the server shuts down.
+func (s *Server) streamProgress(w http.ResponseWriter, r *http.Request) {
+    interval := progressInterval
+    if value := r.URL.Query().Get("interval"); value != "" {
+        d, err := time.ParseDuration(value)
+        if err != nil || d < 100 * time.Millisecond {
+            http.Error(w, fmt.Sprintf("invalid interval %q", value), http.StatusBadRequest)
+            return
+        }
+        interval = d
+    }
+
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    ticker := s.clock().NewTicker(interval)
+    defer ticker.Stop()
+
+    prev := make(map[uint64]int64)
+    since := s.clock().Now()
+    for {
+        snap := s.transfers.snapshot(prev, since)
+        since = snap.Time
+
+        data, _ := json.Marshal(snap)
+        if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+            return
+        }
+        flusher.Flush()
+
+        select {
+        case <-r.Context().Done():
+            return
+        case <-ticker.C():
+        }
+
+        // The stream would keep the shutdown waiting for it.
+        if s.isClosing() {
+            return
+        }
+    }
+}
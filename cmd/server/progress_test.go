@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// progressStream reads the snapshots of the progress stream.
+type progressStream struct {
+    t *testing.T
+    r *bufio.Reader
+}
+
+func (ps *progressStream) next() *progressSnapshot {
+    ps.t.Helper()
+    for {
+        line, err := ps.r.ReadString('\n')
+        if err != nil {
+            ps.t.Fatal(err)
+        }
+        if !strings.HasPrefix(line, "data: ") {
+            continue
+        }
+
+        snap := &progressSnapshot{}
+        if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), snap); err != nil {
+            ps.t.Fatal(err)
+        }
+        return snap
+    }
+}
+
+// waitReceived returns the progress of the transfer of the name once it
+// received more than the bytes.
+func (ps *progressStream) waitReceived(name string, than int64) transferProgress {
+    ps.t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        for _, p := range ps.next().Transfers {
+            if p.Name == name && p.Received > than {
+                return p
+            }
+        }
+    }
+
+    ps.t.Fatalf("the stream never told %s received more than %d bytes", name, than)
+    return transferProgress{}
+}
+
+func TestProgressStream(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+    ts := httptest.NewServer(s.metricsHandler())
+    t.Cleanup(ts.Close)
+
+    con := dialTest(t, addr)
+    con.request("Name: a.txt", "Status: true")
+    if first := con.reply(); first.Error != "" {
+        t.Fatal(first.Error)
+    }
+    zw, _ := flate.NewWriter(con, flate.BestSpeed)
+    chunk := []byte(strings.Repeat("x", 10000))
+    zw.Write(chunk)
+    zw.Flush()
+
+    resp, err := http.Get(ts.URL + progressPath + "?interval=100ms")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if resp.Header.Get("Content-Type") != "text/event-stream" {
+        t.Fatalf("the stream is of %q", resp.Header.Get("Content-Type"))
+    }
+    ps := &progressStream{t: t, r: bufio.NewReader(resp.Body)}
+
+    first := ps.waitReceived("a.txt", 0)
+    if first.Remote == "" || first.ID == 0 {
+        t.Fatalf("the progress %+v doesn't tell the transfer apart", first)
+    }
+
+    // The snapshots follow the transfer.
+    zw.Write(chunk)
+    zw.Flush()
+    if p := ps.waitReceived("a.txt", first.Received); p.ID != first.ID {
+        t.Fatalf("the transfer is %d now, was %d", p.ID, first.ID)
+    }
+
+    zw.Close()
+    con.closeWrite()
+    if status := con.reply(); status.Status != "ok" || *status.Size != 20000 {
+        t.Fatalf("the transfer ended with %+v", status)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for len(ps.next().Transfers) > 0 {
+        if time.Now().After(deadline) {
+            t.Fatal("the ended transfer is still streamed")
+        }
+    }
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The PROXY protocol lets a TCP proxy pass the address of the real client in
+// front of the data. Only the proxies in the trusted networks have to (and
+// are allowed to) send the header, since anyone else could make up any
+// address.
+
+// proxyV1Prefix opens the human readable version of the header.
+const proxyV1Prefix = "PROXY "
+
+// proxyV1MaxLine is the longest line the version 1 header may be, including
+// the trailing \r\n.
+const proxyV1MaxLine = 107
+
+// proxyV2Signature opens the binary version of the header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseNetworks parses the comma separated list of CIDRs. The bare IP
+// addresses are taken as networks of a single address.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+    var networks []*net.IPNet
+    for _, item := range strings.Split(list, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            continue
+        }
+
+        if !strings.Contains(item, "/") {
+            ip := net.ParseIP(item)
+            if ip == nil {
+                return nil, fmt.Errorf("malformed address %q", item)
+            }
+
+            bits := 8 * net.IPv6len
+            if ip.To4() != nil {
+                ip = ip.To4()
+                bits = 8 * net.IPv4len
+            }
+            networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+
+        _, network, err := net.ParseCIDR(item)
+        if err != nil {
+            return nil, fmt.Errorf("malformed network %q", item)
+        }
+        networks = append(networks, network)
+    }
+
+    return networks, nil
+}
+
+// proxyListener accepts the connections of the trusted proxies as if they
+// came from the clients the proxies tell about.
+type proxyListener struct {
+    net.Listener
+    trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+    con, err := l.Listener.Accept()
+    if err != nil {
+        return nil, err
+    }
+
+    if !l.isTrusted(con.RemoteAddr()) {
+        return con, nil
+    }
+
+    return &proxyConn{Conn: con, r: bufio.NewReader(con)}, nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+    tcpAddr, ok := addr.(*net.TCPAddr)
+    return ok && isTrustedIP(l.trusted, tcpAddr.IP)
+}
+
+// isTrustedIP tells whether the address is in one of the trusted networks.
+func isTrustedIP(trusted []*net.IPNet, ip net.IP) bool {
+    for _, network := range trusted {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// forwardedFor returns the address of the client of the HTTP request. The
+// requests of the trusted proxies are taken as coming from the right-most
+// address of their X-Forwarded-For headers that isn't a trusted proxy: every
+// proxy appends the address it got the request from, so the addresses to the
+// left of the first untrusted one are whatever the client made up. The
+// address of the connection is returned as it is otherwise.
+func forwardedFor(trusted []*net.IPNet, r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil || !isTrustedIP(trusted, net.ParseIP(host)) {
+        return r.RemoteAddr
+    }
+
+    var hops []string
+    for _, header := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+        hops = append(hops, strings.Split(header, ",")...)
+    }
+
+    for i := len(hops) - 1; i >= 0; i-- {
+        ip := net.ParseIP(strings.TrimSpace(hops[i]))
+        if ip == nil {
+            // Nothing to the left of a malformed hop can be relied on.
+            break
+        }
+        if !isTrustedIP(trusted, ip) {
+            return ip.String()
+        }
+    }
+
+    return r.RemoteAddr
+}
+
+// proxyConn is a connection of a trusted proxy. The header is read lazily,
+// on the first read or when the address is asked for, so that a slow proxy
+// doesn't hold up accepting the other connections.
+type proxyConn struct {
+    net.Conn
+    r *bufio.Reader
+
+    once   sync.Once
+    remote net.Addr
+    err    error
+}
+
+func (c *proxyConn) readHeader() {
+    c.once.Do(func() {
+        c.remote, c.err = readProxyHeader(c.r)
+        if c.err != nil {
+            c.err = fmt.Errorf("malformed PROXY header from %v, %v",
+                               c.Conn.RemoteAddr(), c.err)
+        }
+        if c.remote == nil {
+            c.remote = c.Conn.RemoteAddr()
+        }
+    })
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+    c.readHeader()
+    if c.err != nil {
+        return 0, c.err
+    }
+
+    return c.r.Read(p)
+}
+
+// RemoteAddr returns the address of the client, as told by the proxy.
+func (c *proxyConn) RemoteAddr() net.Addr {
+    c.readHeader()
+    return c.remote
+}
+
+// readProxyHeader reads the header of either version. A nil address means
+// the proxy didn't pass one, e.g. for its own health checks.
+//
+// No more is peeked than the header of the version has for sure, so that a
+// short one, e.g. "PROXY UNKNOWN\r\n", is read without waiting for the data
+// of the client after it.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+    start, err := r.Peek(len(proxyV1Prefix))
+    if err != nil {
+        return nil, err
+    }
+
+    switch {
+    case string(start) == proxyV1Prefix:
+        return readProxyV1(r)
+    case start[0] == proxyV2Signature[0]:
+        start, err := r.Peek(len(proxyV2Signature))
+        if err != nil {
+            return nil, err
+        }
+        if bytes.Equal(start, proxyV2Signature) {
+            return readProxyV2(r)
+        }
+    }
+
+    return nil, fmt.Errorf("no PROXY header")
+}
+
+// readProxyV1 reads "PROXY TCP4|TCP6|UNKNOWN <src> <dst> <src port> <dst port>\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+    var line []byte
+    for !bytes.HasSuffix(line, []byte("\r\n")) {
+        if len(line) == proxyV1MaxLine {
+            return nil, fmt.Errorf("header line too long")
+        }
+
+        b, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        line = append(line, b)
+    }
+
+    fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        return nil, nil
+    }
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return nil, fmt.Errorf("malformed header line %q", line)
+    }
+
+    ip := net.ParseIP(fields[2])
+    port, err := strconv.ParseUint(fields[4], 10, 16)
+    if ip == nil || err != nil {
+        return nil, fmt.Errorf("malformed source address in %q", line)
+    }
+
+    return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// The binary header carries the version and the command in a single byte.
+const (
+    proxyV2Version = 0x20
+    proxyV2Local   = 0x00
+    proxyV2Proxy   = 0x01
+)
+
+// The address families of the binary header, combined with the stream
+// transport.
+const (
+    proxyV2TCP4 = 0x11
+    proxyV2TCP6 = 0x21
+)
+
+// readProxyV2 reads the binary header. The type-length-value extensions
+// following the addresses are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+    header := make([]byte, len(proxyV2Signature) + 4)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, err
+    }
+
+    verCmd, family := header[12], header[13]
+    length := binary.BigEndian.Uint16(header[14:])
+
+    body := make([]byte, length)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+
+    if verCmd & 0xf0 != proxyV2Version {
+        return nil, fmt.Errorf("unsupported version %#x", verCmd >> 4)
+    }
+
+    switch verCmd & 0x0f {
+    case proxyV2Local:
+        return nil, nil
+    case proxyV2Proxy:
+    default:
+        return nil, fmt.Errorf("unsupported command %#x", verCmd & 0x0f)
+    }
+
+    var ipLen int
+    switch family {
+    case proxyV2TCP4:
+        ipLen = net.IPv4len
+    case proxyV2TCP6:
+        ipLen = net.IPv6len
+    default:
+        // Nothing the server could make use of, the connection is taken
+        // as it is.
+        return nil, nil
+    }
+
+    if len(body) < 2 * ipLen + 4 {
+        return nil, fmt.Errorf("addresses truncated")
+    }
+
+    ip := net.IP(body[:ipLen])
+    port := binary.BigEndian.Uint16(body[2 * ipLen:])
+
+    return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
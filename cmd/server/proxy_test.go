@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNetworks(t *testing.T) {
+    networks, err := parseNetworks("10.0.0.0/8, 127.0.0.1,::1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(networks) != 3 {
+        t.Fatalf("got %d networks, want 3", len(networks))
+    }
+
+    for _, addr := range []string{"10.1.2.3", "127.0.0.1", "::1"} {
+        if !isTrustedIP(networks, net.ParseIP(addr)) {
+            t.Errorf("%s is not trusted", addr)
+        }
+    }
+    for _, addr := range []string{"11.0.0.1", "127.0.0.2"} {
+        if isTrustedIP(networks, net.ParseIP(addr)) {
+            t.Errorf("%s is trusted", addr)
+        }
+    }
+
+    if _, err := parseNetworks("10.0.0.0/33"); err == nil {
+        t.Errorf("a malformed network is parsed")
+    }
+}
+
+func TestReadProxyV1(t *testing.T) {
+    r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 192.0.2.2 5000 8888\r\nFILES/1\n"))
+    addr, err := readProxyHeader(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if addr.String() != "192.0.2.1:5000" {
+        t.Errorf("got %v, want 192.0.2.1:5000", addr)
+    }
+
+    rest, _ := r.ReadString('\n')
+    if rest != "FILES/1\n" {
+        t.Errorf("the data after the header is %q", rest)
+    }
+
+    addr, err = readProxyHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+    if err != nil || addr != nil {
+        t.Errorf("got %v, %v for UNKNOWN, want no address", addr, err)
+    }
+
+    if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("FILES/1\nName: a\n\n"))); err == nil {
+        t.Errorf("a connection with no header is accepted")
+    }
+}
+
+func TestReadShortProxyV1(t *testing.T) {
+    // The proxy sends the header and waits, as does the client behind it,
+    // for the server to reply.
+    readWaiting := func(header string) (net.Addr, error) {
+        server, client := net.Pipe()
+        defer server.Close()
+        defer client.Close()
+        go client.Write([]byte(header))
+
+        server.SetReadDeadline(time.Now().Add(5 * time.Second))
+        return readProxyHeader(bufio.NewReader(server))
+    }
+
+    addr, err := readWaiting("PROXY UNKNOWN\r\n")
+    if err != nil || addr != nil {
+        t.Errorf("got %v, %v for UNKNOWN with the client waiting, want no address", addr, err)
+    }
+
+    // Shorter than the binary signature, the line is still read whole.
+    _, err = readWaiting("PROXY X\r\n")
+    if err == nil || !strings.Contains(err.Error(), "malformed header line") {
+        t.Errorf("got %v for a short malformed header with the client waiting, want it malformed", err)
+    }
+}
+
+func TestReadProxyV2(t *testing.T) {
+    var header bytes.Buffer
+    header.Write(proxyV2Signature)
+    header.Write([]byte{proxyV2Version | proxyV2Proxy, proxyV2TCP4})
+    binary.Write(&header, binary.BigEndian, uint16(12))
+    header.Write(net.ParseIP("198.51.100.7").To4())
+    header.Write(net.ParseIP("198.51.100.8").To4())
+    binary.Write(&header, binary.BigEndian, uint16(4000))
+    binary.Write(&header, binary.BigEndian, uint16(8888))
+
+    addr, err := readProxyHeader(bufio.NewReader(&header))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if addr.String() != "198.51.100.7:4000" {
+        t.Errorf("got %v, want 198.51.100.7:4000", addr)
+    }
+}
+
+func TestForwardedFor(t *testing.T) {
+    trusted, _ := parseNetworks("10.0.0.0/8")
+
+    tests := []struct {
+        remote    string
+        forwarded []string
+        want      string
+    }{
+        {"10.0.0.1:5000", nil, "10.0.0.1:5000"},
+        {"10.0.0.1:5000", []string{"203.0.113.9"}, "203.0.113.9"},
+        // The proxies in the chain are skipped, the client's own claims
+        // to the left are not taken.
+        {"10.0.0.1:5000", []string{"1.1.1.1, 203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+        {"10.0.0.1:5000", []string{"1.1.1.1", "203.0.113.9"}, "203.0.113.9"},
+        {"10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.1:5000"},
+        {"10.0.0.1:5000", []string{"203.0.113.9, junk"}, "10.0.0.1:5000"},
+        // The untrusted clients can't tell their address.
+        {"192.0.2.1:5000", []string{"203.0.113.9"}, "192.0.2.1:5000"},
+    }
+
+    for _, test := range tests {
+        r := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+        for _, v := range test.forwarded {
+            r.Header.Add("X-Forwarded-For", v)
+        }
+
+        if got := forwardedFor(trusted, r); got != test.want {
+            t.Errorf("forwardedFor(%s, %q) = %s, want %s", test.remote, test.forwarded, got, test.want)
+        }
+    }
+}
+
+func TestProxyListener(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+
+    trusted, _ := parseNetworks("127.0.0.1")
+    pl := &proxyListener{Listener: l, trusted: trusted}
+
+    go func() {
+        con, err := net.Dial("tcp", l.Addr().String())
+        if err != nil {
+            return
+        }
+        defer con.Close()
+        con.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 8888\r\nhello\n"))
+    }()
+
+    con, err := pl.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer con.Close()
+
+    if con.RemoteAddr().String() != "192.0.2.1:5000" {
+        t.Errorf("the connection is from %v, want 192.0.2.1:5000", con.RemoteAddr())
+    }
+    line, _ := bufio.NewReader(con).ReadString('\n')
+    if line != "hello\n" {
+        t.Errorf("read %q after the header", line)
+    }
+}
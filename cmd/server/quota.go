@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// quotaRescanInterval is how often the stored files are looked through, so
+// that the quotas are freed of the files removed behind the back of the
+// server.
+const quotaRescanInterval = time.Minute
+
+// quotaTracker keeps the number of bytes every uploader stores within the
+// limit. The bytes are charged as they are received, so that the concurrent
+// uploads of an uploader can't exceed the limit together.
+type quotaTracker struct {
+    limit   int64
+    meta    *metaStore
+    markers bool
+
+    // owners maps the names of the stored files to their uploaders and sizes.
+    owners map[string]quotaFile
+
+    // stored is the number of bytes of every uploader in the stored files,
+    // bounded like the other tables of the limits. An uploader evicted is
+    // counted again from the owners when seen next, so no stored byte is
+    // ever forgotten.
+    stored     *lruTable
+    maxTracked int
+
+    // receiving is the number of bytes of every uploader in the files being
+    // received. The uploaders are forgotten once they have none, so it never
+    // holds more uploaders than there are uploads in progress.
+    receiving map[string]int64
+    clock     Clock
+    sync.Mutex
+}
+
+type quotaFile struct {
+    uploader string
+    size     int64
+}
+
+func newQuotaTracker(limit int64, meta *metaStore, markers bool, maxTracked int,
+                     clock Clock) *quotaTracker {
+    return &quotaTracker{
+        limit:      limit,
+        meta:       meta,
+        markers:    markers,
+        clock:      clock,
+        owners:     make(map[string]quotaFile),
+        stored:     newLRUTable(maxTracked, nil),
+        maxTracked: maxTracked,
+        receiving:  make(map[string]int64),
+    }
+}
+
+// storedLocked returns the number of bytes the uploader stores. The caller
+// must hold the lock.
+func (q *quotaTracker) storedLocked(uploader string) int64 {
+    now := q.clock.Now()
+    if value, ok := q.stored.get(uploader, now); ok {
+        return value.(int64)
+    }
+    if q.stored.evicted == 0 {
+        return 0
+    }
+
+    // The uploaders with nothing stored are kept too, so that the owners
+    // are looked through once per uploader rather than for every chunk
+    // received.
+    var total int64
+    for _, file := range q.owners {
+        if file.uploader == uploader {
+            total += file.size
+        }
+    }
+    q.stored.put(uploader, total, now)
+    return total
+}
+
+func (q *quotaTracker) exceeded(uploader string) error {
+    return fmt.Errorf("quota exceeded, %s may store at most %d bytes", uploader, q.limit)
+}
+
+// exceedsLocked tells whether n more bytes would exceed the quota of the
+// uploader. The size declared by the client can be anything up to the int64
+// limit, so it's compared to what's left of the quota rather than added up.
+// The caller must hold the lock.
+func (q *quotaTracker) exceedsLocked(uploader string, n int64) bool {
+    return n > q.limit - q.storedLocked(uploader) - q.receiving[uploader]
+}
+
+// check tells whether the uploader could store n more bytes.
+func (q *quotaTracker) check(uploader string, n int64) error {
+    q.Lock()
+    defer q.Unlock()
+
+    if q.exceedsLocked(uploader, n) {
+        return q.exceeded(uploader)
+    }
+
+    return nil
+}
+
+// charge takes n more bytes being received from the quota of the uploader,
+// unless the quota would be exceeded.
+func (q *quotaTracker) charge(uploader string, n int64) error {
+    q.Lock()
+    defer q.Unlock()
+
+    if q.exceedsLocked(uploader, n) {
+        return q.exceeded(uploader)
+    }
+    q.receiving[uploader] += n
+
+    return nil
+}
+
+// refund gives back the bytes charged for a file that's no longer being
+// received, whether it was stored or not.
+func (q *quotaTracker) refund(uploader string, n int64) {
+    q.Lock()
+    defer q.Unlock()
+
+    q.receiving[uploader] -= n
+    if q.receiving[uploader] <= 0 {
+        delete(q.receiving, uploader)
+    }
+}
+
+// add counts the stored file against the quota of the uploader.
+func (q *quotaTracker) add(name, uploader string, size int64) {
+    q.Lock()
+    defer q.Unlock()
+
+    q.removeLocked(name)
+    total := q.storedLocked(uploader) + size
+    q.owners[name] = quotaFile{uploader: uploader, size: size}
+    q.stored.put(uploader, total, q.clock.Now())
+}
+
+// swap exchanges the files of the names, which swapped their contents.
+func (q *quotaTracker) swap(a, b string) {
+    q.Lock()
+    defer q.Unlock()
+
+    fileA, okA := q.owners[a]
+    fileB, okB := q.owners[b]
+    delete(q.owners, a)
+    delete(q.owners, b)
+    if okA {
+        q.owners[b] = fileA
+    }
+    if okB {
+        q.owners[a] = fileB
+    }
+}
+
+// remove frees the quota taken by the stored file.
+func (q *quotaTracker) remove(name string) {
+    q.Lock()
+    defer q.Unlock()
+
+    q.removeLocked(name)
+}
+
+func (q *quotaTracker) removeLocked(name string) {
+    file, ok := q.owners[name]
+    if !ok {
+        return
+    }
+
+    // The owner is looked up before the file is forgotten, in case it was
+    // evicted and has to be counted again.
+    total := q.storedLocked(file.uploader) - file.size
+    delete(q.owners, name)
+    if total <= 0 {
+        q.stored.remove(file.uploader)
+    } else {
+        q.stored.put(file.uploader, total, q.clock.Now())
+    }
+}
+
+// rescan counts the stored files again, according to their metadata. The
+// files with no uploader recorded are not counted.
+func (q *quotaTracker) rescan() error {
+    dir, err := os.Open(".")
+    if err != nil {
+        return fmt.Errorf("could not open storage directory, %v", err)
+    }
+    defer dir.Close()
+
+    owners := make(map[string]quotaFile)
+    for {
+        stats, err := dir.Readdir(scanBatch)
+        for _, stat := range stats {
+            if !isStoredFile(stat, q.markers) {
+                continue
+            }
+
+            meta, metaErr := q.meta.load(stat.Name())
+            if metaErr != nil {
+                log.Print(metaErr)
+                continue
+            }
+            if meta == nil || meta.Uploader == "" {
+                continue
+            }
+
+            owners[stat.Name()] = quotaFile{uploader: meta.Uploader, size: stat.Size()}
+        }
+
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("could not list stored files, %v", err)
+        }
+    }
+
+    totals := make(map[string]int64)
+    for _, file := range owners {
+        totals[file.uploader] += file.size
+    }
+    stored := newLRUTable(q.maxTracked, nil)
+    now := q.clock.Now()
+    for uploader, total := range totals {
+        stored.put(uploader, total, now)
+    }
+
+    q.Lock()
+    defer q.Unlock()
+
+    q.owners = owners
+    q.stored = stored
+    return nil
+}
+
+// rescanPeriodically will keep counting the stored files again.
+func (q *quotaTracker) rescanPeriodically() {
+    for range q.clock.Tick(quotaRescanInterval) {
+        if err := q.rescan(); err != nil {
+            log.Print(err)
+        }
+    }
+}
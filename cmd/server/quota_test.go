@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+    s := newTestServer(t)
+    s.quota = newQuotaTracker(100, s.meta, false, 0, realClock{})
+    addr := serveTest(t, s)
+    data := strings.Repeat("x", 60)
+
+    first := mustUpload(t, addr, "a.txt", data)
+
+    // The declared size is refused up front, the undeclared one as it's
+    // received.
+    if first, _ := upload(t, addr, "b.txt", data, "Size: 60"); first.Error == "" {
+        t.Fatal("the declared upload over the quota was accepted")
+    }
+    mustUploadFails(t, addr, "c.txt", data)
+    assertFiles(t, first)
+
+    if err := s.quota.check("10.0.0.2", 100); err != nil {
+        t.Fatalf("another uploader is limited too, %v", err)
+    }
+
+    // Deleting the file frees its part of the quota.
+    if err := os.Remove(first); err != nil {
+        t.Fatal(err)
+    }
+    s.quota.remove(first)
+    mustUpload(t, addr, "d.txt", data)
+
+    // The files are counted again from their metadata.
+    if err := s.quota.rescan(); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.quota.check("127.0.0.1", 60); err == nil {
+        t.Fatal("the rescan forgot the stored file")
+    }
+    if err := s.quota.check("127.0.0.1", 40); err != nil {
+        t.Fatalf("the rescan counted the deleted file, %v", err)
+    }
+}
+
+func TestQuotaHeld(t *testing.T) {
+    s := newTestServer(t)
+    s.quota = newQuotaTracker(100, s.meta, false, 0, realClock{})
+    var err error
+    s.holds, err = newHoldStore(holdDir, time.Hour, realClock{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTest(t, s)
+    data := strings.Repeat("x", 60)
+
+    // Both fit while held, only one once approved.
+    a, _ := upload(t, addr, "a.txt", data)
+    b, _ := upload(t, addr, "b.txt", data)
+    if resp := decide(t, addr, opApprove, a.Token); resp.Error != "" {
+        t.Fatalf("the approval within the quota got %+v", resp)
+    }
+    resp := decide(t, addr, opApprove, b.Token)
+    if !strings.Contains(resp.Error, "quota exceeded") {
+        t.Fatalf("the approval over the quota got %+v, want it refused", resp)
+    }
+    if name, err := s.holds.find(b.Token); err != nil || name != "b.txt" {
+        t.Fatalf("the upload refused approval is %q, %v, want b.txt still held", name, err)
+    }
+    assertFiles(t, "a.txt")
+
+    // The approved file is counted from its metadata too.
+    if err := s.quota.rescan(); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.quota.check("127.0.0.1", 60); err == nil {
+        t.Fatal("the rescan forgot the approved file")
+    }
+
+    // Once room is made, it can be approved.
+    if err := os.Remove("a.txt"); err != nil {
+        t.Fatal(err)
+    }
+    s.quota.remove("a.txt")
+    if resp := decide(t, addr, opApprove, b.Token); resp.Error != "" {
+        t.Fatalf("the approval once room was made got %+v", resp)
+    }
+    assertFiles(t, "b.txt")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the aggregate rate of all the
+// transfers sharing it. A second worth of bytes may pass in a burst.
+type rateLimiter struct {
+    rate   float64
+    tokens float64
+    last   time.Time
+    clock  Clock
+    sync.Mutex
+}
+
+// newRateLimiter will create a limiter letting through bytesPerSec bytes per
+// second.
+func newRateLimiter(bytesPerSec int64, clock Clock) *rateLimiter {
+    return &rateLimiter{
+        rate:   float64(bytesPerSec),
+        tokens: float64(bytesPerSec),
+        last:   clock.Now(),
+        clock:  clock,
+    }
+}
+
+// wait blocks until n more bytes may pass. The bytes are taken from the
+// bucket right away, possibly leaving it in debt, so that the concurrent
+// callers queue up behind each other instead of all waking up at once.
+func (l *rateLimiter) wait(n int) {
+    l.Lock()
+    now := l.clock.Now()
+    l.tokens += now.Sub(l.last).Seconds() * l.rate
+    if l.tokens > l.rate {
+        l.tokens = l.rate
+    }
+    l.last = now
+
+    l.tokens -= float64(n)
+    debt := -l.tokens
+    l.Unlock()
+
+    if debt > 0 {
+        sleep(l.clock, time.Duration(debt / l.rate * float64(time.Second)))
+    }
+}
+
+// limitedWriter passes the writes through the limiter.
+type limitedWriter struct {
+    w       io.Writer
+    limiter *rateLimiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+    w.limiter.wait(len(p))
+    return w.w.Write(p)
+}
+
+// limitedReader passes the reads through the limiter.
+type limitedReader struct {
+    r       io.Reader
+    limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+    n, err := r.r.Read(p)
+    if n > 0 {
+        r.limiter.wait(n)
+    }
+    return n, err
+}
+
+// idleLimiterTimeout is how long the limiter of the pool is kept once the
+// last transfer sharing it is done. It outlives the transfers, so that the
+// client can't get a fresh burst by reconnecting.
+const idleLimiterTimeout = time.Minute
+
+// limiterPool hands out a rate limiter per key, shared by all the transfers
+// with the key in progress, e.g. the uploads with the same credentials. The
+// limiters in use are never evicted, the table of the limiters holds at most
+// its max of the idle ones besides.
+type limiterPool struct {
+    rate  int64
+    clock Clock
+
+    limiters  *lruTable
+    lastSweep time.Time
+    sync.Mutex
+}
+
+type pooledLimiter struct {
+    *rateLimiter
+
+    // active is the number of the transfers using the limiter.
+    active int
+}
+
+func isLimiterActive(value interface{}) bool {
+    return value.(*pooledLimiter).active > 0
+}
+
+// newLimiterPool will create a pool whose limiters let through bytesPerSec
+// bytes per second each, keeping at most maxIdle idle limiters.
+func newLimiterPool(bytesPerSec int64, maxIdle int, clock Clock) *limiterPool {
+    return &limiterPool{
+        rate:      bytesPerSec,
+        clock:     clock,
+        limiters:  newLRUTable(maxIdle, isLimiterActive),
+        lastSweep: clock.Now(),
+    }
+}
+
+// sweep removes the limiters idle for longer than the timeout.
+func (p *limiterPool) sweep() {
+    p.Lock()
+    defer p.Unlock()
+
+    p.sweepLocked(p.clock.Now())
+}
+
+func (p *limiterPool) sweepLocked(now time.Time) {
+    // The limiters are used last when they are released, so the idle ones
+    // are found in the order they went idle.
+    p.limiters.removeIdle(idleLimiterTimeout, now)
+    p.lastSweep = now
+}
+
+// acquire returns the limiter of the key, to be released once the transfer
+// is done.
+func (p *limiterPool) acquire(key string) *rateLimiter {
+    p.Lock()
+    defer p.Unlock()
+
+    now := p.clock.Now()
+    if now.Sub(p.lastSweep) > idleLimiterTimeout {
+        p.sweepLocked(now)
+    }
+
+    var l *pooledLimiter
+    if value, ok := p.limiters.get(key, now); ok {
+        l = value.(*pooledLimiter)
+    } else {
+        l = &pooledLimiter{rateLimiter: newRateLimiter(p.rate, p.clock)}
+    }
+    l.active++
+    p.limiters.put(key, l, now)
+    return l.rateLimiter
+}
+
+// release tells that a transfer using the limiter of the key is done.
+func (p *limiterPool) release(key string) {
+    p.Lock()
+    defer p.Unlock()
+
+    // The limiter goes idle from now on.
+    value, _ := p.limiters.get(key, p.clock.Now())
+    value.(*pooledLimiter).active--
+}
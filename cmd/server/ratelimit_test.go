@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskRate(t *testing.T) {
+    const rate, uploads, size = 20000, 3, 10000
+
+    s := newTestServer(t)
+    s.diskLimiter = newRateLimiter(rate, realClock{})
+    addr := serveTest(t, s)
+
+    start := time.Now()
+    var wg sync.WaitGroup
+    for i := 0; i < uploads; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := tryUpload(addr, "file.bin", strings.Repeat("x", size)); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+
+    // A second worth of the bytes passes in a burst, the rest at the rate.
+    elapsed := time.Since(start)
+    least := time.Duration(float64(uploads * size - rate) / rate * float64(time.Second))
+    if elapsed < least * 8 / 10 {
+        t.Fatalf("wrote %d bytes in %v, want at least %v at %d bytes per second",
+                 uploads * size, elapsed, least, rate)
+    }
+}
+
+func TestTokenRate(t *testing.T) {
+    const rate, size = 20000, 20000
+
+    s := newTestServer(t)
+    s.auth = newAuthenticator([]byte("secret"), realClock{})
+    s.tokenLimiters = newLimiterPool(rate, 0, realClock{})
+    addr := serveTest(t, s)
+
+    start := time.Now()
+    var wg sync.WaitGroup
+    for i := 0; i < 2; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := tryUpload(addr, "file.bin", strings.Repeat("x", size), "Auth: secret"); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+
+    // The transfers share the bucket of the token, a second worth of the
+    // bytes passes in a burst, the rest at the rate.
+    elapsed := time.Since(start)
+    least := time.Duration(float64(2 * size - rate) / rate * float64(time.Second))
+    if elapsed < least * 8 / 10 {
+        t.Fatalf("received %d bytes under one token in %v, want at least %v at %d bytes per second",
+                 2 * size, elapsed, least, rate)
+    }
+}
+
+func TestLimiterPoolSweep(t *testing.T) {
+    clock := newFakeClock()
+    p := newLimiterPool(1000, 0, clock)
+
+    first := p.acquire("token")
+    if p.acquire("token") != first {
+        t.Fatal("the transfers under one token got limiters of their own")
+    }
+    p.release("token")
+    p.release("token")
+
+    // The active limiters are kept, the idle ones only for a while.
+    active := p.acquire("active")
+    clock.Advance(2 * idleLimiterTimeout)
+    p.sweep()
+    if n := p.limiters.len(); n != 1 {
+        t.Fatalf("%d limiters are left once swept, want the active one", n)
+    }
+    if p.acquire("active") != active {
+        t.Fatal("the active limiter was swept")
+    }
+    if p.acquire("token") == first {
+        t.Fatal("the idle limiter was kept")
+    }
+}
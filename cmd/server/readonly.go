@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// readOnlyCheckInterval is how often the storage that turned read-only is
+// checked for being writable again.
+const readOnlyCheckInterval = 10 * time.Second
+
+// readOnlyGuard refuses the uploads once the storage turned out read-only,
+// e.g. after the filesystem was remounted so because of an error, rather than
+// receiving every file only to fail to store it. The storage is checked for
+// being writable again meanwhile, and the uploads accepted once it is.
+type readOnlyGuard struct {
+    // probe tells whether the storage can be written to.
+    probe func() error
+
+    clock Clock
+
+    readOnly bool
+    sync.Mutex
+}
+
+func newReadOnlyGuard(clock Clock) *readOnlyGuard {
+    return &readOnlyGuard{probe: probeWritable, clock: clock}
+}
+
+// probeWritable creates and removes a file in the directory of the server.
+func probeWritable() error {
+    file, err := ioutil.TempFile(dataDir, "probe")
+    if err != nil {
+        return err
+    }
+
+    file.Close()
+    return os.Remove(file.Name())
+}
+
+// isReadOnlyError tells whether the error is one of the read-only storage.
+func isReadOnlyError(err error) bool {
+    var se *storageError
+    return errors.As(err, &se) && errors.Is(se.cause, syscall.EROFS)
+}
+
+// note takes the failure of the storage into account, refusing the uploads
+// if it tells the storage is read-only.
+func (g *readOnlyGuard) note(err error) {
+    if !isReadOnlyError(err) {
+        return
+    }
+
+    g.Lock()
+    defer g.Unlock()
+
+    if g.readOnly {
+        return
+    }
+    g.readOnly = true
+
+    log.Printf("warning: the storage is read-only, refusing the uploads until it's writable again")
+    go g.waitWritable()
+}
+
+// waitWritable checks the storage until it's writable again.
+func (g *readOnlyGuard) waitWritable() {
+    ticker := g.clock.NewTicker(readOnlyCheckInterval)
+    defer ticker.Stop()
+
+    for range ticker.C() {
+        err := g.probe()
+        if err != nil {
+            if !errors.Is(err, syscall.EROFS) {
+                log.Printf("could not check whether the storage is writable, %v", err)
+            }
+            continue
+        }
+
+        g.Lock()
+        g.readOnly = false
+        g.Unlock()
+
+        log.Printf("the storage is writable again, accepting the uploads")
+        return
+    }
+}
+
+// check refuses the upload while the storage is read-only, as an error of
+// the unavailable storage so that the client may try again later.
+func (g *readOnlyGuard) check() error {
+    g.Lock()
+    defer g.Unlock()
+
+    if !g.readOnly {
+        return nil
+    }
+
+    err := fmt.Errorf("the storage is read-only, the server can't store any files for now")
+    return &storageError{kind: ErrBackendUnavailable, err: err, cause: syscall.EROFS}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+    clock := newFakeClock()
+    s := newTestServer(t)
+    s.readOnly = newReadOnlyGuard(clock)
+    var mu sync.Mutex
+    probeErr := error(syscall.EROFS)
+    s.readOnly.probe = func() error {
+        mu.Lock()
+        defer mu.Unlock()
+        return probeErr
+    }
+    addr := serveTest(t, s)
+
+    // The file failed to be created as the storage was remounted read-only.
+    cause := &os.PathError{Op: "open", Path: "a.txt.part", Err: syscall.EROFS}
+    s.readOnly.note(newStorageError(cause, fmt.Errorf("could not create file, %v", cause)))
+
+    first, status := upload(t, addr, "a.txt", "data")
+    if status != nil || !strings.Contains(first.Error, "read-only") || first.Kind != "unavailable" {
+        t.Fatalf("the upload was refused with %+v, want the storage told read-only", first)
+    }
+
+    // Still read-only at the next check.
+    clock.waitPending(t, 1)
+    clock.Advance(readOnlyCheckInterval)
+    if first, _ := upload(t, addr, "a.txt", "data"); first.Error == "" {
+        t.Fatal("the upload was accepted while the storage is still read-only")
+    }
+
+    mu.Lock()
+    probeErr = nil
+    mu.Unlock()
+    clock.Advance(readOnlyCheckInterval)
+    for deadline := time.Now().Add(5 * time.Second); s.readOnly.check() != nil; {
+        if time.Now().After(deadline) {
+            t.Fatal("the storage writable again still refuses the uploads")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    mustUpload(t, addr, "a.txt", "data")
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"compress/zlib"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The recompressor compresses the stored files that weren't kept compressed,
+// e.g. those uploaded over HTTP, in the background, for the HTTP downloads.
+// The compressed data is kept in compressedDir next to the data kept with
+// -keep-compressed, by the checksum of the file, so the same contents are
+// compressed once, and sent to the clients accepting its content coding. The
+// stored files themselves are left as they are, everything else reads them.
+
+const (
+    // defaultRecompressInterval is how long the recompressor waits between
+    // the passes over the stored files.
+    defaultRecompressInterval = time.Hour
+
+    // defaultRecompressRate is the rate the recompressor reads the files at
+    // by default, in bytes per second, to leave the disk to the transfers.
+    defaultRecompressRate = 8 << 20
+
+    // defaultRecompressMinSize is the size of the smallest file recompressed,
+    // the smaller ones saving too little to be worth it.
+    defaultRecompressMinSize = 4096
+
+    // recompressIdleWait is how long the recompressor waits for the
+    // transfers in progress to end before it goes on with the next file.
+    recompressIdleWait = time.Second
+
+    // recompressMinSaving is the part of the size the compressed data must
+    // save to be kept, otherwise it's only noted in the metadata that the
+    // file doesn't compress.
+    recompressMinSaving = 0.1
+)
+
+// recompressPath is the path the recompressor is told about, paused and
+// resumed at, next to the metrics.
+const recompressPath = "/debug/recompress"
+
+var (
+    recompressedFiles      = expvar.NewInt("recompressed_files")
+    recompressedSavedBytes = expvar.NewInt("recompressed_saved_bytes")
+)
+
+// codec compresses the stored files for the recompressor.
+type codec interface {
+    // name is the content coding of the data, as HTTP calls it.
+    name() string
+
+    // ext is appended to the checksum of the file for the name of its
+    // compressed data.
+    ext() string
+
+    newWriter(w io.Writer) (io.WriteCloser, error)
+    newReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// deflateCodec compresses the files as zlib streams, like the data kept with
+// -keep-compressed, which it shares its files with.
+type deflateCodec struct{}
+
+func (deflateCodec) name() string {
+    return "deflate"
+}
+
+func (deflateCodec) ext() string {
+    return ""
+}
+
+func (deflateCodec) newWriter(w io.Writer) (io.WriteCloser, error) {
+    return zlib.NewWriterLevel(w, zlib.BestCompression)
+}
+
+func (deflateCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+    return zlib.NewReader(r)
+}
+
+// codecs are the codecs the recompressor can compress the files with.
+var codecs = map[string]codec{
+    "deflate": deflateCodec{},
+}
+
+// parseCodec returns the codec of the name.
+func parseCodec(name string) (codec, error) {
+    c, ok := codecs[name]
+    if !ok {
+        return nil, fmt.Errorf("unknown codec %q, want deflate", name)
+    }
+
+    return c, nil
+}
+
+// encodedPath returns the path of the compressed data of the contents.
+func encodedPath(c codec, sum string) string {
+    return filepath.Join(compressedDir, sum + c.ext())
+}
+
+// recompressor goes through the stored files now and then, compressing those
+// with no compressed data yet. Its reads are limited by the rate limiter, a
+// file at a time, and it waits while the server is receiving files, so that
+// it only runs when the server is idle otherwise. It can be paused.
+type recompressor struct {
+    codec    codec
+    meta     *metaStore
+    minSize  int64
+    interval time.Duration
+    clock    Clock
+    markers  bool
+
+    // limiter, if not nil, limits the rate at which the files are read.
+    limiter *rateLimiter
+
+    // busy tells whether the server is receiving files.
+    busy func() bool
+
+    paused  bool
+    resumed chan struct{}
+    sync.Mutex
+}
+
+func newRecompressor(c codec, meta *metaStore, markers bool, minSize int64,
+                     interval time.Duration, limiter *rateLimiter, busy func() bool,
+                     clock Clock) *recompressor {
+    return &recompressor{
+        codec:    c,
+        meta:     meta,
+        markers:  markers,
+        minSize:  minSize,
+        interval: interval,
+        clock:    clock,
+        limiter:  limiter,
+        busy:     busy,
+    }
+}
+
+// pause stops the recompressor before the next file, until resumed.
+func (rc *recompressor) pause() {
+    rc.Lock()
+    defer rc.Unlock()
+
+    if !rc.paused {
+        rc.paused = true
+        rc.resumed = make(chan struct{})
+    }
+}
+
+func (rc *recompressor) resume() {
+    rc.Lock()
+    defer rc.Unlock()
+
+    if rc.paused {
+        rc.paused = false
+        close(rc.resumed)
+    }
+}
+
+func (rc *recompressor) isPaused() bool {
+    rc.Lock()
+    defer rc.Unlock()
+
+    return rc.paused
+}
+
+// waitTurn blocks while the recompressor is paused or the server is
+// receiving files.
+func (rc *recompressor) waitTurn() {
+    for {
+        rc.Lock()
+        paused, resumed := rc.paused, rc.resumed
+        rc.Unlock()
+
+        switch {
+        case paused:
+            <-resumed
+        case rc.busy != nil && rc.busy():
+            sleep(rc.clock, recompressIdleWait)
+        default:
+            return
+        }
+    }
+}
+
+// run will keep recompressing the stored files, a pass every interval.
+func (rc *recompressor) run() {
+    for {
+        n, saved, err := rc.pass()
+        if err != nil {
+            log.Print(err)
+        }
+        if n > 0 {
+            log.Printf("recompressed %d files with %s, saving %d bytes", n, rc.codec.name(), saved)
+        }
+
+        sleep(rc.clock, rc.interval)
+    }
+}
+
+// pass recompresses the stored files that weren't yet, telling how many it
+// did and the bytes it saved.
+func (rc *recompressor) pass() (int, int64, error) {
+    count, saved := 0, int64(0)
+    err := eachStoredFile("", rc.markers, func(stat os.FileInfo) error {
+        if stat.Size() < rc.minSize {
+            return nil
+        }
+        rc.waitTurn()
+
+        n, err := rc.recompress(stat)
+        if err != nil {
+            log.Print(err)
+            return nil
+        }
+        if n > 0 {
+            count++
+            saved += stat.Size() - n
+        }
+        return nil
+    })
+
+    return count, saved, err
+}
+
+// recompress compresses the stored file, unless its contents are compressed
+// already or are known not to compress, and tells the size of the compressed
+// data, if it's kept.
+func (rc *recompressor) recompress(stat os.FileInfo) (int64, error) {
+    meta, err := rc.meta.checksums(stat)
+    if err != nil {
+        return 0, err
+    }
+    if meta.Recompressed == rc.codec.name() {
+        return 0, nil
+    }
+    path := encodedPath(rc.codec, meta.SHA256)
+    if _, err := os.Stat(path); err == nil {
+        return 0, nil
+    }
+
+    size, err := rc.encode(stat.Name(), path, stat.Size())
+    if err != nil {
+        return 0, fmt.Errorf("could not recompress %q, %v", stat.Name(), err)
+    }
+
+    // The file may have changed meanwhile, then the metadata is not fresh
+    // and is recomputed the next time.
+    meta.Recompressed, meta.RecompressedSize = rc.codec.name(), size
+    if err := rc.meta.save(stat.Name(), meta); err != nil {
+        log.Print(err)
+    }
+
+    if size > 0 {
+        recompressedFiles.Add(1)
+        recompressedSavedBytes.Add(stat.Size() - size)
+    }
+    return size, nil
+}
+
+// encode compresses the file into the path, keeping the data only if it saves
+// enough, and returns its size, or zero if it wasn't kept.
+func (rc *recompressor) encode(name, path string, size int64) (int64, error) {
+    src, err := os.Open(name)
+    if err != nil {
+        return 0, err
+    }
+    defer src.Close()
+
+    if err := os.MkdirAll(compressedDir, 0777); err != nil {
+        return 0, err
+    }
+    temp, err := ioutil.TempFile(compressedDir, "*" + partSuffix)
+    if err != nil {
+        return 0, err
+    }
+    defer os.Remove(temp.Name())
+    defer temp.Close()
+
+    zw, err := rc.codec.newWriter(temp)
+    if err != nil {
+        return 0, err
+    }
+
+    var r io.Reader = src
+    if rc.limiter != nil {
+        r = &limitedReader{r: src, limiter: rc.limiter}
+    }
+    if _, err := io.Copy(zw, r); err != nil {
+        return 0, err
+    }
+    if err := zw.Close(); err != nil {
+        return 0, err
+    }
+
+    stat, err := temp.Stat()
+    if err != nil {
+        return 0, err
+    }
+    if float64(stat.Size()) > float64(size) * (1 - recompressMinSaving) {
+        return 0, nil
+    }
+
+    if err := temp.Sync(); err != nil {
+        return 0, err
+    }
+    if err := temp.Close(); err != nil {
+        return 0, err
+    }
+    if err := os.Rename(temp.Name(), path); err != nil {
+        return 0, err
+    }
+
+    return stat.Size(), nil
+}
+
+// recompressString formats the settings of the recompressor for the logs.
+func (s *Server) recompressString() string {
+    rc := s.recompressor
+    if rc == nil {
+        return "none"
+    }
+
+    rate := int64(0)
+    if rc.limiter != nil {
+        rate = int64(rc.limiter.rate)
+    }
+    return fmt.Sprintf("%s,rate=%s,min-size=%d,interval=%s", rc.codec.name(), limitString(rate),
+                       rc.minSize, durationString(rc.interval))
+}
+
+// downloadCodec returns the codec of the compressed data served to the HTTP
+// clients accepting it, nil if there's none.
+func (s *Server) downloadCodec() codec {
+    switch {
+    case s.recompressor != nil:
+        return s.recompressor.codec
+    case s.KeepCompressed:
+        return deflateCodec{}
+    }
+
+    return nil
+}
+
+// recompressState is what the recompressor is told about.
+type recompressState struct {
+    Codec  string `json:"codec"`
+    Paused bool   `json:"paused"`
+}
+
+// serveRecompress tells about the recompressor, pausing it on POST with
+// ?pause and resuming it with ?resume.
+func (s *Server) serveRecompress(w http.ResponseWriter, r *http.Request) {
+    rc := s.recompressor
+    if rc == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet, http.MethodHead:
+    case http.MethodPost:
+        query := r.URL.Query()
+        _, pause := query["pause"]
+        _, resume := query["resume"]
+        switch {
+        case pause && !resume:
+            rc.pause()
+            log.Print("the recompressor is paused")
+        case resume && !pause:
+            rc.resume()
+            log.Print("the recompressor is resumed")
+        default:
+            http.Error(w, "either ?pause or ?resume is needed", http.StatusBadRequest)
+            return
+        }
+    default:
+        w.Header().Set("Allow", "GET, HEAD, POST")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(&recompressState{Codec: rc.codec.name(), Paused: rc.isPaused()})
+}
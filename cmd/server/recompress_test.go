@@ -0,0 +1,172 @@
+package main
+
+import (
+	"compress/zlib"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRecompressor(s *Server) *recompressor {
+    rc := newRecompressor(deflateCodec{}, s.meta, false, 16, time.Hour, nil, s.transfers.busy, realClock{})
+    s.recompressor = rc
+    return rc
+}
+
+func download(s *Server, name, encoding string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(http.MethodGet, filesPath + name, nil)
+    if encoding != "" {
+        r.Header.Set("Accept-Encoding", encoding)
+    }
+    w := httptest.NewRecorder()
+    s.sendFile(w, r)
+    return w
+}
+
+func TestRecompressPass(t *testing.T) {
+    s := newTestServer(t)
+    rc := newTestRecompressor(s)
+
+    data := strings.Repeat("compresses well ", 1000)
+    writeFile(t, "text.txt", data)
+    writeFile(t, "small.txt", "tiny")
+
+    n, saved, err := rc.pass()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n != 1 || saved <= 0 {
+        t.Fatalf("pass recompressed %d files saving %d bytes, want 1 and some", n, saved)
+    }
+    if got := readFile(t, "text.txt"); got != data {
+        t.Fatal("the stored file was changed")
+    }
+
+    // The next pass finds it done.
+    if n, _, err := rc.pass(); err != nil || n != 0 {
+        t.Fatalf("the second pass recompressed %d files, %v, want none", n, err)
+    }
+
+    w := download(s, "text.txt", "gzip, deflate")
+    if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "deflate" {
+        t.Fatalf("got %d with the encoding %q, want 200 deflate", w.Code, w.Header().Get("Content-Encoding"))
+    }
+    zr, err := zlib.NewReader(w.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    decoded, err := ioutil.ReadAll(zr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(decoded) != data {
+        t.Fatal("the compressed data doesn't decode to the file")
+    }
+
+    w = download(s, "text.txt", "")
+    if w.Header().Get("Content-Encoding") != "" || w.Body.String() != data {
+        t.Fatal("the client not accepting deflate didn't get the file as it is")
+    }
+    if w := download(s, "text.txt", "deflate;q=0"); w.Body.String() != data {
+        t.Fatal("the client refusing deflate didn't get the file as it is")
+    }
+}
+
+func TestRecompressSkipsIncompressible(t *testing.T) {
+    s := newTestServer(t)
+    rc := newTestRecompressor(s)
+
+    random := make([]byte, 8192)
+    if _, err := rand.Read(random); err != nil {
+        t.Fatal(err)
+    }
+    writeFile(t, "random.bin", string(random))
+
+    if n, _, err := rc.pass(); err != nil || n != 0 {
+        t.Fatalf("recompressed %d files, %v, want none", n, err)
+    }
+    if w := download(s, "random.bin", "deflate"); w.Header().Get("Content-Encoding") != "" {
+        t.Fatal("served compressed data that wasn't kept")
+    }
+}
+
+func TestRecompressPause(t *testing.T) {
+    s := newTestServer(t)
+    rc := newTestRecompressor(s)
+    writeFile(t, "text.txt", strings.Repeat("compresses well ", 100))
+
+    post := func(query string) int {
+        w := httptest.NewRecorder()
+        s.serveRecompress(w, httptest.NewRequest(http.MethodPost, recompressPath + "?" + query, nil))
+        return w.Code
+    }
+
+    if code := post("pause"); code != http.StatusOK || !rc.isPaused() {
+        t.Fatalf("got %d, paused %t, want 200 and paused", code, rc.isPaused())
+    }
+
+    done := make(chan int)
+    go func() {
+        n, _, _ := rc.pass()
+        done <- n
+    }()
+    select {
+    case <-done:
+        t.Fatal("the paused recompressor made a pass")
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    if code := post("resume"); code != http.StatusOK || rc.isPaused() {
+        t.Fatalf("got %d, paused %t, want 200 and resumed", code, rc.isPaused())
+    }
+    select {
+    case n := <-done:
+        if n != 1 {
+            t.Fatalf("the resumed pass recompressed %d files, want 1", n)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("the resumed recompressor is still waiting")
+    }
+
+    if code := post(""); code != http.StatusBadRequest {
+        t.Fatalf("got %d with neither ?pause nor ?resume, want 400", code)
+    }
+}
+
+func TestRecompressWaitsForTransfers(t *testing.T) {
+    s := newTestServer(t)
+    clock := newFakeClock()
+    busy := true
+    var rc *recompressor
+    rc = newRecompressor(deflateCodec{}, s.meta, false, 16, time.Hour, nil, func() bool {
+        rc.Lock()
+        defer rc.Unlock()
+        return busy
+    }, clock)
+    writeFile(t, "text.txt", strings.Repeat("compresses well ", 100))
+
+    done := make(chan int)
+    go func() {
+        n, _, _ := rc.pass()
+        done <- n
+    }()
+
+    clock.waitPending(t, 1)
+    rc.Lock()
+    busy = false
+    rc.Unlock()
+    clock.Advance(recompressIdleWait)
+
+    select {
+    case n := <-done:
+        if n != 1 {
+            t.Fatalf("recompressed %d files, want 1", n)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("the recompressor is still waiting once idle")
+    }
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// The index can be rebuilt from the storage directory while the server runs,
+// e.g. once files were added to or removed from it behind the back of the
+// server, so that the copy numbers match the directory again. The index is
+// rebuilt in place: the in-flight uploads keep using it all along, and the
+// new contents still have every name given out meanwhile. The guarantee is
+// that no name is ever given out twice, whether reserved before the reload
+// or during it; the names of the files removed behind the back of the server
+// are only forgotten if nothing took them since the reload started.
+//
+// Alternatively, the new uploads can simply be refused while the index is
+// rebuilt, as unavailable for the clients to try again shortly. The uploads
+// already in progress still go on.
+
+// Reload rebuilds the index from the directory, with the occupied filenames
+// taken as well, like the held uploads. The directory is read without
+// holding the lock, the names resolved to in the meantime are remembered and
+// carried over along with the reservations.
+func (fi *FileIndex) Reload(dir *os.File, occupied []string) error {
+    fi.Lock()
+    fi.added = make(map[string]struct{})
+    fi.Unlock()
+
+    fresh, err := NewFileIndexFromDir(dir)
+    if err == nil {
+        fresh.occupy(occupied)
+    }
+
+    fi.Lock()
+    defer fi.Unlock()
+
+    added := fi.added
+    fi.added = nil
+    if err != nil {
+        return err
+    }
+
+    carried := make([]string, 0, len(added) + 2 * len(fi.reserved))
+    for filename := range added {
+        carried = append(carried, filename)
+    }
+    for resolved, r := range fi.reserved {
+        carried = append(carried, resolved, r.filename)
+    }
+
+    for _, filename := range carried {
+        copyNum, exists := fi.index[filename]
+        if !exists {
+            continue
+        }
+        if current, taken := fresh.index[filename]; !taken || current < copyNum {
+            fresh.index[filename] = copyNum
+        }
+    }
+
+    fi.index = fresh.index
+    return nil
+}
+
+// reloadIndexOnSignal will rebuild the index every time SIGHUP is received.
+func (s *Server) reloadIndexOnSignal() {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+
+    for range hup {
+        if err := s.reloadIndex(); err != nil {
+            log.Print(err)
+            continue
+        }
+
+        log.Printf("reloaded the index, indexed-files=%d", s.index.Len())
+    }
+}
+
+// reloadIndex rebuilds the index from the storage directory, refusing the new
+// uploads meanwhile if asked to.
+func (s *Server) reloadIndex() error {
+    var held []string
+    if s.holds != nil {
+        var err error
+        held, err = s.holds.names()
+        if err != nil {
+            return fmt.Errorf("could not reload the index, %v", err)
+        }
+    }
+
+    dir, err := os.Open(".")
+    if err != nil {
+        return fmt.Errorf("could not reload the index, %v", err)
+    }
+    defer dir.Close()
+
+    if s.RejectDuringReload {
+        atomic.StoreInt32(&s.reloading, 1)
+        defer atomic.StoreInt32(&s.reloading, 0)
+    }
+    if err := s.index.Reload(dir, held); err != nil {
+        return fmt.Errorf("could not reload the index, %v", err)
+    }
+
+    return nil
+}
+
+// checkReloading refuses the upload while the index is being rebuilt, as an
+// error of the unavailable storage so that the client may try again.
+func (s *Server) checkReloading() error {
+    if atomic.LoadInt32(&s.reloading) == 0 {
+        return nil
+    }
+
+    err := fmt.Errorf("the index is being rebuilt, try again in a moment")
+    return &storageError{kind: ErrBackendUnavailable, err: err}
+}
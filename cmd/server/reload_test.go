@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadDuringUploads(t *testing.T) {
+    const uploads = 40
+
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+
+    done := make(chan struct{})
+    reloaded := make(chan int)
+    go func() {
+        n := 0
+        defer func() { reloaded <- n }()
+        for {
+            select {
+            case <-done:
+                return
+            default:
+            }
+
+            dir, err := os.Open(".")
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            if err := s.index.Reload(dir, nil); err != nil {
+                t.Error(err)
+            }
+            dir.Close()
+            n++
+
+            // Left to spin, the reloads starve the uploads on a single CPU.
+            time.Sleep(time.Millisecond)
+        }
+    }()
+
+    names := make(chan [2]string, uploads)
+    var wg sync.WaitGroup
+    for i := 0; i < uploads; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            data := fmt.Sprintf("upload %d", i)
+            name, err := tryUpload(addr, "a.txt", data)
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            names <- [2]string{name, data}
+        }(i)
+    }
+    wg.Wait()
+    close(done)
+    close(names)
+    if n := <-reloaded; n == 0 {
+        t.Fatal("the index was never reloaded")
+    }
+
+    // Every upload got a name of its own and kept its contents.
+    seen := make(map[string]bool)
+    for upload := range names {
+        if seen[upload[0]] {
+            t.Errorf("%s was given out twice", upload[0])
+        }
+        seen[upload[0]] = true
+        if got := readFile(t, upload[0]); got != upload[1] {
+            t.Errorf("%s holds %q, want %q", upload[0], got, upload[1])
+        }
+    }
+    if n := len(listFiles(t)); n != uploads {
+        t.Fatalf("stored %d files, want %d", n, uploads)
+    }
+}
+
+func TestRejectDuringReload(t *testing.T) {
+    s := newTestServer(t)
+    s.RejectDuringReload = true
+    addr := serveTest(t, s)
+
+    // The rebuild is in progress.
+    atomic.StoreInt32(&s.reloading, 1)
+    first, status := upload(t, addr, "a.txt", "data")
+    if status != nil || first.Kind != "unavailable" || !strings.Contains(first.Error, "try again") {
+        t.Fatalf("got %+v for the upload during the rebuild, want it refused as unavailable", first)
+    }
+    atomic.StoreInt32(&s.reloading, 0)
+
+    writeFile(t, "a.txt", "behind the back")
+    if err := s.reloadIndex(); err != nil {
+        t.Fatal(err)
+    }
+    if atomic.LoadInt32(&s.reloading) != 0 {
+        t.Fatal("the uploads are still refused once the index is rebuilt")
+    }
+    if stored := mustUpload(t, addr, "a.txt", "data"); stored != "a_copy1.txt" {
+        t.Fatalf("the upload after the rebuild was stored as %s, want a_copy1.txt", stored)
+    }
+}
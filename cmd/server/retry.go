@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// maxReadRetries is how many times in a row a read failing with a transient
+// error is retried before the error is taken for what it is.
+const maxReadRetries = 5
+
+// readRetryDelay is how long the first retry waits, every next one waits
+// that much longer.
+const readRetryDelay = 10 * time.Millisecond
+
+// retryReader retries the reads failing with the transient errors, like
+// EINTR, so that they don't abort the transfer.
+type retryReader struct {
+    r       io.Reader
+    retries int
+}
+
+func (rr *retryReader) Read(p []byte) (int, error) {
+    for {
+        n, err := rr.r.Read(p)
+        if err == nil || !isTransient(err) {
+            if n > 0 {
+                rr.retries = 0
+            }
+            return n, err
+        }
+
+        // The data read is not lost, the error comes up again if it lasts.
+        if n > 0 {
+            rr.retries = 0
+            return n, nil
+        }
+
+        if rr.retries >= maxReadRetries {
+            return 0, err
+        }
+        rr.retries++
+        time.Sleep(time.Duration(rr.retries) * readRetryDelay)
+    }
+}
+
+// isTransient tells whether the read failing with err may succeed if tried
+// again. The timeouts are not transient, the deadlines are set on purpose.
+func isTransient(err error) bool {
+    if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+        return true
+    }
+
+    var netErr net.Error
+    return errors.As(err, &netErr) && netErr.Temporary() && !netErr.Timeout()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// flakyReader fails the reads with the error, the given number of times,
+// after every chunk of the data.
+type flakyReader struct {
+    r        io.Reader
+    err      error
+    failures int
+    failed   int
+    chunk    int
+}
+
+func (fr *flakyReader) Read(p []byte) (int, error) {
+    if fr.failed < fr.failures {
+        fr.failed++
+        return 0, fr.err
+    }
+
+    fr.failed = 0
+    if len(p) > fr.chunk {
+        p = p[:fr.chunk]
+    }
+    return fr.r.Read(p)
+}
+
+func TestRetryReader(t *testing.T) {
+    data := strings.Repeat("retried ", 1000)
+    eintr := &os.SyscallError{Syscall: "read", Err: syscall.EINTR}
+
+    fr := &flakyReader{r: bytes.NewReader(deflate(data)), err: eintr, failures: 1, chunk: 100}
+    zr := flate.NewReader(&retryReader{r: fr})
+    got, err := ioutil.ReadAll(zr)
+    if err != nil {
+        t.Fatalf("the transfer failed on a transient error, %v", err)
+    }
+    if string(got) != data {
+        t.Fatal("the transfer lost data on a transient error")
+    }
+
+    // The retries are bounded.
+    fr = &flakyReader{r: bytes.NewReader(deflate(data)), err: eintr, failures: maxReadRetries + 1, chunk: 100}
+    if _, err := (&retryReader{r: fr}).Read(make([]byte, 100)); !errors.Is(err, syscall.EINTR) {
+        t.Fatalf("the lasting transient error gave %v, want EINTR", err)
+    }
+
+    // The other errors are not retried.
+    fr = &flakyReader{r: bytes.NewReader(deflate(data)), err: io.ErrUnexpectedEOF, failures: 1, chunk: 100}
+    if _, err := (&retryReader{r: fr}).Read(make([]byte, 100)); err != io.ErrUnexpectedEOF || fr.failed != 1 {
+        t.Fatalf("the permanent error gave %v after %d reads, want it at once", err, fr.failed)
+    }
+}
+
+func TestIsTransient(t *testing.T) {
+    for _, test := range []struct {
+        err  error
+        want bool
+    }{
+        {syscall.EINTR, true},
+        {&os.SyscallError{Syscall: "read", Err: syscall.EAGAIN}, true},
+        {os.ErrDeadlineExceeded, false},
+        {io.EOF, false},
+        {syscall.ECONNRESET, false},
+    } {
+        if got := isTransient(test.err); got != test.want {
+            t.Errorf("isTransient(%v) = %t, want %t", test.err, got, test.want)
+        }
+    }
+}
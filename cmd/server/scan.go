@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// quarantineDir keeps the uploads waiting to be scanned, and the ones that
+// failed the scan. It's laid out like the hold directory.
+const quarantineDir = dataDir + "/quarantine"
+
+// scanner runs the scan command on the quarantined files. The command gets
+// the path of the file as its last argument and passes the file by exiting
+// with zero.
+type scanner struct {
+    command []string
+    timeout time.Duration
+}
+
+func (sc *scanner) scan(path string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), sc.timeout)
+    defer cancel()
+
+    args := append(append([]string{}, sc.command[1:]...), path)
+    out, err := exec.CommandContext(ctx, sc.command[0], args...).CombinedOutput()
+    if ctx.Err() != nil {
+        err = fmt.Errorf("timed out after %v", sc.timeout)
+    }
+    if err != nil {
+        return fmt.Errorf("%q failed the scan, %v: %s", path, err, bytes.TrimSpace(out))
+    }
+
+    return nil
+}
+
+// serveScanned scans the quarantined upload and moves it to the storage
+// directory if it passes. Otherwise it stays quarantined, until a local
+// client approves or rejects it.
+func (s *Server) serveScanned(token, name string) error {
+    dir, err := s.holds.tokenDir(token)
+    if err != nil {
+        return err
+    }
+
+    // What the scanner found is only logged, the client is told no more
+    // than that the file was refused.
+    if err := s.scanner.scan(filepath.Join(dir, name)); err != nil {
+        log.Printf("%v, quarantined with token %q", err, token)
+        return fmt.Errorf("%q failed the scan", name)
+    }
+
+    _, err = s.holds.approve(token)
+    return err
+}
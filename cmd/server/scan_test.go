@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestScanBeforeServe(t *testing.T) {
+    if _, err := exec.LookPath("sh"); err != nil {
+        t.Skip("no shell to scan with")
+    }
+
+    s := newTestServer(t)
+    s.scanner = &scanner{command: []string{"sh", "-c", `! grep -q VIRUS "$0"`}, timeout: 10 * time.Second}
+    var err error
+    s.holds, err = newHoldStore(quarantineDir, 0, realClock{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTest(t, s)
+
+    mustUpload(t, addr, "clean.txt", "clean")
+    first, status := upload(t, addr, "infected.txt", "a VIRUS")
+    if first.Token != "" || status.Status != "error" {
+        t.Fatalf("the infected upload got %+v and %+v, want no token and an error", first, status)
+    }
+    assertFiles(t, "clean.txt")
+
+    tokens, err := readDirNames(quarantineDir)
+    if err != nil || len(tokens) != 1 {
+        t.Fatalf("%d uploads are quarantined, %v, want 1", len(tokens), err)
+    }
+    if resp := decide(t, addr, opApprove, tokens[0]); resp.Name != "infected.txt" {
+        t.Fatalf("the approval got %+v", resp)
+    }
+    assertFiles(t, "clean.txt", "infected.txt")
+
+    mustUploadFails(t, addr, "again.txt", "VIRUS again")
+    tokens, _ = readDirNames(quarantineDir)
+    if resp := decide(t, addr, opReject, tokens[0]); resp.Name != "again.txt" {
+        t.Fatalf("the rejection got %+v", resp)
+    }
+    assertFiles(t, "clean.txt", "infected.txt")
+    if tokens, _ := readDirNames(quarantineDir); len(tokens) != 0 {
+        t.Fatalf("%d uploads are left quarantined", len(tokens))
+    }
+}
@@ -1,29 +1,125 @@
 package main
 
 import (
+	"bufio"
 	"compress/flate"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/adler32"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 const copySuffix = "_copy"
 
+// maxCopyNum is the largest copy number the names found in the storage
+// directory are taken for copies with. The names with larger ones, e.g. made
+// by another tool, are unrelated files as far as the index goes, so that they
+// don't make the next copies jump to absurd numbers, or overflow them.
+const maxCopyNum = 1000000
+
+// parseCopyNum parses the digits following the copy suffix, telling whether
+// they make a copy number at all.
+func parseCopyNum(digits string) (int, bool) {
+    if digits == "" || strings.TrimLeft(digits, "0123456789") != "" {
+        return 0, false
+    }
+
+    copyNum, err := strconv.Atoi(digits)
+    if err != nil || copyNum > maxCopyNum {
+        return 0, false
+    }
+
+    return copyNum, true
+}
+
+// partSuffix is appended to the names of the files being received.
+const partSuffix = ".part"
+
+// fileExt returns the extension of the filename like filepath.Ext, except
+// that a trailing dot is no extension. The copies of "archive." are then
+// named "archive._copy1" rather than "archive_copy1.", whose trailing dot
+// some filesystems refuse or drop.
+func fileExt(filename string) string {
+    ext := filepath.Ext(filename)
+    if ext == "." {
+        return ""
+    }
+
+    return ext
+}
+
 func getBareFilename(filename string) string {
-    return strings.TrimSuffix(filename, filepath.Ext(filename))
+    return strings.TrimSuffix(filename, fileExt(filename))
 }
 
 type FileIndex struct {
     index map[string]int
+
+    // reserved maps the reserved names to what they were resolved from.
+    reserved map[string]reservation
+
+    // added, while the index is being reloaded, has the filenames resolved
+    // to and from since the reload started.
+    added map[string]struct{}
     sync.Mutex
 }
 
+// reservation tells what a reserved name was resolved from, the requested
+// filename and the copy number.
+type reservation struct {
+    filename string
+    copyNum  int
+}
+
+// latestCopy determines the maximal copy number of the filename among the
+// filenames. Only the names the copies of the filename are given count, the
+// copy suffix following the whole bare name, so that e.g. "report2_copy1" is
+// not taken for a copy of "report". Neither are the names with copy numbers
+// beyond maxCopyNum.
+func latestCopy(filename string, filenames []string) int {
+    latestCopy := 0
+
+    prefix := getBareFilename(filename) + copySuffix
+    ext := fileExt(filename)
+    for _, copyName := range filenames {
+        if len(copyName) <= len(prefix) + len(ext) ||
+           !strings.HasPrefix(copyName, prefix) || !strings.HasSuffix(copyName, ext) {
+            continue
+        }
+
+        copyNum, ok := parseCopyNum(copyName[len(prefix):len(copyName) - len(ext)])
+        if !ok {
+            continue
+        }
+
+        if latestCopy < copyNum {
+            latestCopy = copyNum
+        }
+    }
+
+    return latestCopy
+}
+
 // NewFileIndexFromSlice will generate a file index give a slice of filenames.
 // It will process the filenames and determine tha maximal copy number for
 // each filename.
@@ -32,164 +128,2654 @@ func NewFileIndexFromSlice(filenames []string) (*FileIndex, error) {
     fi.index = make(map[string]int)
 
     for _, filename := range filenames {
-        latestCopy := 0
+        fi.index[filename] = latestCopy(filename, filenames)
+    }
 
-        fileBare := getBareFilename(filename)
-        for _, copyName := range filenames {
-            if !strings.HasPrefix(copyName, fileBare) {
-                continue
+    return fi, nil
+}
+
+// scanBatch is the number of the directory entries read at once.
+const scanBatch = 1024
+
+// newFileIndexParallel does the same as NewFileIndexFromSlice, splitting the
+// filenames between the workers. Every worker builds a partial index of its
+// share of the filenames, still looking for their copies among all of them,
+// so the merged result is identical to the sequential one.
+func newFileIndexParallel(filenames []string, workers int) *FileIndex {
+    fi := &FileIndex{}
+    fi.index = make(map[string]int, len(filenames))
+
+    share := (len(filenames) + workers - 1) / workers
+
+    var wg sync.WaitGroup
+    for start := 0; start < len(filenames); start += share {
+        end := start + share
+        if end > len(filenames) {
+            end = len(filenames)
+        }
+
+        wg.Add(1)
+        go func(part []string) {
+            defer wg.Done()
+
+            partial := &FileIndex{}
+            partial.index = make(map[string]int, len(part))
+            for _, filename := range part {
+                partial.index[filename] = latestCopy(filename, filenames)
             }
-            copyName := copyName[len(fileBare):]
 
-            copyBare := getBareFilename(copyName)
-            numStart := strings.LastIndex(copyBare, copySuffix)
-            if numStart == -1 {
-                continue
+            fi.MergeFrom(partial)
+        }(filenames[start:end])
+    }
+    wg.Wait()
+
+    return fi
+}
+
+// NewFileIndexFromDir will generate a FileIndex given a specified directory.
+// Only the regular files are indexed, the directories, symbolic links, FIFOs
+// and the like are ignored. The directory is read in batches and the index is
+// built using all the CPUs.
+func NewFileIndexFromDir(dir *os.File) (*FileIndex, error) {
+    var filenames []string
+    for {
+        batch, err := dir.Readdir(scanBatch)
+        for _, stat := range batch {
+            if stat.Mode().IsRegular() {
+                filenames = append(filenames, stat.Name())
             }
-            numStart += len(copySuffix)
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("could not generate index, %v", err)
+        }
+    }
 
-            copyNum, err := strconv.Atoi(copyBare[numStart:])
-            if err != nil {
-                continue
+    return newFileIndexParallel(filenames, runtime.GOMAXPROCS(0)), nil
+}
+
+// MergeFrom combines the other index into this one, keeping the highest copy
+// number of every filename. The other index is left as it is. The indexes
+// are never locked at the same time, so merging them both ways concurrently
+// (or an index into itself) can't deadlock.
+func (fi *FileIndex) MergeFrom(other *FileIndex) {
+    snapshot := other.snapshot()
+
+    fi.Lock()
+    defer fi.Unlock()
+
+    for filename, copyNum := range snapshot {
+        if current, exists := fi.index[filename]; !exists || current < copyNum {
+            fi.index[filename] = copyNum
+            if fi.added != nil {
+                fi.added[filename] = struct{}{}
             }
+        }
+    }
+}
+
+// snapshot returns a copy of the index.
+func (fi *FileIndex) snapshot() map[string]int {
+    fi.Lock()
+    defer fi.Unlock()
+
+    snapshot := make(map[string]int, len(fi.index))
+    for filename, copyNum := range fi.index {
+        snapshot[filename] = copyNum
+    }
+
+    return snapshot
+}
+
+// occupy marks the filenames as taken, as if they were in the directory the
+// index was built from.
+func (fi *FileIndex) occupy(filenames []string) {
+    for filename := range fi.snapshot() {
+        filenames = append(filenames, filename)
+    }
+
+    occupied, _ := NewFileIndexFromSlice(filenames)
+    fi.MergeFrom(occupied)
+}
+
+// has tells whether the filename is in the index. The caller must hold the
+// lock.
+func (fi *FileIndex) has(filename string) bool {
+    _, exists := fi.index[filename]
+    return exists
+}
+
+// Len returns the number of the filenames in the index.
+func (fi *FileIndex) Len() int {
+    fi.Lock()
+    defer fi.Unlock()
+
+    return len(fi.index)
+}
+
+// Names returns the filenames in the index, sorted.
+func (fi *FileIndex) Names() []string {
+    fi.Lock()
+    defer fi.Unlock()
+
+    names := make([]string, 0, len(fi.index))
+    for filename := range fi.index {
+        names = append(names, filename)
+    }
+    sort.Strings(names)
+
+    return names
+}
+
+// CopyCount returns the latest copy number of the filename, and whether the
+// filename is in the index at all.
+func (fi *FileIndex) CopyCount(filename string) (int, bool) {
+    fi.Lock()
+    defer fi.Unlock()
+
+    copyNum, exists := fi.index[filename]
+    return copyNum, exists
+}
+
+// Dump returns a copy of the index, mapping every filename to its latest
+// copy number. Changing it doesn't change the index.
+func (fi *FileIndex) Dump() map[string]int {
+    return fi.snapshot()
+}
+
+// CopyHistogram returns how many filenames have every number of copies, e.g.
+// {0: 10, 1: 2} for ten filenames without copies and two with one copy. The
+// copies themselves are not counted, unless their original is gone.
+func (fi *FileIndex) CopyHistogram() map[int]int {
+    snapshot := fi.snapshot()
 
-            if latestCopy < copyNum {
-                latestCopy = copyNum
+    histogram := make(map[int]int)
+    for filename, copyNum := range snapshot {
+        if original, ok := copyOriginal(filename); ok {
+            if _, exists := snapshot[original]; exists {
+                continue
             }
         }
 
-        fi.index[filename] = latestCopy
+        histogram[copyNum]++
     }
 
-    return fi, nil
+    return histogram
 }
 
-// NewFileIndexFromDir will generate a FileIndex given a specified directory.
-func NewFileIndexFromDir(dir *os.File) (*FileIndex, error) {
-    filenames, err := dir.Readdirnames(-1)
-    if err != nil {
-        return nil, fmt.Errorf("could not generate index, %v", err)
+// copyOriginal returns the filename the name of the copy was made from, e.g.
+// "name.ext" for "name_copy2.ext", and whether the name is one of a copy at
+// all. The copies of the names ending in a dot, like "archive._copy1", have
+// no extension of their own.
+func copyOriginal(filename string) (string, bool) {
+    splits := [][2]string{
+        {getBareFilename(filename), fileExt(filename)},
+        {filename, ""},
+    }
+
+    for _, split := range splits {
+        bare, ext := split[0], split[1]
+        numStart := strings.LastIndex(bare, copySuffix)
+        if numStart == -1 {
+            continue
+        }
+
+        copyNum, ok := parseCopyNum(bare[numStart + len(copySuffix):])
+        if !ok || copyNum < 1 {
+            continue
+        }
+
+        return bare[:numStart] + ext, true
     }
 
-    return NewFileIndexFromSlice(filenames)
+    return "", false
 }
 
 // Resolve will return the passed in filename if there's no file in the root
 // with the same name. Otherwise, a new filename is generated in the form
-// "<original filename><copy suffix><copy number><file extension>".
+// "<original filename><copy suffix><copy number><file extension>". If the
+// name of the copy is taken as well (e.g. a file was uploaded under that very
+// name), the next copy number is tried, so the returned names are always
+// unique.
 // Additionally, the index itself is updated to reflect the expected changes
 // in the filesystem. Was the filesystem really changed or not, doesn't matter, 
 // it is assumed that the name of the presumed copy is occupied.
 func (fi *FileIndex) Resolve(filename string) (uniqueName string) {
+    uniqueName, _ = fi.resolve(filename)
+    return
+}
+
+// resolve does the same as Resolve, also returning the number of the copies
+// the filename had before, that is, the latest copy number.
+func (fi *FileIndex) resolve(filename string) (uniqueName string, priorCopies int) {
     fi.Lock()
     defer fi.Unlock()
 
-    uniqueName = filename
+    return fi.resolveLocked(filename)
+}
 
-    copyNum, exists := fi.index[filename]
+// resolveLocked does the same as resolve, the caller must hold the lock.
+func (fi *FileIndex) resolveLocked(filename string) (uniqueName string, priorCopies int) {
+    bare := getBareFilename(filename)
+    ext := fileExt(filename)
 
-    if exists {
-        bare := getBareFilename(filename)
-        ext := filepath.Ext(filename)
-        uniqueName = fmt.Sprintf("%s%s%d%s", bare, copySuffix, copyNum+1, ext)
+    priorCopies = fi.index[filename]
+    uniqueName = filename
+    for fi.has(uniqueName) {
         fi.index[filename]++
+        uniqueName = fmt.Sprintf("%s%s%d%s", bare, copySuffix, fi.index[filename], ext)
     }
 
     fi.index[uniqueName] = 0
+    if fi.added != nil {
+        fi.added[filename] = struct{}{}
+        fi.added[uniqueName] = struct{}{}
+    }
     return
 }
 
-// receiveFile is the handler for the incomming connections.
-// It expects the preferred name of the file and the file size in bytes to be
-// specified in the first two lines of the input respectively. After the
-// expected number of bytes is received, the actual name of the file, where
-// the data is saved, is written to the socket (without \n) and the connection 
-// is closed.
-func receiveFile(con net.Conn, index *FileIndex) {
-    defer con.Close()
+// Reserve does the same as Resolve, but the returned name can be given back
+// with Release if it ends up unused, e.g. because the upload was abandoned.
+func (fi *FileIndex) Reserve(filename string) (resolved string) {
+    resolved, _ = fi.reserve(filename)
+    return
+}
 
-    var filename string
-    _, err := fmt.Fscanf(con, "%s\n", &filename)
-    if err != nil {
-        log.Print("could not read the name of the file. connection terminated.")
+// reserve does the same as Reserve, also returning the number of the prior
+// copies like resolve.
+func (fi *FileIndex) reserve(filename string) (resolved string, priorCopies int) {
+    fi.Lock()
+    defer fi.Unlock()
+
+    resolved, priorCopies = fi.resolveLocked(filename)
+
+    r := reservation{filename: filename}
+    if resolved != filename {
+        r.copyNum = fi.index[filename]
+    }
+
+    if fi.reserved == nil {
+        fi.reserved = make(map[string]reservation)
+    }
+    fi.reserved[resolved] = r
+
+    return
+}
+
+// Release gives back the reserved name, so that it's resolved to again. The
+// names that are not reserved, or were kept, are left as they are.
+func (fi *FileIndex) Release(resolved string) {
+    fi.Lock()
+    defer fi.Unlock()
+
+    r, ok := fi.reserved[resolved]
+    if !ok {
         return
     }
+    delete(fi.reserved, resolved)
 
-    serverFilename := index.Resolve(filename)
-    _, err = fmt.Fprint(con, serverFilename)
-    if err != nil {
-        log.Printf("could not send the name of the file back.")
+    // A released filename takes the copy number with it, resolving it
+    // again starts over, skipping the copies that are still taken. A
+    // released copy lowers the copy number below itself, so that it's the
+    // next copy resolved to.
+    delete(fi.index, resolved)
+    if r.copyNum == 0 {
+        return
     }
 
-    file, err := os.Create(serverFilename)
+    if current, exists := fi.index[r.filename]; exists && current >= r.copyNum {
+        fi.index[r.filename] = r.copyNum - 1
+    }
+}
+
+// keep makes the reserved name taken for good, it can't be released anymore.
+func (fi *FileIndex) keep(resolved string) {
+    fi.Lock()
+    defer fi.Unlock()
+
+    delete(fi.reserved, resolved)
+}
+
+// protocolMagic opens the requests of the clients speaking the header-based
+// protocol. It can never be mistaken for a filename of a legacy client, since
+// it contains a slash.
+const protocolMagic = "FILES/1"
+
+// The operations the clients can ask for.
+const (
+    opUpload   = "upload"
+    opManifest = "manifest"
+    opAudit    = "audit"
+    opStat     = "stat"
+
+    // opSwap exchanges the contents of the stored files Name and With.
+    opSwap = "swap"
+
+    // opTar uploads a tar archive, every file in it is stored on its own.
+    opTar = "tar"
+
+    // The operations deciding the fate of the held uploads.
+    opApprove = "approve"
+    opReject  = "reject"
+)
+
+// request describes what the client wants the server to do.
+type request struct {
+    Op   string
+    Name string
+
+    // Prefix limits the manifest or the audit to the files whose names start
+    // with it.
+    Prefix string
+
+    // Token refers to the held upload to approve or reject.
+    Token string
+
+    // With is the stored file to swap the contents of Name with.
+    With string
+
+    // Also are the names the uploaded file is to be stored under too.
+    Also []string
+
+    // Size is the size of the file in bytes declared by the client, or -1 if
+    // the client didn't declare it.
+    Size int64
+
+    // SHA256 is the hex encoded checksum the received data must match, if
+    // the client sent it.
+    SHA256 string
+
+    // Confirm tells that the client wants to see the name of the file on the
+    // server before deciding whether to send the data or not.
+    Confirm bool
+
+    // Status tells that the client wants to be told whether the file was
+    // stored once the data was received.
+    Status bool
+
+    // Verbose tells that the client wants to be told how well the data
+    // compressed, in the final status.
+    Verbose bool
+
+    // Auth is either the secret of the server or an upload token.
+    Auth string
+
+    // Footer is what the client sends after the DEFLATE stream, if anything.
+    Footer string
+
+    // Dictionary is the hex encoded SHA-256 of the preset dictionary the data
+    // is compressed with, if any.
+    Dictionary string
+
+    // Seq is the sequence number of the upload within the batch the client
+    // sends on the connection, nil if the connection carries only this
+    // request.
+    Seq *int64
+
+    // maxSize is the limit of the size of the file set by the upload token,
+    // zero if there's none.
+    maxSize int64
+
+    // deferMarker tells that the completion marker of the file is written by
+    // the caller, e.g. once the whole archive is stored.
+    deferMarker bool
+
+    // streamed tells that the data of the upload started to be read, so the
+    // connection can't be followed by another request if the upload failed.
+    streamed bool
+
+    // flateStats, if not nil, are the statistics of the decompression for
+    // the verbose clients.
+    flateStats *flateStats
+
+    // deflate tells that the data of the request is DEFLATE compressed, and
+    // inflation, if not nil, counts it for the limit of the ratio.
+    deflate   bool
+    inflation *flateStats
+
+    // compressed, if not nil, keeps the compressed data of the upload to be
+    // served as such.
+    compressed *compressedCopy
+
+    // originalName is the name the client sent, if the file is stored under
+    // another one because it wasn't valid UTF-8.
+    originalName string
+
+    // uploader is the address of the client, without the port.
+    uploader string
+
+    // remote is the address of the client, with the port.
+    remote string
+
+    // credentials tell apart the credentials the request was authorized
+    // with, empty if it wasn't.
+    credentials string
+
+    legacy bool
+}
+
+// response is what the server tells the clients speaking the header-based
+// protocol, encoded as a single line of JSON.
+type response struct {
+    Name  string `json:"name,omitempty"`
+    Copy  bool   `json:"copy,omitempty"`
+
+    // PriorCopies is the number of the copies the requested name had when
+    // the file was renamed.
+    PriorCopies *int `json:"prior_copies,omitempty"`
+
+    Token string `json:"token,omitempty"`
+
+    // Status is "ok" or "error" in the final response after the data, sent
+    // only if the client asked for it. The size and the checksum describe
+    // the stored file, on success, the ETag is the one it's downloaded with
+    // over HTTP.
+    Status string `json:"status,omitempty"`
+    Size   *int64 `json:"size,omitempty"`
+    SHA256 string `json:"sha256,omitempty"`
+    ETag   string `json:"etag,omitempty"`
+
+    // Adler32 is the weak checksum of the stored file, hex encoded, if the
+    // server keeps them.
+    Adler32 string `json:"adler32,omitempty"`
+
+    // OriginalName is the name the file was uploaded with, in base64, if it
+    // was stored under another because it wasn't valid UTF-8.
+    OriginalName []byte `json:"original_name,omitempty"`
+
+    // Path is where the stored file is, relative to the storage directory.
+    // AbsPath and Device, the ID of the device of the filesystem, are only
+    // told if the server exposes them.
+    Path    string `json:"path,omitempty"`
+    AbsPath string `json:"abs_path,omitempty"`
+    Device  string `json:"device,omitempty"`
+
+    // Deduplicated tells that the file was stored as a link to a stored file
+    // with the same contents, rather than as the bytes received.
+    Deduplicated bool `json:"deduplicated,omitempty"`
+
+    // CompressedSize, CompressionRatio and DecompressionMs tell the verbose
+    // clients how many bytes of the compressed data were received, how many
+    // times larger the data was and how long decompressing it took, not
+    // counting the waits for the data.
+    CompressedSize   *int64   `json:"compressed_size,omitempty"`
+    CompressionRatio float64  `json:"compression_ratio,omitempty"`
+    DecompressionMs  *float64 `json:"decompression_ms,omitempty"`
+
+    // Appended tells that the file was appended to the file of the name, in
+    // the append mode, rather than stored on its own.
+    Appended bool `json:"appended,omitempty"`
+
+    // Names are the names the files of a tar archive were stored under, or
+    // the ones the uploaded file was, if it was stored under more of them.
+    Names []string `json:"names,omitempty"`
+
+    Error string `json:"error,omitempty"`
+
+    // Seq is the sequence number of the upload the response is about, if the
+    // client numbered it.
+    Seq *int64 `json:"seq,omitempty"`
+
+    // Kind tells what kind of error the error is, if any: "unavailable",
+    // "not_found" or "permission" for the errors of the storage, or
+    // "header_too_large" for the request.
+    Kind string `json:"kind,omitempty"`
+}
+
+// maxHeaderLine is the longest line the clients may send before the data,
+// line terminator included.
+const maxHeaderLine = 4096
+
+// maxHeaderLines is the largest number of lines in the header.
+const maxHeaderLines = 64
+
+// defaultMaxHeaderSize is the largest total size of the header lines,
+// terminators included, unless the server is told otherwise. The lines may
+// all be short and few enough, and still add up to more than the server is
+// willing to take.
+const defaultMaxHeaderSize = 16 * 1024
+
+// readLine reads a line without the line terminator. The line is read into
+// the buffer of r, which has to be at least maxHeaderLine bytes long, so no
+// matter what the client sends, no more than that is ever allocated.
+func readLine(r *bufio.Reader) (string, error) {
+    line, err := r.ReadSlice('\n')
+    if err == bufio.ErrBufferFull {
+        return "", fmt.Errorf("a line is longer than %d bytes", maxHeaderLine)
+    }
     if err != nil {
-        log.Printf("could not create file %q, %v", serverFilename, err)
-        return
+        return "", err
     }
-    defer file.Close()
 
-    log.Printf("receiving %q...", serverFilename)
+    return strings.TrimRight(string(line), "\r\n"), nil
+}
 
-    fileSize := 0
-    buf := make([]byte, 1024)
-    zr := flate.NewReader(con)
-    for {
-        n, err := zr.Read(buf)
-        if n == 0 {
-            if err == io.EOF {
-                break
-            }
+// readHeader reads the "Key: value" lines up to and including the first
+// empty line, adding up to no more than maxSize bytes.
+func readHeader(r *bufio.Reader, maxSize int) (textproto.MIMEHeader, error) {
+    header := make(textproto.MIMEHeader)
+    size := 0
+    for lines := 0; ; lines++ {
+        if lines == maxHeaderLines {
+            return nil, fmt.Errorf("the header is longer than %d lines", maxHeaderLines)
+        }
 
-            log.Printf("could not receive file %q, %v", serverFilename, err)
-            return
+        line, err := readLine(r)
+        if err != nil {
+            return nil, fmt.Errorf("could not read the header, %v", err)
+        }
+
+        size += len(line) + 1
+        if size > maxSize {
+            err := fmt.Errorf("the header is larger than %d bytes", maxSize)
+            return nil, &storageError{kind: ErrHeaderTooLarge, err: err}
         }
 
-        fileSize += n
+        if line == "" {
+            return header, nil
+        }
 
-        _, err = file.Write(buf[:n])
-        if err != nil {
-            log.Printf("could not receive file %q, %v", serverFilename, err)
-            return
+        i := strings.IndexByte(line, ':')
+        if i == -1 {
+            return nil, fmt.Errorf("malformed header line %q", line)
         }
-    }
 
-    if err := zr.Close(); err != nil {
-        log.Printf("warning: could not close DEFLATE decompressor for %q, %v", 
-                   serverFilename, err)
+        key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))
+        header.Add(key, strings.TrimSpace(line[i+1:]))
     }
+}
 
-    log.Printf("received %q (%d bytes)", serverFilename, fileSize)
+// requiredHeaders lists the headers the operations can't do without.
+var requiredHeaders = map[string][]string{
+    opUpload:  {"Name"},
+    opStat:    {"Name"},
+    opSwap:    {"Name", "With"},
+    opApprove: {"Token"},
+    opReject:  {"Token"},
 }
 
-func main() {
-    if len(os.Args) != 2 {
-        fmt.Printf("Usage:\n\tfiles <port>\n\n")
-        return
+// checkHeader makes sure every key is given at most once, so that the order
+// of the lines never matters, and that the operation gets all its required
+// keys.
+func checkHeader(header textproto.MIMEHeader, op string) error {
+    for key, values := range header {
+        if len(values) > 1 {
+            return fmt.Errorf("the %s header is given more than once", key)
+        }
     }
 
-    dir, err := os.Open("./")
+    var missing []string
+    for _, key := range requiredHeaders[op] {
+        if header.Get(key) == "" {
+            missing = append(missing, key)
+        }
+    }
+
+    if len(missing) > 0 {
+        return fmt.Errorf("the %s operation needs the %s header",
+                          op, strings.Join(missing, ", "))
+    }
+
+    return nil
+}
+
+// readRequest reads the request of either a legacy client, which only sends
+// the name of the file, or of a client speaking the header-based protocol.
+// The returned request is not nil as soon as the protocol is known, even if
+// an error is returned, so that the client can be told what went wrong.
+func readRequest(r *bufio.Reader, maxHeaderSize int) (*request, error) {
+    first, err := readLine(r)
     if err != nil {
-        log.Fatalf("could not open current directory, %v", err)
+        return nil, fmt.Errorf("could not read the name of the file, %v", err)
     }
-    defer dir.Close()
+    first = strings.TrimSpace(first)
 
-    index, err := NewFileIndexFromDir(dir)
+    if first != protocolMagic {
+        return &request{Op: opUpload, Name: first, Size: -1, legacy: true}, nil
+    }
+
+    req := &request{Size: -1}
+    header, err := readHeader(r, maxHeaderSize)
     if err != nil {
-        log.Fatal(err)
+        return req, err
+    }
+
+    req.Op = header.Get("Op")
+    switch req.Op {
+    case "":
+        req.Op = opUpload
+    case opUpload, opTar, opManifest, opAudit, opStat, opSwap, opApprove, opReject:
+    default:
+        return req, fmt.Errorf("unknown operation %q", req.Op)
+    }
+
+    if err := checkHeader(header, req.Op); err != nil {
+        return req, err
     }
 
-    l, err := net.Listen("tcp", ":" + os.Args[1])
+    req.Name = header.Get("Name")
+    req.Prefix = header.Get("Prefix")
+    req.Token = header.Get("Token")
+    req.With = header.Get("With")
+    req.Also, err = parseAlso(header.Get("Also"))
     if err != nil {
-        log.Fatalf("could not start listening, %v", err)
+        return req, err
     }
-    defer l.Close()
+    req.SHA256, err = parseSHA256(header.Get("SHA256"))
+    if err != nil {
+        return req, err
+    }
+    req.Auth = header.Get("Auth")
+    req.Dictionary = strings.ToLower(header.Get("Dictionary"))
 
-    for {
-        con, err := l.Accept()
+    if err := checkChecksums(header); err != nil {
+        return req, err
+    }
+    req.Footer = strings.ToLower(header.Get("Footer"))
+
+    if size := header.Get("Size"); size != "" {
+        req.Size, err = strconv.ParseInt(size, 10, 64)
+        if err != nil || req.Size < 0 {
+            return req, fmt.Errorf("malformed Size header %q", size)
+        }
+    }
+
+    if confirm := header.Get("Confirm"); confirm != "" {
+        req.Confirm, err = strconv.ParseBool(confirm)
         if err != nil {
-            log.Fatalf("could not accept an incoming connection, %v", err)
+            return req, fmt.Errorf("malformed Confirm header %q", confirm)
         }
+    }
+
+    if status := header.Get("Status"); status != "" {
+        req.Status, err = strconv.ParseBool(status)
+        if err != nil {
+            return req, fmt.Errorf("malformed Status header %q", status)
+        }
+    }
 
-        go receiveFile(con, index)
+    if verbose := header.Get("Verbose"); verbose != "" {
+        req.Verbose, err = strconv.ParseBool(verbose)
+        if err != nil {
+            return req, fmt.Errorf("malformed Verbose header %q", verbose)
+        }
+    }
+
+    if seq := header.Get("Seq"); seq != "" {
+        n, err := strconv.ParseInt(seq, 10, 64)
+        if err != nil || n < 0 {
+            return req, fmt.Errorf("malformed Seq header %q", seq)
+        }
+        if req.Op != opUpload || !req.Status {
+            return req, fmt.Errorf("the Seq header is only for the uploads with Status: true")
+        }
+        req.Seq = &n
+    }
+
+    return req, nil
+}
+
+// parseSHA256 checks the hex encoded SHA-256 the client sent, so that the
+// upload with a malformed one is refused before the data is received. The
+// checksum is returned in lowercase, or empty if the client sent none.
+func parseSHA256(sum string) (string, error) {
+    if sum == "" {
+        return "", nil
+    }
+
+    if _, err := hex.DecodeString(sum); err != nil {
+        return "", fmt.Errorf("malformed SHA256 %q, it's not hex encoded", sum)
+    }
+    if len(sum) != 2 * sha256.Size {
+        return "", fmt.Errorf("malformed SHA256 %q, it's %d hex digits long instead of %d",
+                              sum, len(sum), 2 * sha256.Size)
+    }
+
+    return strings.ToLower(sum), nil
+}
+
+// reply sends the response in the form the client expects it. Legacy clients
+// only ever get the name of the file on the server (without \n).
+func (req *request) reply(w io.Writer, resp *response) error {
+    if req.legacy {
+        if resp.Error != "" {
+            return nil
+        }
+
+        _, err := fmt.Fprint(w, resp.Name)
+        return err
+    }
+
+    resp.Seq = req.Seq
+    return json.NewEncoder(w).Encode(resp)
+}
+
+// Server receives the files and stores them in the current working directory.
+type Server struct {
+    index *FileIndex
+    meta  *metaStore
+
+    // MaxDeclaredSize is the largest size of the file in bytes the clients
+    // are allowed to declare. Zero means no limit.
+    MaxDeclaredSize int64
+
+    // MaxSize is the largest number of bytes the server is willing to receive
+    // for a single file, whatever the client declared. Zero means no limit.
+    MaxSize int64
+
+    // MaxDeflateSize and MaxDeflateRatio limit the files arriving DEFLATE
+    // compressed, unlike the HTTP uploads: the largest size, instead of
+    // MaxSize if not zero, and the largest ratio of the decompressed data to
+    // the compressed, zero meaning no limit.
+    MaxDeflateSize  int64
+    MaxDeflateRatio float64
+
+    // TrustDeclaredSize tells whether the size declared by the client is
+    // used to check for the free space and to preallocate the file. Clients
+    // sending more than they declared are then cut off.
+    TrustDeclaredSize bool
+
+    // ExposeLocation tells to report the absolute paths and the devices of
+    // the stored files to the clients asking for their stat.
+    ExposeLocation bool
+
+    // KeepPartial tells to keep what was decompressed of the uploads whose
+    // data fails to decompress, in the partial directory.
+    KeepPartial bool
+
+    // DoneMarkers tells to write an empty marker file next to every stored
+    // file once it's complete and durable, for the tools watching the
+    // directory. The names of the markers can't be uploaded to then.
+    DoneMarkers bool
+
+    // KeepCompressed tells to keep the DEFLATE streams the uploads arrived
+    // in, and to serve them to the HTTP clients that accept them.
+    KeepCompressed bool
+
+    // recompressor, if not nil, compresses the stored files in the
+    // background, for the HTTP clients accepting its codec.
+    recompressor *recompressor
+
+    // Append tells to append the uploads to the file of the name instead of
+    // storing them as copies, preceded by AppendSeparator unless the file is
+    // empty.
+    Append          bool
+    AppendSeparator string
+    appends         *appendLocks
+
+    // decompressions, if not nil, limits the number of the uploads
+    // decompressing their data at once.
+    decompressions *decompressionLimiter
+
+    // inodes, if not nil, refuses the uploads once the inodes run low.
+    inodes *inodeGuard
+
+    // readOnly, if not nil, refuses the uploads while the storage is
+    // read-only.
+    readOnly *readOnlyGuard
+
+    // events, if not nil, receives an event for every transfer.
+    events *eventSink
+
+    // MaxBatchFiles is the largest number of the requests a connection may
+    // carry, zero means no limit.
+    MaxBatchFiles int
+
+    // NamePolicy tells what to do with the names that aren't valid UTF-8,
+    // they're kept if empty.
+    NamePolicy namePolicy
+
+    // StalePartAge is how long the temporary file in the way of an upload
+    // has to be left unchanged for to be removed, never if zero.
+    StalePartAge time.Duration
+
+    // MaxTrackedKeys is the number of the names, the credentials and the
+    // uploaders the limits keep track of, no limit if zero. It's only told
+    // about, the limits are created with it.
+    MaxTrackedKeys int
+
+    // RejectDuringReload tells to refuse the new uploads while the index is
+    // being rebuilt, reloading being 1 meanwhile.
+    RejectDuringReload bool
+    reloading          int32
+
+    // swaps serializes the swaps of the stored files.
+    swaps sync.Mutex
+
+    // storms, if not nil, tells about the names uploaded too many times in a
+    // row, refusing the excess uploads if asked to.
+    storms *stormDetector
+
+    // holds, if not nil, keeps the received files until they are approved.
+    holds *holdStore
+
+    // tracer, if not nil, exports a span for every request.
+    tracer *tracer
+
+    // diskLimiter, if not nil, limits the aggregate rate at which the
+    // received files are written to the disk.
+    diskLimiter *rateLimiter
+
+    // tokenLimiters, if not nil, limit the aggregate rate at which the files
+    // are received with the same credentials, the secret or an upload token.
+    tokenLimiters *limiterPool
+
+    // dict, if not nil, is the preset dictionary the clients may compress the
+    // data with.
+    dict *flateDict
+
+    // scanner, if not nil, scans the uploads before they are served. The
+    // uploads are quarantined in the holds meanwhile.
+    scanner *scanner
+
+    // auth, if not nil, checks that the requests carry the secret or an
+    // upload token.
+    auth *authenticator
+
+    // httpAuth and metricsAuth, if not nil, check the credentials of the
+    // HTTP uploads and downloads and of the metrics, independently of auth.
+    httpAuth    *authenticator
+    metricsAuth *authenticator
+
+    // TrustedProxies are the networks of the proxies whose X-Forwarded-For
+    // headers tell the addresses of the HTTP clients.
+    TrustedProxies []*net.IPNet
+
+    // quota, if not nil, limits the number of bytes every uploader may
+    // store.
+    quota *quotaTracker
+
+    // evictor, if not nil, removes the least recently used files once the
+    // total size of the stored files exceeds the limit.
+    evictor *evictor
+
+    // content, if not nil, makes the files with the same contents as a
+    // stored one hard links to it.
+    content *contentIndex
+
+    // MaxArchiveFiles and MaxArchiveSize limit the number of the entries of
+    // a tar archive and the total size of its files. Zero means no limit.
+    MaxArchiveFiles int
+    MaxArchiveSize  int64
+
+    // RequireChecksum makes the server refuse the uploads that come with
+    // neither the SHA256 header nor the sha256 footer, the legacy ones too.
+    RequireChecksum bool
+
+    // StrictTrailer makes the server refuse the uploads followed by any
+    // bytes after the DEFLATE stream (and the footer), instead of only
+    // warning about them.
+    StrictTrailer bool
+
+    // StrictClose makes the server refuse the uploads whose DEFLATE
+    // decompressor fails to close once the stream ends, instead of only
+    // warning about it.
+    StrictClose bool
+
+    // DefaultExt, if not empty, is appended to the names without an
+    // extension, e.g. ".bin".
+    DefaultExt string
+
+    // Clock tells the time, the wall-clock time if nil.
+    Clock Clock
+
+    // MaxLifetime, if positive, is how long the server runs before it shuts
+    // down on its own.
+    MaxLifetime time.Duration
+
+    // HandshakeTimeout, if positive, is how long the clients have to get
+    // through the TLS handshake and the PROXY header before the connection
+    // is dropped.
+    HandshakeTimeout time.Duration
+
+    // MaxHeaderSize is the largest total size in bytes of the header lines
+    // of a request, defaultMaxHeaderSize if zero.
+    MaxHeaderSize int
+
+    // MaxNameAttempts is how many names are tried for a file, should they
+    // be taken by directories or the like, defaultMaxNameAttempts if zero.
+    MaxNameAttempts int
+
+    // AcceptTimeout, if positive, is how often the idle listener checks
+    // whether the server is shutting down, should closing it not interrupt
+    // the accept.
+    AcceptTimeout time.Duration
+
+    // transfers are the files being received, for the progress stream.
+    transfers *transfers
+
+    listener    net.Listener
+    httpServers []*http.Server
+    closing     bool
+    conns       sync.WaitGroup
+    mu          sync.Mutex
+}
+
+// clock returns the clock of the server.
+func (s *Server) clock() Clock {
+    if s.Clock == nil {
+        return realClock{}
+    }
+
+    return s.Clock
+}
+
+// Serve accepts the connections on the listener and handles them until the
+// server is shut down, possibly because it reached its MaxLifetime. It then
+// returns once all the accepted connections are handled.
+func (s *Server) Serve(l net.Listener) error {
+    s.mu.Lock()
+    s.listener = l
+    closing := s.closing
+    s.mu.Unlock()
+
+    // Shut down before it got the listener, the accept wouldn't be
+    // interrupted otherwise.
+    if closing {
+        l.Close()
+    }
+
+    if s.MaxLifetime > 0 {
+        timer := s.clock().AfterFunc(s.MaxLifetime, func() {
+            log.Printf("reached the lifetime of %v, shutting down", s.MaxLifetime)
+            s.Shutdown()
+        })
+        defer timer.Stop()
+    }
+
+    for {
+        con, err := l.Accept()
+
+        s.mu.Lock()
+        if s.closing {
+            s.mu.Unlock()
+            if con != nil {
+                con.Close()
+            }
+
+            s.conns.Wait()
+            s.shutdownHTTP()
+            return nil
+        }
+        if err == nil {
+            s.conns.Add(1)
+        }
+        s.mu.Unlock()
+
+        if err != nil {
+            return fmt.Errorf("could not accept an incoming connection, %v", err)
+        }
+
+        go func() {
+            defer s.conns.Done()
+            s.handle(con)
+        }()
+    }
+}
+
+// Shutdown stops accepting new connections and waits for the transfers in
+// progress to finish.
+func (s *Server) Shutdown() {
+    s.mu.Lock()
+    s.closing = true
+    l := s.listener
+    s.mu.Unlock()
+
+    if l != nil {
+        l.Close()
+    }
+
+    s.conns.Wait()
+}
+
+// isClosing tells whether the server is shutting down.
+func (s *Server) isClosing() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.closing
+}
+
+// limitString formats the limit for the logs, zero meaning no limit.
+func limitString(limit int64) string {
+    if limit <= 0 {
+        return "none"
+    }
+
+    return strconv.FormatInt(limit, 10)
+}
+
+func ratioString(ratio float64) string {
+    if ratio <= 0 {
+        return "none"
+    }
+
+    return strconv.FormatFloat(ratio, 'g', -1, 64)
+}
+
+// optionString formats the optional setting for the logs, e.g. the default
+// extension, empty meaning none.
+func optionString(value string) string {
+    if value == "" {
+        return "none"
+    }
+
+    return value
+}
+
+// durationString formats the duration for the logs, zero meaning no limit.
+func durationString(d time.Duration) string {
+    if d <= 0 {
+        return "none"
+    }
+
+    return d.String()
+}
+
+// settings describes the effective configuration of the server as key=value
+// pairs.
+func (s *Server) settings() []string {
+    maxTotal, policy := s.evictionSettings()
+    return []string{
+        fmt.Sprintf("indexed-files=%d", s.index.Len()),
+        "max-declared-size=" + limitString(s.MaxDeclaredSize),
+        "max-size=" + limitString(s.MaxSize),
+        "max-deflate-size=" + limitString(s.MaxDeflateSize),
+        "max-deflate-ratio=" + ratioString(s.MaxDeflateRatio),
+        fmt.Sprintf("trust-declared-size=%t", s.TrustDeclaredSize),
+        fmt.Sprintf("strict-trailer=%t", s.StrictTrailer),
+        fmt.Sprintf("strict-close=%t", s.StrictClose),
+        fmt.Sprintf("require-checksum=%t", s.RequireChecksum),
+        "max-archive-files=" + limitString(int64(s.MaxArchiveFiles)),
+        "max-batch-files=" + limitString(int64(s.MaxBatchFiles)),
+        fmt.Sprintf("event-socket=%t", s.events != nil),
+        "max-archive-size=" + limitString(s.MaxArchiveSize),
+        "disk-rate=" + limitString(s.diskRate()),
+        "token-rate=" + limitString(s.tokenRate()),
+        "min-free-inodes=" + limitString(s.minFreeInodes()),
+        "max-decompressions=" + limitString(int64(s.maxDecompressions())),
+        "max-same-name=" + limitString(int64(s.maxSameName())),
+        fmt.Sprintf("reject-same-name=%t", s.storms != nil && s.storms.reject),
+        "max-total-size=" + limitString(maxTotal),
+        "evict-by=" + policy,
+        "quota=" + limitString(s.quotaLimit()),
+        "max-tracked-keys=" + limitString(int64(s.MaxTrackedKeys)),
+        "dedup=" + s.dedupPolicy(),
+        fmt.Sprintf("done-marker=%t", s.DoneMarkers),
+        fmt.Sprintf("keep-partial=%t", s.KeepPartial),
+        "stale-part-age=" + durationString(s.StalePartAge),
+        fmt.Sprintf("non-utf8-names=%s", s.NamePolicy.String()),
+        fmt.Sprintf("reject-during-reload=%t", s.RejectDuringReload),
+        fmt.Sprintf("keep-compressed=%t", s.KeepCompressed),
+        "recompress=" + s.recompressString(),
+        fmt.Sprintf("append=%t", s.Append),
+        fmt.Sprintf("weak-checksum=%t", s.meta.weak),
+        fmt.Sprintf("expose-location=%t", s.ExposeLocation),
+        fmt.Sprintf("flate-dict=%t", s.dict != nil),
+        fmt.Sprintf("auth=%t", s.auth != nil),
+        fmt.Sprintf("http-auth=%t", s.httpAuth != nil),
+        fmt.Sprintf("metrics-auth=%t", s.metricsAuth != nil),
+        fmt.Sprintf("hold=%t", s.holds != nil && s.scanner == nil),
+        fmt.Sprintf("scan-before-serve=%t", s.scanner != nil),
+        fmt.Sprintf("tracing=%t", s.tracer != nil),
+        "default-ext=" + optionString(s.DefaultExt),
+        fmt.Sprintf("max-header-size=%d", s.maxHeaderSize()),
+        "handshake-timeout=" + durationString(s.HandshakeTimeout),
+        "accept-timeout=" + durationString(s.AcceptTimeout),
+        fmt.Sprintf("max-name-attempts=%d", s.MaxNameAttempts),
+        "max-lifetime=" + durationString(s.MaxLifetime),
+    }
+}
+
+// diskRate returns the limit of the disk write rate in bytes per second, zero
+// meaning no limit.
+func (s *Server) diskRate() int64 {
+    if s.diskLimiter == nil {
+        return 0
+    }
+
+    return int64(s.diskLimiter.rate)
+}
+
+// tokenRate returns the limit of the receive rate per credentials in bytes
+// per second, zero meaning no limit.
+func (s *Server) tokenRate() int64 {
+    if s.tokenLimiters == nil {
+        return 0
+    }
+
+    return s.tokenLimiters.rate
+}
+
+// minFreeInodes returns the number of the free inodes below which the uploads
+// are refused, zero meaning no limit.
+func (s *Server) minFreeInodes() int64 {
+    if s.inodes == nil {
+        return 0
+    }
+
+    return s.inodes.min
+}
+
+// maxDecompressions returns the limit of the concurrent decompressions, zero
+// meaning no limit.
+func (s *Server) maxDecompressions() int {
+    if s.decompressions == nil {
+        return 0
+    }
+
+    return cap(s.decompressions.slots)
+}
+
+// maxSameName returns the number of the uploads of the same name within the
+// window beyond which the server warns, zero meaning no limit.
+func (s *Server) maxSameName() int {
+    if s.storms == nil {
+        return 0
+    }
+
+    return s.storms.max
+}
+
+// dedupPolicy returns the policy for the same contents under different
+// names, for the logs.
+func (s *Server) dedupPolicy() string {
+    if s.content == nil {
+        return dedupNone
+    }
+
+    return dedupHardlink
+}
+
+// evictionSettings returns the limit of the total size and the eviction
+// policy, for the logs.
+func (s *Server) evictionSettings() (int64, string) {
+    if s.evictor == nil {
+        return 0, "none"
+    }
+
+    return s.evictor.maxTotal, s.evictor.policy
+}
+
+func (s *Server) quotaLimit() int64 {
+    if s.quota == nil {
+        return 0
+    }
+
+    return s.quota.limit
+}
+
+// evict makes room for the newly stored file, if the total size is limited.
+func (s *Server) evict(keep string) {
+    if s.evictor == nil {
+        return
+    }
+
+    if err := s.evictor.evict(keep); err != nil {
+        log.Print(err)
+    }
+}
+
+// checkRequest will tell whether the server is willing to accept the
+// described transfer at all.
+func (s *Server) checkRequest(req *request) error {
+    if req.Op == opUpload {
+        name, err := s.NamePolicy.apply(req.Name)
+        if err != nil {
+            return err
+        }
+        if name != req.Name {
+            req.originalName, req.Name = req.Name, name
+        }
+
+        if err := s.checkStoredName(req.Name); err != nil {
+            return err
+        }
+
+        for i, alias := range req.Also {
+            if req.Also[i], err = s.NamePolicy.apply(alias); err != nil {
+                return err
+            }
+            if err := s.checkStoredName(req.Also[i]); err != nil {
+                return err
+            }
+        }
+    }
+
+    if s.quota != nil && (req.Op == opUpload || req.Op == opTar) && req.Size > 0 {
+        if err := s.quota.check(req.uploader, req.Size); err != nil {
+            return err
+        }
+    }
+
+    if len(req.Also) > 0 {
+        switch {
+        case req.Op != opUpload:
+            return fmt.Errorf("the Also header is only for the uploads")
+        case s.holds != nil:
+            return fmt.Errorf("the Also header can't be used while the uploads are held")
+        case s.Append:
+            return fmt.Errorf("the Also header can't be used with the appends")
+        }
+    }
+
+    if s.RejectDuringReload && (req.Op == opUpload || req.Op == opTar) {
+        if err := s.checkReloading(); err != nil {
+            return err
+        }
+    }
+
+    if s.readOnly != nil && (req.Op == opUpload || req.Op == opTar) {
+        if err := s.readOnly.check(); err != nil {
+            return err
+        }
+    }
+
+    if s.inodes != nil && (req.Op == opUpload || req.Op == opTar) {
+        if err := s.inodes.check(); err != nil {
+            return err
+        }
+    }
+
+    if s.RequireChecksum && (req.Op == opUpload || req.Op == opTar) &&
+       req.SHA256 == "" && req.Footer == "" {
+        return fmt.Errorf("a SHA256 header or a sha256 footer is required")
+    }
+
+    if req.Dictionary != "" && (s.dict == nil || s.dict.sum != req.Dictionary) {
+        return fmt.Errorf("unknown DEFLATE dictionary %s", req.Dictionary)
+    }
+
+    if s.MaxDeclaredSize > 0 && req.Size > s.MaxDeclaredSize {
+        return fmt.Errorf("the declared size of %d bytes exceeds the limit of %d bytes",
+                          req.Size, s.MaxDeclaredSize)
+    }
+
+    if s.TrustDeclaredSize && req.Size > 0 {
+        free, err := freeSpace(".")
+        if err != nil {
+            return fmt.Errorf("could not check the free space, %v", err)
+        }
+
+        if free >= 0 && req.Size > free {
+            return fmt.Errorf("not enough space for %d bytes", req.Size)
+        }
+    }
+
+    // Only the uploads that are otherwise accepted are counted.
+    if s.storms != nil && req.Op == opUpload {
+        if err := s.storms.record(s.withDefaultExt(req.Name)); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// handle is the handler for the incomming connections.
+// Legacy clients send the preferred name of the file in the first line of the
+// input, the others send the protocolMagic line followed by the header (see
+// readRequest). Unless the request is refused, the server then does what the
+// client asked for and closes the connection.
+func (s *Server) handle(con net.Conn) {
+    defer con.Close()
+    if err := s.handshake(con); err != nil {
+        log.Print(err)
+        return
+    }
+
+    r := bufio.NewReaderSize(&retryReader{r: con}, maxHeaderLine)
+
+    served := 0
+    for s.handleRequest(con, r) {
+        // The batch ends once the client closes the connection.
+        if _, err := r.Peek(1); err != nil {
+            return
+        }
+
+        served++
+        if s.MaxBatchFiles > 0 && served >= s.MaxBatchFiles {
+            s.refuseBatch(con, r)
+            return
+        }
+    }
+}
+
+// refuseBatch refuses the request following the last one the connection may
+// carry, before its data, so that the client can tell which uploads to send
+// again on another connection.
+func (s *Server) refuseBatch(con net.Conn, r *bufio.Reader) {
+    err := &storageError{
+        kind: ErrBatchLimit,
+        err:  fmt.Errorf("the connection carried the limit of %d files, send the rest on another one",
+                         s.MaxBatchFiles),
+    }
+    log.Printf("%v from %v. connection terminated.", err, con.RemoteAddr())
+
+    req, _ := readRequest(r, s.maxHeaderSize())
+    if req == nil {
+        req = &request{}
+    }
+    req.reply(con, &response{Error: err.Error(), Kind: errorKind(err)})
+}
+
+// handleRequest serves a single request of the connection and tells whether
+// the next one may follow on the same connection. Only the sequenced uploads
+// are followed by more requests, and only if nothing of their data is left
+// unread, i.e. they either went through or were refused before the data.
+func (s *Server) handleRequest(con net.Conn, r *bufio.Reader) bool {
+    sp := s.tracer.start("files")
+    defer s.tracer.end(sp)
+    sp.set("client.address", con.RemoteAddr().String())
+
+    req, err := readRequest(r, s.maxHeaderSize())
+    if req != nil {
+        req.uploader = remoteHost(con)
+        req.remote = con.RemoteAddr().String()
+    }
+    if err == nil && s.auth != nil {
+        if err := s.auth.authorize(req); err != nil {
+            authFailures.Add(1)
+            log.Printf("%v from %v. connection terminated.", err, con.RemoteAddr())
+            sp.fail(err)
+            req.reply(con, &response{Error: errUnauthorized.Error()})
+            return false
+        }
+    }
+    if err == nil {
+        err = s.checkRequest(req)
+        if err != nil && req.Seq != nil {
+            log.Printf("%v. upload %d refused.", err, *req.Seq)
+            sp.fail(err)
+            return req.reply(con, &response{Error: err.Error(), Kind: errorKind(err)}) == nil
+        }
+    }
+    if err != nil {
+        log.Printf("%v. connection terminated.", err)
+        sp.fail(err)
+        if req != nil {
+            req.reply(con, &response{Error: err.Error(), Kind: errorKind(err)})
+        }
+        return false
+    }
+
+    sp.rename("files " + req.Op)
+    if req.Seq != nil {
+        sp.set("files.seq", strconv.FormatInt(*req.Seq, 10))
+    }
+    switch req.Op {
+    case opUpload:
+        err = s.receiveFile(con, r, req, sp)
+    case opTar:
+        err = s.receiveArchive(con, r, req, sp)
+    case opManifest:
+        err = s.sendManifest(con, req.Prefix)
+    case opAudit:
+        err = s.sendAudit(con, req.Prefix)
+    case opStat:
+        err = s.sendStat(con, req)
+    case opSwap:
+        err = s.sendSwap(con, req)
+    case opApprove, opReject:
+        err = s.decideHold(con, req)
+    }
+
+    if err != nil {
+        log.Print(err)
+        sp.fail(err)
+    }
+
+    return req.Seq != nil && (err == nil || !req.streamed)
+}
+
+// remoteHost returns the address of the client without the port.
+func remoteHost(con net.Conn) string {
+    addr := con.RemoteAddr().String()
+    if host, _, err := net.SplitHostPort(addr); err == nil {
+        return host
+    }
+
+    return addr
+}
+
+// isLoopback tells whether the connection comes from the same host.
+func isLoopback(con net.Conn) bool {
+    addr, ok := con.RemoteAddr().(*net.TCPAddr)
+    return ok && addr.IP.IsLoopback()
+}
+
+// decideHold approves or rejects the held upload. Only the local clients are
+// allowed to, otherwise the uploaders could approve their own uploads.
+func (s *Server) decideHold(con net.Conn, req *request) error {
+    var err error
+    var name string
+    switch {
+    case s.holds == nil:
+        err = fmt.Errorf("the uploads are not held by the server")
+    case !isLoopback(con):
+        err = fmt.Errorf("only local clients may %s uploads", req.Op)
+    case req.Op == opApprove:
+        name, err = s.approveHold(req.Token)
+    default:
+        name, err = s.holds.reject(req.Token)
+        if err == nil {
+            s.meta.remove(name)
+        }
+    }
+
+    if err != nil {
+        req.reply(con, &response{Error: err.Error()})
+        return err
+    }
+
+    log.Printf("%sd held upload %q", req.Op, name)
+    if req.Op == opApprove {
+        if s.DoneMarkers {
+            if err := writeMarker(name); err != nil {
+                log.Printf("warning: %v", err)
+            }
+        }
+        s.evict(name)
+    }
+    req.reply(con, &response{Name: name})
+    return nil
+}
+
+// approveHold moves the held upload to the storage and returns its name,
+// charging it to the quota of the uploader saved in its metadata as it was
+// held. The upload stays held if the quota would be exceeded.
+func (s *Server) approveHold(token string) (string, error) {
+    name, err := s.holds.find(token)
+    if err != nil {
+        return "", err
+    }
+
+    var meta *fileMeta
+    if s.quota != nil {
+        stat, err := os.Stat(s.holds.heldPath(token, name))
+        if err != nil {
+            return "", fmt.Errorf("could not approve %q, %v", name, err)
+        }
+        meta, err = s.meta.load(name)
+        if err != nil {
+            log.Print(err)
+        }
+        if meta != nil && (!meta.fresh(stat) || meta.Uploader == "") {
+            meta = nil
+        }
+        if meta != nil {
+            if err := s.quota.check(meta.Uploader, meta.Size); err != nil {
+                return "", fmt.Errorf("could not approve %q, %v", name, err)
+            }
+        }
+    }
+
+    if _, err := s.holds.approve(token); err != nil {
+        return "", err
+    }
+    if meta != nil {
+        s.quota.add(name, meta.Uploader, meta.Size)
+    }
+
+    return name, nil
+}
+
+// withDefaultExt appends the default extension to the name if it has none.
+// The dotfiles, like ".profile", are taken as having one.
+func (s *Server) withDefaultExt(name string) string {
+    if s.DefaultExt == "" || filepath.Ext(name) != "" || strings.HasPrefix(name, ".") {
+        return name
+    }
+
+    return name + s.DefaultExt
+}
+
+// checkName makes sure the requested name is one of a file in the storage
+// directory, before it's resolved. The NUL bytes would cut the name short at
+// the system calls, and the other control characters (newlines included)
+// only ever confuse the logs and the tools listing the files, so they're all
+// refused, as are the names leading out of the flat storage directory.
+func checkName(name string) error {
+    switch {
+    case name == "":
+        return fmt.Errorf("the name of the file is empty")
+    case name == "." || name == "..":
+        return fmt.Errorf("invalid name of the file %q", name)
+    case strings.ContainsRune(name, '/') || strings.ContainsRune(name, os.PathSeparator):
+        return fmt.Errorf("the name of the file %q contains a path separator", name)
+    case strings.HasSuffix(name, partSuffix):
+        return fmt.Errorf("the names ending with %s are kept for the files being received", partSuffix)
+    }
+
+    for _, r := range name {
+        if unicode.IsControl(r) {
+            return fmt.Errorf("the name of the file %q contains the control character %U", name, r)
+        }
+    }
+
+    return nil
+}
+
+// checkStoredName checks the name like checkName, also refusing the names of
+// the completion markers when the server writes them.
+func (s *Server) checkStoredName(name string) error {
+    if err := checkName(name); err != nil {
+        return err
+    }
+    if isMarker(name, s.DoneMarkers) {
+        return fmt.Errorf("the names ending with %s are kept for the completion markers", doneSuffix)
+    }
+    return nil
+}
+
+// isTargetFree tells whether the file can be stored under the name. Since the
+// index only knows the regular files, the name might be taken by a directory
+// or the like, which must not be replaced.
+func isTargetFree(name string) bool {
+    stat, err := os.Lstat(name)
+    return err != nil || stat.Mode().IsRegular()
+}
+
+// maxHeaderSize returns the largest total size of the header lines of a
+// request.
+func (s *Server) maxHeaderSize() int {
+    if s.MaxHeaderSize <= 0 {
+        return defaultMaxHeaderSize
+    }
+    return s.MaxHeaderSize
+}
+
+// defaultMaxNameAttempts is how many names are tried for a file before giving
+// up, should they all be taken by directories or the like.
+const defaultMaxNameAttempts = 100
+
+// reserveTarget reserves the name the file is to be stored under, like the
+// index does, only skipping the names taken by something besides a regular
+// file, e.g. a directory, as if they were taken by the files. These then
+// stay taken, so the next uploads go right to the copies too. Should the
+// names tried all be taken, e.g. by another tool making the directories as
+// fast, the upload fails rather than trying on and on.
+func (s *Server) reserveTarget(name string) (resolved string, priorCopies int, err error) {
+    // The appends all go to the name itself.
+    if s.Append {
+        return name, 0, nil
+    }
+
+    maxAttempts := s.MaxNameAttempts
+    if maxAttempts <= 0 {
+        maxAttempts = defaultMaxNameAttempts
+    }
+
+    resolved, priorCopies = s.index.reserve(name)
+    for attempt := 1; !isTargetFree(resolved); attempt++ {
+        s.index.keep(resolved)
+        if attempt >= maxAttempts {
+            return "", 0, &storageError{
+                kind: ErrBackendUnavailable,
+                err:  fmt.Errorf("could not find a name to store %q under, the %d names tried are "+
+                                 "taken by directories or the like", name, attempt),
+            }
+        }
+
+        log.Printf("%q is taken by a directory or the like, storing %q under a copy name", resolved, name)
+        resolved, _ = s.index.reserve(name)
+    }
+
+    return resolved, priorCopies, nil
+}
+
+// checkPathLength makes sure the paths the file will be written to are within
+// the limits of the filesystem: the temporary file, which is the longest
+// name of it in the storage directory, and the place it's held at, if it is.
+func checkPathLength(name, token string) error {
+    paths := []string{name + partSuffix}
+    if token != "" {
+        paths = append(paths, filepath.Join(holdDir, token, name))
+    }
+
+    for _, path := range paths {
+        if len(filepath.Base(path)) > maxNameLen {
+            return fmt.Errorf("the name %q is too long, %q would exceed the limit of %d bytes",
+                              name, filepath.Base(path), maxNameLen)
+        }
+
+        abs, err := filepath.Abs(path)
+        if err != nil {
+            return fmt.Errorf("could not check the path of %q, %v", name, err)
+        }
+        if len(abs) >= maxPathLen {
+            return fmt.Errorf("the name %q is too long, the path %q would exceed the limit of %d bytes",
+                              name, abs, maxPathLen - 1)
+        }
+    }
+
+    return nil
+}
+
+// deflateRatioGrace is how much of the data is decompressed before the
+// ratio of the decompressed data to the compressed is checked.
+const deflateRatioGrace = 1 << 20
+
+// checkSize tells whether the server is willing to receive the file after
+// the first received bytes.
+func (s *Server) checkSize(req *request, received int64) error {
+    if req.deflate && s.MaxDeflateSize > 0 {
+        if received > s.MaxDeflateSize {
+            return fmt.Errorf("the file exceeds the limit of %d bytes of the compressed uploads",
+                              s.MaxDeflateSize)
+        }
+    } else if s.MaxSize > 0 && received > s.MaxSize {
+        return fmt.Errorf("the file exceeds the limit of %d bytes", s.MaxSize)
+    }
+
+    // The start of the data may well compress better than the rest of it,
+    // the ratio is only checked once there's enough to tell.
+    if fs := req.inflation; s.MaxDeflateRatio > 0 && fs != nil && fs.decompressed > deflateRatioGrace &&
+       float64(fs.decompressed) > s.MaxDeflateRatio * float64(fs.compressed) {
+        return fmt.Errorf("the data decompresses to more than %g times its size", s.MaxDeflateRatio)
+    }
+
+    if req.maxSize > 0 && received > req.maxSize {
+        return fmt.Errorf("the file exceeds the limit of the upload token of %d bytes", req.maxSize)
+    }
+
+    if s.TrustDeclaredSize && req.Size >= 0 && received > req.Size {
+        return fmt.Errorf("the file exceeds the declared size of %d bytes", req.Size)
+    }
+
+    return nil
+}
+
+// receiveFile uploads the file described by the request. The actual name of
+// the file, where the data will be saved, is written back to the socket. If
+// the client asked to confirm, it then says whether it wants to "proceed" or
+// to "abort". Then, the DEFLATE compressed data is received until the end of
+// the stream, followed by the footer if the client announced one. Finally, if
+// the client asked for it, whether the file was stored is written back too.
+func (s *Server) receiveFile(con net.Conn, r *bufio.Reader, req *request,
+                             sp *span) error {
+    sp.set("files.name", req.Name)
+
+    // The held uploads are given a token right away, to be sure the file can
+    // be referred to once received.
+    var token string
+    if s.holds != nil {
+        var err error
+        token, err = newHoldToken()
+        if err != nil {
+            req.reply(con, &response{Error: err.Error()})
+            return err
+        }
+    }
+
+    name := s.withDefaultExt(req.Name)
+    serverFilename, priorCopies, err := s.reserveTarget(name)
+    if err != nil {
+        req.reply(con, &response{Error: err.Error(), Kind: errorKind(err)})
+        return err
+    }
+    sp.set("files.server_name", serverFilename)
+
+    // Unless it's handed over to storeFile, the name is given back if the
+    // upload doesn't go through.
+    handedOver := false
+    defer func() {
+        if !handedOver {
+            s.index.Release(serverFilename)
+        }
+    }()
+
+    if err := checkPathLength(serverFilename, token); err != nil {
+        req.reply(con, &response{Error: err.Error()})
+        return err
+    }
+
+    // The quarantined uploads are served once scanned, there's nothing the
+    // client could do with the token.
+    resp := &response{Name: serverFilename}
+    if s.scanner == nil {
+        resp.Token = token
+    }
+    if serverFilename != name {
+        resp.Copy = true
+        resp.PriorCopies = &priorCopies
+    }
+
+    err = req.reply(con, resp)
+    if err != nil {
+        log.Printf("could not send the name of the file back.")
+    }
+
+    if req.Confirm {
+        answer, err := readLine(r)
+        if err != nil || answer != "proceed" {
+            return fmt.Errorf("the client did not proceed with uploading %q",
+                              serverFilename)
+        }
+    }
+
+    start := s.clock().Now()
+    zr := s.newFlateReader(r, req)
+    defer req.compressed.discard()
+    src := &trailerReader{zr: zr, con: con, r: r, req: req, strict: s.StrictTrailer,
+                          strictClose: s.StrictClose}
+    handedOver = true
+    req.streamed = true
+    file, err := s.storeFile(src, req, serverFilename, token, sp)
+    if s.readOnly != nil {
+        s.readOnly.note(err)
+    }
+    if closeErr := zr.Close(); err == nil && closeErr != nil {
+        log.Printf("warning: could not close DEFLATE decompressor for %q, %v", 
+                   serverFilename, closeErr)
+    }
+    s.events.transfer(req, start, file, err)
+
+    if req.Status {
+        status := &response{Status: "ok", Name: serverFilename, Size: &file.size,
+                             SHA256: file.sha256, ETag: fileETag(file.sha256),
+                             Deduplicated: file.dedup, Appended: file.appended}
+        if len(file.also) > 0 {
+            status.Names = append([]string{serverFilename}, file.also...)
+        }
+        if err != nil {
+            status = errorResponse(err)
+        }
+        req.flateStats.report(status)
+
+        if err := req.reply(con, status); err != nil {
+            log.Printf("could not send the status of %q back.", serverFilename)
+        }
+    }
+
+    return err
+}
+
+// newFlateReader decompresses the data of the request, with the preset
+// dictionary if the client used it, within the limit of the concurrent
+// decompressions. The decompression is measured for the verbose clients, and
+// the compressed data kept with KeepCompressed.
+func (s *Server) newFlateReader(r *bufio.Reader, req *request) io.ReadCloser {
+    req.deflate = true
+
+    var in flateInput = r
+    if req.Verbose || s.MaxDeflateRatio > 0 {
+        req.inflation = &flateStats{}
+        in = &countingReader{r: r, stats: req.inflation}
+    }
+    if req.Verbose {
+        req.flateStats = req.inflation
+    }
+
+    // The data compressed with the preset dictionary couldn't be
+    // decompressed by anyone else, and the fragments appended are only parts
+    // of the files.
+    if s.KeepCompressed && req.Op == opUpload && req.Dictionary == "" && !s.Append {
+        req.compressed = newCompressedCopy(in)
+        if req.compressed != nil {
+            in = req.compressed
+        }
+    }
+
+    var zr io.ReadCloser
+    if req.Dictionary != "" {
+        zr = flate.NewReaderDict(in, s.dict.data)
+    } else {
+        zr = flate.NewReader(in)
+    }
+
+    if req.inflation != nil {
+        zr = &timedDecompressor{ReadCloser: zr, stats: req.inflation}
+    }
+
+    if s.decompressions == nil {
+        return zr
+    }
+
+    return &limitedDecompressor{ReadCloser: zr, limiter: s.decompressions}
+}
+
+// storeFile saves the data read from src until the end under the name, or
+// holds it if the token is set. The data is written to a temporary file,
+// which is renamed to the name only after the whole file was received.
+// Whatever way the transfer fails, the temporary file is removed. The stored
+// file is returned, with its size and its checksum. The name must be reserved
+// in the index, it's kept once the file is stored (or held) and released
+// otherwise.
+func (s *Server) storeFile(src io.Reader, req *request, serverFilename, token string,
+                           sp *span) (receivedFile, error) {
+    committed := false
+    defer func() {
+        if committed {
+            s.index.keep(serverFilename)
+        } else {
+            s.index.Release(serverFilename)
+        }
+    }()
+
+    // The concurrent appends to the same name are received side by side.
+    tempFilename := serverFilename + partSuffix
+    var file *os.File
+    var err error
+    if s.Append {
+        file, err = ioutil.TempFile(".", serverFilename + ".*" + partSuffix)
+        if err == nil {
+            tempFilename = file.Name()
+        }
+    } else {
+        file, err = os.OpenFile(tempFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+        if os.IsExist(err) && s.removeStalePart(tempFilename) {
+            file, err = os.OpenFile(tempFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+        }
+    }
+    if err != nil {
+        // Whatever is in the way would be in the way of the next upload of
+        // the same name too.
+        if os.IsExist(err) {
+            s.index.keep(serverFilename)
+        }
+        return receivedFile{}, newStorageError(err, fmt.Errorf("could not create file %q, %v",
+                                                               tempFilename, err))
+    }
+
+    // What was decompressed before the data failed to decompress is kept
+    // aside with KeepPartial.
+    salvage := false
+    var fileSize int64
+    defer func() {
+        if committed {
+            return
+        }
+
+        if salvage {
+            path, err := salvagePartial(file, tempFilename, serverFilename, fileSize)
+            if err == nil {
+                log.Printf("kept the %d bytes of %q decompressed before the error in %q",
+                           fileSize, serverFilename, path)
+                return
+            }
+            log.Print(err)
+        }
+
+        file.Close()
+        if err := os.Remove(tempFilename); err != nil {
+            log.Printf("could not remove partial file %q, %v", tempFilename, err)
+        }
+    }()
+
+    if s.TrustDeclaredSize && req.Size > 0 {
+        err := preallocate(file, req.Size)
+        if errors.Is(err, syscall.ENOSPC) {
+            return receivedFile{}, newStorageError(err, fmt.Errorf("could not receive file %q, %v",
+                                                                   serverFilename, err))
+        }
+        if err != nil {
+            log.Printf("warning: could not preallocate %q, %v", tempFilename, err)
+        }
+    }
+
+    h := sha256.New()
+    var out io.Writer = file
+    if s.diskLimiter != nil {
+        out = &limitedWriter{w: file, limiter: s.diskLimiter}
+    }
+    if s.tokenLimiters != nil && req.credentials != "" {
+        out = &limitedWriter{w: out, limiter: s.tokenLimiters.acquire(req.credentials)}
+        defer s.tokenLimiters.release(req.credentials)
+    }
+    weak := adler32.New()
+    if s.meta.weak || req.compressed != nil {
+        out = io.MultiWriter(out, h, weak)
+    } else {
+        out = io.MultiWriter(out, h)
+    }
+
+    log.Printf("receiving %q...", serverFilename)
+    progress := s.transfers.start(serverFilename, req.remote)
+    defer s.transfers.end(progress)
+
+    // The received bytes are charged to the quota until the file is either
+    // stored, and counted as such, or given up on.
+    var charged int64
+    if s.quota != nil {
+        defer func() { s.quota.refund(req.uploader, charged) }()
+    }
+
+    buf := make([]byte, 1024)
+    for {
+        n, err := src.Read(buf)
+        if n == 0 {
+            if err == io.EOF {
+                break
+            }
+
+            salvage = s.KeepPartial && isDecompressionError(err)
+            return receivedFile{}, fmt.Errorf("could not receive file %q, %v", serverFilename, err)
+        }
+
+        fileSize += int64(n)
+        progress.add(int64(n))
+        sp.set("files.size", fileSize)
+        if err := s.checkSize(req, fileSize); err != nil {
+            return receivedFile{}, fmt.Errorf("could not receive file %q, %v", serverFilename, err)
+        }
+
+        if s.quota != nil {
+            if err := s.quota.charge(req.uploader, int64(n)); err != nil {
+                return receivedFile{}, fmt.Errorf("could not receive file %q, %v", serverFilename, err)
+            }
+            charged += int64(n)
+        }
+
+        _, err = out.Write(buf[:n])
+        if err != nil {
+            return receivedFile{}, newStorageError(err, fmt.Errorf("could not receive file %q, %v",
+                                                                   serverFilename, err))
+        }
+    }
+
+    // The data must be durable before the completion marker is written.
+    if s.DoneMarkers {
+        if err := file.Sync(); err != nil {
+            return receivedFile{}, newStorageError(err, fmt.Errorf("could not receive file %q, %v",
+                                                                   serverFilename, err))
+        }
+    }
+
+    if err := file.Close(); err != nil {
+        return receivedFile{}, newStorageError(err, fmt.Errorf("could not receive file %q, %v",
+                                                               serverFilename, err))
+    }
+
+    sum := hex.EncodeToString(h.Sum(nil))
+    sp.set("files.sha256", sum)
+    received := receivedFile{name: serverFilename, token: token, size: fileSize, sha256: sum}
+
+    if req.SHA256 != "" && req.SHA256 != sum {
+        return receivedFile{}, fmt.Errorf("could not receive file %q, the checksum %s doesn't match the expected %s",
+                                          serverFilename, sum, req.SHA256)
+    }
+
+    if token != "" {
+        if err := s.holds.hold(token, tempFilename, serverFilename); err != nil {
+            return receivedFile{}, err
+        }
+        committed = true
+
+        if s.scanner == nil {
+            // The name stays reserved while held, the metadata is saved
+            // under it already so that the uploader is charged on approval.
+            if stat, err := os.Stat(s.holds.heldPath(token, serverFilename)); err == nil {
+                if err := s.meta.save(serverFilename, s.newFileMeta(stat, req, sum, weak.Sum32())); err != nil {
+                    log.Print(err)
+                }
+            }
+
+            log.Printf("received %q (%d bytes), held with token %q",
+                       serverFilename, fileSize, token)
+            return received, nil
+        }
+
+        if err := s.serveScanned(token, serverFilename); err != nil {
+            return receivedFile{}, err
+        }
+    } else if s.Append {
+        total, err := s.appendFragment(tempFilename, serverFilename)
+        if err != nil {
+            return receivedFile{}, err
+        }
+        committed = true
+        received.appended = true
+
+        // The checksum of the whole file is computed once it's asked for.
+        if stat, err := os.Stat(serverFilename); err == nil {
+            err := s.meta.save(serverFilename, &fileMeta{
+                Size:     stat.Size(),
+                ModTime:  stat.ModTime(),
+                Uploader: req.uploader,
+            })
+            if err != nil {
+                log.Print(err)
+            }
+        }
+        if s.quota != nil {
+            s.quota.add(serverFilename, req.uploader, total)
+        }
+        if s.DoneMarkers && !req.deferMarker {
+            if err := writeMarker(serverFilename); err != nil {
+                log.Printf("warning: %v", err)
+            }
+        }
+
+        log.Printf("appended %d bytes to %q (%d bytes)", fileSize, serverFilename, total)
+        s.evict(serverFilename)
+
+        return received, nil
+    } else {
+        if err := os.Rename(tempFilename, serverFilename); err != nil {
+            return receivedFile{}, newStorageError(err, fmt.Errorf("could not receive file %q, %v",
+                                                                   serverFilename, err))
+        }
+        committed = true
+    }
+
+    if s.content != nil {
+        received.dedup = s.content.link(serverFilename, sum, fileSize)
+    }
+
+    // The checksum is already known, there's no need to compute it again
+    // once the manifest is asked for.
+    if stat, err := os.Stat(serverFilename); err == nil {
+        if err := s.meta.save(serverFilename, s.newFileMeta(stat, req, sum, weak.Sum32())); err != nil {
+            log.Print(err)
+        }
+    }
+    req.compressed.keep(sum, weak.Sum32())
+
+    if s.quota != nil {
+        s.quota.add(serverFilename, req.uploader, fileSize)
+    }
+
+    if s.DoneMarkers && !req.deferMarker {
+        if err := writeMarker(serverFilename); err != nil {
+            log.Printf("warning: %v", err)
+        }
+    }
+
+    log.Printf("received %q (%d bytes)", serverFilename, fileSize)
+    if len(req.Also) > 0 {
+        received.also = s.storeAliases(serverFilename, req, sum, fileSize)
+    }
+    s.evict(serverFilename)
+
+    return received, nil
+}
+
+// newFileMeta returns the metadata of the file received for the request, with
+// its checksums.
+func (s *Server) newFileMeta(stat os.FileInfo, req *request, sum string, weak uint32) *fileMeta {
+    meta := &fileMeta{
+        Size:     stat.Size(),
+        ModTime:  stat.ModTime(),
+        SHA256:   sum,
+        Uploader: req.uploader,
+    }
+    if s.meta.weak {
+        meta.Adler32 = adlerString(weak)
+    }
+    if req.originalName != "" {
+        meta.OriginalName = []byte(req.originalName)
+    }
+
+    return meta
+}
+
+// privilegedPorts are the ports below which only the privileged processes
+// may listen on Unix.
+const privilegedPorts = 1024
+
+// listen starts listening on the address, or on the port of all the
+// addresses if only the port is given. The errors tell what to do about the
+// usual reasons it fails for.
+func listen(addr string) (net.Listener, error) {
+    if !strings.Contains(addr, ":") {
+        addr = ":" + addr
+    }
+
+    l, err := net.Listen("tcp", addr)
+    if err == nil {
+        return l, nil
+    }
+
+    _, port, _ := net.SplitHostPort(addr)
+    n, _ := strconv.Atoi(port)
+    switch {
+    case errors.Is(err, os.ErrPermission) && n > 0 && n < privilegedPorts:
+        return nil, fmt.Errorf("%v; the ports below %d need privileges, use a higher port, "+
+                               "grant the executable CAP_NET_BIND_SERVICE "+
+                               "(setcap cap_net_bind_service=+ep <executable>) "+
+                               "or run the server behind a proxy listening on port %d",
+                               err, privilegedPorts, n)
+    case errors.Is(err, syscall.EADDRINUSE):
+        return nil, fmt.Errorf("%v; port %s is taken, is another server running?", err, port)
+    }
+
+    return nil, err
+}
+
+var (
+    tlsCert = flag.String("tls-cert", "",
+        "PEM file with the TLS certificate, enables TLS together with -tls-key")
+    tlsKey = flag.String("tls-key", "", "PEM file with the TLS private key")
+    tlsMinVersion = flag.String("tls-min-version", "1.2",
+        "oldest TLS version the clients may use, 1.2 or 1.3")
+    tlsCiphers = flag.String("tls-ciphers", "",
+        "comma separated list of the TLS 1.2 cipher suites the clients may use, the secure defaults of Go if empty")
+
+    httpPort = flag.String("http-port", "",
+        "port, or address:port, to upload and download the files over HTTP on, disabled if empty")
+    httpSecretFile = flag.String("http-secret-file", "",
+        "file with the secret of the HTTP uploads and downloads, the one of -secret-file if empty")
+
+    metricsPort = flag.String("metrics-port", "",
+        "port, or address:port, to serve the metrics over HTTP on, disabled if empty")
+    uiAddr = flag.String("ui-addr", "",
+        "port, or address:port, to serve the web interface for the browsers on, disabled if empty")
+    metricsSecretFile = flag.String("metrics-secret-file", "",
+        "file with the secret of the metrics, anyone may read them if empty")
+
+    flateDictFile = flag.String("flate-dict", "",
+        "file with the preset DEFLATE dictionary the clients may compress the data with")
+
+    secretFile = flag.String("secret-file", "",
+        "file with the secret the clients must authenticate with, or mint the upload tokens with")
+
+    trustedProxies = flag.String("trusted-proxies", "",
+        "comma separated CIDRs of the proxies sending the PROXY protocol header, " +
+        "or the X-Forwarded-For header over HTTP")
+
+    maxDeclaredSize = flag.Int64("max-declared-size", 0,
+        "largest file size in bytes the clients may declare, 0 means no limit")
+    maxSize = flag.Int64("max-size", 0,
+        "largest number of bytes received for a file, 0 means no limit")
+    maxDeflateSize = flag.Int64("max-deflate-size", 0,
+        "largest number of bytes received for a file uploaded compressed, instead of -max-size if not 0")
+    maxDeflateRatio = flag.Float64("max-deflate-ratio", 0,
+        "largest ratio of the decompressed data to the compressed, 0 means no limit")
+    trustDeclaredSize = flag.Bool("trust-declared-size", false,
+        "check the free space for and preallocate the size declared by the clients")
+    keepCompressed = flag.Bool("keep-compressed", false,
+        "keep the compressed data of the uploads and serve it to the HTTP clients accepting deflate")
+    recompress = flag.String("recompress", "",
+        "compress the stored files in the background with the codec, deflate, and serve them " +
+        "to the HTTP clients accepting it, none if empty")
+    recompressRate = flag.Int64("recompress-rate", defaultRecompressRate,
+        "limit of the rate the recompressor reads the files at in bytes per second, 0 means no limit")
+    recompressMinSize = flag.Int64("recompress-min-size", defaultRecompressMinSize,
+        "size of the smallest file the recompressor compresses")
+    recompressInterval = flag.Duration("recompress-interval", defaultRecompressInterval,
+        "how long the recompressor waits between its passes over the stored files")
+    eventSocket = flag.String("event-socket", "",
+        "Unix socket or named pipe to write a JSON line to for every transfer")
+    maxBatchFiles = flag.Int("max-batch-files", 0,
+        "largest number of the files a connection may carry, 0 means no limit")
+    nonUTF8Names = flag.String("non-utf8-names", string(namesKeep),
+        "what to do with the names that aren't valid UTF-8: keep, reject or escape them")
+    stalePartAge = flag.Duration("stale-part-age", defaultStalePartAge,
+        "how long the temporary files of the interrupted transfers must be left unchanged for to be removed, 0 keeps them")
+    rejectDuringReload = flag.Bool("reject-during-reload", false,
+        "refuse the new uploads while the index is rebuilt on SIGHUP, for the clients to try again")
+    weakChecksum = flag.Bool("weak-checksum", false,
+        "keep the Adler-32 of every stored file too and tell it in its stat")
+    exposeLocation = flag.Bool("expose-location", false,
+        "tell the absolute paths and the devices of the stored files in their stat")
+    keepPartial = flag.Bool("keep-partial", false,
+        "keep what was decompressed of the uploads failing to decompress in " + partialDir)
+    appendMode = flag.Bool("append", false,
+        "append the uploads to the file of the name instead of storing them as copies")
+    appendSeparator = flag.String("append-separator", "",
+        "separator written between the appended uploads, with the escapes of Go strings, e.g. \\n")
+    doneMarker = flag.Bool("done-marker", false,
+        "write an empty <name>.done file once every file is durably stored")
+    minFreeInodes = flag.Int64("min-free-inodes", 0,
+        "number of free inodes below which the uploads are refused, 0 means no limit")
+    maxSameName = flag.Int("max-same-name", 0,
+        "number of uploads of the same name within -same-name-window beyond which the server warns, 0 means no limit")
+    sameNameWindow = flag.Duration("same-name-window", time.Minute,
+        "the window of -max-same-name")
+    rejectSameName = flag.Bool("reject-same-name", false,
+        "refuse the uploads beyond -max-same-name instead of only warning")
+    maxDecompressions = flag.Int("max-decompressions", 0,
+        "largest number of uploads decompressing their data at once, 0 means no limit")
+    diskRate = flag.Int64("disk-rate", 0,
+        "limit of the aggregate disk write rate in bytes per second, 0 means no limit")
+    tokenRate = flag.Int64("token-rate", 0,
+        "limit of the aggregate receive rate per secret or upload token in bytes per second, 0 means no limit")
+
+    quota = flag.Int64("quota", 0,
+        "largest number of bytes every client address may store, 0 means no limit")
+    maxTrackedKeys = flag.Int("max-tracked-keys", defaultMaxTrackedKeys,
+        "most names, credentials and client addresses every limit keeps track of, " +
+        "the least recently seen beyond are forgotten, 0 means no limit")
+
+    maxTotalSize = flag.Int64("max-total-size", 0,
+        "evict the least recently used files beyond the total size in bytes, 0 means no limit")
+    evictBy = flag.String("evict-by", evictByMtime,
+        "what the least recently used files are, by \"mtime\" or by \"atime\"")
+
+    dedup = flag.String("dedup", dedupNone,
+        "what to do with the same contents uploaded under different names, " +
+        dedupNone + " to store them as they are or " + dedupHardlink +
+        " to store them as hard links to the first file with the contents")
+
+    otlpEndpoint = flag.String("otlp-endpoint", "",
+        "OTLP/HTTP URL to export the traces to, e.g. http://localhost:4318/v1/traces")
+
+    maxArchiveFiles = flag.Int("max-archive-files", 10000,
+        "largest number of entries of a tar upload, 0 means no limit")
+    maxArchiveSize = flag.Int64("max-archive-size", 0,
+        "largest total size in bytes of the files of a tar upload, 0 means no limit")
+
+    requireChecksum = flag.Bool("require-checksum", false,
+        "refuse the uploads without a SHA256 header or a sha256 footer")
+
+    strictTrailer = flag.Bool("strict-trailer", false,
+        "refuse the uploads followed by unexpected bytes after the data, instead of warning")
+    strictClose = flag.Bool("strict-close", false,
+        "refuse the uploads whose DEFLATE decompressor fails to close, instead of warning")
+
+    defaultExt = flag.String("default-ext", "",
+        "extension appended to the names without one, e.g. .bin")
+
+    runAsUser = flag.String("user", "",
+        "user, by name or ID, to switch to once listening, e.g. after binding a low port as root")
+    runAsGroup = flag.String("group", "",
+        "group, by name or ID, to switch to once listening, the primary group of -user if empty")
+
+    maxHeaderSizeFlag = flag.Int("max-header-size", defaultMaxHeaderSize,
+        "largest total size in bytes of the header lines of a request")
+
+    handshakeTimeout = flag.Duration("handshake-timeout", defaultHandshakeTimeout,
+        "how long the clients have to complete the TLS handshake and the PROXY header, 0 means no limit")
+    maxNameAttempts = flag.Int("max-name-attempts", defaultMaxNameAttempts,
+        "how many names to try for a file whose names are taken by directories or the like")
+    acceptTimeout = flag.Duration("accept-timeout", defaultAcceptTimeout,
+        "how often the idle listener checks whether the server is shutting down, 0 means never")
+
+    maxLifetime = flag.Duration("max-lifetime", 0,
+        "shut down gracefully after running for the duration, 0 means run forever")
+
+    hold = flag.Bool("hold", false,
+        "hold the received files until a local client approves them")
+    holdTTL = flag.Duration("hold-ttl", 24 * time.Hour,
+        "how long the files are held before they are discarded")
+
+    scanBeforeServe = flag.Bool("scan-before-serve", false,
+        "quarantine the received files until -scan-cmd passes them")
+    scanCmd = flag.String("scan-cmd", "",
+        "command scanning the quarantined files, given the path of the file as the last argument")
+    scanTimeout = flag.Duration("scan-timeout", time.Minute,
+        "how long the scan of a file may take before it's failed")
+)
+
+func main() {
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(),
+            "Usage:\n\tfiles [flags] <port>\n\tfiles export-index\n\tfiles migrate [-dry-run]\n" +
+            "\tfiles -secret-file <file> mint-token [-ttl <duration>] [-name <name>] [-max-size <bytes>]\n" +
+            "\tfiles bench [-size <bytes>] [-concurrency <n>] [-duration <duration>] <host>:<port>\n" +
+            "\nFlags:\n")
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    if flag.Arg(0) == "mint-token" {
+        if err := mintCommand(flag.Args()[1:], *secretFile); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    if flag.Arg(0) == "bench" {
+        if err := benchCommand(flag.Args()[1:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    if flag.Arg(0) == "migrate" {
+        if err := migrateCommand(flag.Args()[1:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    if flag.NArg() != 1 {
+        flag.Usage()
+        return
+    }
+
+    server := &Server{
+        readOnly:        newReadOnlyGuard(realClock{}),
+        MaxDeclaredSize: *maxDeclaredSize,
+        MaxSize:         *maxSize,
+        MaxDeflateSize:  *maxDeflateSize,
+        MaxDeflateRatio: *maxDeflateRatio,
+        MaxLifetime:     *maxLifetime,
+        DefaultExt:      *defaultExt,
+        StrictTrailer:   *strictTrailer,
+        StrictClose:     *strictClose,
+        RequireChecksum: *requireChecksum,
+        MaxArchiveFiles: *maxArchiveFiles,
+        MaxArchiveSize:  *maxArchiveSize,
+
+        TrustDeclaredSize: *trustDeclaredSize,
+        KeepPartial:       *keepPartial,
+        DoneMarkers:       *doneMarker,
+        ExposeLocation:    *exposeLocation,
+        HandshakeTimeout:  *handshakeTimeout,
+        AcceptTimeout:     *acceptTimeout,
+        MaxNameAttempts:   *maxNameAttempts,
+        MaxHeaderSize:     *maxHeaderSizeFlag,
+
+        RejectDuringReload: *rejectDuringReload,
+        StalePartAge:       *stalePartAge,
+        MaxTrackedKeys:     *maxTrackedKeys,
+        MaxBatchFiles:      *maxBatchFiles,
+        KeepCompressed:     *keepCompressed,
+    }
+
+    server.transfers = newTransfers(server.clock())
+
+    // The index is built without the leftovers of the interrupted transfers,
+    // which export-index leaves as they are.
+    if flag.Arg(0) != "export-index" && *stalePartAge > 0 {
+        removed, err := server.removeStaleParts()
+        if err != nil {
+            log.Fatal(err)
+        }
+        if removed > 0 {
+            log.Printf("removed %d stale temporary files", removed)
+        }
+    }
+
+    dir, err := os.Open("./")
+    if err != nil {
+        log.Fatalf("could not open current directory, %v", err)
+    }
+    defer dir.Close()
+
+    index, err := NewFileIndexFromDir(dir)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    if flag.Arg(0) == "export-index" {
+        if err := exportIndexCSV(os.Stdout, index); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    meta, err := newMetaStore(metaDir)
+    if err != nil {
+        log.Fatal(err)
+    }
+    meta.weak = *weakChecksum
+    server.index = index
+    server.meta = meta
+
+    server.NamePolicy, err = parseNamePolicy(*nonUTF8Names)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    if *eventSocket != "" {
+        server.events = newEventSink(*eventSocket, server.clock())
+    }
+    if *appendMode {
+        server.Append = true
+        server.AppendSeparator, err = strconv.Unquote(`"` + *appendSeparator + `"`)
+        if err != nil {
+            log.Fatalf("could not parse -append-separator, %v", err)
+        }
+        server.appends = newAppendLocks()
+    }
+    if *diskRate > 0 {
+        server.diskLimiter = newRateLimiter(*diskRate, server.clock())
+    }
+
+    if *maxSameName > 0 {
+        server.storms = newStormDetector(*maxSameName, *sameNameWindow, *rejectSameName, *maxTrackedKeys,
+                                          server.clock())
+    }
+
+    if *maxDecompressions > 0 {
+        server.decompressions = newDecompressionLimiter(*maxDecompressions)
+    }
+
+    if *minFreeInodes > 0 {
+        server.inodes = newInodeGuard(*minFreeInodes, server.clock())
+        if err := server.inodes.update(); err != nil {
+            log.Fatal(err)
+        }
+        go server.inodes.updatePeriodically()
+    }
+
+    if server.DefaultExt != "" && !strings.HasPrefix(server.DefaultExt, ".") {
+        server.DefaultExt = "." + server.DefaultExt
+    }
+
+    if *flateDictFile != "" {
+        server.dict, err = loadDict(*flateDictFile)
+        if err != nil {
+            log.Fatal(err)
+        }
+    }
+
+    server.auth, err = loadAuthenticator(*secretFile, server.clock())
+    if err != nil {
+        log.Fatal(err)
+    }
+    server.httpAuth = server.auth
+    if *httpSecretFile != "" {
+        server.httpAuth, err = loadAuthenticator(*httpSecretFile, server.clock())
+        if err != nil {
+            log.Fatal(err)
+        }
+    }
+
+    if *tokenRate > 0 {
+        if server.auth == nil && server.httpAuth == nil {
+            log.Fatal("-secret-file or -http-secret-file is needed to limit the rate per token")
+        }
+        server.tokenLimiters = newLimiterPool(*tokenRate, *maxTrackedKeys, server.clock())
+    }
+
+    server.TrustedProxies, err = parseNetworks(*trustedProxies)
+    if err != nil {
+        log.Fatalf("could not parse -trusted-proxies, %v", err)
+    }
+
+    server.metricsAuth, err = loadAuthenticator(*metricsSecretFile, server.clock())
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    if *quota > 0 {
+        server.quota = newQuotaTracker(*quota, meta, server.DoneMarkers, *maxTrackedKeys, server.clock())
+        if err := server.quota.rescan(); err != nil {
+            log.Fatal(err)
+        }
+        go server.quota.rescanPeriodically()
+    }
+
+    if server.storms != nil || server.tokenLimiters != nil {
+        go server.sweepTrackedPeriodically()
+    }
+
+    if *recompress != "" {
+        c, err := parseCodec(*recompress)
+        if err != nil {
+            log.Fatalf("could not parse -recompress, %v", err)
+        }
+        if *recompressInterval <= 0 {
+            log.Fatal("-recompress-interval must be positive")
+        }
+
+        var limiter *rateLimiter
+        if *recompressRate > 0 {
+            limiter = newRateLimiter(*recompressRate, server.clock())
+        }
+        server.recompressor = newRecompressor(c, meta, server.DoneMarkers, *recompressMinSize,
+                                              *recompressInterval, limiter, server.transfers.busy,
+                                              server.clock())
+        go server.recompressor.run()
+    }
+
+    go server.reloadIndexOnSignal()
+
+    if *maxTotalSize > 0 {
+        server.evictor, err = newEvictor(*maxTotalSize, *evictBy, ".", meta, server.DoneMarkers)
+        if err != nil {
+            log.Fatal(err)
+        }
+        server.evictor.quota = server.quota
+    }
+
+    switch *dedup {
+    case dedupNone:
+    case dedupHardlink:
+        server.content, err = newContentIndex(meta, server.DoneMarkers)
+        if err != nil {
+            log.Fatal(err)
+        }
+    default:
+        log.Fatalf("unknown -dedup policy %q", *dedup)
+    }
+
+    if *otlpEndpoint != "" {
+        server.tracer = newTracer(*otlpEndpoint)
+    }
+
+    if *hold && *scanBeforeServe {
+        log.Fatal("-hold and -scan-before-serve can't be used together")
+    }
+
+    // The held files and the links are stored whole, they can't be
+    // appended to.
+    if *appendMode && (*hold || *scanBeforeServe || *dedup != dedupNone) {
+        log.Fatal("-append can't be used together with -hold, -scan-before-serve or -dedup")
+    }
+
+    if *scanBeforeServe {
+        command := strings.Fields(*scanCmd)
+        if len(command) == 0 {
+            log.Fatal("-scan-cmd is needed to scan the files before serving them")
+        }
+        server.scanner = &scanner{command: command, timeout: *scanTimeout}
+
+        // The files failing the scan are kept until someone looks at them.
+        server.holds, err = newHoldStore(quarantineDir, 0, server.clock())
+        if err != nil {
+            log.Fatal(err)
+        }
+    }
+
+    if *hold {
+        server.holds, err = newHoldStore(holdDir, *holdTTL, server.clock())
+        if err != nil {
+            log.Fatal(err)
+        }
+        server.holds.sweep()
+        go server.holds.sweepPeriodically()
+    }
+
+    if server.holds != nil {
+        held, err := server.holds.names()
+        if err != nil {
+            log.Fatal(err)
+        }
+        index.occupy(held)
+    }
+
+    // The user and the group are looked up before anything is bound, so
+    // that a mistake in their names fails right away.
+    creds, err := lookupCredentials(*runAsUser, *runAsGroup)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    l, err := listen(flag.Arg(0))
+    if err != nil {
+        log.Fatalf("could not start listening, %v", err)
+    }
+    defer l.Close()
+    l = server.withAcceptTimeout(l)
+
+    // The PROXY header precedes the TLS handshake, so the proxied
+    // connections have to be unwrapped first.
+    if *trustedProxies != "" {
+        l = &proxyListener{Listener: l, trusted: server.TrustedProxies}
+    }
+
+    var tlsConfig *tls.Config
+    if *tlsCert != "" || *tlsKey != "" {
+        if *tlsCert == "" || *tlsKey == "" {
+            log.Fatal("both -tls-cert and -tls-key are needed to enable TLS")
+        }
+
+        certs, err := newCertCache(*tlsCert, *tlsKey)
+        if err != nil {
+            log.Fatal(err)
+        }
+        go certs.reloadOnSignal()
+
+        tlsConfig, err = newTLSConfig(certs, *tlsMinVersion, *tlsCiphers)
+        if err != nil {
+            log.Fatalf("could not configure TLS, %v", err)
+        }
+        l = tls.NewListener(l, tlsConfig)
+    }
+
+    // Every HTTP surface listens on its own address, so that the network
+    // policy can tell them apart.
+    surfaces := []struct {
+        addr    string
+        handler http.Handler
+    }{
+        {*httpPort, server.httpHandler()},
+        {*metricsPort, server.metricsHandler()},
+        {*uiAddr, server.uiHandler()},
+    }
+    for _, surface := range surfaces {
+        if surface.addr == "" {
+            continue
+        }
+
+        hl, err := listen(surface.addr)
+        if err != nil {
+            log.Fatalf("could not start listening for HTTP, %v", err)
+        }
+        if tlsConfig != nil {
+            hl = tls.NewListener(hl, tlsConfig)
+        }
+
+        server.serveHTTP(hl, surface.handler)
+    }
+
+    // Every listener is bound by now, nothing needs the privileges anymore.
+    if *runAsUser != "" || *runAsGroup != "" {
+        if err := chownState(creds); err != nil {
+            log.Fatal(err)
+        }
+        if err := dropPrivileges(creds); err != nil {
+            log.Fatal(err)
+        }
+        log.Printf("dropped the privileges, uid=%d gid=%d", syscall.Getuid(), syscall.Getgid())
+    }
+
+    settings := []string{
+        "port=" + flag.Arg(0),
+        fmt.Sprintf("tls=%t", *tlsCert != ""),
+    }
+    if tlsConfig != nil {
+        settings = append(settings, "tls-min-version=" + *tlsMinVersion)
+    }
+    settings = append(settings, "http-port=" + optionString(*httpPort),
+                      "metrics-port=" + optionString(*metricsPort), "ui-addr=" + optionString(*uiAddr))
+    if *trustedProxies != "" {
+        settings = append(settings, "trusted-proxies=" + *trustedProxies)
+    } else {
+        settings = append(settings, "trusted-proxies=none")
+    }
+    settings = append(settings, server.settings()...)
+    log.Printf("listening, %s", strings.Join(settings, " "))
+
+    if err := server.Serve(l); err != nil {
+        log.Fatal(err)
     }
+    log.Print("shut down")
 }
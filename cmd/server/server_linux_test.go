@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+
+    c := dialTest(t, addr)
+    c.request("Name: ok.txt", "Status: true")
+    if first := c.reply(); first.Name != "ok.txt" || first.Status != "" {
+        t.Fatalf("got %+v first, want only the name", first)
+    }
+    c.sendData("data")
+    c.closeWrite()
+    status := c.reply()
+    if status.Status != "ok" || status.Name != "ok.txt" || *status.Size != 4 || status.SHA256 != sha256Hex("data") {
+        t.Fatalf("got the status %+v, want ok.txt stored", status)
+    }
+
+    // The files larger than the limit of the process can't be written, the
+    // writes fail with EFBIG instead of the signal.
+    signal.Ignore(syscall.SIGXFSZ)
+    defer signal.Reset(syscall.SIGXFSZ)
+    var limit syscall.Rlimit
+    if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+        t.Fatal(err)
+    }
+    small := limit
+    small.Cur = 1000
+    if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &small); err != nil {
+        t.Fatal(err)
+    }
+    first, status := upload(t, addr, "large.txt", strings.Repeat("x", 10000))
+    syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit)
+
+    if first.Name != "large.txt" || status.Status != "error" || !strings.Contains(status.Error, "file too large") {
+        t.Fatalf("got %+v and the status %+v, want the name and the write error", first, status)
+    }
+    assertFiles(t, "ok.txt")
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckName(t *testing.T) {
+    valid := []string{"report.txt", "archive.", "a b", "report.txt.done", "backup.partial"}
+    for _, name := range valid {
+        if err := checkName(name); err != nil {
+            t.Errorf("checkName(%q) = %v, want nil", name, err)
+        }
+    }
+
+    invalid := []string{"", ".", "..", "a/b", "backup.part", ".part", "a\nb", "a\x00b", "a\tb", "a\x7fb"}
+    for _, name := range invalid {
+        if err := checkName(name); err == nil {
+            t.Errorf("checkName(%q) = nil, want an error", name)
+        }
+    }
+}
+
+func TestCheckNameMarkers(t *testing.T) {
+    s := newTestServer(t)
+    if err := s.checkStoredName("report.txt.done"); err != nil {
+        t.Errorf("checkStoredName of a marker name = %v with the markers off, want nil", err)
+    }
+
+    s.DoneMarkers = true
+    if err := s.checkStoredName("report.txt.done"); err == nil {
+        t.Errorf("checkStoredName of a marker name = nil with the markers on, want an error")
+    }
+}
+
+func TestConfirm(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+
+    c := dialTest(t, addr)
+    c.request("Name: report.txt", "Confirm: true", "Status: true")
+    if resp := c.reply(); resp.Name != "report.txt" {
+        t.Fatalf("got the name %q before the data, want report.txt", resp.Name)
+    }
+    c.write([]byte("proceed\n"))
+    c.sendData("data")
+    c.closeWrite()
+    if resp := c.reply(); resp.Status != "ok" {
+        t.Fatalf("the upload that proceeded failed, %s", resp.Error)
+    }
+
+    c = dialTest(t, addr)
+    c.request("Name: report.txt", "Confirm: true", "Status: true")
+    if resp := c.reply(); resp.Name != "report_copy1.txt" {
+        t.Fatalf("got the name %q before the data, want report_copy1.txt", resp.Name)
+    }
+    c.write([]byte("abort\n"))
+    if !c.isClosed() {
+        t.Fatal("the server didn't close the aborted upload")
+    }
+
+    // The aborted name is given back.
+    assertFiles(t, "report.txt")
+    if name := mustUpload(t, addr, "report.txt", "more"); name != "report_copy1.txt" {
+        t.Fatalf("the next upload is stored as %q, want report_copy1.txt", name)
+    }
+}
+
+func TestMaxDeclaredSize(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxDeclaredSize = 10
+    addr := serveTest(t, s)
+
+    first, status := upload(t, addr, "large.bin", "data", "Size: 11")
+    if first.Error == "" || status != nil {
+        t.Fatal("the upload declaring more than the limit wasn't refused before the data")
+    }
+    if !strings.Contains(first.Error, "exceeds the limit of 10 bytes") {
+        t.Fatalf("got the error %q, want it to tell the limit", first.Error)
+    }
+    assertFiles(t)
+
+    mustUpload(t, addr, "small.bin", "data", "Size: 10")
+    assertFiles(t, "small.bin")
+}
+
+func TestSettings(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxSize = 1000
+    s.diskLimiter = newRateLimiter(500, realClock{})
+    s.StrictTrailer = true
+
+    settings := strings.Join(s.settings(), " ")
+    for _, want := range []string{"max-size=1000", "disk-rate=500", "strict-trailer=true",
+                                  "max-declared-size=none", "quota=none", "indexed-files=0"} {
+        if !strings.Contains(" " + settings + " ", " " + want + " ") {
+            t.Errorf("the settings %q don't tell %s", settings, want)
+        }
+    }
+}
+
+func TestNoPartialFilesLeft(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxSize = 100
+    addr := serveTest(t, s)
+
+    wrongSum := strings.Repeat("0", 64)
+    failures := []struct {
+        name   string
+        data   string
+        header []string
+    }{
+        {"mismatch.txt", "data", []string{"SHA256: " + wrongSum}},
+        {"large.txt", strings.Repeat("x", 101), nil},
+        {"footer.txt", "data", []string{"Footer: sha256"}},
+    }
+    for _, f := range failures {
+        if _, status := upload(t, addr, f.name, f.data, f.header...); status == nil || status.Status != "error" {
+            t.Errorf("the upload of %s didn't fail", f.name)
+        }
+    }
+
+    // The data that fails to decompress.
+    c := dialTest(t, addr)
+    c.request("Name: corrupt.txt", "Status: true")
+    c.reply()
+    c.write([]byte{0xff, 0xff, 0xff, 0xff})
+    c.closeWrite()
+    if status := c.reply(); status.Status != "error" {
+        t.Error("the upload of corrupt data didn't fail")
+    }
+
+    // The client going away half way.
+    c = dialTest(t, addr)
+    c.request("Name: cut.txt")
+    c.reply()
+    data := deflate(strings.Repeat("0123456789", 5))
+    c.write(data[:len(data) / 2])
+    c.Close()
+
+    s.Shutdown()
+    assertFiles(t)
+    if s.index.Len() != 0 {
+        t.Fatalf("the index has %v, want nothing", s.index.Names())
+    }
+}
+
+func TestLongHeaderLine(t *testing.T) {
+    huge := strings.Repeat("a", 4 << 20)
+    inputs := map[string]string{
+        "legacy name": huge + "\n",
+        "header value": protocolMagic + "\nName: " + huge + "\n\n",
+    }
+    for what, input := range inputs {
+        var before, after runtime.MemStats
+        runtime.ReadMemStats(&before)
+        _, err := readRequest(bufio.NewReaderSize(strings.NewReader(input), maxHeaderLine), defaultMaxHeaderSize)
+        runtime.ReadMemStats(&after)
+
+        if err == nil {
+            t.Errorf("a %s of %d bytes was read, want an error", what, len(huge))
+        }
+        if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64 << 10 {
+            t.Errorf("reading a %s of %d bytes allocated %d bytes", what, len(huge), allocated)
+        }
+    }
+}
+
+func TestTrustDeclaredSize(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxSize = 100
+    addr := serveTest(t, s)
+
+    // Untrusted, the declared size doesn't matter, the limit does.
+    if _, err := tryUpload(addr, "more.txt", strings.Repeat("x", 50), "Size: 10"); err != nil {
+        t.Fatalf("the upload sending more than declared within the limit failed, %v", err)
+    }
+    if _, status := upload(t, addr, "large.txt", strings.Repeat("x", 101), "Size: 10"); status.Status != "error" {
+        t.Fatal("the upload declaring less than the limit and sending more was stored")
+    }
+
+    s.TrustDeclaredSize = true
+    _, status := upload(t, addr, "lie.txt", strings.Repeat("x", 50), "Size: 10")
+    if status.Status != "error" || !strings.Contains(status.Error, "declared size") {
+        t.Fatalf("got %+v for the upload sending more than declared, want the declared size error", status)
+    }
+    if _, err := tryUpload(addr, "exact.txt", strings.Repeat("x", 10), "Size: 10"); err != nil {
+        t.Fatalf("the upload sending the declared size failed, %v", err)
+    }
+    assertFiles(t, "exact.txt", "more.txt")
+}
+
+func parseRequest(lines ...string) (*request, error) {
+    input := protocolMagic + "\n" + strings.Join(lines, "\n") + "\n\n"
+    return readRequest(bufio.NewReaderSize(strings.NewReader(input), maxHeaderLine), defaultMaxHeaderSize)
+}
+
+func TestHeaderOrder(t *testing.T) {
+    sum := strings.Repeat("ab", 32)
+    orders := [][]string{
+        {"Name: a.txt", "Size: 5", "SHA256: " + sum},
+        {"Size: 5", "Name: a.txt", "SHA256: " + sum},
+        {"SHA256: " + sum, "Size: 5", "Name: a.txt"},
+        {"size: 5", "sha256: " + sum, "NAME: a.txt"},
+    }
+    for _, lines := range orders {
+        req, err := parseRequest(lines...)
+        if err != nil {
+            t.Errorf("the header %q is refused, %v", lines, err)
+            continue
+        }
+        if req.Op != opUpload || req.Name != "a.txt" || req.Size != 5 || req.SHA256 != sum {
+            t.Errorf("the header %q is read as %+v", lines, req)
+        }
+    }
+
+    invalid := map[string][]string{
+        "no name":          {"Size: 5"},
+        "twice the name":   {"Name: a.txt", "Size: 5", "Name: b.txt"},
+        "swap with no one": {"Op: swap", "Name: a.txt"},
+        "no token":         {"Op: approve"},
+        "negative size":    {"Name: a.txt", "Size: -1"},
+    }
+    for what, lines := range invalid {
+        if _, err := parseRequest(lines...); err == nil {
+            t.Errorf("the header with %s is read", what)
+        }
+    }
+}
+
+func TestMaxLifetime(t *testing.T) {
+    s := newTestServer(t)
+    clock := newFakeClock()
+    s.Clock = clock
+    s.MaxLifetime = time.Minute
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan struct{})
+    go func() {
+        s.Serve(l)
+        close(done)
+    }()
+    clock.waitPending(t, 1)
+
+    c := dialTest(t, l.Addr().String())
+    c.request("Name: inflight.txt", "Status: true")
+    c.reply()
+
+    clock.Advance(time.Minute)
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+        con, err := net.Dial("tcp", l.Addr().String())
+        if err != nil {
+            break
+        }
+        con.Close()
+        if time.Now().After(deadline) {
+            t.Fatal("the server still accepts the connections past its lifetime")
+        }
+    }
+    select {
+    case <-done:
+        t.Fatal("the server shut down before the transfer in flight finished")
+    default:
+    }
+
+    c.sendData("data")
+    c.closeWrite()
+    if status := c.reply(); status.Status != "ok" {
+        t.Fatalf("the transfer in flight failed, %s", status.Error)
+    }
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("the server didn't shut down once the transfer finished")
+    }
+    assertFiles(t, "inflight.txt")
+}
+
+func TestPriorCopies(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+
+    want := []struct {
+        name  string
+        prior int
+    }{
+        {"same.txt", -1},
+        {"same_copy1.txt", 0},
+        {"same_copy2.txt", 1},
+    }
+    for _, w := range want {
+        first, _ := upload(t, addr, "same.txt", "data")
+        prior := -1
+        if first.PriorCopies != nil {
+            prior = *first.PriorCopies
+        }
+        if first.Name != w.name || first.Copy != (w.prior >= 0) || prior != w.prior {
+            t.Errorf("got %q, copy %t, %d prior copies, want %q with %d", first.Name, first.Copy, prior,
+                     w.name, w.prior)
+        }
+    }
+}
+
+func TestPathLength(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+
+    // The temporary file is the longest name, 5 bytes longer.
+    longest := strings.Repeat("a", maxNameLen - len(partSuffix))
+    mustUpload(t, addr, longest, "data")
+    if first, _ := upload(t, addr, "b" + longest, "data"); !strings.Contains(first.Error, "too long") {
+        t.Fatalf("got %q for the name too long with the suffix, want it refused", first.Error)
+    }
+
+    // Deep down, the path is too long before the name is.
+    wd, _ := os.Getwd()
+    for depth := len(wd); depth < maxPathLen - 10; {
+        length := maxPathLen - 10 - depth
+        if length > 200 {
+            length = 200
+        }
+        dir := strings.Repeat("d", length)
+        if err := os.Mkdir(dir, 0777); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.Chdir(dir); err != nil {
+            t.Fatal(err)
+        }
+        depth += 1 + len(dir)
+    }
+    if err := checkPathLength("short.txt", ""); err == nil || !strings.Contains(err.Error(), "path") {
+        t.Fatalf("got %v for the path too long, want it refused", err)
+    }
+}
+
+func TestDefaultExt(t *testing.T) {
+    s := newTestServer(t)
+    s.DefaultExt = ".bin"
+    addr := serveTest(t, s)
+
+    want := map[string]string{
+        "noext":      "noext.bin",
+        "report.txt": "report.txt",
+        ".profile":   ".profile",
+    }
+    for name, stored := range want {
+        if got := mustUpload(t, addr, name, "data"); got != stored {
+            t.Errorf("%s is stored as %q, want %q", name, got, stored)
+        }
+    }
+
+    // The copies see the extended name.
+    if got := mustUpload(t, addr, "noext", "data"); got != "noext_copy1.bin" {
+        t.Errorf("the second noext is stored as %q, want noext_copy1.bin", got)
+    }
+}
+
+func TestListenErrors(t *testing.T) {
+    l, err := listen("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+
+    _, port, _ := net.SplitHostPort(l.Addr().String())
+    if _, err := listen("127.0.0.1:" + port); err == nil || !strings.Contains(err.Error(), "is taken") {
+        t.Errorf("listening on the taken port failed with %v, want it told taken", err)
+    }
+
+    // The privileged ports can only be refused to the unprivileged.
+    privileged, err := listen("127.0.0.1:1")
+    if err == nil {
+        privileged.Close()
+        t.Skip("the process may listen on the privileged ports")
+    }
+    if !strings.Contains(err.Error(), "CAP_NET_BIND_SERVICE") || !strings.Contains(err.Error(), "higher port") {
+        t.Errorf("listening on a privileged port failed with %v, want the guidance", err)
+    }
+}
+
+func TestNULName(t *testing.T) {
+    addr := serveTest(t, newTestServer(t))
+
+    first, status := upload(t, addr, "report.txt\x00.jpg", "data")
+    if status != nil || !strings.Contains(first.Error, "control character U+0000") {
+        t.Fatalf("the name with a NUL was refused with %q, want it refused up front", first.Error)
+    }
+    assertFiles(t)
+}
+
+func TestLargeSizes(t *testing.T) {
+    // The sizes are int64 on every platform.
+    var _ int64 = (&request{}).Size
+    var _ *int64 = (&response{}).Size
+    var _ int64 = (&Server{}).MaxSize
+
+    req, err := parseRequest("Name: a.bin", "Size: 6000000000")
+    if err != nil || req.Size != 6000000000 {
+        t.Fatalf("the size of 6 GB parsed as %d, %v", req.Size, err)
+    }
+    if _, err := parseRequest("Name: a.bin", "Size: 9223372036854775808"); err == nil {
+        t.Fatal("the size overflowing int64 was accepted")
+    }
+
+    s := newTestServer(t)
+    s.MaxDeclaredSize = 5 << 30
+    if err := s.checkRequest(&request{Op: opUpload, Name: "a.bin", Size: 4 << 30}); err != nil {
+        t.Fatalf("4 GB under the limit of 5 GB was refused, %v", err)
+    }
+    if err := s.checkRequest(&request{Op: opUpload, Name: "a.bin", Size: 6 << 30}); err == nil {
+        t.Fatal("6 GB over the limit of 5 GB was accepted")
+    }
+
+    // The sizes near the limit of int64 don't wrap around.
+    q := newQuotaTracker(8 << 30, s.meta, false, 0, realClock{})
+    if err := q.check("10.0.0.1", 7 << 30); err != nil {
+        t.Fatalf("7 GB under the quota of 8 GB was refused, %v", err)
+    }
+    if err := q.check("10.0.0.1", math.MaxInt64); err == nil {
+        t.Fatal("the largest size was accepted under the quota")
+    }
+}
+
+func TestNameOfDirectory(t *testing.T) {
+    addr := serveTest(t, newTestServer(t))
+    if err := os.Mkdir("logs", 0777); err != nil {
+        t.Fatal(err)
+    }
+
+    // The directory is never replaced, the file gets a copy name.
+    if name := mustUpload(t, addr, "logs", "data"); name != "logs_copy1" {
+        t.Fatalf("stored as %q next to the logs directory, want logs_copy1", name)
+    }
+    if stat, err := os.Stat("logs"); err != nil || !stat.IsDir() {
+        t.Fatal("the logs directory was replaced")
+    }
+    if got := readFile(t, "logs_copy1"); got != "data" {
+        t.Fatalf("logs_copy1 holds %q", got)
+    }
+}
+
+// paddedHeader returns the header lines of the upload of the name adding up
+// to the size, terminators included.
+func paddedHeader(name string, size int) []string {
+    lines := []string{"Name: " + name}
+    size -= len(lines[0]) + 1
+    for i := 0; size > 0; i++ {
+        key := fmt.Sprintf("X-Pad-%d: ", i)
+        n := size - len(key) - 1
+        if n > 1000 {
+            // The next line is left room for its key.
+            n = 1000
+            if rest := size - len(key) - n - 1; rest < 32 {
+                n -= 32
+            }
+        }
+        line := key + strings.Repeat("x", n)
+        lines = append(lines, line)
+        size -= len(line) + 1
+    }
+
+    return lines
+}
+
+func TestHeaderTooLarge(t *testing.T) {
+    // The lines are each short and few enough, and still add up to too much.
+    _, err := parseRequest(paddedHeader("a.txt", defaultMaxHeaderSize + 100)...)
+    if err == nil || errorKind(err) != "header_too_large" {
+        t.Fatalf("got %v for the header of more than %d bytes, want it too large", err,
+                 defaultMaxHeaderSize)
+    }
+    if _, err := parseRequest(paddedHeader("a.txt", defaultMaxHeaderSize - 1)...); err != nil {
+        t.Fatalf("the header within the limit, the empty line included, is refused, %v", err)
+    }
+
+    // The empty line ending the header is the one over the limit, so the
+    // server has read everything sent when it refuses.
+    // The limit of the server applies instead of the default.
+    s := newTestServer(t)
+    s.MaxHeaderSize = 1024
+    addr := serveTest(t, s)
+    c := dialTest(t, addr)
+    c.request(paddedHeader("a.txt", 1024)...)
+    if resp := c.reply(); resp.Kind != "header_too_large" || !strings.Contains(resp.Error, "1024 bytes") {
+        t.Fatalf("got %+v for the header too large, want the header_too_large kind", resp)
+    }
+    mustUpload(t, addr, "b.txt", "data", paddedHeader("b.txt", 900)[1:]...)
+    assertFiles(t, "b.txt")
+}
+
+func TestDeflateLimits(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxSize = 1000
+    s.MaxDeflateSize = 100
+    addr := serveTest(t, s)
+
+    // The stricter limit of the compressed uploads applies to them only.
+    _, status := upload(t, addr, "compressed.txt", strings.Repeat("x", 200))
+    if status == nil || status.Status != "error" || !strings.Contains(status.Error, "compressed uploads") {
+        t.Fatalf("got %+v for the compressed upload over its limit, want it refused", status)
+    }
+    if w := putFile(s, "plain.txt", strings.Repeat("x", 200)); w.Code != http.StatusCreated {
+        t.Fatalf("got %d for the HTTP upload within the global limit, want 201", w.Code)
+    }
+    if w := putFile(s, "large.txt", strings.Repeat("x", 1001)); w.Code == http.StatusCreated {
+        t.Fatal("the HTTP upload over the global limit was stored")
+    }
+    mustUpload(t, addr, "small.txt", strings.Repeat("x", 100))
+
+    // With no limit of their own, the global one applies.
+    s = newTestServer(t)
+    s.MaxSize = 1000
+    s.MaxDeflateRatio = 10
+    addr = serveTest(t, s)
+    mustUpload(t, addr, "within.txt", strings.Repeat("x", 1000))
+    mustUploadFails(t, addr, "over.txt", strings.Repeat("x", 1001))
+
+    // The ratio is only told once there's enough data.
+    s = newTestServer(t)
+    s.MaxDeflateRatio = 10
+    addr = serveTest(t, s)
+    mustUpload(t, addr, "start.txt", strings.Repeat("x", deflateRatioGrace / 2))
+    _, status = upload(t, addr, "bomb.txt", strings.Repeat("x", 2 * deflateRatioGrace))
+    if status == nil || status.Status != "error" || !strings.Contains(status.Error, "decompresses") {
+        t.Fatalf("got %+v for the upload decompressing too much, want it refused", status)
+    }
+    assertFiles(t, "start.txt")
+}
+
+func TestNameAttempts(t *testing.T) {
+    s := newTestServer(t)
+    s.MaxNameAttempts = 3
+    addr := serveTest(t, s)
+    for _, name := range []string{"a.txt", "a_copy1.txt", "a_copy2.txt"} {
+        if err := os.Mkdir(name, 0777); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Every name tried is taken, the upload gives up.
+    first, status := upload(t, addr, "a.txt", "data")
+    if status != nil || first.Kind != "unavailable" || !strings.Contains(first.Error, "3 names tried") {
+        t.Fatalf("got %+v for the upload with every name taken, want it refused after 3 names", first)
+    }
+
+    // The names taken stay taken, the next upload goes on from there.
+    if name := mustUpload(t, addr, "a.txt", "data"); name != "a_copy3.txt" {
+        t.Fatalf("the next upload was stored as %s, want a_copy3.txt", name)
+    }
+
+    // The temporary file can't be created exclusively, the upload fails
+    // once and the name stays taken too.
+    if err := os.Mkdir("b.txt" + partSuffix, 0777); err != nil {
+        t.Fatal(err)
+    }
+    if _, status := upload(t, addr, "b.txt", "data"); status == nil || status.Status != "error" {
+        t.Fatalf("got %+v for the upload whose temporary file exists, want it failed", status)
+    }
+    if name := mustUpload(t, addr, "b.txt", "data"); name != "b_copy1.txt" {
+        t.Fatalf("the next upload was stored as %s, want b_copy1.txt", name)
+    }
+}
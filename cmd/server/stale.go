@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultStalePartAge is how long a temporary file has to be left unchanged
+// for before it's taken for the leftover of an interrupted transfer.
+const defaultStalePartAge = time.Hour
+
+// The temporary files of the transfers the server was receiving when it
+// crashed or was killed are left behind, and would be in the way of the next
+// uploads of the same names, which create their temporary files exclusively.
+// Those not written to for the stale age are removed at startup, before the
+// server receives anything. A leftover found in the way of an upload later on
+// is removed too, once it's stale; the name of the upload is reserved, so the
+// file isn't that of a transfer of this server. Only the modification time
+// tells, though: the transfer of another server sharing the directory whose
+// client stalled for longer than the stale age is taken for stale all the
+// same, so the age has to be longer than the clients may stall.
+
+// isStalePart tells whether the file is a temporary file left unchanged for
+// longer than maxAge.
+func isStalePart(stat os.FileInfo, maxAge time.Duration, now time.Time) bool {
+    return stat.Mode().IsRegular() && strings.HasSuffix(stat.Name(), partSuffix) &&
+           now.Sub(stat.ModTime()) > maxAge
+}
+
+// removeStaleParts removes the stale temporary files from the storage
+// directory and the directories of the server, telling how many there were.
+// The directories that don't exist yet are skipped.
+func (s *Server) removeStaleParts() (int, error) {
+    now := s.clock().Now()
+    removed := 0
+    for _, dir := range []string{".", compressedDir} {
+        n, err := removeStalePartsIn(dir, s.StalePartAge, now)
+        removed += n
+        if err != nil {
+            return removed, err
+        }
+    }
+
+    return removed, nil
+}
+
+func removeStalePartsIn(dir string, maxAge time.Duration, now time.Time) (int, error) {
+    f, err := os.Open(dir)
+    if os.IsNotExist(err) {
+        return 0, nil
+    }
+    if err != nil {
+        return 0, fmt.Errorf("could not look for the stale temporary files, %v", err)
+    }
+    defer f.Close()
+
+    removed := 0
+    for {
+        batch, err := f.Readdir(scanBatch)
+        for _, stat := range batch {
+            if !isStalePart(stat, maxAge, now) {
+                continue
+            }
+
+            path := filepath.Join(dir, stat.Name())
+            if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+                log.Printf("could not remove the stale temporary file %q, %v", path, err)
+                continue
+            }
+            log.Printf("removed the stale temporary file %q (%d bytes, last written %s)",
+                       path, stat.Size(), stat.ModTime().Format(time.RFC3339))
+            removed++
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return removed, fmt.Errorf("could not look for the stale temporary files, %v", err)
+        }
+    }
+
+    return removed, nil
+}
+
+// removeStalePart removes the temporary file in the way of an upload if it's
+// stale, telling whether it did. The name of the upload is reserved, so the
+// file isn't that of another transfer of this server.
+func (s *Server) removeStalePart(path string) bool {
+    if s.StalePartAge <= 0 {
+        return false
+    }
+
+    stat, err := os.Lstat(path)
+    if err != nil || !isStalePart(stat, s.StalePartAge, s.clock().Now()) {
+        return false
+    }
+
+    if err := os.Remove(path); err != nil {
+        log.Printf("could not remove the stale temporary file %q, %v", path, err)
+        return false
+    }
+
+    log.Printf("removed the stale temporary file %q in the way of the upload", path)
+    return true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// sendStat replies with the size, the checksum and the location of the
+// stored file, for the tools looking into where the file actually is. The
+// path is relative to the storage directory, the absolute one and the device
+// are only told with ExposeLocation, since they tell about the host.
+func (s *Server) sendStat(w io.Writer, req *request) error {
+    // The file of a name that isn't UTF-8 is found where it was stored.
+    name, err := s.NamePolicy.apply(req.Name)
+    if err == nil {
+        req.Name = name
+        err = s.checkStoredName(req.Name)
+    }
+    if err != nil {
+        req.reply(w, &response{Error: err.Error()})
+        return err
+    }
+
+    stat, err := os.Stat(req.Name)
+    if err == nil && !isStoredFile(stat, s.DoneMarkers) {
+        err = os.ErrNotExist
+    }
+    if err != nil {
+        err = newStorageError(err, fmt.Errorf("could not stat %q, %v", req.Name, err))
+        req.reply(w, errorResponse(err))
+        return err
+    }
+
+    meta, err := s.meta.checksums(stat)
+    if err != nil {
+        req.reply(w, errorResponse(err))
+        return err
+    }
+    sum := meta.SHA256
+
+    size := stat.Size()
+    resp := &response{
+        Status: "ok",
+        Name:   req.Name,
+        Size:   &size,
+        SHA256: sum,
+        ETag:   fileETag(sum),
+        Path:   filepath.ToSlash(req.Name),
+
+        Adler32: meta.Adler32,
+
+        OriginalName: meta.OriginalName,
+    }
+    if s.ExposeLocation {
+        resp.AbsPath, err = filepath.Abs(req.Name)
+        if err != nil {
+            req.reply(w, errorResponse(err))
+            return fmt.Errorf("could not stat %q, %v", req.Name, err)
+        }
+        resp.Device = deviceID(stat)
+    }
+
+    return req.reply(w, resp)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStatLocation(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+    stored := mustUpload(t, addr, "a.txt", "data")
+    mustUpload(t, addr, "a.txt", "data")
+
+    stat := statFile(t, addr, "a_copy1.txt")
+    if stat.Status != "ok" || stat.Path != "a_copy1.txt" || *stat.Size != 4 || stat.SHA256 != sha256Hex("data") {
+        t.Fatalf("the stat told %+v, want the relative path, the size and the checksum", stat)
+    }
+
+    // The host isn't told about unless asked to.
+    if stat.AbsPath != "" || stat.Device != "" {
+        t.Fatalf("the stat told the absolute path %q and the device %q", stat.AbsPath, stat.Device)
+    }
+
+    s = newTestServer(t)
+    s.ExposeLocation = true
+    addr = serveTest(t, s)
+    mustUpload(t, addr, stored, "data")
+    stat = statFile(t, addr, stored)
+    abs, err := filepath.Abs(stored)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stat.Path != stored || stat.AbsPath != abs {
+        t.Fatalf("the stat told the paths %q and %q, want %q and %q", stat.Path, stat.AbsPath, stored, abs)
+    }
+}
+
+func TestWeakChecksum(t *testing.T) {
+    s := newTestServer(t)
+    addr := serveTest(t, s)
+    mustUpload(t, addr, "a.txt", "Wikipedia")
+    if stat := statFile(t, addr, "a.txt"); stat.Adler32 != "" {
+        t.Fatalf("the stat told the Adler-32 %q, want none unless kept", stat.Adler32)
+    }
+
+    s = newTestServer(t)
+    s.meta.weak = true
+    addr = serveTest(t, s)
+    mustUpload(t, addr, "a.txt", "Wikipedia")
+    if stat := statFile(t, addr, "a.txt"); stat.Adler32 != "11e60398" {
+        t.Fatalf("the stat told the Adler-32 %q, want 11e60398", stat.Adler32)
+    }
+
+    // The file stored some other way gets one at its first stat.
+    writeFile(t, "b.txt", "Wikipedia")
+    if stat := statFile(t, addr, "b.txt"); stat.Adler32 != "11e60398" || stat.SHA256 != sha256Hex("Wikipedia") {
+        t.Fatalf("the stat of the unknown file told %+v, want both checksums", stat)
+    }
+}
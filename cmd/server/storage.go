@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// The kinds of the errors of the storage, so that the clients can tell what
+// to do about them, e.g. to try again later if the storage is unavailable,
+// but not when the server isn't permitted to store the file.
+var (
+    ErrBackendUnavailable = errors.New("the storage is unavailable")
+    ErrNotFound           = errors.New("not found")
+    ErrPermission         = errors.New("permission denied")
+)
+
+// ErrHeaderTooLarge is the kind of the requests whose header adds up to more
+// than the server takes, so that the clients can tell to send less of it.
+var ErrHeaderTooLarge = errors.New("the header is too large")
+
+// ErrBatchLimit is the kind of the requests past the limit of the files of a
+// connection, so that the clients can tell to send them on another one.
+var ErrBatchLimit = errors.New("too many files on the connection")
+
+// The kinds of the errors as the clients are told them.
+var errorKinds = map[error]string{
+    ErrBackendUnavailable: "unavailable",
+    ErrNotFound:           "not_found",
+    ErrPermission:         "permission",
+
+    ErrHeaderTooLarge: "header_too_large",
+    ErrBatchLimit:     "batch_limit",
+}
+
+// storageError is an error of the storage, or of the request, of a known
+// kind. It reads like the error it was made from, and errors.Is tells its
+// kind.
+type storageError struct {
+    kind error
+    err  error
+
+    // cause is the error of the filesystem the error was made from.
+    cause error
+}
+
+func (e *storageError) Error() string {
+    return e.err.Error()
+}
+
+func (e *storageError) Unwrap() error {
+    return e.kind
+}
+
+// storageKind maps the error of the filesystem to its kind, nil if it's of
+// none of them.
+func storageKind(cause error) error {
+    switch {
+    case os.IsNotExist(cause):
+        return ErrNotFound
+    case os.IsPermission(cause):
+        return ErrPermission
+    case errors.Is(cause, syscall.ENOSPC), errors.Is(cause, syscall.EDQUOT),
+         errors.Is(cause, syscall.EROFS), errors.Is(cause, syscall.EIO):
+        return ErrBackendUnavailable
+    }
+
+    return nil
+}
+
+// newStorageError returns err, which describes the cause, as an error of the
+// kind of the cause, if it's of any.
+func newStorageError(cause, err error) error {
+    kind := storageKind(cause)
+    if kind == nil {
+        return err
+    }
+
+    return &storageError{kind: kind, err: err, cause: cause}
+}
+
+// errorKind returns the kind of the error for the clients, empty if it has
+// none.
+func errorKind(err error) string {
+    for kind, name := range errorKinds {
+        if errors.Is(err, kind) {
+            return name
+        }
+    }
+
+    return ""
+}
+
+// errorResponse is the final response to the failed upload.
+func errorResponse(err error) *response {
+    return &response{Status: "error", Error: err.Error(), Kind: errorKind(err)}
+}
+
+// httpStatus returns the status code of the failed HTTP upload. The errors
+// of the storage are the fault of the server, unlike the rest.
+func httpStatus(err error) int {
+    switch {
+    case errors.Is(err, ErrBackendUnavailable):
+        return http.StatusServiceUnavailable
+    case errors.Is(err, ErrPermission), errors.Is(err, ErrNotFound):
+        return http.StatusInternalServerError
+    }
+
+    return http.StatusBadRequest
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestStorageErrors(t *testing.T) {
+    for _, test := range []struct {
+        cause error
+        kind  error
+        name  string
+        code  int
+    }{
+        {syscall.ENOENT, ErrNotFound, "not_found", http.StatusInternalServerError},
+        {syscall.EACCES, ErrPermission, "permission", http.StatusInternalServerError},
+        {syscall.ENOSPC, ErrBackendUnavailable, "unavailable", http.StatusServiceUnavailable},
+        {syscall.EDQUOT, ErrBackendUnavailable, "unavailable", http.StatusServiceUnavailable},
+        {syscall.EROFS, ErrBackendUnavailable, "unavailable", http.StatusServiceUnavailable},
+        {syscall.EIO, ErrBackendUnavailable, "unavailable", http.StatusServiceUnavailable},
+        {syscall.EINVAL, nil, "", http.StatusBadRequest},
+    } {
+        cause := &os.PathError{Op: "open", Path: "a.txt", Err: test.cause}
+        err := newStorageError(cause, fmt.Errorf("could not store %q, %v", "a.txt", cause))
+
+        if test.kind != nil && !errors.Is(err, test.kind) {
+            t.Errorf("%v is not of the kind %v", test.cause, test.kind)
+        }
+        if name := errorKind(err); name != test.name {
+            t.Errorf("%v is of the kind %q, want %q", test.cause, name, test.name)
+        }
+        if code := httpStatus(err); code != test.code {
+            t.Errorf("%v is answered with %d, want %d", test.cause, code, test.code)
+        }
+
+        // The clients are told the error as it reads, with its kind.
+        resp := errorResponse(err)
+        if resp.Error != "could not store \"a.txt\", " + cause.Error() || resp.Kind != test.name {
+            t.Errorf("%v is told as %+v", test.cause, resp)
+        }
+    }
+}
+
+func TestStorageErrorOverProtocol(t *testing.T) {
+    addr := serveTest(t, newTestServer(t))
+    if stat := statFile(t, addr, "missing.txt"); stat.Kind != "not_found" || stat.Status == "ok" {
+        t.Fatalf("the stat of a missing file told %+v, want the not_found kind", stat)
+    }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// A client retrying the same upload in a loop, e.g. because it never sees
+// the final status, leaves a copy of the file behind with every attempt. The
+// storm detector counts the recent uploads of every name, warning once there
+// are more than the limit within the window, and refusing the excess ones if
+// asked to.
+type stormDetector struct {
+    max    int
+    window time.Duration
+    reject bool
+    clock  Clock
+
+    // names are the recent uploads of the names, bounded like the other
+    // tables of the limits. A name evicted is only counted afresh.
+    names     *lruTable
+    lastSweep time.Time
+    sync.Mutex
+}
+
+// stormHistory is when the name was recently uploaded, and whether it was
+// warned about already.
+type stormHistory struct {
+    times  []time.Time
+    warned bool
+}
+
+func newStormDetector(max int, window time.Duration, reject bool, maxNames int, clock Clock) *stormDetector {
+    return &stormDetector{
+        max:       max,
+        window:    window,
+        reject:    reject,
+        clock:     clock,
+        names:     newLRUTable(maxNames, nil),
+        lastSweep: clock.Now(),
+    }
+}
+
+// sweep forgets the names not uploaded within the window.
+func (d *stormDetector) sweep() {
+    d.Lock()
+    defer d.Unlock()
+
+    d.sweepLocked(d.clock.Now())
+}
+
+func (d *stormDetector) sweepLocked(now time.Time) {
+    d.names.removeIdle(d.window, now)
+    d.lastSweep = now
+}
+
+// record counts the upload of the name, telling whether it's one too many.
+// The refused uploads aren't counted, so the name is accepted again once the
+// storm calms down.
+func (d *stormDetector) record(name string) error {
+    d.Lock()
+    defer d.Unlock()
+
+    now := d.clock.Now()
+    if now.Sub(d.lastSweep) > d.window {
+        d.sweepLocked(now)
+    }
+
+    history := &stormHistory{}
+    if value, ok := d.names.get(name, now); ok {
+        history = value.(*stormHistory)
+    }
+    for len(history.times) > 0 && now.Sub(history.times[0]) > d.window {
+        history.times = history.times[1:]
+    }
+    if len(history.times) == 0 {
+        history.warned = false
+    }
+
+    if len(history.times) >= d.max {
+        if !history.warned {
+            history.warned = true
+            log.Printf("warning: more than %d uploads of %q within %v, is a client retrying in a loop?",
+                       d.max, name, d.window)
+        }
+
+        if d.reject {
+            d.names.put(name, history, now)
+            return fmt.Errorf("too many uploads of %q within %v, try again later", name, d.window)
+        }
+    }
+
+    history.times = append(history.times, now)
+    d.names.put(name, history, now)
+    return nil
+}
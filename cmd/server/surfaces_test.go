@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+// serveSurface serves the HTTP handler of the server on an address of its
+// own, like main does, and returns its URL.
+func serveSurface(t *testing.T, s *Server, handler http.Handler) string {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.serveHTTP(l, handler)
+
+    return "http://" + l.Addr().String()
+}
+
+// getStatus returns the status code of the GET of the URL, with the secret
+// as the Bearer token.
+func getStatus(t *testing.T, url, secret string) int {
+    t.Helper()
+    req, err := http.NewRequest(http.MethodGet, url, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Authorization", "Bearer " + secret)
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    return resp.StatusCode
+}
+
+func TestSurfaces(t *testing.T) {
+    s := newTestServer(t)
+    s.auth = newAuthenticator([]byte("upload"), realClock{})
+    s.httpAuth = newAuthenticator([]byte("http"), realClock{})
+    s.metricsAuth = newAuthenticator([]byte("metrics"), realClock{})
+    addr := serveTest(t, s)
+    files := serveSurface(t, s, s.httpHandler())
+    metrics := serveSurface(t, s, s.metricsHandler())
+    ui := serveSurface(t, s, s.uiHandler())
+
+    mustUpload(t, addr, "a.txt", "data", "Auth: upload")
+    if first, _ := upload(t, addr, "b.txt", "data", "Auth: http"); first.Error == "" {
+        t.Fatal("the upload with the HTTP secret was accepted")
+    }
+
+    for _, test := range []struct {
+        url, secret string
+        want        int
+    }{
+        {files + filesPath + "a.txt", "http", http.StatusOK},
+        {files + filesPath + "a.txt", "upload", http.StatusUnauthorized},
+        {files + filesPath + "a.txt", "metrics", http.StatusUnauthorized},
+        {files + metricsPath, "metrics", http.StatusNotFound},
+
+        {metrics + metricsPath, "metrics", http.StatusOK},
+        {metrics + metricsPath, "http", http.StatusUnauthorized},
+        {metrics + filesPath + "a.txt", "http", http.StatusNotFound},
+
+        {ui + "/", "http", http.StatusOK},
+        {ui + "/", "metrics", http.StatusUnauthorized},
+        {ui + metricsPath, "http", http.StatusNotFound},
+    } {
+        if code := getStatus(t, test.url, test.secret); code != test.want {
+            t.Errorf("got %d for %s with the %s secret, want %d", code, test.url, test.secret, test.want)
+        }
+    }
+}
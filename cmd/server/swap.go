@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// swapDir keeps the links made while swapping the files without an atomic
+// exchange, which only stay behind if the swap fails half way.
+const swapDir = dataDir + "/swap"
+
+// swapFiles exchanges the files of the two stored names, e.g. to switch
+// which build of an artifact is served under the name. On Linux, the names
+// are exchanged at once; elsewhere, each name is replaced by a hard link to
+// the other file, one after the other, so neither name is ever missing but
+// both are the same file for a moment. The reads in progress keep reading
+// the file they opened either way. The metadata follows the files.
+func (s *Server) swapFiles(a, b string) error {
+    for _, name := range []string{a, b} {
+        if err := s.checkStoredName(name); err != nil {
+            return err
+        }
+    }
+    if a == b {
+        return fmt.Errorf("could not swap %q with itself", a)
+    }
+
+    // Only one swap runs at once, and the appends to the files wait for it.
+    s.swaps.Lock()
+    defer s.swaps.Unlock()
+    if s.appends != nil {
+        first, second := a, b
+        if second < first {
+            first, second = second, first
+        }
+        defer s.appends.lock(first)()
+        defer s.appends.lock(second)()
+    }
+
+    metas := make([]*fileMeta, 2)
+    for i, name := range []string{a, b} {
+        stat, err := os.Lstat(name)
+        if err == nil && !isStoredFile(stat, s.DoneMarkers) {
+            err = os.ErrNotExist
+        }
+        if err != nil {
+            return newStorageError(err, fmt.Errorf("could not swap %q, %v", name, err))
+        }
+
+        metas[i], err = s.meta.load(name)
+        if err != nil {
+            return err
+        }
+    }
+
+    if err := exchangeFiles(a, b); err != nil {
+        return newStorageError(err, fmt.Errorf("could not swap %q and %q, %v", a, b, err))
+    }
+
+    for i, name := range []string{b, a} {
+        var err error
+        if metas[i] != nil {
+            err = s.meta.save(name, metas[i])
+        } else {
+            err = s.meta.remove(name)
+        }
+        if err != nil {
+            log.Print(err)
+        }
+    }
+
+    if s.quota != nil {
+        s.quota.swap(a, b)
+    }
+    if s.content != nil {
+        s.content.swap(a, b)
+    }
+
+    return nil
+}
+
+// linkFiles exchanges the names with the hard links. The links are made
+// before either name is replaced, so that a failure leaves both files as they
+// were, up to the second rename: if it fails, both names are the file of b,
+// the file of a being left in swapDir.
+func linkFiles(a, b string) error {
+    if err := os.MkdirAll(swapDir, 0777); err != nil {
+        return err
+    }
+
+    linkA, linkB := filepath.Join(swapDir, a), filepath.Join(swapDir, b)
+    for _, link := range []string{linkA, linkB} {
+        if err := clearSwapLink(link, a, b); err != nil {
+            return err
+        }
+    }
+
+    if err := os.Link(a, linkB); err != nil {
+        return err
+    }
+    if err := os.Link(b, linkA); err != nil {
+        os.Remove(linkB)
+        return err
+    }
+
+    if err := os.Rename(linkA, a); err != nil {
+        os.Remove(linkA)
+        os.Remove(linkB)
+        return err
+    }
+    if err := os.Rename(linkB, b); err != nil {
+        log.Printf("could not swap %q and %q, the former file of %q is kept in %q",
+                   a, b, a, linkB)
+        return err
+    }
+
+    return nil
+}
+
+// clearSwapLink makes way for the link of a swap, in case an interrupted swap
+// left one behind. The link is removed if it's still the file of either name,
+// otherwise it's the only copy left of a former file and is kept aside, under
+// a name of its own.
+func clearSwapLink(link string, names ...string) error {
+    stat, err := os.Lstat(link)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    for _, name := range names {
+        if other, err := os.Lstat(name); err == nil && os.SameFile(stat, other) {
+            return os.Remove(link)
+        }
+    }
+
+    aside := fmt.Sprintf("%s.%d", link, stat.ModTime().UnixNano())
+    log.Printf("the former file left in %q by an interrupted swap is kept in %q", link, aside)
+    return os.Rename(link, aside)
+}
+
+// sendSwap swaps the files of the request. Only the local clients are
+// allowed to, like with the held uploads, since the name decides what's
+// served.
+func (s *Server) sendSwap(con net.Conn, req *request) error {
+    var err error
+    if !isLoopback(con) {
+        err = fmt.Errorf("only local clients may swap files")
+    } else {
+        err = s.swapFiles(req.Name, req.With)
+    }
+
+    if err != nil {
+        req.reply(con, errorResponse(err))
+        return err
+    }
+
+    log.Printf("swapped %q and %q", req.Name, req.With)
+    return req.reply(con, &response{Status: "ok", Names: []string{req.Name, req.With}})
+}
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// exchangeFiles exchanges the two names at once with RENAME_EXCHANGE. The
+// kernels and the filesystems that don't support it get the links instead.
+func exchangeFiles(a, b string) error {
+    err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+    if err == unix.ENOSYS || err == unix.EINVAL {
+        return linkFiles(a, b)
+    }
+
+    return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// exchangeFiles exchanges the two names with the links, there's no rename
+// exchanging them at once.
+func exchangeFiles(a, b string) error {
+    return linkFiles(a, b)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapFiles(t *testing.T) {
+    s := newTestServer(t)
+    writeFile(t, "blue.bin", "blue")
+    writeFile(t, "green.bin", "green")
+    if err := s.meta.save("blue.bin", &fileMeta{SHA256: "b"}); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := s.swapFiles("blue.bin", "green.bin"); err != nil {
+        t.Fatal(err)
+    }
+    if got := readFile(t, "blue.bin"); got != "green" {
+        t.Errorf("blue.bin has %q, want green", got)
+    }
+    if got := readFile(t, "green.bin"); got != "blue" {
+        t.Errorf("green.bin has %q, want blue", got)
+    }
+
+    meta, err := s.meta.load("green.bin")
+    if err != nil || meta == nil || meta.SHA256 != "b" {
+        t.Errorf("the metadata didn't follow the file, %+v, %v", meta, err)
+    }
+    if meta, _ := s.meta.load("blue.bin"); meta != nil {
+        t.Errorf("blue.bin kept the metadata %+v", meta)
+    }
+
+    if err := s.swapFiles("blue.bin", "missing.bin"); err == nil {
+        t.Error("a file is swapped with a missing one")
+    }
+    if err := s.swapFiles("blue.bin", "blue.bin"); err == nil {
+        t.Error("a file is swapped with itself")
+    }
+}
+
+func TestLinkFilesStaleLinks(t *testing.T) {
+    inStorage(t)
+    writeFile(t, "a", "a")
+    writeFile(t, "b", "b")
+
+    // An interrupted swap left a link to a stored file, which is removed,
+    // and the only copy of a former file, which is kept aside.
+    if err := os.MkdirAll(swapDir, 0777); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Link("a", filepath.Join(swapDir, "b")); err != nil {
+        t.Fatal(err)
+    }
+    writeFile(t, filepath.Join(swapDir, "a"), "former")
+
+    for i := 0; i < 2; i++ {
+        if err := linkFiles("a", "b"); err != nil {
+            t.Fatalf("swap %d failed, %v", i, err)
+        }
+    }
+    if readFile(t, "a") != "a" || readFile(t, "b") != "b" {
+        t.Errorf("the files are not swapped back")
+    }
+
+    names, err := readDirNames(swapDir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(names) != 1 || filepath.Ext(names[0]) == "" {
+        t.Fatalf("the swap directory has %q, want the former file kept aside", names)
+    }
+    if got := readFile(t, filepath.Join(swapDir, names[0])); got != "former" {
+        t.Errorf("the former file kept aside has %q", got)
+    }
+}
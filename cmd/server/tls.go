@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certCache hands out the TLS certificate loaded from the certificate and
+// key files. The files are reloaded whenever they change or when the process
+// receives SIGHUP, so that rotated certificates are picked up by the new
+// connections without a restart. If the files can not be loaded, the
+// previous certificate is kept.
+type certCache struct {
+    certFile string
+    keyFile  string
+
+    cert *tls.Certificate
+
+    // modTime is the modification time of the files at the latest attempt
+    // to load them, successful or not.
+    modTime time.Time
+    sync.Mutex
+}
+
+// newCertCache will load the certificate and the key for the first time.
+// Unlike the later reloads, failing to load them is an error.
+func newCertCache(certFile, keyFile string) (*certCache, error) {
+    c := &certCache{certFile: certFile, keyFile: keyFile}
+
+    c.modTime = c.filesModTime()
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return nil, fmt.Errorf("could not load TLS certificate, %v", err)
+    }
+    c.cert = &cert
+
+    return c, nil
+}
+
+// filesModTime returns the latest modification time of the certificate and
+// the key files. The files that can't be stat'ed are ignored, loading them
+// will fail anyway.
+func (c *certCache) filesModTime() time.Time {
+    var latest time.Time
+    for _, name := range []string{c.certFile, c.keyFile} {
+        stat, err := os.Stat(name)
+        if err != nil {
+            continue
+        }
+
+        if stat.ModTime().After(latest) {
+            latest = stat.ModTime()
+        }
+    }
+
+    return latest
+}
+
+// reload will load the certificate and the key again. If force is false, the
+// files are only loaded if they changed since the latest attempt.
+func (c *certCache) reload(force bool) {
+    c.Lock()
+    defer c.Unlock()
+
+    modTime := c.filesModTime()
+    if !force && modTime.Equal(c.modTime) {
+        return
+    }
+    c.modTime = modTime
+
+    cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+    if err != nil {
+        log.Printf("could not reload TLS certificate, keeping the previous one, %v", err)
+        return
+    }
+    c.cert = &cert
+
+    log.Printf("reloaded TLS certificate from %q", c.certFile)
+}
+
+// reloadOnSignal will reload the certificate every time SIGHUP is received.
+func (c *certCache) reloadOnSignal() {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+
+    for range hup {
+        c.reload(true)
+    }
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate.
+func (c *certCache) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    c.reload(false)
+
+    c.Lock()
+    defer c.Unlock()
+
+    return c.cert, nil
+}
+
+// tlsVersions are the TLS versions the server may be limited to, the older
+// ones are insecure.
+var tlsVersions = map[string]uint16{
+    "1.2": tls.VersionTLS12,
+    "1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion returns the TLS version named like "1.2".
+func parseTLSVersion(name string) (uint16, error) {
+    version, ok := tlsVersions[name]
+    if !ok {
+        return 0, fmt.Errorf("unsupported TLS version %q, use 1.2 or 1.3", name)
+    }
+
+    return version, nil
+}
+
+// parseCipherSuites returns the cipher suites of the comma separated list of
+// their names, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. The insecure
+// suites are refused.
+func parseCipherSuites(list string) ([]uint16, error) {
+    secure := make(map[string]uint16)
+    for _, suite := range tls.CipherSuites() {
+        secure[suite.Name] = suite.ID
+    }
+    insecure := make(map[string]bool)
+    for _, suite := range tls.InsecureCipherSuites() {
+        insecure[suite.Name] = true
+    }
+
+    var ids []uint16
+    for _, name := range strings.Split(list, ",") {
+        name = strings.TrimSpace(name)
+        if insecure[name] {
+            return nil, fmt.Errorf("the cipher suite %s is insecure", name)
+        }
+
+        id, ok := secure[name]
+        if !ok {
+            return nil, fmt.Errorf("unknown cipher suite %q", name)
+        }
+        ids = append(ids, id)
+    }
+
+    return ids, nil
+}
+
+// newTLSConfig returns the configuration of the listeners, with the minimum
+// version and the cipher suites if any. The cipher suites can't be chosen for
+// TLS 1.3, so they're only allowed with TLS 1.2.
+func newTLSConfig(certs *certCache, minVersion, ciphers string) (*tls.Config, error) {
+    config := &tls.Config{GetCertificate: certs.GetCertificate}
+
+    var err error
+    config.MinVersion, err = parseTLSVersion(minVersion)
+    if err != nil {
+        return nil, err
+    }
+
+    if ciphers != "" {
+        if config.MinVersion == tls.VersionTLS13 {
+            return nil, fmt.Errorf("the cipher suites of TLS 1.3 can't be configured")
+        }
+
+        config.CipherSuites, err = parseCipherSuites(ciphers)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return config, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate of the common name and its key,
+// marking the files modified at the time.
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: name},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        DNSNames:     []string{name},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    writeFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+    writeFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+    for _, file := range []string{certFile, keyFile} {
+        if err := os.Chtimes(file, modTime, modTime); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+// newTestCerts returns the cache of a self-signed certificate of the server.
+func newTestCerts(t *testing.T) *certCache {
+    t.Helper()
+    dir := t.TempDir()
+    certFile, keyFile := dir + "/cert.pem", dir + "/key.pem"
+    writeCert(t, certFile, keyFile, "server", time.Now().Add(-time.Minute))
+    certs, err := newCertCache(certFile, keyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return certs
+}
+
+// serveTLSTest serves the connections of a test server over TLS with the
+// configuration.
+func serveTLSTest(t *testing.T, config *tls.Config) string {
+    t.Helper()
+    s := newTestServer(t)
+    s.HandshakeTimeout = 5 * time.Second
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    go s.Serve(tls.NewListener(l, config))
+    t.Cleanup(s.Shutdown)
+    return l.Addr().String()
+}
+
+// peerName connects to the server and returns the common name of its
+// certificate.
+func peerName(t *testing.T, addr string) string {
+    t.Helper()
+    con, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer con.Close()
+
+    return con.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+    dir := t.TempDir()
+    certFile, keyFile := dir + "/cert.pem", dir + "/key.pem"
+    start := time.Now().Add(-time.Minute)
+    writeCert(t, certFile, keyFile, "first", start)
+
+    certs, err := newCertCache(certFile, keyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    config, err := newTLSConfig(certs, "1.2", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTLSTest(t, config)
+
+    if name := peerName(t, addr); name != "first" {
+        t.Fatalf("got the certificate of %q, want first", name)
+    }
+
+    writeCert(t, certFile, keyFile, "second", start.Add(time.Second))
+    if name := peerName(t, addr); name != "second" {
+        t.Fatalf("got the certificate of %q once swapped, want second", name)
+    }
+
+    // A broken certificate leaves the previous one in use.
+    writeFile(t, certFile, "not a certificate")
+    os.Chtimes(certFile, start.Add(2 * time.Second), start.Add(2 * time.Second))
+    if name := peerName(t, addr); name != "second" {
+        t.Fatalf("got the certificate of %q once broken, want the previous second", name)
+    }
+}
+
+func TestTLSMinVersion(t *testing.T) {
+    certs := newTestCerts(t)
+
+    config, err := newTLSConfig(certs, "1.3", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := serveTLSTest(t, config)
+
+    old := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+    if con, err := tls.Dial("tcp", addr, old); err == nil {
+        con.Close()
+        t.Fatal("the handshake with TLS 1.2 went through, want it refused")
+    }
+    con, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+    if err != nil {
+        t.Fatalf("the handshake with TLS 1.3 failed, %v", err)
+    }
+    con.Close()
+
+    // The insecure settings are refused up front.
+    for _, test := range []struct{ version, ciphers string }{
+        {"1.0", ""},
+        {"1.1", ""},
+        {"1.2", "TLS_RSA_WITH_RC4_128_SHA"},
+        {"1.2", "TLS_NO_SUCH_SUITE"},
+        {"1.3", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+    } {
+        if _, err := newTLSConfig(certs, test.version, test.ciphers); err == nil {
+            t.Errorf("the minimum version %s with the cipher suites %q was accepted", test.version, test.ciphers)
+        }
+    }
+    if _, err := newTLSConfig(certs, "1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"); err != nil {
+        t.Errorf("a secure cipher suite was refused, %v", err)
+    }
+}
+
+func TestStalledHandshake(t *testing.T) {
+    certs := newTestCerts(t)
+    config, err := newTLSConfig(certs, "1.2", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s := newTestServer(t)
+    s.HandshakeTimeout = 100 * time.Millisecond
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go s.Serve(tls.NewListener(l, config))
+    t.Cleanup(s.Shutdown)
+
+    // The client connects and never starts the handshake.
+    con, err := net.Dial("tcp", l.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer con.Close()
+    con.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+    start := time.Now()
+    if _, err := con.Read(make([]byte, 1)); err == nil {
+        t.Fatal("the server sent something to the stalled client")
+    } else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+        t.Fatal("the stalled handshake wasn't dropped")
+    }
+    if elapsed := time.Since(start); elapsed > 2 * time.Second {
+        t.Fatalf("the stalled handshake was dropped after %v, want about %v", elapsed, s.HandshakeTimeout)
+    }
+}
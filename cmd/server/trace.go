@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+    // traceQueue is the number of finished spans waiting for the export. If
+    // the collector can't keep up, the spans beyond are dropped rather than
+    // slowing the transfers down.
+    traceQueue = 1024
+
+    // traceBatch is the largest number of spans exported at once.
+    traceBatch = 64
+
+    // traceFlushInterval is how long the spans may wait for a batch to fill.
+    traceFlushInterval = 5 * time.Second
+)
+
+// span records a single request. All the methods of a nil span do nothing,
+// so that the handlers don't have to care whether tracing is enabled.
+type span struct {
+    traceID [16]byte
+    spanID  [8]byte
+
+    name  string
+    start time.Time
+    end   time.Time
+    attrs map[string]interface{}
+    err   error
+}
+
+// set annotates the span with the attribute, a string, an int64 or a bool.
+func (sp *span) set(key string, value interface{}) {
+    if sp == nil {
+        return
+    }
+
+    sp.attrs[key] = value
+}
+
+// rename changes the name of the span, once it's known what it records.
+func (sp *span) rename(name string) {
+    if sp == nil {
+        return
+    }
+
+    sp.name = name
+}
+
+// fail records the error the request ended with.
+func (sp *span) fail(err error) {
+    if sp == nil {
+        return
+    }
+
+    sp.err = err
+}
+
+// tracer exports the spans to an OpenTelemetry collector using OTLP over HTTP
+// with the JSON encoding. A nil tracer does nothing.
+type tracer struct {
+    endpoint string
+    client   *http.Client
+    spans    chan *span
+}
+
+// newTracer will start exporting the spans to the endpoint in background.
+func newTracer(endpoint string) *tracer {
+    t := &tracer{
+        endpoint: endpoint,
+        client:   &http.Client{Timeout: 10 * time.Second},
+        spans:    make(chan *span, traceQueue),
+    }
+    go t.export()
+
+    return t
+}
+
+// start begins a new span.
+func (t *tracer) start(name string) *span {
+    if t == nil {
+        return nil
+    }
+
+    sp := &span{
+        name:  name,
+        start: time.Now(),
+        attrs: make(map[string]interface{}),
+    }
+    rand.Read(sp.traceID[:])
+    rand.Read(sp.spanID[:])
+
+    return sp
+}
+
+// end finishes the span and queues it for the export.
+func (t *tracer) end(sp *span) {
+    if t == nil {
+        return
+    }
+
+    sp.end = time.Now()
+    result := "ok"
+    if sp.err != nil {
+        result = "error"
+    }
+    sp.set("files.result", result)
+
+    select {
+    case t.spans <- sp:
+    default:
+    }
+}
+
+func (t *tracer) export() {
+    ticker := time.NewTicker(traceFlushInterval)
+    defer ticker.Stop()
+
+    var batch []*span
+    for {
+        select {
+        case sp := <-t.spans:
+            batch = append(batch, sp)
+            if len(batch) < traceBatch {
+                continue
+            }
+        case <-ticker.C:
+            if len(batch) == 0 {
+                continue
+            }
+        }
+
+        if err := t.post(batch); err != nil {
+            log.Printf("could not export %d spans, %v", len(batch), err)
+        }
+        batch = nil
+    }
+}
+
+// The messages of OTLP, as mapped to JSON. The 64 bit integers are encoded
+// as strings and the ids as hex, as the specification wants it.
+type (
+    otlpValue struct {
+        StringValue *string `json:"stringValue,omitempty"`
+        IntValue    *string `json:"intValue,omitempty"`
+        BoolValue   *bool   `json:"boolValue,omitempty"`
+    }
+
+    otlpAttribute struct {
+        Key   string    `json:"key"`
+        Value otlpValue `json:"value"`
+    }
+
+    otlpStatus struct {
+        Code    int    `json:"code"`
+        Message string `json:"message,omitempty"`
+    }
+
+    otlpSpan struct {
+        TraceID    string          `json:"traceId"`
+        SpanID     string          `json:"spanId"`
+        Name       string          `json:"name"`
+        Kind       int             `json:"kind"`
+        Start      string          `json:"startTimeUnixNano"`
+        End        string          `json:"endTimeUnixNano"`
+        Attributes []otlpAttribute `json:"attributes"`
+        Status     otlpStatus      `json:"status"`
+    }
+)
+
+const (
+    otlpKindServer  = 2
+    otlpStatusOK    = 1
+    otlpStatusError = 2
+)
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+    var result []otlpAttribute
+    for key, value := range attrs {
+        attr := otlpAttribute{Key: key}
+        switch value := value.(type) {
+        case string:
+            attr.Value.StringValue = &value
+        case int64:
+            s := strconv.FormatInt(value, 10)
+            attr.Value.IntValue = &s
+        case bool:
+            attr.Value.BoolValue = &value
+        default:
+            s := fmt.Sprint(value)
+            attr.Value.StringValue = &s
+        }
+
+        result = append(result, attr)
+    }
+
+    return result
+}
+
+func (sp *span) otlp() otlpSpan {
+    status := otlpStatus{Code: otlpStatusOK}
+    if sp.err != nil {
+        status = otlpStatus{Code: otlpStatusError, Message: sp.err.Error()}
+    }
+
+    return otlpSpan{
+        TraceID:    hex.EncodeToString(sp.traceID[:]),
+        SpanID:     hex.EncodeToString(sp.spanID[:]),
+        Name:       sp.name,
+        Kind:       otlpKindServer,
+        Start:      strconv.FormatInt(sp.start.UnixNano(), 10),
+        End:        strconv.FormatInt(sp.end.UnixNano(), 10),
+        Attributes: otlpAttributes(sp.attrs),
+        Status:     status,
+    }
+}
+
+// post sends the spans to the collector.
+func (t *tracer) post(batch []*span) error {
+    spans := make([]otlpSpan, len(batch))
+    for i, sp := range batch {
+        spans[i] = sp.otlp()
+    }
+
+    serviceName := "files"
+    body, err := json.Marshal(map[string]interface{}{
+        "resourceSpans": []interface{}{map[string]interface{}{
+            "resource": map[string]interface{}{
+                "attributes": []otlpAttribute{{
+                    Key:   "service.name",
+                    Value: otlpValue{StringValue: &serviceName},
+                }},
+            },
+            "scopeSpans": []interface{}{map[string]interface{}{
+                "scope": map[string]string{"name": "github.com/kureduro/files"},
+                "spans": spans,
+            }},
+        }},
+    })
+    if err != nil {
+        return err
+    }
+
+    resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("collector replied %s", resp.Status)
+    }
+
+    return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceUpload(t *testing.T) {
+    s := newTestServer(t)
+
+    // The spans are queued for the export, the test takes them instead.
+    s.tracer = &tracer{spans: make(chan *span, traceQueue)}
+    addr := serveTest(t, s)
+    mustUpload(t, addr, "traced.txt", "data")
+
+    var sp *span
+    select {
+    case sp = <-s.tracer.spans:
+    case <-time.After(5 * time.Second):
+        t.Fatal("no span was emitted for the upload")
+    }
+
+    want := map[string]interface{}{
+        "files.name":        "traced.txt",
+        "files.server_name": "traced.txt",
+        "files.size":        int64(4),
+        "files.sha256":      sha256Hex("data"),
+        "files.result":      "ok",
+    }
+    for key, value := range want {
+        if sp.attrs[key] != value {
+            t.Errorf("the span has %s=%v, want %v", key, sp.attrs[key], value)
+        }
+    }
+    if sp.name != "files upload" || sp.end.Before(sp.start) {
+        t.Errorf("the span is %q from %v to %v", sp.name, sp.start, sp.end)
+    }
+    select {
+    case sp := <-s.tracer.spans:
+        t.Errorf("another span %q was emitted for the upload", sp.name)
+    default:
+    }
+}
+
+func TestTracePost(t *testing.T) {
+    var body map[string]interface{}
+    collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        json.NewDecoder(r.Body).Decode(&body)
+    }))
+    defer collector.Close()
+
+    tr := &tracer{endpoint: collector.URL, client: collector.Client()}
+    sp := (&tracer{}).start("files upload")
+    sp.set("files.size", int64(1) << 40)
+    sp.end = sp.start.Add(time.Second)
+    if err := tr.post([]*span{sp}); err != nil {
+        t.Fatal(err)
+    }
+
+    encoded, _ := json.Marshal(body)
+    for _, want := range []string{`"name":"files upload"`, `"intValue":"1099511627776"`, `"service.name"`} {
+        if !strings.Contains(string(encoded), want) {
+            t.Errorf("the export %s doesn't have %s", encoded, want)
+        }
+    }
+}
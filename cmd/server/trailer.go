@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// footerSHA256 is the only footer the clients may send after the DEFLATE
+// stream, the hex encoded SHA-256 of the data on a line of its own. It's
+// meant for the clients that can't know the checksum up front.
+const footerSHA256 = "sha256"
+
+// trailingWait is how long the strict server waits for any bytes following
+// the end of the DEFLATE stream.
+const trailingWait = 50 * time.Millisecond
+
+// trailerReader reads the decompressed data. Once the DEFLATE stream ends,
+// it reads the footer the client announced, if any, and looks for the bytes
+// that shouldn't be there. With strictClose, the decompressor is closed right
+// away too, failing the upload if it fails to.
+type trailerReader struct {
+    zr  io.ReadCloser
+    con net.Conn
+    r   *bufio.Reader
+    req *request
+
+    strict      bool
+    strictClose bool
+
+    done bool
+    err  error
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+    n, err := t.zr.Read(p)
+    if err == io.EOF {
+        if !t.done {
+            t.done = true
+            t.err = t.finish()
+        }
+        if t.err != nil {
+            return n, t.err
+        }
+    }
+
+    return n, err
+}
+
+func (t *trailerReader) finish() error {
+    if t.strictClose {
+        if err := t.zr.Close(); err != nil {
+            return fmt.Errorf("could not close the DEFLATE decompressor, %v", err)
+        }
+    }
+
+    if t.req.Footer == footerSHA256 {
+        line, err := readLine(t.r)
+        if err != nil {
+            return fmt.Errorf("could not read the footer, %v", err)
+        }
+
+        sum, err := parseSHA256(line)
+        if err != nil || sum == "" {
+            return fmt.Errorf("malformed footer %q", line)
+        }
+        if t.req.SHA256 != "" && t.req.SHA256 != sum {
+            return fmt.Errorf("the footer %s doesn't match the SHA256 header %s", sum, t.req.SHA256)
+        }
+        t.req.SHA256 = sum
+    }
+
+    // The next upload of the batch may follow right away.
+    if t.req.Seq != nil {
+        return nil
+    }
+
+    trailing := t.r.Buffered()
+    if trailing == 0 && t.strict {
+        trailing = t.waitTrailing()
+    }
+    if trailing == 0 {
+        return nil
+    }
+
+    if t.strict {
+        return fmt.Errorf("unexpected bytes after the end of the data")
+    }
+
+    log.Printf("warning: %d unexpected bytes after the end of the data of %q",
+               trailing, t.req.Name)
+    return nil
+}
+
+// waitTrailing waits a moment for the bytes the client might still send and
+// returns how many came.
+func (t *trailerReader) waitTrailing() int {
+    t.con.SetReadDeadline(time.Now().Add(trailingWait))
+    defer t.con.SetReadDeadline(time.Time{})
+
+    _, err := t.r.Peek(1)
+    var netErr net.Error
+    if (errors.As(err, &netErr) && netErr.Timeout()) || err == io.EOF {
+        return 0
+    }
+
+    return t.r.Buffered()
+}
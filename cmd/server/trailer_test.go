@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// uploadRaw uploads the DEFLATE compressed data followed by the bytes,
+// returning the final status.
+func uploadRaw(t *testing.T, addr, name, data, after string, header ...string) *response {
+    t.Helper()
+    c := dialTest(t, addr)
+    c.request(append([]string{"Name: " + name, "Status: true"}, header...)...)
+    if first := c.reply(); first.Error != "" {
+        t.Fatalf("the upload of %s was refused, %s", name, first.Error)
+    }
+    c.write(append(deflate(data), after...))
+    c.closeWrite()
+    return c.reply()
+}
+
+func TestTrailer(t *testing.T) {
+    for _, strict := range []bool{false, true} {
+        s := newTestServer(t)
+        s.StrictTrailer = strict
+        addr := serveTest(t, s)
+
+        if status := uploadRaw(t, addr, "clean.txt", "data", ""); status.Status != "ok" {
+            t.Errorf("the clean stream failed, strict %t, %s", strict, status.Error)
+        }
+        status := uploadRaw(t, addr, "footer.txt", "data", sha256Hex("data") + "\n", "Footer: sha256")
+        if status.Status != "ok" {
+            t.Errorf("the stream with the footer failed, strict %t, %s", strict, status.Error)
+        }
+        status = uploadRaw(t, addr, "bad-footer.txt", "data", sha256Hex("other") + "\n", "Footer: sha256")
+        if status.Status != "error" {
+            t.Errorf("the stream with the wrong footer was stored, strict %t", strict)
+        }
+
+        status = uploadRaw(t, addr, "trailing.txt", "data", "garbage")
+        if strict && status.Status != "error" {
+            t.Error("the stream with the trailing bytes was stored in the strict mode")
+        }
+        if !strict && status.Status != "ok" {
+            t.Errorf("the stream with the trailing bytes failed in the lenient mode, %s", status.Error)
+        }
+    }
+}
+
+// failingCloser is a decompressor whose data ends well but that fails to
+// close.
+type failingCloser struct {
+    io.Reader
+}
+
+func (failingCloser) Close() error {
+    return errors.New("the stream wasn't quite valid")
+}
+
+func TestStrictClose(t *testing.T) {
+    for _, strict := range []bool{false, true} {
+        tr := &trailerReader{zr: failingCloser{strings.NewReader("data")}, r: bufio.NewReader(strings.NewReader("")),
+                             req: &request{}, strictClose: strict}
+        _, err := ioutil.ReadAll(tr)
+        if strict && (err == nil || !strings.Contains(err.Error(), "could not close")) {
+            t.Errorf("the failed close gave %v in the strict mode, want the upload failed", err)
+        }
+        if !strict && err != nil {
+            t.Errorf("the failed close gave %v, want only a warning", err)
+        }
+    }
+
+    // The truncated stream fails, leaving nothing behind.
+    s := newTestServer(t)
+    s.StrictClose = true
+    addr := serveTest(t, s)
+    c := dialTest(t, addr)
+    c.request("Name: a.txt", "Status: true")
+    if first := c.reply(); first.Error != "" {
+        t.Fatal(first.Error)
+    }
+    compressed := deflate(strings.Repeat("truncated ", 1000))
+    c.write(compressed[:len(compressed) / 2])
+    c.closeWrite()
+    if status := c.reply(); status.Status == "ok" {
+        t.Fatal("the truncated stream was stored in the strict mode")
+    }
+    assertFiles(t)
+    mustUpload(t, addr, "a.txt", "data")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// uiUploadPath is the path the upload form of the web interface is posted
+// to, as multipart/form-data with the file in the "file" field.
+const uiUploadPath = "/upload"
+
+// uiTemplates render the page of the web interface: the upload form and the
+// list of the stored files. The list is rendered a row at a time, as the
+// directory is read, so that a huge directory is never held in memory.
+var uiTemplates = template.Must(template.New("ui").Funcs(template.FuncMap{
+    "uploadPath": func() string { return uiUploadPath },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>files</title>
+</head>
+<body>
+<h1>files</h1>
+{{if .}}<p>Stored as <a href="{{.URL}}">{{.Name}}</a>.</p>
+{{end}}<form method="post" action="{{uploadPath}}" enctype="multipart/form-data">
+<input type="file" name="file" required>
+<input type="submit" value="Upload">
+</form>
+<table>
+<tr><th>Name</th><th>Size</th></tr>
+{{end}}
+{{define "row"}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td>{{.Size}}</td></tr>
+{{end}}
+{{define "footer"}}</table>
+</body>
+</html>
+{{end}}
+`))
+
+// uiFile is a stored file as the web interface lists it.
+type uiFile struct {
+    Name string
+    URL  *url.URL
+    Size int64
+}
+
+func newUIFile(name string, size int64) *uiFile {
+    return &uiFile{Name: name, URL: &url.URL{Path: filesPath + name}, Size: size}
+}
+
+// uiChallenge makes the browsers ask for the secret, as the password of the
+// HTTP Basic authentication.
+const uiChallenge = `Basic realm="files", charset="UTF-8"`
+
+// uiHandler serves the web interface, for the people uploading and
+// downloading the files with a browser. The uploads and the downloads go
+// through the same checks and limits as those over HTTP. The browsers can't
+// send a Bearer token on their own, so the secret is asked for as the
+// password of the Basic authentication, whatever the user name; the Bearer
+// one is good too.
+func (s *Server) uiHandler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", s.servePage)
+    mux.HandleFunc(uiUploadPath, s.receiveForm)
+    mux.HandleFunc(filesPath, func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            w.Header().Set("Allow", "GET, HEAD")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if s.checkUICredentials(w, r) {
+            s.sendFile(w, r)
+        }
+    })
+    return mux
+}
+
+// servePage renders the upload form and the list of the stored files, with
+// the link to the file just stored, if the page follows an upload.
+func (s *Server) servePage(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/" {
+        http.NotFound(w, r)
+        return
+    }
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        w.Header().Set("Allow", "GET, HEAD")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if !s.checkUICredentials(w, r) {
+        return
+    }
+
+    var stored *uiFile
+    if name := r.URL.Query().Get("stored"); name != "" {
+        stored = newUIFile(name, 0)
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    if err := uiTemplates.ExecuteTemplate(w, "header", stored); err != nil {
+        log.Printf("could not render the web interface, %v", err)
+        return
+    }
+    if r.Method == http.MethodHead {
+        return
+    }
+
+    err := eachStoredFile("", s.DoneMarkers, func(stat os.FileInfo) error {
+        return uiTemplates.ExecuteTemplate(w, "row", newUIFile(stat.Name(), stat.Size()))
+    })
+    if err != nil {
+        log.Printf("could not render the web interface, %v", err)
+        return
+    }
+
+    uiTemplates.ExecuteTemplate(w, "footer", nil)
+}
+
+// receiveForm stores the file of the upload form, streaming it from the
+// multipart body like the body of an HTTP upload, and sends the browser back
+// to the page.
+func (s *Server) receiveForm(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", "POST")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if !isSameOrigin(r) {
+        log.Printf("refused the upload form from %s, posted from another site", s.httpRemote(r))
+        http.Error(w, "the form was posted from another site", http.StatusForbidden)
+        return
+    }
+
+    mr, err := r.MultipartReader()
+    if err != nil {
+        http.Error(w, fmt.Sprintf("could not read the form, %v", err), http.StatusBadRequest)
+        return
+    }
+
+    for {
+        part, err := mr.NextPart()
+        if err != nil {
+            http.Error(w, "the form has no file", http.StatusBadRequest)
+            return
+        }
+        if part.FormName() != "file" || part.FileName() == "" {
+            part.Close()
+            continue
+        }
+
+        code, resp := s.storeHTTP(r, uiCredentials(r), part.FileName(), part, -1)
+        part.Close()
+        if code != http.StatusCreated {
+            if code == http.StatusUnauthorized {
+                w.Header().Set("WWW-Authenticate", uiChallenge)
+            }
+            http.Error(w, resp.Error, code)
+            return
+        }
+
+        // The held file can't be downloaded yet, there's nothing to link to.
+        if resp.Token != "" {
+            w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+            fmt.Fprintf(w, "%s is held until approved, token %s\n", resp.Name, resp.Token)
+            return
+        }
+
+        http.Redirect(w, r, "/?" + url.Values{"stored": {resp.Name}}.Encode(), http.StatusSeeOther)
+        return
+    }
+}
+
+// uiCredentials returns the credentials of the request, the password of the
+// Basic authentication or the Bearer token.
+func uiCredentials(r *http.Request) string {
+    if _, password, ok := r.BasicAuth(); ok {
+        return password
+    }
+
+    return bearerToken(r)
+}
+
+// checkUICredentials tells whether the request carries the secret, making the
+// browser ask for it if it doesn't.
+func (s *Server) checkUICredentials(w http.ResponseWriter, r *http.Request) bool {
+    return s.checkCredentials(s.httpAuth, w, r, uiCredentials(r), uiChallenge)
+}
+
+// isSameOrigin tells whether the form was posted from the page of the web
+// interface, rather than by another site making the browser post it along
+// with the credentials the browser remembers. The browsers tell where from
+// in the Origin header, or at least in the Referer, "null" being from no
+// site of the server; the requests with neither don't come from a page of
+// another site.
+func isSameOrigin(r *http.Request) bool {
+    from := r.Header.Get("Origin")
+    if from == "" {
+        from = r.Header.Get("Referer")
+    }
+    if from == "" {
+        return true
+    }
+
+    u, err := url.Parse(from)
+    return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newUITestServer(t *testing.T) *httptest.Server {
+    s := newTestServer(t)
+    s.httpAuth = newAuthenticator([]byte("secret"), realClock{})
+
+    ts := httptest.NewServer(s.uiHandler())
+    t.Cleanup(ts.Close)
+    return ts
+}
+
+// uploadForm posts the upload form with the file from the origin, if not
+// empty.
+func uploadForm(t *testing.T, ts *httptest.Server, name, data, origin string) *http.Response {
+    t.Helper()
+
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    fw, _ := mw.CreateFormFile("file", name)
+    fw.Write([]byte(data))
+    mw.Close()
+
+    req, _ := http.NewRequest(http.MethodPost, ts.URL + uiUploadPath, &body)
+    req.Header.Set("Content-Type", mw.FormDataContentType())
+    req.SetBasicAuth("anyone", "secret")
+    if origin != "" {
+        req.Header.Set("Origin", origin)
+    }
+
+    // The redirect to the page is told, not followed.
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+    }}
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    return resp
+}
+
+func TestUIBasicAuth(t *testing.T) {
+    ts := newUITestServer(t)
+    writeFile(t, "listed.txt", "data")
+
+    resp, err := http.Get(ts.URL + "/")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusUnauthorized ||
+       !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic") {
+        t.Fatalf("the page is %s with the challenge %q, want the Basic one",
+                 resp.Status, resp.Header.Get("WWW-Authenticate"))
+    }
+
+    for _, auth := range []func(*http.Request){
+        func(r *http.Request) { r.SetBasicAuth("anyone", "secret") },
+        func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+    } {
+        req, _ := http.NewRequest(http.MethodGet, ts.URL + "/", nil)
+        auth(req)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        page, _ := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "listed.txt") {
+            t.Errorf("the page is %s without the file listed", resp.Status)
+        }
+        if !strings.Contains(string(page), `action="` + uiUploadPath + `"`) {
+            t.Errorf("the form of the page isn't posted to %s", uiUploadPath)
+        }
+    }
+
+    req, _ := http.NewRequest(http.MethodGet, ts.URL + filesPath + "listed.txt", nil)
+    req.SetBasicAuth("anyone", "wrong")
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusUnauthorized {
+        t.Errorf("the download with a wrong password is %s", resp.Status)
+    }
+}
+
+func TestUIUploadForm(t *testing.T) {
+    ts := newUITestServer(t)
+
+    resp := uploadForm(t, ts, "form.txt", "hello", ts.URL)
+    if resp.StatusCode != http.StatusSeeOther {
+        t.Fatalf("the upload is %s, want the redirect to the page", resp.Status)
+    }
+    if got := readFile(t, "form.txt"); got != "hello" {
+        t.Errorf("the stored file has %q", got)
+    }
+
+    req, _ := http.NewRequest(http.MethodGet, ts.URL + filesPath + "form.txt", nil)
+    req.SetBasicAuth("anyone", "secret")
+    dl, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data, _ := ioutil.ReadAll(dl.Body)
+    dl.Body.Close()
+    if string(data) != "hello" {
+        t.Errorf("the download has %q", data)
+    }
+}
+
+func TestUIUploadFormCSRF(t *testing.T) {
+    ts := newUITestServer(t)
+
+    for _, origin := range []string{"https://evil.example", "null"} {
+        resp := uploadForm(t, ts, "csrf.txt", "hello", origin)
+        if resp.StatusCode != http.StatusForbidden {
+            t.Errorf("the upload posted from %s is %s, want 403", origin, resp.Status)
+        }
+    }
+    if _, err := ioutil.ReadFile("csrf.txt"); err == nil {
+        t.Error("the upload posted from another site is stored")
+    }
+}
+
+func TestIsSameOrigin(t *testing.T) {
+    tests := []struct {
+        origin, referer string
+        want            bool
+    }{
+        {"", "", true},
+        {"http://files.example:8080", "", true},
+        {"http://FILES.example:8080", "", true},
+        {"http://files.example:9090", "", false},
+        {"", "http://files.example:8080/?stored=a", true},
+        {"", "http://evil.example/", false},
+        {"null", "http://files.example:8080/", false},
+    }
+
+    for _, test := range tests {
+        r := &http.Request{Host: "files.example:8080", Header: http.Header{}}
+        if test.origin != "" {
+            r.Header.Set("Origin", test.origin)
+        }
+        if test.referer != "" {
+            r.Header.Set("Referer", test.referer)
+        }
+
+        if got := isSameOrigin(r); got != test.want {
+            t.Errorf("isSameOrigin(%q, %q) = %t, want %t", test.origin, test.referer, got, test.want)
+        }
+    }
+}
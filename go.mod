@@ -1,8 +1,9 @@
 module github.com/kureduro/files
 
-go 1.15
+go 1.16
 
 require (
-	github.com/cheggaaa/pb/v3 v3.0.5 // indirect
-	golang.org/x/net v0.0.0-20200904194848-62affa334b73 // indirect
+	github.com/cheggaaa/pb/v3 v3.0.5
+	golang.org/x/net v0.0.0-20200904194848-62affa334b73
+	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
 )